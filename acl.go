@@ -0,0 +1,92 @@
+package main
+
+import "fmt"
+
+// ACLTag says whom an ACLEntry applies to.
+type ACLTag int
+
+const (
+	ACLUser ACLTag = iota
+	ACLGroup
+)
+
+func (t ACLTag) String() string {
+	switch t {
+	case ACLUser:
+		return "user"
+	case ACLGroup:
+		return "group"
+	}
+	return fmt.Sprintf("ACLTag(%d)", int(t))
+}
+
+// ACLEntry grants Perm, a combination of the perm bits, to the user or
+// group ID.
+type ACLEntry struct {
+	Tag  ACLTag
+	ID   int
+	Perm uint32
+}
+
+func (e ACLEntry) String() string {
+	return fmt.Sprintf("%s:%d:%s", e.Tag, e.ID, permString(e.Perm))
+}
+
+func permString(perm uint32) string {
+	s := []byte("---")
+	for i, c := range "rwx" {
+		if perm&(4>>i) != 0 {
+			s[i] = byte(c)
+		}
+	}
+	return string(s)
+}
+
+// setfacl replaces the access control list of the inode at path. Each user
+// or group may appear once; an empty list removes the ACL. Like chmod it is
+// reserved to the owner and root.
+func (fs *FileSystem) setfacl(path string, entries []ACLEntry) error {
+	seen := make(map[ACLEntry]bool)
+	for _, e := range entries {
+		key := ACLEntry{Tag: e.Tag, ID: e.ID}
+		if (e.Tag != ACLUser && e.Tag != ACLGroup) || e.ID < 0 || e.Perm > 7 || seen[key] {
+			return fmt.Errorf("ACL entry %v: %w", e, ErrInvalid)
+		}
+		seen[key] = true
+	}
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return ErrNotFound
+	}
+	if fs.cred.UID != 0 && fs.cred.UID != inode.UID {
+		return ErrPermission
+	}
+	fs.preserveInode(inode)
+	inode.ACL = nil
+	if len(entries) > 0 {
+		inode.ACL = append([]ACLEntry(nil), entries...)
+	}
+	fs.addJournalEntry("setfacl", fs.absPath(path), map[string]interface{}{
+		"acl": append([]ACLEntry(nil), entries...),
+	})
+	return nil
+}
+
+// getfacl returns the access control list of the inode at path.
+func (fs *FileSystem) getfacl(path string) ([]ACLEntry, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return nil, ErrNotFound
+	}
+	return append([]ACLEntry(nil), inode.ACL...), nil
+}
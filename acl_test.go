@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestACLGrantsNamedUser(t *testing.T) {
+	fs := NewFileSystem()
+	acl := []ACLEntry{{Tag: ACLUser, ID: 1000, Perm: permRead}}
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.writeFile("/root/f", []byte("data")),
+		fs.chmod("/root/f", 0600),
+		fs.setfacl("/root/f", acl),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := fs.getfacl("/root/f"); err != nil || !reflect.DeepEqual(got, acl) {
+		t.Errorf("getfacl = %v, %v, want %v", got, err, acl)
+	}
+
+	fs.setCred(user)
+	if _, err := fs.readFile("/root/f"); err != nil {
+		t.Errorf("readFile by the named user: %v", err)
+	}
+	if err := fs.writeFile("/root/f", []byte("new")); !errors.Is(err, ErrPermission) {
+		t.Errorf("writeFile by the named user: %v, want ErrPermission", err)
+	}
+	fs.setCred(Cred{UID: 1001, GID: 1001})
+	if _, err := fs.readFile("/root/f"); !errors.Is(err, ErrPermission) {
+		t.Errorf("readFile by another user: %v, want ErrPermission", err)
+	}
+	if err := fs.setfacl("/root/f", nil); !errors.Is(err, ErrPermission) {
+		t.Errorf("setfacl by a non-owner: %v, want ErrPermission", err)
+	}
+}
+
+func TestACLGroupEntry(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.chmod("/root/f", 0600),
+		fs.setfacl("/root/f", []ACLEntry{{Tag: ACLGroup, ID: 1000, Perm: permRead | permWrite}}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.setCred(user)
+	if err := fs.writeFile("/root/f", []byte("data")); err != nil {
+		t.Errorf("writeFile by a member of the named group: %v", err)
+	}
+	fs.setCred(Cred{UID: 1001, GID: 1001})
+	if err := fs.writeFile("/root/f", []byte("data")); !errors.Is(err, ErrPermission) {
+		t.Errorf("writeFile by a non-member: %v, want ErrPermission", err)
+	}
+}
+
+func TestSetfaclRejectsInvalidEntries(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+	for _, entries := range [][]ACLEntry{
+		{{Tag: ACLTag(7), ID: 1000, Perm: permRead}},
+		{{Tag: ACLUser, ID: -1, Perm: permRead}},
+		{{Tag: ACLUser, ID: 1000, Perm: 010}},
+		{{Tag: ACLUser, ID: 1000, Perm: permRead}, {Tag: ACLUser, ID: 1000, Perm: permWrite}},
+	} {
+		if err := fs.setfacl("/root/f", entries); !errors.Is(err, ErrInvalid) {
+			t.Errorf("setfacl %v: %v, want ErrInvalid", entries, err)
+		}
+	}
+	if err := fs.setfacl("/root/missing", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("setfacl of a missing file: %v, want ErrNotFound", err)
+	}
+}
+
+func TestACLSurvivesSnapshotAndReplay(t *testing.T) {
+	fs := NewFileSystem()
+	acl := []ACLEntry{{Tag: ACLUser, ID: 1000, Perm: permRead}}
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.setfacl("/root/f", acl),
+		fs.createNamedSnapshot("s"),
+		fs.setfacl("/root/f", nil),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := fs.getfacl("/root/f"); len(got) != 0 {
+		t.Errorf("after clearing, getfacl = %v, want none", got)
+	}
+	if got, _ := replayed(fs).getfacl("/root/f"); len(got) != 0 {
+		t.Errorf("after replay, getfacl = %v, want none", got)
+	}
+	if err := fs.restoreNamedSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.getfacl("/root/f"); err != nil || !reflect.DeepEqual(got, acl) {
+		t.Errorf("after restore, getfacl = %v, %v, want %v", got, err, acl)
+	}
+}
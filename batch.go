@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// touchMany creates an empty file in dirPath for each of names, as touch
+// does one at a time, but takes the directory's B-tree once and stores it
+// once however many entries go in.
+//
+// Names are independent: one that can't be created, because it exists,
+// repeats an earlier name or is invalid, doesn't stop the rest. The error
+// joins one "name: error" per failure and is nil if all were created. A
+// missing or non-directory dirPath fails the whole call.
+func (fs *FileSystem) touchMany(dirPath string, names []string) error {
+	return fs.createMany(dirPath, names, false)
+}
+
+// mkdirMany is touchMany for directories, creating each of names in
+// parentPath as mkdir does.
+func (fs *FileSystem) mkdirMany(parentPath string, names []string) error {
+	return fs.createMany(parentPath, names, true)
+}
+
+func (fs *FileSystem) createMany(dirPath string, names []string, isDir bool) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	dirPath = fs.absPath(dirPath)
+	dir := fs.resolvePath(dirPath)
+	if dir == nil {
+		return ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return ErrNotDirectory
+	}
+
+	var errs []error
+	fail := func(name string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	tree := fs.dirTree(dir)
+	var created []*Inode
+	for _, name := range names {
+		if err := fs.mayModifyDir(joinPath(dirPath, name)); err != nil {
+			fail(name, err)
+			continue
+		}
+		if err := fs.validateName(name); err != nil {
+			fail(name, err)
+			continue
+		}
+		if _, exists := tree.search(name); exists {
+			fail(name, ErrExists)
+			continue
+		}
+		if err := fs.checkQuota(dir, 0); err != nil {
+			fail(name, err)
+			continue
+		}
+		inode, err := fs.createInode(name, isDir, dir)
+		if err != nil {
+			fail(name, err)
+			continue
+		}
+		tree.insert(DirEntry{Name: name, InodeIndex: inode.InodeNumber})
+		created = append(created, inode)
+	}
+
+	// One trip through the block format verifies the whole batch.
+	if fs.VerifyWrites && len(created) > 0 {
+		stored := deserializeBTree(serializeBTree(tree))
+		kept := created[:0]
+		for _, inode := range created {
+			entry := DirEntry{Name: inode.Name, InodeIndex: inode.InodeNumber}
+			if found, ok := stored.search(entry.Name); !ok || found != entry {
+				tree.remove(entry.Name)
+				fs.releaseInode(inode)
+				fail(entry.Name, ErrVerify)
+				continue
+			}
+			kept = append(kept, inode)
+		}
+		created = kept
+	}
+	fs.storeDirTree(dir, tree)
+
+	for _, inode := range created {
+		path := joinPath(dirPath, inode.Name)
+		if isDir {
+			fs.addJournalEntry("mkdir", path, map[string]interface{}{
+				"parentPath": dirPath,
+				"dirName":    inode.Name,
+			})
+			fs.stats.Mkdirs++
+		} else {
+			fs.addJournalEntry("touch", path, map[string]interface{}{
+				"dirPath":  dirPath,
+				"fileName": inode.Name,
+			})
+			fs.stats.Touches++
+		}
+		fs.queueEvent(Event{Op: EventCreate, Path: path, IsDir: isDir})
+	}
+	if len(created) > 0 {
+		fs.preserveInode(dir)
+		dir.ModifiedAt = now()
+	}
+	return errors.Join(errs...)
+}
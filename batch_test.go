@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// A batch creates every name it can and reports the rest, and what it
+// creates is journaled as if made one at a time.
+func TestCreateMany(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "taken"); err != nil {
+		t.Fatal(err)
+	}
+	err := fs.touchMany("/root", []string{"b", "taken", "a", "b", "", "c"})
+	if !errors.Is(err, ErrExists) || !errors.Is(err, ErrInvalidName) {
+		t.Errorf("touchMany = %v, want ErrExists and ErrInvalidName", err)
+	}
+	if err := fs.mkdirMany("/root", []string{"d1", "d2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.touchMany("/root/d1", []string{"x", "y"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a", "b", "c", "d1", "d2", "taken"}
+	if names, err := fs.list("/root"); err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("list = %v, %v, want %v", names, err, want)
+	}
+	if inode := fs.resolvePath("/root/d2"); inode == nil || !inode.IsDirectory {
+		t.Error("mkdirMany did not create a directory")
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := replayed(fs).list("/root/d1"); err != nil || !reflect.DeepEqual(names, []string{"x", "y"}) {
+		t.Errorf("replayed list = %v, %v", names, err)
+	}
+
+	for _, tt := range []struct {
+		path string
+		want error
+	}{
+		{"/root/missing", ErrNotFound},
+		{"/root/a", ErrNotDirectory},
+	} {
+		if err := fs.touchMany(tt.path, []string{"z"}); err != tt.want {
+			t.Errorf("touchMany(%s) = %v, want %v", tt.path, err, tt.want)
+		}
+	}
+}
+
+func BenchmarkCreateMany(b *testing.B) {
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("f%04d", i)
+	}
+	for _, verify := range []bool{false, true} {
+		b.Run(fmt.Sprintf("touch/verify=%v", verify), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				fs := NewFileSystem()
+				if err := fs.setVerifyWrites(verify); err != nil {
+					b.Fatal(err)
+				}
+				for _, name := range names {
+					fs.touch("/root", name)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("touchMany/verify=%v", verify), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				fs := NewFileSystem()
+				if err := fs.setVerifyWrites(verify); err != nil {
+					b.Fatal(err)
+				}
+				fs.touchMany("/root", names)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// bitmap is a set of non-negative integers, one bit each. It grows as bits
+// are set; bits beyond its end are clear.
+type bitmap []uint64
+
+// has reports whether bit i is set.
+func (b bitmap) has(i int) bool {
+	return i >= 0 && i/64 < len(b) && b[i/64]&(1<<(i%64)) != 0
+}
+
+// set sets bit i.
+func (b *bitmap) set(i int) {
+	for i/64 >= len(*b) {
+		*b = append(*b, 0)
+	}
+	(*b)[i/64] |= 1 << (i % 64)
+}
+
+// clear clears bit i.
+func (b bitmap) clear(i int) {
+	if i >= 0 && i/64 < len(b) {
+		b[i/64] &^= 1 << (i % 64)
+	}
+}
+
+// equal reports whether b and other have the same bits set.
+func (b bitmap) equal(other bitmap) bool {
+	if len(b) < len(other) {
+		b, other = other, b
+	}
+	for i, word := range b {
+		if i < len(other) && word != other[i] || i >= len(other) && word != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// count returns how many bits are set.
+func (b bitmap) count() int {
+	n := 0
+	for _, word := range b {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+// recountBitmaps rebuilds the usage bitmaps from the free block list and
+// the InodeMap, for use after either has been replaced wholesale.
+func (fs *FileSystem) recountBitmaps() {
+	free := make(bitmap, (fs.Superblock.TotalBlocks+63)/64)
+	for _, block := range fs.Superblock.FreeBlocks {
+		if block >= 0 && block < fs.Superblock.TotalBlocks {
+			free.set(block)
+		}
+	}
+	used := make(bitmap, len(free))
+	for block := 0; block < fs.Superblock.TotalBlocks; block++ {
+		if !free.has(block) {
+			used.set(block)
+		}
+	}
+	fs.Superblock.BlockBitmap = used
+
+	fs.Superblock.InodeBitmap = make(bitmap, (len(fs.Superblock.InodeMap)+63)/64)
+	for number, inode := range fs.Superblock.InodeMap {
+		if inode != nil {
+			fs.Superblock.InodeBitmap.set(number)
+		}
+	}
+}
+
+// bitmapErrors compares the usage bitmaps with the blocks and inodes the
+// caller found in use.
+func (fs *FileSystem) bitmapErrors(usedBlocks, usedInodes map[int]bool) error {
+	for block := 0; block < fs.Superblock.TotalBlocks; block++ {
+		if fs.Superblock.BlockBitmap.has(block) != usedBlocks[block] {
+			return fmt.Errorf("block bitmap mismatch for block %d: marked used %v", block, fs.Superblock.BlockBitmap.has(block))
+		}
+	}
+	if n := fs.Superblock.BlockBitmap.count(); n != len(usedBlocks) {
+		return fmt.Errorf("block bitmap mismatch: %d blocks marked used, %d in use", n, len(usedBlocks))
+	}
+	for number := range fs.Superblock.InodeMap {
+		if fs.Superblock.InodeBitmap.has(number) != usedInodes[number] {
+			return fmt.Errorf("inode bitmap mismatch for inode %d: marked used %v", number, fs.Superblock.InodeBitmap.has(number))
+		}
+	}
+	if n := fs.Superblock.InodeBitmap.count(); n != len(usedInodes) {
+		return fmt.Errorf("inode bitmap mismatch: %d inodes marked used, %d in use", n, len(usedInodes))
+	}
+	return nil
+}
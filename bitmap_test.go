@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestBitmap(t *testing.T) {
+	var b bitmap
+	for _, i := range []int{0, 63, 64, 200} {
+		b.set(i)
+	}
+	b.clear(63)
+	b.clear(1000)
+	for i, want := range map[int]bool{0: true, 1: false, 63: false, 64: true, 200: true, 1000: false, -1: false} {
+		if b.has(i) != want {
+			t.Errorf("has(%d) = %v, want %v", i, !want, want)
+		}
+	}
+	if n := b.count(); n != 3 {
+		t.Errorf("count = %d, want 3", n)
+	}
+	longer := append(append(bitmap(nil), b...), 0, 0)
+	if !b.equal(longer) || !longer.equal(b) {
+		t.Error("bitmaps differing only in trailing zero words are unequal")
+	}
+	longer.set(500)
+	if b.equal(longer) {
+		t.Error("bitmaps with different bits are equal")
+	}
+}
+
+// The bitmaps follow every allocation and free, including blocks added as
+// the filesystem grows and inode slots that are reused.
+func TestBitmapsTrackUsage(t *testing.T) {
+	fs := NewFileSystem()
+	check := func(step string) {
+		t.Helper()
+		blocks, inodes := fs.Superblock.BlockBitmap, fs.Superblock.InodeBitmap
+		fs.recountBitmaps()
+		if !blocks.equal(fs.Superblock.BlockBitmap) || !inodes.equal(fs.Superblock.InodeBitmap) {
+			t.Fatalf("%s: bitmaps out of sync with the free list and InodeMap", step)
+		}
+		if err := fs.verifyFilesystem(); err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		if _, err := fs.touch("/root", name); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.writeFile("/root/"+name, bytes.Repeat([]byte{'x'}, (i%4+1)*60*BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fs.Superblock.TotalBlocks == InitialBlocks {
+		t.Fatal("filesystem did not grow")
+	}
+	check("after writes")
+	for i := 0; i < 20; i += 2 {
+		if err := fs.rm(fmt.Sprintf("/root/f%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("after removals")
+	if err := fs.writeFile("/root/f19", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.mkdirAll("/root/a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	check("after reuse")
+	if err := fs.removeAll("/root/a"); err != nil {
+		t.Fatal(err)
+	}
+	check("after removeAll")
+
+	fs.mu.Lock()
+	err := fs.freeBlock(fs.Superblock.FreeBlocks[0])
+	fs.mu.Unlock()
+	if err != ErrBlockFree {
+		t.Errorf("freeing a free block: %v, want ErrBlockFree", err)
+	}
+}
+
+func TestConsistencyCheckFindsBitmapErrors(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+	block := fs.resolvePath("/root/f").BlockPointer
+	fs.Superblock.BlockBitmap.clear(block)
+	want := fmt.Sprintf("block bitmap mismatch for block %d: marked used false", block)
+	if err := fs.verifyFilesystem(); err == nil || err.Error() != want {
+		t.Errorf("verifyFilesystem = %v, want %q", err, want)
+	}
+	if report, err := fs.repair(); err != nil || len(report) != 1 {
+		t.Errorf("repair = %q, %v, want the bitmaps rebuilt", report, err)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Errorf("after repair: %v", err)
+	}
+}
+
+// Testing whether a block is free, as freeBlock does on every call, scans
+// the free list but is a single bit test in the bitmap.
+func BenchmarkFreeBlockTest(b *testing.B) {
+	fs := NewFileSystem()
+	fs.setBlockLimit(1 << 14)
+	for fs.growBlocks() {
+	}
+	free := fs.Superblock.FreeBlocks
+	total := fs.Superblock.TotalBlocks
+	b.Run("slice", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			block := i % total
+			for _, f := range free {
+				if f == block {
+					break
+				}
+			}
+		}
+	})
+	b.Run("bitmap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			fs.Superblock.BlockBitmap.has(i % total)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import "sync/atomic"
+
+// chunkBlocks is how many consecutive blocks a blockTable shares and copies
+// together.
+const chunkBlocks = 64
+
+// blockChunk holds the contents and checksums of chunkBlocks consecutive
+// blocks. Only the table whose generation is gen may change it in place.
+type blockChunk struct {
+	data [chunkBlocks][]byte
+	sums [chunkBlocks]uint32
+	gen  uint64
+}
+
+// blockGen hands out table generations.
+var blockGen atomic.Uint64
+
+// blockTable holds the filesystem's blocks and their checksums in chunks
+// that snapshots share. Taking a snapshot copies only the list of chunks;
+// the filesystem then copies a chunk the first time it writes to it, so a
+// snapshot costs in proportion to what changes after it rather than to the
+// size of the filesystem. Block contents are never modified in place, so a
+// copied chunk shares them too.
+type blockTable struct {
+	chunks []*blockChunk
+	n      int
+	gen    uint64
+}
+
+// newBlockTable returns a table of n empty blocks.
+func newBlockTable(n int) blockTable {
+	t := blockTable{gen: blockGen.Add(1)}
+	t.grow(n)
+	return t
+}
+
+// blockTableOf returns a table holding data, with sums as its checksums.
+func blockTableOf(data [][]byte, sums []uint32) blockTable {
+	t := newBlockTable(len(data))
+	for block := range data {
+		c := t.chunks[block/chunkBlocks]
+		c.data[block%chunkBlocks], c.sums[block%chunkBlocks] = data[block], sums[block]
+	}
+	return t
+}
+
+// len returns the number of blocks in the table.
+func (t *blockTable) len() int {
+	return t.n
+}
+
+// data returns the contents of block.
+func (t *blockTable) data(block int) []byte {
+	return t.chunks[block/chunkBlocks].data[block%chunkBlocks]
+}
+
+// sum returns the checksum recorded for block.
+func (t *blockTable) sum(block int) uint32 {
+	return t.chunks[block/chunkBlocks].sums[block%chunkBlocks]
+}
+
+// set stores data as the contents of block with sum as its checksum,
+// copying the block's chunk first if it is shared.
+func (t *blockTable) set(block int, data []byte, sum uint32) {
+	i := block / chunkBlocks
+	c := t.chunks[i]
+	if c.gen != t.gen {
+		copied := *c
+		copied.gen = t.gen
+		c = &copied
+		t.chunks[i] = c
+	}
+	c.data[block%chunkBlocks], c.sums[block%chunkBlocks] = data, sum
+}
+
+// grow extends the table to n blocks. The new blocks are empty: a shared
+// chunk never holds anything past the length of the tables sharing it.
+func (t *blockTable) grow(n int) {
+	for len(t.chunks)*chunkBlocks < n {
+		t.chunks = append(t.chunks, &blockChunk{gen: t.gen})
+	}
+	t.n = n
+}
+
+// share returns a copy of the table for a snapshot to keep. Neither the
+// copy nor t changes the chunks they now share in place.
+func (t *blockTable) share() blockTable {
+	shared := blockTable{
+		chunks: append([]*blockChunk(nil), t.chunks...),
+		n:      t.n,
+		gen:    blockGen.Add(1),
+	}
+	t.gen = blockGen.Add(1)
+	return shared
+}
+
+// slices returns the contents and checksums of every block, as images
+// store them.
+func (t *blockTable) slices() ([][]byte, []uint32) {
+	data := make([][]byte, t.n)
+	sums := make([]uint32, t.n)
+	for block := range data {
+		data[block], sums[block] = t.data(block), t.sum(block)
+	}
+	return data, sums
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The order changes the tree's shape but never what a directory lists, and
+// it survives an image round trip.
+func TestBTreeOrders(t *testing.T) {
+	if _, err := NewFileSystemWithOrder(MinBTreeOrder - 1); !errors.Is(err, ErrInvalid) {
+		t.Errorf("order %d: err = %v, want ErrInvalid", MinBTreeOrder-1, err)
+	}
+
+	names := rand.New(rand.NewSource(3)).Perm(300)
+	var want []string
+	for _, order := range []int{4, 8, 16} {
+		fs, err := NewFileSystemWithOrder(order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range names {
+			if _, err := fs.touch("/root", fmt.Sprintf("f%03d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := fs.list("/root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == nil {
+			want = got
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("order %d lists %v, want %v", order, got, want)
+		}
+		if len(got) != len(names) || !sort.StringsAreSorted(got) {
+			t.Errorf("order %d: listing of %d names not sorted or incomplete", order, len(got))
+		}
+
+		var buf bytes.Buffer
+		if err := fs.ExportImage(&buf); err != nil {
+			t.Fatal(err)
+		}
+		imported := NewFileSystem()
+		if err := imported.ImportImage(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if imported.btreeOrder != order {
+			t.Errorf("imported order = %d, want %d", imported.btreeOrder, order)
+		}
+		got, err = imported.list("/root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("order %d: imported listing differs", order)
+		}
+		if err := imported.verifyFilesystem(); err != nil {
+			t.Fatal(err)
+		}
+
+		tree := newBTree(order)
+		for i := 0; i < 50; i++ {
+			tree.insert(DirEntry{Name: fmt.Sprintf("e%02d", i), InodeIndex: i})
+		}
+		loaded := deserializeBTree(serializeBTree(tree))
+		if loaded.Order != order {
+			t.Errorf("deserialized order = %d, want %d", loaded.Order, order)
+		}
+		if !reflect.DeepEqual(loaded.entries(), tree.entries()) {
+			t.Errorf("order %d: deserialized entries differ", order)
+		}
+	}
+}
+
+// checkTree fails the test unless tree meets the B-tree invariants, its
+// Parent pointers are right and it holds exactly want, in order.
+func checkTree(t *testing.T, tree *BTree, want []DirEntry) {
+	t.Helper()
+	leafDepth := -1
+	var balanced func(node *BTreeNode, depth int) bool
+	balanced = func(node *BTreeNode, depth int) bool {
+		if len(node.Keys) > tree.maxKeys() || node != tree.Root && len(node.Keys) < tree.minKeys() {
+			return false
+		}
+		if node.IsLeaf {
+			if leafDepth < 0 {
+				leafDepth = depth
+			}
+			return depth == leafDepth
+		}
+		if len(node.Children) != len(node.Keys)+1 {
+			return false
+		}
+		for _, child := range node.Children {
+			if !balanced(child, depth+1) {
+				return false
+			}
+		}
+		return true
+	}
+	if !balanced(tree.Root, 0) {
+		t.Fatalf("order %d: tree not balanced", tree.Order)
+	}
+	var parents func(node *BTreeNode) bool
+	parents = func(node *BTreeNode) bool {
+		for _, child := range node.Children {
+			if child.Parent != node || !parents(child) {
+				return false
+			}
+		}
+		return true
+	}
+	if tree.Root.Parent != nil || !parents(tree.Root) {
+		t.Fatalf("order %d: wrong Parent pointers", tree.Order)
+	}
+	if got := tree.entries(); len(got) != len(want) || len(want) > 0 && !reflect.DeepEqual(got, want) {
+		t.Fatalf("order %d: entries = %v, want %v", tree.Order, got, want)
+	}
+}
+
+// sortedEntries returns n entries named in sorted order.
+func sortedEntries(n int) []DirEntry {
+	entries := make([]DirEntry, n)
+	for i := range entries {
+		entries[i] = DirEntry{Name: fmt.Sprintf("f%06d", i), InodeIndex: i}
+	}
+	return entries
+}
+
+// splitChild moves the middle key of an overflowing leaf or inner node up into
+// the parent at the child's position, leaving the keys and children on
+// either side of it in the child and a new sibling after it.
+func TestSplitChild(t *testing.T) {
+	entry := func(name string) DirEntry { return DirEntry{Name: name} }
+	leaf := func(names ...string) *BTreeNode {
+		node := &BTreeNode{IsLeaf: true}
+		for _, name := range names {
+			node.Keys = append(node.Keys, entry(name))
+		}
+		return node
+	}
+	names := func(node *BTreeNode) string {
+		var out []string
+		for _, e := range node.Keys {
+			out = append(out, e.Name)
+		}
+		return strings.Join(out, ",")
+	}
+	layout := func(node *BTreeNode) string {
+		out := names(node)
+		for _, child := range node.Children {
+			if child.Parent != node {
+				return "wrong parent under " + out
+			}
+			out += " [" + names(child) + "]"
+		}
+		return out
+	}
+
+	for _, tt := range []struct {
+		order int
+		full  *BTreeNode
+		want  string
+		kids  []string
+	}{
+		{3, leaf("b", "c", "d"), "a,c,x [a0] [b] [d] [y]", nil},
+		{4, leaf("b", "c", "d", "e"), "a,d,x [a0] [b,c] [e] [y]", nil},
+		{5, leaf("b", "c", "d", "e", "f"), "a,d,x [a0] [b,c] [e,f] [y]", nil},
+		{
+			order: 3,
+			full: &BTreeNode{
+				Keys:     []DirEntry{entry("c"), entry("e"), entry("g")},
+				Children: []*BTreeNode{leaf("b"), leaf("d"), leaf("f"), leaf("h")},
+			},
+			want: "a,e,x [a0] [c] [g] [y]",
+			kids: []string{"b d", "f h"},
+		},
+	} {
+		tree := newBTree(tt.order)
+		parent := &BTreeNode{
+			Keys:     []DirEntry{entry("a"), entry("x")},
+			Children: []*BTreeNode{leaf("a0"), tt.full, leaf("y")},
+		}
+		for _, child := range parent.Children {
+			child.Parent = parent
+		}
+		for _, child := range tt.full.Children {
+			child.Parent = tt.full
+		}
+		tree.Root = parent
+		tree.splitChild(parent, 1)
+
+		if got := layout(parent); got != tt.want {
+			t.Errorf("order %d: after split %q, want %q", tt.order, got, tt.want)
+		}
+		for i, want := range tt.kids {
+			node := parent.Children[1+i]
+			var got []string
+			for _, child := range node.Children {
+				if child.Parent != node {
+					t.Errorf("order %d: child %s not reparented", tt.order, names(child))
+				}
+				got = append(got, names(child))
+			}
+			if strings.Join(got, " ") != want {
+				t.Errorf("order %d: children of node %d = %v, want %q", tt.order, 1+i, got, want)
+			}
+		}
+
+		// The halves don't share storage, so growing one leaves the
+		// other as it was.
+		left, right := parent.Children[1], parent.Children[2]
+		before := names(right)
+		left.Keys = append(left.Keys, entry("z"))
+		if names(right) != before {
+			t.Errorf("order %d: appending to the left half changed the right to %q", tt.order, names(right))
+		}
+	}
+}
+
+func TestBTreeRemove(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for order := MinBTreeOrder; order <= 8; order++ {
+		for _, n := range []int{0, 1, 2, 10, 100, 500} {
+			all := sortedEntries(n)
+			tree := newBTree(order)
+			for _, i := range rng.Perm(n) {
+				tree.insert(all[i])
+			}
+			if tree.remove("missing") {
+				t.Fatalf("order %d: removed a missing entry", order)
+			}
+
+			present := make(map[string]bool)
+			for _, e := range all {
+				present[e.Name] = true
+			}
+			for _, i := range rng.Perm(n) {
+				if !tree.remove(all[i].Name) {
+					t.Fatalf("order %d: %s not removed", order, all[i].Name)
+				}
+				if tree.remove(all[i].Name) {
+					t.Fatalf("order %d: %s removed twice", order, all[i].Name)
+				}
+				delete(present, all[i].Name)
+				var want []DirEntry
+				for _, e := range all {
+					if present[e.Name] {
+						want = append(want, e)
+					}
+				}
+				checkTree(t, tree, want)
+			}
+			if !tree.Root.IsLeaf {
+				t.Errorf("order %d: empty tree has an inner root", order)
+			}
+		}
+	}
+}
+
+// Removals interleaved with inserts keep the tree valid, and it still
+// serializes and searches correctly.
+func TestBTreeRemoveInterleaved(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for order := MinBTreeOrder; order <= 8; order++ {
+		tree := newBTree(order)
+		present := make(map[string]DirEntry)
+		for step := 0; step < 2000; step++ {
+			e := DirEntry{Name: fmt.Sprintf("n%03d", rng.Intn(200)), InodeIndex: step}
+			if _, ok := present[e.Name]; ok {
+				tree.remove(e.Name)
+				delete(present, e.Name)
+			} else {
+				tree.insert(e)
+				present[e.Name] = e
+			}
+		}
+		var want []DirEntry
+		for _, e := range present {
+			want = append(want, e)
+		}
+		sort.Slice(want, func(i, j int) bool { return want[i].Name < want[j].Name })
+		checkTree(t, tree, want)
+		checkTree(t, deserializeBTree(serializeBTree(tree)), want)
+		for _, e := range want {
+			if got, ok := tree.search(e.Name); !ok || got != e {
+				t.Fatalf("order %d: search(%s) = %v, %v", order, e.Name, got, ok)
+			}
+		}
+	}
+}
+
+func TestBulkLoadMatchesInsert(t *testing.T) {
+	for order := MinBTreeOrder; order <= 8; order++ {
+		for _, n := range []int{0, 1, 2, 3, 7, 64, 1000} {
+			all := sortedEntries(n)
+			inserted := newBTree(order)
+			for _, e := range all {
+				inserted.insert(e)
+			}
+			loaded := newBTree(order)
+			loaded.bulkLoad(all)
+			checkTree(t, loaded, inserted.entries())
+		}
+	}
+}
+
+// legacyInsert inserts entry as insert used to, splitting full nodes on the
+// way down. That left a half short of minKeys at odd orders, an empty one at
+// order 3, and images written then can still hold such trees.
+func legacyInsert(tree *BTree, entry DirEntry) {
+	if len(tree.Root.Keys) == tree.maxKeys() {
+		root := &BTreeNode{Children: []*BTreeNode{tree.Root}}
+		tree.Root.Parent = root
+		tree.splitChild(root, 0)
+		tree.Root = root
+	}
+	node := tree.Root
+	for !node.IsLeaf {
+		i := sort.Search(len(node.Keys), func(i int) bool { return node.Keys[i].Name > entry.Name })
+		if len(node.Children[i].Keys) == tree.maxKeys() {
+			tree.splitChild(node, i)
+			if entry.Name > node.Keys[i].Name {
+				i++
+			}
+		}
+		node = node.Children[i]
+	}
+	i := sort.Search(len(node.Keys), func(i int) bool { return node.Keys[i].Name > entry.Name })
+	node.Keys = append(node.Keys, DirEntry{})
+	copy(node.Keys[i+1:], node.Keys[i:])
+	node.Keys[i] = entry
+}
+
+// Trees with underfull and empty nodes, as older inserts built, give up
+// every entry without panicking.
+func TestBTreeRemoveFromLegacyTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	for order := MinBTreeOrder; order <= 6; order++ {
+		all := sortedEntries(200)
+		tree := newBTree(order)
+		for _, i := range rng.Perm(len(all)) {
+			legacyInsert(tree, all[i])
+		}
+		if order%2 == 1 && !tree.underfull() {
+			t.Fatalf("order %d: legacy tree has no underfull nodes", order)
+		}
+		present := make(map[string]bool)
+		for _, e := range all {
+			present[e.Name] = true
+		}
+		for _, i := range rng.Perm(len(all)) {
+			if !tree.remove(all[i].Name) {
+				t.Fatalf("order %d: %s not removed", order, all[i].Name)
+			}
+			delete(present, all[i].Name)
+			var want []DirEntry
+			for _, e := range all {
+				if present[e.Name] {
+					want = append(want, e)
+				}
+			}
+			if got := tree.entries(); len(got) != len(want) || len(want) > 0 && !reflect.DeepEqual(got, want) {
+				t.Fatalf("order %d: after removing %s, %d entries, want %d", order, all[i].Name, len(got), len(want))
+			}
+		}
+	}
+}
+
+// At order 3, removing files from a directory keeps every other entry.
+func TestRemoveAtMinOrder(t *testing.T) {
+	fs, err := NewFileSystemWithOrder(MinBTreeOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"f5", "f1", "f8", "f3", "f9", "f0", "f2", "f7", "f4", "f6"}
+	for _, name := range names {
+		if _, err := fs.touch("/root", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed := map[string]bool{}
+	for _, name := range []string{"f3", "f7", "f0", "f9", "f5"} {
+		if err := fs.rm("/root/" + name); err != nil {
+			t.Fatal(err)
+		}
+		removed[name] = true
+		var want []string
+		for i := 0; i < 10; i++ {
+			if name := fmt.Sprintf("f%d", i); !removed[name] {
+				want = append(want, name)
+			}
+		}
+		if got, err := fs.list("/root"); err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("after rm %s: list = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Trees left underfull by older inserts are rebuilt by repair without
+// changing what the directory lists.
+func TestRebalanceBTree(t *testing.T) {
+	for _, order := range []int{3, 5} {
+		fs, err := NewFileSystemWithOrder(order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range rand.New(rand.NewSource(4)).Perm(200) {
+			if _, err := fs.touch("/root", fmt.Sprintf("f%03d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root := fs.resolvePath("/root")
+		before := newBTree(order)
+		for _, i := range rand.New(rand.NewSource(6)).Perm(200) {
+			legacyInsert(before, fs.dirTree(root).entries()[i])
+		}
+		if !before.underfull() {
+			t.Fatalf("order %d: tree has no underfull nodes to rebalance", order)
+		}
+		fs.mu.Lock()
+		fs.storeDirTree(root, before)
+		fs.flushDirTrees()
+		fs.mu.Unlock()
+		want := before.entries()
+		listing, err := fs.list("/root")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := fs.repair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		line := fmt.Sprintf("rebalanced B-tree of directory inode %d", root.InodeNumber)
+		if len(report) != 1 || report[0] != line {
+			t.Errorf("order %d: repair = %q, want %q", order, report, line)
+		}
+		checkTree(t, fs.dirTree(root), want)
+		if got, err := fs.list("/root"); err != nil || !reflect.DeepEqual(got, listing) {
+			t.Errorf("order %d: listing changed by rebalancing", order)
+		}
+		if err := fs.verifyFilesystem(); err != nil {
+			t.Fatal(err)
+		}
+		if report, _ := fs.repair(); len(report) != 0 {
+			t.Errorf("order %d: second repair reported %v", order, report)
+		}
+	}
+}
+
+func BenchmarkBTreeBuild(b *testing.B) {
+	entries := sortedEntries(10000)
+	b.Run("insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree := newBTree(MaxKeys + 1)
+			for _, e := range entries {
+				tree.insert(e)
+			}
+		}
+	})
+	b.Run("bulkLoad", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			newBTree(MaxKeys + 1).bulkLoad(entries)
+		}
+	})
+}
+
+func BenchmarkBTreeRemove(b *testing.B) {
+	entries := sortedEntries(10000)
+	order := rand.New(rand.NewSource(1)).Perm(len(entries))
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tree := newBTree(MaxKeys + 1)
+		tree.bulkLoad(entries)
+		b.StartTimer()
+		for _, j := range order {
+			tree.remove(entries[j].Name)
+		}
+	}
+}
+
+func TestDirEntries(t *testing.T) {
+	fs, err := NewFileSystemWithOrder(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.mkdir("/root", "d"); err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(100) {
+		name := fmt.Sprintf("f%03d", i)
+		names[name] = true
+		if _, err := fs.touch("/root/d", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, _ := fs.stat("/root/d")
+	if fs.dirTree(dir).Root.IsLeaf {
+		t.Fatal("the directory's B-tree has no internal nodes")
+	}
+
+	entries, err := fs.dirEntries("/root/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(names) {
+		t.Errorf("dirEntries returned %d entries, want %d", len(entries), len(names))
+	}
+	if !sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name }) {
+		t.Errorf("dirEntries not sorted: %v", entries)
+	}
+	for _, entry := range entries {
+		if !names[entry.Name] {
+			t.Errorf("unexpected entry %q", entry.Name)
+		}
+		if inode := fs.lookupInode(entry.InodeIndex); inode == nil || inode.Name != entry.Name {
+			t.Errorf("entry %q points at inode %d", entry.Name, entry.InodeIndex)
+		}
+	}
+
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.dirEntries("/root/f"); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("dirEntries of a file: %v, want ErrNotDirectory", err)
+	}
+	if _, err := fs.dirEntries("/root/missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("dirEntries of a missing path: %v, want ErrNotFound", err)
+	}
+}
+
+// Pruning subtrees must not lose entries: every range agrees with filtering
+// the full listing.
+func TestEntriesInRange(t *testing.T) {
+	fs, err := NewFileSystemWithOrder(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.mkdir("/root", "d"); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range rand.New(rand.NewSource(2)).Perm(300) {
+		if _, err := fs.touch("/root/d", fmt.Sprintf("f%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := fs.dirEntries("/root/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	between := func(lo, hi string) []DirEntry {
+		var out []DirEntry
+		for _, entry := range all {
+			if entry.Name >= lo && entry.Name < hi {
+				out = append(out, entry)
+			}
+		}
+		return out
+	}
+
+	bounds := []string{"", "a", "f", "f0", "f000", "f0005", "f042", "f1", "f150", "f15", "f2995", "f299", "f3", "g"}
+	for _, lo := range bounds {
+		for _, hi := range bounds {
+			got, err := fs.entriesInRange("/root/d", lo, hi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := between(lo, hi); !reflect.DeepEqual(got, want) {
+				t.Errorf("entriesInRange(%q, %q) returned %d entries, want %d", lo, hi, len(got), len(want))
+			}
+		}
+	}
+
+	for prefix, n := range map[string]int{"": 300, "f": 300, "f1": 100, "f04": 10, "f123": 1, "f3": 0, "g": 0} {
+		got, err := fs.entriesWithPrefix("/root/d", prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != n {
+			t.Errorf("entriesWithPrefix(%q) returned %d entries, want %d", prefix, len(got), n)
+		}
+		for _, entry := range got {
+			if !strings.HasPrefix(entry.Name, prefix) {
+				t.Errorf("entriesWithPrefix(%q) returned %q", prefix, entry.Name)
+			}
+		}
+	}
+
+	if _, err := fs.entriesInRange("/root/missing", "b", "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("entriesInRange of a missing path: %v, want ErrNotFound", err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, want := range map[string]string{"": "", "a": "b", "az": "a{", "a\xff": "b", "\xff\xff": ""} {
+		if got := prefixEnd(prefix); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
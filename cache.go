@@ -0,0 +1,241 @@
+package main
+
+import "sync"
+
+// EvictionPolicy selects which cached tree is dropped when the cache is full.
+type EvictionPolicy int
+
+const (
+	// LRU evicts the entry that was accessed least recently.
+	LRU EvictionPolicy = iota
+	// LFU evicts the entry that was accessed least often, breaking ties by
+	// access time.
+	LFU
+)
+
+// CacheConfig controls the directory tree cache. A MaxEntries of zero
+// disables caching.
+type CacheConfig struct {
+	MaxEntries int
+	Policy     EvictionPolicy
+}
+
+var defaultCacheConfig = CacheConfig{MaxEntries: 64, Policy: LRU}
+
+// CacheStats reports how effective the cache has been.
+type CacheStats struct {
+	Hits      int
+	Misses    int
+	Evictions int
+	Entries   int
+	HitRatio  float64
+}
+
+type cacheEntry struct {
+	tree *BTree
+	// dirty marks a tree changed since it was last written to its block.
+	// Only writers leave trees dirty, and unlockWrite writes them all back,
+	// so readers never find one to flush.
+	dirty      bool
+	accesses   int
+	lastAccess uint64
+}
+
+// treeCache holds deserialized directory B-trees keyed by block. It has its
+// own lock because lookups happen under the filesystem's read lock.
+type treeCache struct {
+	mu      sync.Mutex
+	config  CacheConfig
+	entries map[int]*cacheEntry
+	clock   uint64
+	stats   CacheStats
+	// flush writes a dirty tree back to its block before it is evicted.
+	flush func(block int, tree *BTree)
+}
+
+func newTreeCache(config CacheConfig, flush func(block int, tree *BTree)) *treeCache {
+	return &treeCache{
+		config:  config,
+		entries: make(map[int]*cacheEntry),
+		flush:   flush,
+	}
+}
+
+// get returns the cached tree for block, if any.
+func (c *treeCache) get(block int) (*BTree, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[block]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.touch(entry)
+	return entry.tree, true
+}
+
+// peek returns the cached tree for block without counting an access.
+func (c *treeCache) peek(block int) (*BTree, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[block]
+	if !ok {
+		return nil, false
+	}
+	return entry.tree, true
+}
+
+// put caches tree for block, evicting another entry if the cache is full.
+func (c *treeCache) put(block int, tree *BTree, dirty bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.config.MaxEntries <= 0 {
+		if dirty {
+			c.flush(block, tree)
+		}
+		return
+	}
+	if entry, ok := c.entries[block]; ok {
+		entry.tree = tree
+		entry.dirty = entry.dirty || dirty
+		c.touch(entry)
+		return
+	}
+	for len(c.entries) >= c.config.MaxEntries {
+		c.evict()
+	}
+	entry := &cacheEntry{tree: tree, dirty: dirty}
+	c.touch(entry)
+	c.entries[block] = entry
+}
+
+// drop forgets block without flushing it, for blocks that were freed or
+// overwritten underneath the cache.
+func (c *treeCache) drop(block int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, block)
+}
+
+// reset empties the cache without flushing.
+func (c *treeCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[int]*cacheEntry)
+}
+
+// flushAll writes every dirty tree back to its block, keeping it cached.
+func (c *treeCache) flushAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for block, entry := range c.entries {
+		if entry.dirty {
+			c.flush(block, entry.tree)
+			entry.dirty = false
+		}
+	}
+}
+
+// configure replaces the cache settings, evicting entries that no longer fit.
+func (c *treeCache) configure(config CacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.config = config
+	for len(c.entries) > 0 && len(c.entries) > config.MaxEntries {
+		c.evict()
+	}
+}
+
+func (c *treeCache) snapshotStats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+func (c *treeCache) touch(entry *cacheEntry) {
+	c.clock++
+	entry.lastAccess = c.clock
+	entry.accesses++
+}
+
+// evict removes one entry according to the policy, flushing it if dirty.
+// The caller must hold c.mu.
+func (c *treeCache) evict() {
+	victim := -1
+	var worst *cacheEntry
+	for block, entry := range c.entries {
+		if worst == nil || c.less(entry, worst) || (!c.less(worst, entry) && block < victim) {
+			victim, worst = block, entry
+		}
+	}
+	if worst == nil {
+		return
+	}
+	if worst.dirty {
+		c.flush(victim, worst.tree)
+	}
+	delete(c.entries, victim)
+	c.stats.Evictions++
+}
+
+// less reports whether a should be evicted before b.
+func (c *treeCache) less(a, b *cacheEntry) bool {
+	if c.config.Policy == LFU && a.accesses != b.accesses {
+		return a.accesses < b.accesses
+	}
+	return a.lastAccess < b.lastAccess
+}
+
+// dirTree returns the parsed B-tree of a directory, using the cache when
+// possible. Callers that modify the tree must hand it back via storeDirTree.
+func (fs *FileSystem) dirTree(inode *Inode) *BTree {
+	if tree, ok := fs.cache.get(inode.BlockPointer); ok {
+		return tree
+	}
+	tree := deserializeBTree(fs.blocks.data(inode.BlockPointer))
+	fs.cache.put(inode.BlockPointer, tree, false)
+	return tree
+}
+
+// storeDirTree caches a directory's modified B-tree. It is serialized to the
+// directory's block only when evicted or flushed, at the latest by
+// unlockWrite, so a run of changes to one directory within an operation
+// costs a single serialization. The caller must hold the write lock.
+func (fs *FileSystem) storeDirTree(inode *Inode, tree *BTree) {
+	fs.cache.put(inode.BlockPointer, tree, true)
+}
+
+// flushDirTrees writes every modified cached directory back to its block.
+// Anything that reads directory blocks directly, rather than through dirTree,
+// must call it first. Under the read lock there is nothing to write back,
+// since unlockWrite flushed it.
+func (fs *FileSystem) flushDirTrees() {
+	fs.cache.flushAll()
+}
+
+// setCacheConfig changes the size and eviction policy of the tree cache.
+func (fs *FileSystem) setCacheConfig(config CacheConfig) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.cache.configure(config)
+}
+
+// cacheStats reports hit and eviction counts for the tree cache.
+func (fs *FileSystem) cacheStats() CacheStats {
+	return fs.cache.snapshotStats()
+}
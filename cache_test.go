@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// A few hot directories read between scans of many cold ones stay cached
+// under LFU, while LRU lets each scan push them out.
+func TestTreeCacheHitRatioLRUvsLFU(t *testing.T) {
+	ratio := func(policy EvictionPolicy) float64 {
+		c := newTreeCache(CacheConfig{MaxEntries: 3, Policy: policy}, func(int, *BTree) {})
+		access := func(block int) {
+			if _, ok := c.get(block); !ok {
+				c.put(block, newBTree(4), false)
+			}
+		}
+		cold := 100
+		for round := 0; round < 50; round++ {
+			for _, hot := range []int{1, 2, 1, 2} {
+				access(hot)
+			}
+			for i := 0; i < 4; i++ {
+				access(cold)
+				cold++
+			}
+		}
+		return c.snapshotStats().HitRatio
+	}
+	lru, lfu := ratio(LRU), ratio(LFU)
+	// LRU misses each hot entry once a round, LFU only in the first
+	if lru > 0.26 || lfu < 0.49 {
+		t.Errorf("hit ratios LRU %.2f, LFU %.2f; want about 0.25 and 0.5", lru, lfu)
+	}
+}
+
+// The least recently used entry goes first, and a dirty one is written back
+// as it goes.
+func TestTreeCacheLRUEviction(t *testing.T) {
+	flushed := make(map[int]*BTree)
+	c := newTreeCache(CacheConfig{MaxEntries: 3, Policy: LRU}, func(block int, tree *BTree) {
+		flushed[block] = tree
+	})
+	trees := make(map[int]*BTree)
+	for block := 1; block <= 3; block++ {
+		trees[block] = newBTree(4)
+		c.put(block, trees[block], block == 2)
+	}
+	c.get(1)
+
+	var evicted []int
+	for block := 4; block <= 6; block++ {
+		c.put(block, newBTree(4), false)
+		for old := 1; old < block; old++ {
+			if _, ok := c.peek(old); !ok && !contains(evicted, old) {
+				evicted = append(evicted, old)
+			}
+		}
+	}
+	if want := []int{2, 3, 1}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted %v, want %v", evicted, want)
+	}
+	if len(flushed) != 1 || flushed[2] != trees[2] {
+		t.Errorf("flushed %v, want only block 2", flushed)
+	}
+	if stats := c.snapshotStats(); stats.Evictions != 3 || stats.Entries != 3 || stats.Hits != 1 {
+		t.Errorf("stats = %+v, want 3 evictions, 3 entries and 1 hit", stats)
+	}
+}
+
+func contains(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// With room for a single tree, every directory change is evicted, and so
+// written back, before the next directory is read.
+func TestTreeCacheEvictedDirectoriesReload(t *testing.T) {
+	fs := NewFileSystem()
+	fs.setCacheConfig(CacheConfig{MaxEntries: 1, Policy: LRU})
+	for _, dir := range []string{"a", "b", "c"} {
+		if _, err := fs.mkdir("/root", dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := make(map[string][]string)
+	for i := 0; i < 20; i++ {
+		for _, dir := range []string{"a", "b", "c"} {
+			name := fmt.Sprintf("%s%02d", dir, i)
+			if _, err := fs.touch("/root/"+dir, name); err != nil {
+				t.Fatal(err)
+			}
+			want[dir] = append(want[dir], name)
+		}
+	}
+	if stats := fs.cacheStats(); stats.Evictions == 0 || stats.Entries > 1 {
+		t.Fatalf("stats = %+v, want evictions and at most one entry", stats)
+	}
+	for _, dir := range []string{"a", "b", "c"} {
+		if got, err := fs.list("/root/" + dir); err != nil || !reflect.DeepEqual(got, want[dir]) {
+			t.Errorf("list %s = %v, %v, want %v", dir, got, err, want[dir])
+		}
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Resolving paths in a large directory parses its block on every lookup
+// without the cache.
+func BenchmarkResolveLargeDirectory(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		config CacheConfig
+	}{
+		{"cached", defaultCacheConfig},
+		{"uncached", CacheConfig{}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			fs := NewFileSystem()
+			names := make([]string, 2000)
+			for i := range names {
+				names[i] = fmt.Sprintf("f%04d", i)
+				fs.touch("/root", names[i])
+			}
+			fs.setCacheConfig(bench.config)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if fs.resolvePath("/root/"+names[i%len(names)]) == nil {
+					b.Fatal("lookup failed")
+				}
+			}
+		})
+	}
+}
+
+// Write operations leave no modified tree behind for a reader to write
+// back, so readers that flush, like du, never change the block table
+// while others read it. Run with -race.
+func TestTreeCacheCleanAfterWrites(t *testing.T) {
+	fs := NewFileSystem()
+	for i := 0; i < 10; i++ {
+		for _, err := range []error{
+			errOf(fs.touch("/root", fmt.Sprintf("f%d", i))),
+			fs.writeFile(fmt.Sprintf("/root/f%d", i), []byte("data")),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	fs.createFilesystemSnapshot()
+	if _, err := fs.mkdir("/root", "d"); err != nil {
+		t.Fatal(err)
+	}
+	for block, entry := range fs.cache.entries {
+		if entry.dirty {
+			t.Errorf("tree of block %d still modified after mkdir returned", block)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if g%2 == 0 {
+					if _, err := fs.du("/root"); err != nil {
+						t.Error(err)
+					}
+				} else if _, err := fs.readFile(fmt.Sprintf("/root/f%d", i%10)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
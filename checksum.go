@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+// writeBlock stores data as the contents of block and records its checksum.
+// Every write to the block table goes through here.
+func (fs *FileSystem) writeBlock(block int, data []byte) {
+	fs.blocks.set(block, data, crc32.ChecksumIEEE(data))
+	fs.dirtyBlocks.set(block)
+}
+
+// verifyBlock reports an error wrapping ErrChecksum if block no longer
+// matches the checksum recorded when it was written.
+func (fs *FileSystem) verifyBlock(block int) error {
+	if sum, want := crc32.ChecksumIEEE(fs.blocks.data(block)), fs.blocks.sum(block); sum != want {
+		return fmt.Errorf("block %d: %w (have %08x, want %08x)", block, ErrChecksum, sum, want)
+	}
+	return nil
+}
+
+// rehashBlocks recomputes every checksum from the current block contents.
+func (fs *FileSystem) rehashBlocks() {
+	for block := 0; block < fs.blocks.len(); block++ {
+		data := fs.blocks.data(block)
+		fs.blocks.set(block, data, crc32.ChecksumIEEE(data))
+	}
+	fs.markAllDirty()
+}
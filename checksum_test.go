@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCorruptBlockDetected(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("abcdefgh"), BlockSize/8)
+	for _, err := range []error{fs.writeFile("/root/f", data), fs.verifyFilesystem()} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inode, err := fs.stat("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := inode.BlockPointer
+	// Blocks are shared with snapshots, so corrupt a copy, keeping the old
+	// checksum.
+	corrupt := append([]byte(nil), fs.blocks.data(block)...)
+	corrupt[0] ^= 0xff
+	fs.blocks.set(block, corrupt, fs.blocks.sum(block))
+
+	if _, err := fs.readFile("/root/f"); !errors.Is(err, ErrChecksum) {
+		t.Errorf("readFile err = %v, want ErrChecksum", err)
+	}
+	if err := fs.verifyFilesystem(); !errors.Is(err, ErrChecksum) {
+		t.Errorf("verifyFilesystem err = %v, want ErrChecksum", err)
+	}
+
+	// Rewriting the file replaces the bad block and clears the error.
+	if err := fs.writeFile("/root/f", data); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.readFile("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("rewritten file reads back wrong")
+	}
+}
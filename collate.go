@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Collation decides when two directory entry names are the same name. Names
+// are stored as they were given; the collation only affects how they are
+// compared, and so how directories are ordered and looked up.
+type Collation int
+
+const (
+	// CollateNFC compares names in Unicode normalization form C, so that
+	// composed and decomposed spellings of an accented name match.
+	CollateNFC Collation = 1 << iota
+	// CollateFold compares names case-insensitively, using Unicode case
+	// folding.
+	CollateFold
+
+	// CollateBytes compares names byte by byte, the default.
+	CollateBytes Collation = 0
+)
+
+// key returns the form of name that the collation compares.
+func (c Collation) key(name string) string {
+	if c&CollateNFC != 0 {
+		name = norm.NFC.String(name)
+	}
+	if c&CollateFold != 0 {
+		// A Caser holds state, so each call gets its own.
+		name = cases.Fold().String(name)
+		if c&CollateNFC != 0 {
+			// Folding can leave a string that is no longer in NFC.
+			name = norm.NFC.String(name)
+		}
+	}
+	return name
+}
+
+// setCollation changes how names are compared in every directory. Existing
+// directories are re-sorted under the new collation; if that would make two
+// entries of one directory the same name, nothing changes and ErrExists is
+// returned. Like the other settings it takes a checkpoint.
+func (fs *FileSystem) setCollation(c Collation) error {
+	if c&^(CollateNFC|CollateFold) != 0 {
+		return ErrInvalid
+	}
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	// Check every directory before changing any.
+	trees := make(map[*Inode]*BTree)
+	for _, dir := range fs.Superblock.InodeMap {
+		if dir == nil || !dir.IsDirectory {
+			continue
+		}
+		old := fs.dirTree(dir)
+		entries := old.entries()
+		sort.SliceStable(entries, func(i, j int) bool {
+			return c.key(entries[i].Name) < c.key(entries[j].Name)
+		})
+		for i := 1; i < len(entries); i++ {
+			if c.key(entries[i-1].Name) == c.key(entries[i].Name) {
+				return fmt.Errorf("%q and %q: %w", entries[i-1].Name, entries[i].Name, ErrExists)
+			}
+		}
+		tree := newBTree(old.Order)
+		tree.Collation = c
+		tree.bulkLoad(entries)
+		trees[dir] = tree
+	}
+	for dir, tree := range trees {
+		fs.storeDirTree(dir, tree)
+	}
+	fs.collation = c
+	fs.checkpointInternal()
+	return nil
+}
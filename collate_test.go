@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const (
+	composed   = "caf\u00e9"  // é as one code point
+	decomposed = "cafe\u0301" // e and a combining acute accent
+)
+
+// Composed and decomposed spellings are one name under NFC, and names that
+// differ only in case are one name under folding. Lookups and duplicate
+// checks agree, and names are kept as they were first given.
+func TestCollationModes(t *testing.T) {
+	for _, mode := range []struct {
+		name      string
+		collation Collation
+	}{
+		{"bytes", CollateBytes},
+		{"nfc", CollateNFC},
+		{"fold", CollateFold},
+		{"nfc+fold", CollateNFC | CollateFold},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			fs := NewFileSystem()
+			if err := fs.setCollation(mode.collation); err != nil {
+				t.Fatal(err)
+			}
+			nfc, fold := mode.collation&CollateNFC != 0, mode.collation&CollateFold != 0
+
+			for _, same := range []struct {
+				first, second string
+				want          bool
+			}{
+				{composed, decomposed, nfc},
+				{"Readme", "README", fold},
+				{"\u00c4rger", "a\u0308rger", nfc && fold},
+			} {
+				if _, err := fs.touch("/root", same.first); err != nil {
+					t.Fatal(err)
+				}
+				if found := fs.resolvePath("/root/"+same.second) != nil; found != same.want {
+					t.Errorf("resolving %q after creating %q: found %v, want %v", same.second, same.first, found, same.want)
+				}
+				_, err := fs.touch("/root", same.second)
+				if exists := errors.Is(err, ErrExists); exists != same.want {
+					t.Errorf("creating %q after %q: %v, want ErrExists %v", same.second, same.first, err, same.want)
+				}
+			}
+
+			names, err := fs.list("/root")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range names {
+				if name == decomposed && nfc || name == "README" && fold {
+					t.Errorf("list = %q, want the first spelling of each name kept", names)
+				}
+			}
+			if err := fs.verifyFilesystem(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Entries are removed and renamed through any matching spelling.
+func TestCollationRemove(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.setCollation(CollateNFC | CollateFold); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Notes", composed} {
+		if _, err := fs.touch("/root", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.rm("/root/NOTES"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.mv("/root/CAFE\u0301", "/root/other"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := fs.list("/root"); err != nil || !reflect.DeepEqual(names, []string{"other"}) {
+		t.Errorf("list = %v, %v, want [other]", names, err)
+	}
+}
+
+// Switching collation re-sorts existing directories, refusing when two
+// entries would become the same name.
+func TestSetCollation(t *testing.T) {
+	fs := NewFileSystem()
+	for _, name := range []string{"b", "C", "a", composed} {
+		if _, err := fs.touch("/root", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.setCollation(CollateFold); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := fs.list("/root"); !reflect.DeepEqual(names, []string{"a", "b", "C", composed}) {
+		t.Errorf("folded list = %q, want [a b C %s]", names, composed)
+	}
+	if fs.resolvePath("/root/c") == nil {
+		t.Error("existing entry not found under its folded name")
+	}
+
+	if _, err := fs.touch("/root", decomposed); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.setCollation(CollateNFC); !errors.Is(err, ErrExists) {
+		t.Errorf("collation merging two entries: %v, want ErrExists", err)
+	}
+	if fs.resolvePath("/root/c") == nil {
+		t.Error("failed change of collation was not left undone")
+	}
+	if err := fs.setCollation(Collation(4)); !errors.Is(err, ErrInvalid) {
+		t.Errorf("unknown collation: %v, want ErrInvalid", err)
+	}
+}
+
+// The collation is kept with each directory's block and in images.
+func TestCollationPersists(t *testing.T) {
+	tree := newBTree(4)
+	tree.Collation = CollateNFC | CollateFold
+	tree.insert(DirEntry{Name: "Name", InodeIndex: 3})
+	loaded := deserializeBTree(serializeBTree(tree))
+	if loaded.Collation != tree.Collation {
+		t.Errorf("deserialized collation = %d, want %d", loaded.Collation, tree.Collation)
+	}
+	if _, ok := loaded.search("NAME"); !ok {
+		t.Error("deserialized tree doesn't find NAME")
+	}
+
+	fs := NewFileSystem()
+	if err := fs.setCollation(CollateFold); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewFileSystem()
+	restored.applyImage(fs.newImage())
+	if _, err := restored.mkdir("/root", "Dir"); err != nil {
+		t.Fatal(err)
+	}
+	if restored.resolvePath("/root/dir") == nil {
+		t.Error("directory created after loading an image ignores its collation")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+// setCompression turns transparent compression on or off for subsequent
+// writes. While it is on, an unpacked file is stored flate-compressed when
+// that makes it smaller; files already written keep their current form
+// until they are rewritten.
+func (fs *FileSystem) setCompression(enabled bool) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	fs.Compression = enabled
+	fs.checkpointInternal()
+	return nil
+}
+
+// compressData returns data compressed with flate.
+func compressData(data []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// decompressData reverses compressData, returning what could be recovered
+// if the stream is damaged.
+func decompressData(data []byte) []byte {
+	out, _ := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	return out
+}
@@ -0,0 +1,205 @@
+package main
+
+import "fmt"
+
+// cp copies the file or directory at src to the new path dst, following a
+// symlink at src. Directories are copied recursively; symlinks inside them
+// are copied as links. A copied file shares the source's data blocks until
+// either side writes to them. A copy that fails partway, for want of blocks
+// or inodes, is removed again, leaving the filesystem as it was.
+func (fs *FileSystem) cp(src, dst string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	src, dst = fs.absPath(src), fs.absPath(dst)
+	source := fs.resolvePath(src)
+	if source == nil {
+		return ErrNotFound
+	}
+	if !fs.may(source, permRead) {
+		return ErrPermission
+	}
+	if err := fs.mayModifyDir(dst); err != nil {
+		return err
+	}
+	if err := fs.cpInternal(src, dst); err != nil {
+		return err
+	}
+	fs.addJournalEntry("cp", src, map[string]interface{}{
+		"dstPath": dst,
+	})
+	return nil
+}
+
+func (fs *FileSystem) cpInternal(src, dst string) error {
+	source := fs.resolvePath(src)
+	if source == nil {
+		return ErrNotFound
+	}
+	dstDirPath, name := splitPath(dst)
+	if err := fs.validateName(name); err != nil {
+		return err
+	}
+	dstDir := fs.resolvePath(dstDirPath)
+	if dstDir == nil {
+		return ErrNotFound
+	}
+	if !dstDir.IsDirectory {
+		return ErrNotDirectory
+	}
+	if _, exists := fs.dirTree(dstDir).search(name); exists {
+		return ErrExists
+	}
+
+	// A directory cannot be copied into its own subtree.
+	if source.IsDirectory {
+		for p := dstDir; p != nil; p = p.Parent {
+			if p == source {
+				return fmt.Errorf("cannot copy a directory into itself: %w", ErrInvalid)
+			}
+		}
+	}
+	if err := fs.checkQuota(dstDir, fs.quotaUsage(source)); err != nil {
+		return err
+	}
+	if err := fs.copyTree(source, dstDir, name); err != nil {
+		fs.discardCopy(dstDir, name)
+		return err
+	}
+	return nil
+}
+
+// discardCopy undoes a copyTree into dir that failed partway, taking name
+// out of dir and releasing the inodes copied so far. They are all new, so
+// nothing else links to them.
+func (fs *FileSystem) discardCopy(dir *Inode, name string) {
+	entry, ok := fs.dirTree(dir).search(name)
+	if !ok {
+		return
+	}
+	root := fs.lookupInode(entry.InodeIndex)
+	copied := []*Inode{root}
+	if root.IsDirectory {
+		fs.walkTree(root, "", func(_ string, inode *Inode) error {
+			copied = append(copied, inode)
+			return nil
+		})
+	}
+	fs.removeEntryFromDir(dir, name)
+	for _, inode := range copied {
+		fs.releaseInode(inode)
+	}
+}
+
+// copyTree creates name in dir as a copy of src and, for a directory, of
+// everything below it.
+func (fs *FileSystem) copyTree(src, dir *Inode, name string) error {
+	inode, err := fs.createInode(name, src.IsDirectory, dir)
+	if err != nil {
+		return err
+	}
+	inode.Mode = src.Mode
+	inode.Xattrs = copyInode(src).Xattrs
+	if err := fs.addEntryToDir(dir, DirEntry{Name: name, InodeIndex: inode.InodeNumber}); err != nil {
+		fs.releaseInode(inode)
+		return err
+	}
+
+	switch {
+	case src.IsDirectory:
+		for _, entry := range fs.dirTree(src).entries() {
+			child := fs.lookupInode(entry.InodeIndex)
+			if child == nil {
+				continue
+			}
+			if err := fs.copyTree(child, inode, entry.Name); err != nil {
+				return err
+			}
+		}
+	case src.IsSymlink:
+		inode.IsSymlink = true
+		inode.Target = src.Target
+		inode.Size = src.Size
+		fs.resized(inode, inode.Size)
+	case src.Packed != nil || src.BlockPointer < 0:
+		data, err := fs.fileData(src)
+		if err != nil {
+			return err
+		}
+		return fs.storeFileData(inode, data)
+	default:
+		fs.freeBlock(inode.BlockPointer)
+		inode.BlockPointer = src.BlockPointer
+		inode.Overflow = append([]int(nil), src.Overflow...)
+		inode.Compressed = src.Compressed
+		inode.Encrypted = src.Encrypted
+		for _, block := range inodeBlocks(inode) {
+			fs.shareBlock(block)
+		}
+		inode.Size = src.Size
+		fs.resized(inode, inode.Size)
+	}
+	return nil
+}
+
+// shareBlock records one more owner of a block.
+func (fs *FileSystem) shareBlock(block int) {
+	if fs.Superblock.BlockRefs == nil {
+		fs.Superblock.BlockRefs = make(map[int]int)
+	}
+	if fs.Superblock.BlockRefs[block] == 0 {
+		fs.Superblock.BlockRefs[block] = 1
+	}
+	fs.Superblock.BlockRefs[block]++
+}
+
+// dropBlockRef records one owner of a shared block letting go of it.
+func (fs *FileSystem) dropBlockRef(block int) {
+	if fs.Superblock.BlockRefs[block] <= 2 {
+		delete(fs.Superblock.BlockRefs, block)
+		return
+	}
+	fs.Superblock.BlockRefs[block]--
+}
+
+// unshareBlock gives inode a private copy of the i'th of its file blocks
+// if that block is shared, so it can be written without affecting the
+// other owners.
+func (fs *FileSystem) unshareBlock(inode *Inode, i int) error {
+	block := fileBlocks(inode)[i]
+	if fs.Superblock.BlockRefs[block] == 0 {
+		return nil
+	}
+	private := fs.allocateBlock()
+	if private < 0 {
+		return ErrNoSpace
+	}
+	fs.writeBlock(private, append([]byte(nil), fs.blocks.data(block)...))
+	fs.dropBlockRef(block)
+	fs.preserveInode(inode)
+	setFileBlock(inode, i, private)
+	return nil
+}
+
+// countBlockRefs works out the BlockRefs table for inodes from the blocks
+// their files point at.
+func countBlockRefs(inodes []*Inode) map[int]int {
+	owners := make(map[int]int)
+	for _, inode := range inodes {
+		if inode == nil || inode.Packed != nil || inode.BlockPointer < 0 {
+			continue
+		}
+		for _, block := range inodeBlocks(inode) {
+			owners[block]++
+		}
+	}
+	refs := make(map[int]int)
+	for block, n := range owners {
+		if n > 1 {
+			refs[block] = n
+		}
+	}
+	return refs
+}
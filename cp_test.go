@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCpFile(t *testing.T) {
+	fs := NewFileSystem()
+	data := pattern(2 * BlockSize)
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.writeFile("/root/f", data),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, free, _ := fs.df()
+
+	if err := fs.cp("/root/f", "/root/g"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.readFile("/root/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("copy differs from the source")
+	}
+	if _, after, _ := fs.df(); after != free {
+		t.Errorf("copy used %d blocks before being written", free-after)
+	}
+	if err := fs.cp("/root/f", "/root/g"); !errors.Is(err, ErrExists) {
+		t.Errorf("cp over an existing file: %v, want ErrExists", err)
+	}
+
+	if err := fs.writeAt("/root/g", 0, []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	got, err = fs.readFile("/root/f")
+	for _, err := range []error{
+		err,
+		fs.verifyFilesystem(),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("writing the copy changed the source")
+	}
+}
+
+func TestCpDirectory(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "src")),
+		errOf(fs.mkdir("/root/src", "sub")),
+		errOf(fs.touch("/root/src", "a")),
+		fs.writeFile("/root/src/a", []byte("alpha")),
+		errOf(fs.touch("/root/src/sub", "b")),
+		fs.writeFile("/root/src/sub/b", pattern(BlockSize+1)),
+		fs.symlink("sub/b", "/root/src/l"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	original := treeOf(t, fs)
+
+	if err := fs.cp("/root/src", "/root/dst"); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	for path, v := range original {
+		want[path] = v
+		if strings.HasPrefix(path, "/root/src") {
+			want["/root/dst"+strings.TrimPrefix(path, "/root/src")] = v
+		}
+	}
+	if got := treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("tree after cp:\n got %v\nwant %v", got, want)
+	}
+	src, _ := fs.stat("/root/src/sub/b")
+	dst, _ := fs.stat("/root/dst/sub/b")
+	if src.InodeNumber == dst.InodeNumber {
+		t.Error("copy shares an inode with the source")
+	}
+
+	// Changing the copy leaves the original alone.
+	for _, err := range []error{
+		fs.writeFile("/root/dst/a", []byte("changed")),
+		fs.appendFile("/root/dst/sub/b", []byte("more")),
+		fs.rm("/root/dst/l"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.touch("/root/dst/sub", "new"); err != nil {
+		t.Fatal(err)
+	}
+	for path, v := range treeOf(t, fs) {
+		if !strings.HasPrefix(path, "/root/dst") && v != original[path] {
+			t.Errorf("%s changed to %s", path, v)
+		}
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.cp("/root/src", "/root/src/sub/inner"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("cp a directory into itself: %v, want ErrInvalid", err)
+	}
+}
+
+// A copy that runs out of inodes partway is removed again.
+func TestCpFailureLeavesNoPartialCopy(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "src")),
+		errOf(fs.mkdir("/root/src", "sub")),
+		errOf(fs.touch("/root/src", "a")),
+		fs.writeFile("/root/src/a", pattern(2*BlockSize)),
+		errOf(fs.touch("/root/src/sub", "b")),
+		fs.writeFile("/root/src/sub/b", []byte("b")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.setInodeLimit(len(fs.Superblock.InodeMap) + 3); err != nil {
+		t.Fatal(err)
+	}
+	want, stats, used := treeOf(t, fs), fs.Stats(), usedBlocks(fs)
+	n := len(fs.Journal)
+
+	if err := fs.cp("/root/src", "/root/dst"); !errors.Is(err, ErrNoInodes) {
+		t.Fatalf("cp past the inode limit: %v, want ErrNoInodes", err)
+	}
+	if got := treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("tree after a failed cp:\n got %v\nwant %v", got, want)
+	}
+	if got := fs.Stats(); got.Inodes != stats.Inodes || got.Files != stats.Files || got.Directories != stats.Directories || got.BytesUsed != stats.BytesUsed {
+		t.Errorf("stats after a failed cp = %+v, want %+v", got, stats)
+	}
+	if got := usedBlocks(fs); got != used {
+		t.Errorf("%d blocks in use after a failed cp, want %d", got, used)
+	}
+	if len(fs.Journal) != n {
+		t.Errorf("journal grew from %d to %d entries", n, len(fs.Journal))
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+)
+
+// setEncryptionKey sets the AES key used to encrypt file contents written
+// from now on and to decrypt encrypted files on read. The key must be 16,
+// 24 or 32 bytes; nil stops new writes from being encrypted. The key is
+// never stored in the filesystem, so it has to be supplied again after
+// Load. Inode metadata is not encrypted.
+func (fs *FileSystem) setEncryptionKey(key []byte) error {
+	var aead cipher.AEAD
+	if key != nil {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("%v: %w", err, ErrInvalid)
+		}
+		if aead, err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.aead = aead
+	return nil
+}
+
+// encrypt seals data with AES-GCM under a fresh random nonce, which is
+// stored in front of the ciphertext.
+func (fs *FileSystem) encrypt(data []byte) []byte {
+	nonce := make([]byte, fs.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return fs.aead.Seal(nonce, nonce, data, nil)
+}
+
+// decrypt opens data sealed by encrypt. A missing or wrong key, or
+// tampered data, fails with ErrAuthFailed.
+func (fs *FileSystem) decrypt(data []byte) ([]byte, error) {
+	if fs.aead == nil {
+		return nil, fmt.Errorf("no encryption key set: %w", ErrAuthFailed)
+	}
+	n := fs.aead.NonceSize()
+	if len(data) < n {
+		return nil, ErrAuthFailed
+	}
+	plain, err := fs.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return plain, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// pattern returns n non-zero bytes that differ from block to block, so
+// they are neither stored as holes nor deduplicated.
+func pattern(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte('a' + i%23)
+	}
+	return data
+}
+
+func TestTruncateAndAppend(t *testing.T) {
+	advance := fakeClock(t)
+	fs := NewFileSystem()
+	data := pattern(3 * BlockSize)
+	for _, err := range []error{errOf(fs.touch("/root", "f")), fs.writeFile("/root/f", data)} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, free, _ := fs.df()
+
+	readBack := func(want []byte) {
+		t.Helper()
+		got, err := fs.readFile("/root/f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("file holds %d bytes, want %d", len(got), len(want))
+		}
+		if inode, _ := fs.stat("/root/f"); inode.Size != len(want) {
+			t.Fatalf("Size = %d, want %d", inode.Size, len(want))
+		}
+	}
+
+	// Truncating down frees the blocks past the new end.
+	advance(time.Minute)
+	if err := fs.truncate("/root/f", BlockSize+10); err != nil {
+		t.Fatal(err)
+	}
+	readBack(data[:BlockSize+10])
+	if _, after, _ := fs.df(); after != free+1 {
+		t.Errorf("free blocks after truncating down = %d, want %d", after, free+1)
+	}
+	if inode, _ := fs.stat("/root/f"); !inode.ModifiedAt.Equal(now()) {
+		t.Errorf("ModifiedAt not updated by truncate")
+	}
+
+	// Truncating to the same size changes nothing.
+	advance(time.Minute)
+	if err := fs.truncate("/root/f", BlockSize+10); err != nil {
+		t.Fatal(err)
+	}
+	if inode, _ := fs.stat("/root/f"); inode.ModifiedAt.Equal(now()) {
+		t.Errorf("truncate to the same size touched ModifiedAt")
+	}
+
+	// Truncating up fills with zeros.
+	if err := fs.truncate("/root/f", 2*BlockSize+5); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte(nil), data[:BlockSize+10]...), make([]byte, BlockSize-5)...)
+	readBack(want)
+
+	// Appending runs across the block boundary.
+	advance(time.Minute)
+	tail := bytes.Repeat([]byte("z"), 20)
+	if err := fs.appendFile("/root/f", tail); err != nil {
+		t.Fatal(err)
+	}
+	readBack(append(want, tail...))
+	if inode, _ := fs.stat("/root/f"); !inode.ModifiedAt.Equal(now()) {
+		t.Errorf("ModifiedAt not updated by appendFile")
+	}
+
+	if _, err := fs.mkdir("/root", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.truncate("/root/d", 0); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("truncate a directory: %v, want ErrIsDirectory", err)
+	}
+	if err := fs.truncate("/root/f", -1); !errors.Is(err, ErrInvalid) {
+		t.Errorf("truncate to -1: %v, want ErrInvalid", err)
+	}
+	for _, err := range []error{fs.truncate("/root/f", 0), fs.verifyFilesystem()} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	readBack([]byte{})
+}
+
+func TestReadWriteAt(t *testing.T) {
+	fs := NewFileSystem()
+	data := pattern(2 * BlockSize)
+	for _, err := range []error{errOf(fs.touch("/root", "f")), fs.writeFile("/root/f", data)} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A write straddling the first block boundary.
+	patch := bytes.Repeat([]byte("#"), 8)
+	if err := fs.writeAt("/root/f", BlockSize-4, patch); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[BlockSize-4:], patch)
+	got, err := fs.readAt("/root/f", BlockSize-6, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := data[BlockSize-6 : BlockSize+6]; !bytes.Equal(got, want) {
+		t.Errorf("readAt across the boundary = %q, want %q", got, want)
+	}
+
+	// A read past the end is short, and one starting there is empty.
+	got, err = fs.readAt("/root/f", 2*BlockSize-3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[2*BlockSize-3:]) {
+		t.Errorf("short read = %q, want %q", got, data[2*BlockSize-3:])
+	}
+	got, err = fs.readAt("/root/f", 5*BlockSize, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("read past the end returned %d bytes", len(got))
+	}
+
+	// A write past the end zero-fills the gap.
+	off := 4*BlockSize + BlockSize/2
+	if err := fs.writeAt("/root/f", off, patch); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(data, make([]byte, off-len(data))...), patch...)
+	got, err = fs.readFile("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("file after extending write holds %d bytes, want %d", len(got), len(want))
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.writeAt("/root/f", -1, patch); !errors.Is(err, ErrInvalid) {
+		t.Errorf("writeAt -1: %v, want ErrInvalid", err)
+	}
+	if _, err := fs.readAt("/root/f", -1, 1); !errors.Is(err, ErrInvalid) {
+		t.Errorf("readAt -1: %v, want ErrInvalid", err)
+	}
+}
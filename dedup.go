@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+)
+
+// setDedup turns block deduplication on or off for subsequent writes. While
+// it is on, a file block whose contents match a block already written is
+// shared with it instead of being stored again. Blocks that are already
+// shared stay shared until they are rewritten.
+func (fs *FileSystem) setDedup(enabled bool) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	fs.Dedup = enabled
+	fs.checkpointInternal()
+	return nil
+}
+
+// dedupLookup returns a file block already holding data, if the index
+// knows of one. Entries can be stale, so the contents are compared before
+// the block is trusted.
+func (fs *FileSystem) dedupLookup(data []byte) (int, bool) {
+	block, ok := fs.dedupIndex[crc32.ChecksumIEEE(data)]
+	if !ok || !bytes.Equal(fs.blocks.data(block), data) {
+		return -1, false
+	}
+	return block, true
+}
+
+// dedupRecord indexes block, a file block just written, by its contents.
+func (fs *FileSystem) dedupRecord(block int) {
+	if fs.dedupIndex == nil {
+		fs.dedupIndex = make(map[uint32]int)
+	}
+	fs.dedupIndex[fs.blocks.sum(block)] = block
+}
+
+// dedupForget drops block from the index when it is freed, so the block
+// can be reused for other purposes.
+func (fs *FileSystem) dedupForget(block int) {
+	sum := fs.blocks.sum(block)
+	if fs.dedupIndex[sum] == block {
+		delete(fs.dedupIndex, sum)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ChangeKind says how a path differs between two snapshots.
+type ChangeKind int
+
+const (
+	ChangeAdded ChangeKind = iota
+	ChangeRemoved
+	ChangeModified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// Change is one difference reported by diffSnapshots.
+type Change struct {
+	Path string
+	Kind ChangeKind
+}
+
+func (c Change) String() string {
+	return c.Kind.String() + " " + c.Path
+}
+
+// diffState is what diffSnapshots compares for each path: the kind of
+// inode, its permissions and, for files and symlinks, the contents.
+type diffState struct {
+	isDir, isSymlink bool
+	mode             uint32
+	content          string
+}
+
+// diffSnapshots lists the paths added, removed or modified between the
+// snapshots named a and b, sorted by path. A path present in both is
+// modified when its type, mode or contents differ.
+func (fs *FileSystem) diffSnapshots(a, b string) ([]Change, error) {
+	before, err := fs.mountSnapshot(a)
+	if err != nil {
+		return nil, err
+	}
+	after, err := fs.mountSnapshot(b)
+	if err != nil {
+		return nil, err
+	}
+	old, err := before.diffStates()
+	if err != nil {
+		return nil, err
+	}
+	cur, err := after.diffStates()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(old)+len(cur))
+	for path := range old {
+		paths = append(paths, path)
+	}
+	for path := range cur {
+		if _, ok := old[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	changes := []Change{}
+	for _, path := range paths {
+		was, inBefore := old[path]
+		is, inAfter := cur[path]
+		switch {
+		case !inBefore:
+			changes = append(changes, Change{Path: path, Kind: ChangeAdded})
+		case !inAfter:
+			changes = append(changes, Change{Path: path, Kind: ChangeRemoved})
+		case was != is:
+			changes = append(changes, Change{Path: path, Kind: ChangeModified})
+		}
+	}
+	return changes, nil
+}
+
+// diffStates records the state of every path below the root.
+func (fs *FileSystem) diffStates() (map[string]diffState, error) {
+	states := make(map[string]diffState)
+	err := fs.walkTree(fs.Superblock.InodeMap[0], "/root", func(path string, inode *Inode) error {
+		state := diffState{isDir: inode.IsDirectory, isSymlink: inode.IsSymlink, mode: inode.Mode}
+		switch {
+		case inode.IsSymlink:
+			state.content = inode.Target
+		case !inode.IsDirectory:
+			data, err := fs.fileData(inode)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			state.content = string(data)
+		}
+		states[path] = state
+		return nil
+	})
+	return states, err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.mkdir("/root", "d"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"same", "edit", "gone", "mode"} {
+		for _, err := range []error{
+			errOf(fs.touch("/root/d", name)),
+			fs.writeFile("/root/d/"+name, []byte(name)),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := fs.createNamedSnapshot("before"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, err := range []error{
+		fs.writeFile("/root/d/edit", []byte("edited")),
+		fs.rm("/root/d/gone"),
+		fs.chmod("/root/d/mode", 0600),
+		errOf(fs.mkdir("/root", "new")),
+		errOf(fs.mkdir("/root/new", "sub")),
+		fs.symlink("d/same", "/root/link"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rewriting a file with the same bytes is not a change.
+	if err := fs.writeFile("/root/d/same", []byte("same")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.createNamedSnapshot("after"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := fs.diffSnapshots("before", "after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{"/root/d/edit", ChangeModified},
+		{"/root/d/gone", ChangeRemoved},
+		{"/root/d/mode", ChangeModified},
+		{"/root/link", ChangeAdded},
+		{"/root/new", ChangeAdded},
+		{"/root/new/sub", ChangeAdded},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("diff:\n got %v\nwant %v", changes, want)
+	}
+
+	changes, err = fs.diffSnapshots("after", "after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("diff of a snapshot with itself = %v", changes)
+	}
+	if _, err := fs.diffSnapshots("before", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("diff against a missing snapshot: %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import "fmt"
+
+// EventOp is the kind of change an Event reports.
+type EventOp int
+
+const (
+	EventCreate EventOp = iota
+	EventDelete
+	EventRename
+	EventWrite
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case EventCreate:
+		return "create"
+	case EventDelete:
+		return "delete"
+	case EventRename:
+		return "rename"
+	case EventWrite:
+		return "write"
+	}
+	return fmt.Sprintf("EventOp(%d)", int(op))
+}
+
+// Event describes a completed change. Path is absolute; for a rename it is
+// the new path and OldPath the old one.
+type Event struct {
+	Op      EventOp
+	Path    string
+	OldPath string
+	IsDir   bool
+}
+
+// OnEvent registers fn to be called after every successful mkdir, touch,
+// writeFile, rm, rmdir and mv. Subscribers are called in registration
+// order, after the filesystem lock has been released, so they may call
+// back into the filesystem.
+func (fs *FileSystem) OnEvent(fn func(ev Event)) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.subscribers = append(fs.subscribers, fn)
+}
+
+// queueEvent records ev for delivery once the write lock is released by
+// unlockWrite. The caller must hold the write lock.
+func (fs *FileSystem) queueEvent(ev Event) {
+	if len(fs.subscribers) > 0 || len(fs.watchers) > 0 {
+		fs.pendingEvents = append(fs.pendingEvents, ev)
+	}
+}
+
+// unlockWrite writes modified directory trees back to their blocks,
+// releases the write lock and then delivers any queued events. Operations
+// that change directories or raise events defer it in place of
+// fs.mu.Unlock, so that nothing is left to write back, and the block table
+// is never changed, under the read lock.
+func (fs *FileSystem) unlockWrite() {
+	fs.flushDirTrees()
+	events, subscribers := fs.pendingEvents, fs.subscribers
+	fs.pendingEvents = nil
+	fs.notifyWatchers(events)
+	fs.mu.Unlock()
+
+	for _, ev := range events {
+		for _, fn := range subscribers {
+			fn(ev)
+		}
+	}
+}
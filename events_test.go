@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOnEvent(t *testing.T) {
+	fs := NewFileSystem()
+	var first, second []Event
+	var order []string
+	fs.OnEvent(func(ev Event) {
+		first = append(first, ev)
+		order = append(order, "first")
+	})
+	fs.OnEvent(func(ev Event) {
+		second = append(second, ev)
+		order = append(order, "second")
+	})
+
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "d")),
+		errOf(fs.touch("/root/d", "f")),
+		fs.writeFile("/root/d/f", []byte("data")),
+		fs.mv("/root/d/f", "/root/g"),
+		fs.rm("/root/g"),
+		fs.rmdir("/root/d"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A failed operation raises nothing.
+	if err := fs.rm("/root/missing"); err == nil {
+		t.Fatal("rm of a missing file succeeded")
+	}
+
+	want := []Event{
+		{Op: EventCreate, Path: "/root/d", IsDir: true},
+		{Op: EventCreate, Path: "/root/d/f"},
+		{Op: EventWrite, Path: "/root/d/f"},
+		{Op: EventRename, Path: "/root/g", OldPath: "/root/d/f"},
+		{Op: EventDelete, Path: "/root/g"},
+		{Op: EventDelete, Path: "/root/d", IsDir: true},
+	}
+	if !reflect.DeepEqual(first, want) {
+		t.Errorf("events:\n got %v\nwant %v", first, want)
+	}
+	if !reflect.DeepEqual(second, want) {
+		t.Errorf("second subscriber got %v", second)
+	}
+	for i := 0; i < len(order); i += 2 {
+		if order[i] != "first" || order[i+1] != "second" {
+			t.Fatalf("subscribers called out of order: %v", order)
+		}
+	}
+}
+
+// A subscriber may call back into the filesystem.
+func TestSubscriberReentry(t *testing.T) {
+	fs := NewFileSystem()
+	var seen []string
+	fs.OnEvent(func(ev Event) {
+		seen = append(seen, ev.Path)
+		if _, err := fs.readFile(ev.Path); err != nil {
+			t.Errorf("reading %s from the subscriber: %v", ev.Path, err)
+		}
+	})
+	if _, err := fs.touch("/root", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/root/a"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("seen %v, want %v", seen, want)
+	}
+}
+
+// A committed transaction raises an event per operation; one that fails
+// raises none.
+func TestTxnEvents(t *testing.T) {
+	fs := NewFileSystem()
+	var seen []Event
+	fs.OnEvent(func(ev Event) { seen = append(seen, ev) })
+
+	tx := fs.Begin()
+	tx.Mkdir("/root", "d")
+	tx.Touch("/root/d", "f")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{Op: EventCreate, Path: "/root/d", IsDir: true},
+		{Op: EventCreate, Path: "/root/d/f"},
+	}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("events:\n got %v\nwant %v", seen, want)
+	}
+
+	seen = nil
+	tx = fs.Begin()
+	tx.Touch("/root/d", "g")
+	tx.Rm("/root/missing")
+	if err := tx.Commit(); err == nil {
+		t.Fatal("commit removing a missing file succeeded")
+	}
+	if len(seen) != 0 {
+		t.Errorf("failed commit raised %v", seen)
+	}
+}
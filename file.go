@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io"
+	iofs "io/fs"
+	"strings"
+)
+
+// File is an open handle on a regular file with its own read/write
+// position. Any number of handles may refer to the same inode; each sees
+// the others' writes.
+type File struct {
+	fs     *FileSystem
+	fd     int
+	inode  *Inode
+	pos    int64
+	closed bool
+}
+
+// open returns a handle positioned at the start of the file at path and
+// records it in the descriptor table.
+func (fs *FileSystem) open(path string) (*File, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	inode := fs.resolvePath(path)
+	readable := inode != nil && fs.may(inode, permRead)
+	fs.mu.RUnlock()
+	if inode == nil {
+		return nil, ErrNotFound
+	}
+	if inode.IsDirectory {
+		return nil, ErrIsDirectory
+	}
+	if !readable {
+		return nil, ErrPermission
+	}
+
+	fs.filesMu.Lock()
+	defer fs.filesMu.Unlock()
+	f := &File{fs: fs, fd: fs.nextFD, inode: inode}
+	fs.files[f.fd] = f
+	fs.nextFD++
+	return f, nil
+}
+
+// Fd returns the handle's descriptor.
+func (f *File) Fd() int { return f.fd }
+
+// live reports whether the handle's inode still exists; a handle on a
+// removed file can no longer be used.
+func (f *File) live() bool {
+	num := f.inode.InodeNumber
+	return num < len(f.fs.Superblock.InodeMap) && f.fs.Superblock.InodeMap[num] == f.inode
+}
+
+// path returns where the handle's file is now, following its Parent
+// entries up to the root, so writes can be journaled by path.
+func (f *File) path() string {
+	var names []string
+	for p := f.inode; p != nil; p = p.Parent {
+		names = append([]string{p.Name}, names...)
+	}
+	return "/" + strings.Join(names, "/")
+}
+
+// Read reads from the current position, returning io.EOF at the end of
+// the file.
+func (f *File) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, iofs.ErrClosed
+	}
+	fs := f.fs
+	if err := fs.lockRead(); err != nil {
+		return 0, err
+	}
+	defer fs.mu.RUnlock()
+
+	if !f.live() {
+		return 0, ErrNotFound
+	}
+	for _, block := range inodeBlocks(f.inode) {
+		if err := fs.verifyBlock(block); err != nil {
+			return 0, err
+		}
+	}
+	data, err := fs.fileData(f.inode)
+	if err != nil {
+		return 0, err
+	}
+	if f.pos >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[f.pos:])
+	f.pos += int64(n)
+	fs.touchAccessTime(f.inode)
+	return n, nil
+}
+
+// Write writes at the current position, extending the file as needed.
+func (f *File) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, iofs.ErrClosed
+	}
+	fs := f.fs
+	if err := fs.lockWrite(); err != nil {
+		return 0, err
+	}
+	defer fs.unlockWrite()
+
+	if !f.live() {
+		return 0, ErrNotFound
+	}
+	if !fs.may(f.inode, permWrite) {
+		return 0, ErrPermission
+	}
+	if err := fs.writeAtInternal(f.inode, int(f.pos), p); err != nil {
+		return 0, err
+	}
+	path := f.path()
+	fs.journalWriteAt(path, int(f.pos), p)
+	fs.queueEvent(Event{Op: EventWrite, Path: path})
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+// Seek sets the position for the next Read or Write, interpreted according
+// to whence as in io.Seeker. Seeking past the end is allowed; a later
+// Write zero-fills the gap.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, iofs.ErrClosed
+	}
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		base = f.pos
+	case io.SeekEnd:
+		if err := f.fs.lockRead(); err != nil {
+			return 0, err
+		}
+		base = int64(f.inode.Size)
+		f.fs.mu.RUnlock()
+	default:
+		return 0, ErrInvalid
+	}
+	if base+offset < 0 {
+		return 0, ErrInvalid
+	}
+	f.pos = base + offset
+	return f.pos, nil
+}
+
+// Close releases the handle's descriptor. Closing twice is an error.
+func (f *File) Close() error {
+	if f.closed {
+		return iofs.ErrClosed
+	}
+	f.closed = true
+	f.fs.filesMu.Lock()
+	delete(f.fs.files, f.fd)
+	f.fs.filesMu.Unlock()
+	return nil
+}
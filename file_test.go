@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"testing"
+)
+
+func TestFileHandles(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.open("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := pattern(BlockSize + 100)
+	n, err := f.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Fatalf("Write = %d, want %d", n, len(data))
+	}
+	pos, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos != 0 {
+		t.Fatalf("Seek = %d, want 0", pos)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read back %d bytes, want %d", len(got), len(data))
+	}
+
+	// A second handle has its own position and sees the first's writes.
+	g, err := fs.open("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Fd() == f.Fd() {
+		t.Errorf("two handles share descriptor %d", f.Fd())
+	}
+	_, err = f.Seek(-4, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("TAIL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.Seek(int64(len(data)-4), io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	n, err = g.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "TAIL" {
+		t.Errorf("second handle read %q, want TAIL", buf[:n])
+	}
+	if _, err := g.Read(buf); err != io.EOF {
+		t.Errorf("Read at the end: %v, want io.EOF", err)
+	}
+	if _, err := g.Seek(-1, io.SeekStart); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Seek before the start: %v, want ErrInvalid", err)
+	}
+
+	for _, err := range []error{
+		f.Close(),
+		g.Close(),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); !errors.Is(err, iofs.ErrClosed) {
+		t.Errorf("second Close: %v, want ErrClosed", err)
+	}
+	if _, err := f.Read(buf); !errors.Is(err, iofs.ErrClosed) {
+		t.Errorf("Read after Close: %v, want ErrClosed", err)
+	}
+	if _, err := fs.open("/root"); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("open a directory: %v, want ErrIsDirectory", err)
+	}
+}
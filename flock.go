@@ -0,0 +1,68 @@
+package main
+
+// advisoryLock is the state of the advisory lock on one inode: either a
+// number of shared holders or a single exclusive one.
+type advisoryLock struct {
+	shared    int
+	exclusive bool
+}
+
+// lock takes an advisory lock on the inode at path, waiting until it is
+// available. An exclusive lock excludes every other lock; shared locks
+// exclude only exclusive ones. The locks are advisory: reads and writes
+// ignore them, they only coordinate callers that take them.
+func (fs *FileSystem) lock(path string, exclusive bool) error {
+	inode, err := fs.stat(path)
+	if err != nil {
+		return err
+	}
+
+	fs.locksMu.Lock()
+	defer fs.locksMu.Unlock()
+
+	for {
+		l := fs.locks[inode.InodeNumber]
+		if l == nil {
+			l = &advisoryLock{}
+			fs.locks[inode.InodeNumber] = l
+		}
+		switch {
+		case l.exclusive:
+		case exclusive && l.shared == 0:
+			l.exclusive = true
+			return nil
+		case !exclusive:
+			l.shared++
+			return nil
+		}
+		fs.locksFreed.Wait()
+	}
+}
+
+// unlock releases an advisory lock taken with lock on the inode at path:
+// the exclusive lock, or else one shared lock. It returns ErrNotLocked if
+// the inode is not locked.
+func (fs *FileSystem) unlock(path string) error {
+	inode, err := fs.stat(path)
+	if err != nil {
+		return err
+	}
+
+	fs.locksMu.Lock()
+	defer fs.locksMu.Unlock()
+
+	l := fs.locks[inode.InodeNumber]
+	switch {
+	case l == nil:
+		return ErrNotLocked
+	case l.exclusive:
+		l.exclusive = false
+	default:
+		l.shared--
+	}
+	if l.shared == 0 && !l.exclusive {
+		delete(fs.locks, inode.InodeNumber)
+	}
+	fs.locksFreed.Broadcast()
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// lockAsync takes the lock in a goroutine and returns a channel closed
+// once it is held.
+func lockAsync(t *testing.T, fs *FileSystem, path string, exclusive bool) <-chan struct{} {
+	held := make(chan struct{})
+	go func() {
+		if err := fs.lock(path, exclusive); err != nil {
+			t.Error(err)
+		}
+		close(held)
+	}()
+	return held
+}
+
+// expectBlocked fails the test if held is closed within a short wait.
+func expectBlocked(t *testing.T, held <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-held:
+		t.Fatalf("%s acquired while it should block", what)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// expectHeld fails the test unless held is closed soon.
+func expectHeld(t *testing.T, held <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s never acquired", what)
+	}
+}
+
+func TestExclusiveLockBlocks(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.lock("/root/f", true),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	second := lockAsync(t, fs, "/root/f", true)
+	expectBlocked(t, second, "second exclusive lock")
+	shared := lockAsync(t, fs, "/root/f", false)
+	expectBlocked(t, shared, "shared lock")
+
+	// Locks are advisory, so reads and writes go ahead.
+	if err := fs.writeFile("/root/f", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.unlock("/root/f"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-second:
+		expectBlocked(t, shared, "shared lock beside an exclusive one")
+	case <-shared:
+		expectBlocked(t, second, "exclusive lock beside a shared one")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no waiter acquired the lock after unlock")
+	}
+	if err := fs.unlock("/root/f"); err != nil {
+		t.Fatal(err)
+	}
+	expectHeld(t, second, "second exclusive lock")
+	expectHeld(t, shared, "shared lock")
+	if err := fs.unlock("/root/f"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedLocksCoexist(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.lock("/root/f", false),
+		fs.lock("/root/f", false),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exclusive := lockAsync(t, fs, "/root/f", true)
+	expectBlocked(t, exclusive, "exclusive lock over two shared ones")
+	if err := fs.unlock("/root/f"); err != nil {
+		t.Fatal(err)
+	}
+	expectBlocked(t, exclusive, "exclusive lock over one shared one")
+	if err := fs.unlock("/root/f"); err != nil {
+		t.Fatal(err)
+	}
+	expectHeld(t, exclusive, "exclusive lock")
+	if err := fs.unlock("/root/f"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.unlock("/root/f"); !errors.Is(err, ErrNotLocked) {
+		t.Errorf("unlock of an unlocked file: %v, want ErrNotLocked", err)
+	}
+	if err := fs.lock("/root/missing", true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("lock of a missing file: %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// hasMeta reports whether a path segment contains pattern characters.
+func hasMeta(segment string) bool {
+	return strings.ContainsAny(segment, `*?[\`)
+}
+
+// checkPattern reports whether pattern is well formed for path.Match.
+func checkPattern(pattern string) error {
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+// matchName reports whether name matches pattern.
+func matchName(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// glob returns the paths matching pattern in sorted order. Each segment of
+// pattern is matched against directory entries with path.Match, so '*' and
+// '?' never cross a '/'. A pattern without wildcards matches itself if it
+// exists. No matches is not an error; a malformed pattern is.
+func (fs *FileSystem) glob(pattern string) ([]string, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	segments, ok := pathSegments(fs.absPath(pattern))
+	if !ok {
+		return []string{}, nil
+	}
+	for _, segment := range segments {
+		if err := checkPattern(segment); err != nil {
+			return nil, err
+		}
+	}
+
+	matches := []string{"/root"}
+	for _, segment := range segments {
+		var next []string
+		for _, dirPath := range matches {
+			dir := fs.resolvePath(dirPath)
+			if dir == nil || !dir.IsDirectory {
+				continue
+			}
+			if !hasMeta(segment) {
+				if _, found := fs.dirTree(dir).search(segment); found {
+					next = append(next, dirPath+"/"+segment)
+				}
+				continue
+			}
+			for _, entry := range fs.dirTree(dir).entries() {
+				if matchName(segment, entry.Name) {
+					next = append(next, dirPath+"/"+entry.Name)
+				}
+			}
+		}
+		matches = next
+	}
+
+	sort.Strings(matches)
+	return append([]string{}, matches...), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGlob(t *testing.T) {
+	fs := NewFileSystem()
+	for _, dir := range [][2]string{{"/root", "src"}, {"/root/src", "a"}, {"/root/src", "b"}} {
+		if _, err := fs.mkdir(dir[0], dir[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{
+		"/root/notes.txt", "/root/todo.txt", "/root/todo.md",
+		"/root/src/a/x1.go", "/root/src/a/x2.go", "/root/src/b/y1.go", "/root/src/b/xa.go",
+	} {
+		if _, err := fs.touch(splitPath(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.txt", []string{"/root/notes.txt", "/root/todo.txt"}},
+		{"todo.??", []string{"/root/todo.md"}},
+		{"/root/src/*/x?.go", []string{"/root/src/a/x1.go", "/root/src/a/x2.go", "/root/src/b/xa.go"}},
+		{"src/*/[xy][0-9].go", []string{"/root/src/a/x1.go", "/root/src/a/x2.go", "/root/src/b/y1.go"}},
+		{"src/[^a]/*", []string{"/root/src/b/xa.go", "/root/src/b/y1.go"}},
+		{"*.rs", []string{}},
+		{"todo.md", []string{"/root/todo.md"}},
+	} {
+		got, err := fs.glob(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("glob(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+	if _, err := fs.glob("[x"); err == nil {
+		t.Error("malformed pattern accepted")
+	}
+
+	got, err := fs.find("/root", "x[0-9].go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/root/src/a/x1.go", "/root/src/a/x2.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("find with a character class = %v, want %v", got, want)
+	}
+}
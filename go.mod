@@ -1,3 +1,5 @@
 module github.com/antiartificial/gotoyfs
 
 go 1.22
+
+require golang.org/x/text v0.14.0
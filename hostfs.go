@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ExportToOS recreates the subtree under fsPath inside the host directory
+// osDir, which is created if needed. Files and directories keep their
+// permission bits and symbolic links are recreated as host symlinks.
+func (fs *FileSystem) ExportToOS(fsPath, osDir string) error {
+	if err := fs.lockRead(); err != nil {
+		return err
+	}
+	defer fs.mu.RUnlock()
+
+	dir := fs.resolvePath(fsPath)
+	if dir == nil {
+		return ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return ErrNotDirectory
+	}
+	// Directories are created writable so the walk can fill them, and
+	// their modes applied once everything is written, deepest first.
+	if err := os.MkdirAll(osDir, 0755); err != nil {
+		return err
+	}
+	dirs := []string{osDir}
+	modes := []uint32{dir.Mode}
+
+	err := fs.walkTree(dir, "", func(path string, inode *Inode) error {
+		hostPath := filepath.Join(osDir, filepath.FromSlash(path))
+		switch {
+		case inode.IsDirectory:
+			dirs = append(dirs, hostPath)
+			modes = append(modes, inode.Mode)
+			return os.MkdirAll(hostPath, 0755)
+		case inode.IsSymlink:
+			return os.Symlink(inode.Target, hostPath)
+		default:
+			data, err := fs.fileData(inode)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			return os.WriteFile(hostPath, data, os.FileMode(inode.Mode))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], os.FileMode(modes[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportFromOS copies the contents of the host directory osDir into the
+// existing directory at fsPath. Directories that already exist are merged
+// and files that already exist are overwritten; any other name collision
+// fails with ErrExists. Host file types other than directories, regular
+// files and symlinks are rejected.
+func (fs *FileSystem) ImportFromOS(osDir, fsPath string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	base := fs.absPath(fsPath)
+	dir := fs.resolvePath(base)
+	if dir == nil {
+		return ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return ErrNotDirectory
+	}
+
+	return filepath.WalkDir(osDir, func(hostPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(osDir, hostPath)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		path := base + "/" + filepath.ToSlash(rel)
+		mode := uint32(info.Mode().Perm())
+
+		switch {
+		case d.IsDir():
+			return fs.importDir(path, mode)
+		case d.Type()&os.ModeSymlink != 0:
+			target, err := os.Readlink(hostPath)
+			if err != nil {
+				return err
+			}
+			return fs.importSymlink(path, target)
+		case d.Type().IsRegular():
+			data, err := os.ReadFile(hostPath)
+			if err != nil {
+				return err
+			}
+			return fs.importFile(path, mode, data)
+		default:
+			return fmt.Errorf("%s: unsupported file type %v: %w", hostPath, d.Type(), ErrInvalid)
+		}
+	})
+}
+
+// importDir, importFile and importSymlink check permissions as mkdir,
+// writeFile and symlink would, and journal each entry they create or
+// overwrite, so replay repeats an import one entry at a time.
+
+// importDir creates the directory at path with mode, or leaves an existing
+// directory there as it is.
+func (fs *FileSystem) importDir(path string, mode uint32) error {
+	if fs.resolvePathNoFollow(path) == nil {
+		if err := fs.mayModifyDir(path); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := fs.importDirInternal(path, mode); err != nil {
+		return err
+	}
+	fs.addJournalEntry("importDir", path, map[string]interface{}{
+		"mode": mode,
+	})
+	return nil
+}
+
+func (fs *FileSystem) importDirInternal(path string, mode uint32) error {
+	if existing := fs.resolvePathNoFollow(path); existing != nil {
+		if existing.IsDirectory {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", path, ErrExists)
+	}
+	dirPath, name := splitPath(path)
+	if _, err := fs.mkdirInternal(dirPath, name); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	fs.resolvePathNoFollow(path).Mode = mode
+	return nil
+}
+
+// importFile creates or overwrites the regular file at path.
+func (fs *FileSystem) importFile(path string, mode uint32, data []byte) error {
+	if file := fs.resolvePathNoFollow(path); file == nil {
+		if err := fs.mayModifyDir(path); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !file.IsDirectory && !file.IsSymlink && !fs.may(file, permWrite) {
+		return fmt.Errorf("%s: %w", path, ErrPermission)
+	}
+	if err := fs.importFileInternal(path, mode, data); err != nil {
+		return err
+	}
+	fs.addJournalEntry("importFile", path, map[string]interface{}{
+		"mode": mode,
+		"data": data,
+	})
+	return nil
+}
+
+func (fs *FileSystem) importFileInternal(path string, mode uint32, data []byte) error {
+	file := fs.resolvePathNoFollow(path)
+	if file == nil {
+		dirPath, name := splitPath(path)
+		if _, err := fs.touchInternal(dirPath, name); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		file = fs.resolvePathNoFollow(path)
+	} else if file.IsDirectory || file.IsSymlink {
+		return fmt.Errorf("%s: %w", path, ErrExists)
+	}
+	if err := fs.storeFileData(file, data); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	file.Mode = mode
+	return nil
+}
+
+// importSymlink creates a symbolic link at path, or leaves an identical
+// link there as it is.
+func (fs *FileSystem) importSymlink(path, target string) error {
+	if fs.resolvePathNoFollow(path) == nil {
+		if err := fs.mayModifyDir(path); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := fs.importSymlinkInternal(path, target); err != nil {
+		return err
+	}
+	fs.addJournalEntry("importSymlink", path, map[string]interface{}{
+		"target": target,
+	})
+	return nil
+}
+
+func (fs *FileSystem) importSymlinkInternal(path, target string) error {
+	if existing := fs.resolvePathNoFollow(path); existing != nil {
+		if existing.IsSymlink && existing.Target == target {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", path, ErrExists)
+	}
+	dirPath, name := splitPath(path)
+	if err := fs.symlinkInternal(target, dirPath, name); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
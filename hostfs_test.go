@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A read-only directory is only made read-only once its contents are
+// written, so exporting it works for any host user.
+func TestExportToOSReadOnlyDirectories(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "ro")),
+		errOf(fs.mkdir("/root/ro", "inner")),
+		errOf(fs.touch("/root/ro/inner", "f")),
+		fs.writeFile("/root/ro/inner/f", []byte("data")),
+		fs.chmod("/root/ro/inner/f", 0444),
+		fs.symlink("inner/f", "/root/ro/l"),
+		fs.chmod("/root/ro/inner", 0555),
+		fs.chmod("/root/ro", 0500),
+		fs.chmod("/root", 0555),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	host := filepath.Join(t.TempDir(), "out")
+	if err := fs.ExportToOS("/root", host); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		filepath.WalkDir(host, func(path string, d os.DirEntry, err error) error {
+			if err == nil && d.IsDir() {
+				os.Chmod(path, 0755)
+			}
+			return nil
+		})
+	})
+
+	modes := make(map[string]os.FileMode)
+	for _, rel := range []string{".", "ro", "ro/inner", "ro/inner/f"} {
+		info, err := os.Stat(filepath.Join(host, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		modes[rel] = info.Mode().Perm()
+	}
+	want := map[string]os.FileMode{".": 0555, "ro": 0500, "ro/inner": 0555, "ro/inner/f": 0444}
+	if !reflect.DeepEqual(modes, want) {
+		t.Errorf("modes = %v, want %v", modes, want)
+	}
+	if data, err := os.ReadFile(filepath.Join(host, "ro", "l")); err != nil || string(data) != "data" {
+		t.Errorf("ro/l = %q, %v; want \"data\"", data, err)
+	}
+}
+
+func TestImportFromOS(t *testing.T) {
+	host := t.TempDir()
+	big := pattern(3*BlockSize + 7)
+	for _, err := range []error{
+		os.MkdirAll(filepath.Join(host, "a", "b"), 0755),
+		os.WriteFile(filepath.Join(host, "top"), []byte("top"), 0644),
+		os.WriteFile(filepath.Join(host, "a", "big"), big, 0600),
+		os.WriteFile(filepath.Join(host, "a", "b", "clash"), []byte("host"), 0644),
+		os.Symlink("../top", filepath.Join(host, "a", "l")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "imp")),
+		errOf(fs.mkdir("/root/imp", "a")),
+		errOf(fs.mkdir("/root/imp/a", "b")),
+		errOf(fs.touch("/root/imp/a/b", "clash")),
+		fs.writeFile("/root/imp/a/b/clash", []byte("old")),
+		errOf(fs.touch("/root/imp/a/b", "kept")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.ImportFromOS(host, "/root/imp"); err != nil {
+		t.Fatal(err)
+	}
+	for dir, want := range map[string][]string{
+		"/root/imp":     {"a", "top"},
+		"/root/imp/a":   {"b", "big", "l"},
+		"/root/imp/a/b": {"clash", "kept"},
+	} {
+		got, err := fs.list(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("list(%s) = %v, want %v", dir, got, want)
+		}
+	}
+	for path, want := range map[string][]byte{
+		"/root/imp/top":       []byte("top"),
+		"/root/imp/a/big":     big,
+		"/root/imp/a/b/clash": []byte("host"),
+		"/root/imp/a/l":       []byte("top"),
+	} {
+		got, err := fs.readFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s holds %d bytes, want %d", path, len(got), len(want))
+		}
+	}
+	if inode, _ := fs.stat("/root/imp/a/big"); inode.Mode != 0600 {
+		t.Errorf("big has mode %o, want 600", inode.Mode)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := treeOf(t, replayed(fs)), treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after replaying the import:\n got %v\nwant %v", got, want)
+	}
+
+	// A host directory where the filesystem has a file can't be merged.
+	if err := fs.rm("/root/imp/a/big"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		os.Remove(filepath.Join(host, "a", "big")),
+		os.Mkdir(filepath.Join(host, "a", "big"), 0755),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.touch("/root/imp/a", "big"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ImportFromOS(host, "/root/imp"); !errors.Is(err, ErrExists) {
+		t.Errorf("import over a file: %v, want ErrExists", err)
+	}
+}
+
+func TestExportToOSRoundTrip(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "a")),
+		errOf(fs.mkdir("/root/a", "b")),
+		errOf(fs.touch("/root/a/b", "f")),
+		fs.writeFile("/root/a/b/f", []byte("hello")),
+		fs.symlink("b/f", "/root/a/l"),
+		fs.chmod("/root/a", 0750),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	host := t.TempDir()
+	if err := fs.ExportToOS("/root/a", host); err != nil {
+		t.Fatal(err)
+	}
+
+	back := NewFileSystem()
+	for _, err := range []error{
+		errOf(back.mkdir("/root", "a")),
+		back.ImportFromOS(host, "/root/a"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := back.chmod("/root/a", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := treeOf(t, back), treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after export and import:\n got %v\nwant %v", got, want)
+	}
+}
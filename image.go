@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	// Journal entries carry their arguments as a generic map, or for a
+	// transaction the entries it groups.
+	gob.Register(map[string]interface{}{})
+	gob.Register([]JournalEntry{})
+	gob.Register([]ACLEntry{})
+}
+
+// imageInode is the serialized form of an inode. Parent pointers can't be
+// encoded directly, so the parent is recorded by inode number instead.
+type imageInode struct {
+	Inode  Inode
+	Parent int
+}
+
+// fsImage is the serialized form of the filesystem state.
+type fsImage struct {
+	TotalInodes    int
+	TotalBlocks    int
+	ReservedBlocks int
+	// ReservedPercent is zero in images from before it was kept.
+	ReservedPercent int
+	FreeBlocks      []int
+	Inodes          []*imageInode
+	DataBlocks      [][]byte
+	Checksums       []uint32
+	BlockLimit      int
+	InodeLimit      int
+	Journal         []JournalEntry
+	JournalSeq      uint64
+	JournalMax      int
+	JournalPolicy   JournalPolicy
+	BlockPacking    bool
+	Dedup           bool
+	Compression     bool
+	Trash           bool
+	VerifyWrites    bool
+	BTreeOrder      int
+	Collation       Collation
+	MaxNameLen      int
+	SyncID          uint64
+	SyncSeq         uint64
+
+	// stats holds the counters as the image was taken. Images don't save
+	// them; it is there for rollbackTo.
+	stats FSStats
+}
+
+// newImage captures the current filesystem state.
+func (fs *FileSystem) newImage() *fsImage {
+	fs.flushDirTrees()
+	blocks, checksums := fs.blocks.slices()
+	img := &fsImage{
+		TotalInodes:     fs.Superblock.TotalInodes,
+		TotalBlocks:     fs.Superblock.TotalBlocks,
+		ReservedBlocks:  fs.Superblock.ReservedBlocks,
+		ReservedPercent: fs.Superblock.ReservedPercent,
+		FreeBlocks:      fs.Superblock.FreeBlocks,
+		DataBlocks:      blocks,
+		Checksums:       checksums,
+		BlockLimit:      fs.blockLimit,
+		InodeLimit:      fs.inodeLimit,
+		Journal:         fs.Journal,
+		JournalSeq:      fs.journalSeq,
+		JournalMax:      fs.journalMax,
+		JournalPolicy:   fs.journalPolicy,
+		BlockPacking:    fs.BlockPacking,
+		Dedup:           fs.Dedup,
+		Compression:     fs.Compression,
+		Trash:           fs.Trash,
+		VerifyWrites:    fs.VerifyWrites,
+		BTreeOrder:      fs.btreeOrder,
+		Collation:       fs.collation,
+		MaxNameLen:      fs.maxNameLen,
+		SyncID:          fs.syncID,
+		SyncSeq:         fs.syncSeq,
+		stats:           fs.stats,
+	}
+	// Readers may be bumping access times under the read lock.
+	fs.atimeMu.Lock()
+	defer fs.atimeMu.Unlock()
+	img.Inodes = toImageInodes(fs.Superblock.InodeMap)
+	return img
+}
+
+// toImageInodes copies inodes into their serialized form.
+func toImageInodes(inodes []*Inode) []*imageInode {
+	entries := make([]*imageInode, len(inodes))
+	for i, inode := range inodes {
+		if inode == nil {
+			continue
+		}
+		entry := &imageInode{Inode: copyInode(inode), Parent: -1}
+		entry.Inode.Parent = nil
+		if inode.Parent != nil {
+			entry.Parent = inode.Parent.InodeNumber
+		}
+		entries[i] = entry
+	}
+	return entries
+}
+
+// fromImageInodes copies serialized inodes back, rebuilding Parent pointers
+// from the recorded inode numbers.
+func fromImageInodes(entries []*imageInode) []*Inode {
+	inodes := make([]*Inode, len(entries))
+	for i, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		inode := copyInode(&entry.Inode)
+		inodes[i] = &inode
+	}
+	for i, entry := range entries {
+		if entry == nil || entry.Parent < 0 || entry.Parent >= len(inodes) {
+			continue
+		}
+		inodes[i].Parent = inodes[entry.Parent]
+	}
+	return inodes
+}
+
+// applyImage replaces the filesystem state with the image, rebuilding Parent
+// pointers from the recorded inode numbers.
+func (fs *FileSystem) applyImage(img *fsImage) {
+	inodes := fromImageInodes(img.Inodes)
+
+	fs.Superblock = Superblock{
+		TotalInodes:     img.TotalInodes,
+		TotalBlocks:     len(img.DataBlocks),
+		ReservedBlocks:  img.ReservedBlocks,
+		ReservedPercent: img.ReservedPercent,
+		FreeBlocks:      append([]int(nil), img.FreeBlocks...),
+		InodeMap:        inodes,
+		FreeInodes:      freeInodeSlots(inodes),
+		BlockRefs:       countBlockRefs(inodes),
+	}
+	if img.ReservedPercent == 0 && img.ReservedBlocks > 0 {
+		// Images from before the percentage was kept: recover it from the
+		// reserve it was set to.
+		fs.Superblock.ReservedPercent = (img.ReservedBlocks*100 + len(img.DataBlocks) - 1) / len(img.DataBlocks)
+	}
+	if len(img.Checksums) == len(img.DataBlocks) {
+		fs.blocks = blockTableOf(img.DataBlocks, img.Checksums)
+	} else {
+		// Images from before checksums were kept
+		fs.blocks = blockTableOf(img.DataBlocks, make([]uint32, len(img.DataBlocks)))
+		fs.rehashBlocks()
+	}
+	fs.markAllDirty()
+	fs.blockLimit = DefaultBlockLimit
+	if img.BlockLimit >= len(img.DataBlocks) {
+		fs.blockLimit = img.BlockLimit
+	}
+	fs.inodeLimit = 0
+	if img.InodeLimit >= len(img.Inodes) {
+		fs.inodeLimit = img.InodeLimit
+	}
+	fs.cache.reset()
+	fs.dedupIndex = nil
+	fs.recountQuotas()
+	fs.recountStats()
+	fs.recountBitmaps()
+	fs.Journal = img.Journal
+	fs.journalSeq = img.JournalSeq
+	// Images from before the limit was configurable leave it as it is.
+	if img.JournalMax >= 1 {
+		fs.journalMax, fs.journalPolicy = img.JournalMax, img.JournalPolicy
+	}
+	fs.BlockPacking = img.BlockPacking
+	fs.Dedup = img.Dedup
+	fs.Compression = img.Compression
+	fs.Trash = img.Trash
+	fs.VerifyWrites = img.VerifyWrites
+	if img.BTreeOrder >= MinBTreeOrder {
+		fs.btreeOrder = img.BTreeOrder
+	}
+	fs.collation = img.Collation
+	// Images from before the limit was kept get the default.
+	fs.maxNameLen = DefaultMaxNameLength
+	if img.MaxNameLen >= 1 {
+		fs.maxNameLen = img.MaxNameLen
+	}
+	if fs.Journal == nil {
+		fs.Journal = make([]JournalEntry, 0, JournalMax)
+	}
+	fs.filesystemSnapshots = nil
+	fs.directorySnapshots = make(map[string]DirectorySnapshot)
+}
+
+// rollbackTo returns the filesystem to the state in img, which newImage
+// took. Unlike applyImage it keeps the snapshots, which are not part of the
+// image, and puts back the counters reported by Stats.
+func (fs *FileSystem) rollbackTo(img *fsImage) {
+	snapshots, dirSnapshots := fs.filesystemSnapshots, fs.directorySnapshots
+	fs.applyImage(img)
+	fs.filesystemSnapshots, fs.directorySnapshots = snapshots, dirSnapshots
+	fs.stats = img.stats
+}
+
+// encode writes the image with gob. gob rejects nil pointers inside slices,
+// so empty inode slots are sent as a presence mask alongside the inodes.
+func (img *fsImage) encode(w io.Writer) error {
+	present := make([]bool, len(img.Inodes))
+	inodes := make([]imageInode, 0, len(img.Inodes))
+	for i, entry := range img.Inodes {
+		if entry != nil {
+			present[i] = true
+			inodes = append(inodes, *entry)
+		}
+	}
+
+	enc := gob.NewEncoder(w)
+	header := *img
+	header.Inodes = nil
+	if err := enc.Encode(&header); err != nil {
+		return err
+	}
+	if err := enc.Encode(present); err != nil {
+		return err
+	}
+	return enc.Encode(inodes)
+}
+
+func decodeImage(r io.Reader) (*fsImage, error) {
+	dec := gob.NewDecoder(r)
+	img := &fsImage{}
+	if err := dec.Decode(img); err != nil {
+		return nil, err
+	}
+	var present []bool
+	if err := dec.Decode(&present); err != nil {
+		return nil, err
+	}
+	var inodes []imageInode
+	if err := dec.Decode(&inodes); err != nil {
+		return nil, err
+	}
+
+	img.Inodes = make([]*imageInode, len(present))
+	next := 0
+	for i, ok := range present {
+		if !ok {
+			continue
+		}
+		if next >= len(inodes) {
+			return nil, fmt.Errorf("image is truncated: missing inode %d", i)
+		}
+		img.Inodes[i] = &inodes[next]
+		next++
+	}
+	return img, nil
+}
+
+// ExportImage writes a self-contained image of the filesystem. The state is
+// checked for consistency first and the journal is left empty, so importing
+// the image never requires a replay.
+func (fs *FileSystem) ExportImage(w io.Writer) error {
+	if err := fs.lockRead(); err != nil {
+		return err
+	}
+	defer fs.mu.RUnlock()
+
+	if err := fs.verifyFilesystem(); err != nil {
+		return fmt.Errorf("refusing to export inconsistent filesystem: %w", err)
+	}
+	img := fs.newImage()
+	img.Journal = nil
+	return img.encode(w)
+}
+
+// ImportImage replaces the filesystem with an image written by ExportImage.
+func (fs *FileSystem) ImportImage(r io.Reader) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	img, err := decodeImage(r)
+	if err != nil {
+		return err
+	}
+	fs.applyImage(img)
+	fs.checkpointInternal()
+	return nil
+}
+
+// exportSnapshot writes the named filesystem snapshot to w in the image
+// format, so it outlives the process and can be loaded with importSnapshot.
+func (fs *FileSystem) exportSnapshot(name string, w io.Writer) error {
+	if err := fs.lockRead(); err != nil {
+		return err
+	}
+	defer fs.mu.RUnlock()
+
+	idx := fs.snapshotIndex(name)
+	if idx < 0 {
+		return fmt.Errorf("snapshot %q: %w", name, ErrNoSnapshot)
+	}
+	snapshot := fs.filesystemSnapshots[idx]
+	blocks, checksums := snapshot.Data.slices()
+	img := &fsImage{
+		TotalInodes: snapshot.TotalInodes,
+		TotalBlocks: snapshot.Data.len(),
+		FreeBlocks:  snapshot.FreeBlocks,
+		Inodes:      toImageInodes(fs.snapshotInodes(snapshot)),
+		DataBlocks:  blocks,
+		Checksums:   checksums,
+	}
+	return img.encode(w)
+}
+
+// importSnapshot reads a snapshot written by exportSnapshot and adds it as
+// the newest filesystem snapshot under name, which must not already be in
+// use. It can then be restored like any other.
+func (fs *FileSystem) importSnapshot(name string, r io.Reader) error {
+	if name == "" {
+		return ErrInvalid
+	}
+	img, err := decodeImage(r)
+	if err != nil {
+		return fmt.Errorf("snapshot %q: %w", name, err)
+	}
+	if len(img.Checksums) != len(img.DataBlocks) {
+		return fmt.Errorf("snapshot %q: %d checksums for %d blocks: %w", name, len(img.Checksums), len(img.DataBlocks), ErrInvalid)
+	}
+
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	if fs.snapshotIndex(name) >= 0 {
+		return fmt.Errorf("snapshot %q: %w", name, ErrExists)
+	}
+	fs.filesystemSnapshots = append(fs.filesystemSnapshots, Snapshot{
+		Name:        name,
+		Inodes:      fromImageInodes(img.Inodes),
+		Data:        blockTableOf(img.DataBlocks, img.Checksums),
+		FreeBlocks:  img.FreeBlocks,
+		TotalInodes: img.TotalInodes,
+	})
+	return nil
+}
+
+// Save writes the filesystem, including its journal, to the file at path.
+// The file is replaced atomically so a failed save leaves the old copy.
+func (fs *FileSystem) Save(path string) error {
+	if err := fs.lockRead(); err != nil {
+		return err
+	}
+	defer fs.mu.RUnlock()
+
+	return fs.save(path)
+}
+
+// save is Save with fs.mu already held.
+func (fs *FileSystem) save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := fs.newImage().encode(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads a filesystem written by Save, along with whatever Sync has
+// recorded for it since.
+func Load(path string) (*FileSystem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, err := decodeImage(f)
+	if err != nil {
+		return nil, fmt.Errorf("load %s: %w", path, err)
+	}
+	if err := img.applySyncRecords(syncPath(path)); err != nil {
+		return nil, fmt.Errorf("load %s: %w", path, err)
+	}
+	fs := NewFileSystem()
+	fs.applyImage(img)
+	fs.syncID, fs.syncSeq = img.SyncID, img.SyncSeq
+	fs.dirtyBlocks = nil
+	// The saved journal is already part of the loaded state, so replay
+	// starts here and skips it.
+	fs.lastCheckpoint = fs.checkpointImage()
+	return fs, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// treeOf describes every inode under root by path: its type, mode and, for
+// files, contents.
+func treeOf(t *testing.T, fs *FileSystem) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	var walk func(dir *Inode, path string)
+	walk = func(dir *Inode, path string) {
+		tree[path] = fmt.Sprintf("dir %o", dir.Mode)
+		for _, entry := range fs.dirTree(dir).entries() {
+			child := fs.lookupInode(entry.InodeIndex)
+			childPath := path + "/" + entry.Name
+			if child.IsDirectory {
+				walk(child, childPath)
+				continue
+			}
+			if child.IsSymlink {
+				tree[childPath] = "link " + child.Target
+				continue
+			}
+			data, err := fs.readFile(childPath)
+			if err != nil {
+				t.Fatalf("%s: %v", childPath, err)
+			}
+			tree[childPath] = fmt.Sprintf("file %o %q", child.Mode, data)
+		}
+	}
+	walk(fs.Superblock.InodeMap[0], "/root")
+	return tree
+}
+
+func TestExportImportImage(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("root", "a")
+	fs.mkdir("root/a", "b")
+	fs.touch("root/a/b", "f")
+	fs.touch("root", "g")
+	for _, err := range []error{
+		fs.writeFile("root/a/b/f", bytes.Repeat([]byte("data"), 100)),
+		fs.chmod("root/a", 0700),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := treeOf(t, fs)
+	var buf bytes.Buffer
+	if err := fs.ExportImage(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := NewFileSystem()
+	imported.touch("root", "replaced")
+	if err := imported.ImportImage(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.Journal) != 0 {
+		t.Errorf("imported filesystem has %d journal entries to replay", len(imported.Journal))
+	}
+	if got := treeOf(t, imported); !reflect.DeepEqual(got, want) {
+		t.Errorf("imported tree:\n got %v\nwant %v", got, want)
+	}
+	if err := imported.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+
+	imported.replayJournal()
+	if got := treeOf(t, imported); !reflect.DeepEqual(got, want) {
+		t.Errorf("imported tree after replay:\n got %v\nwant %v", got, want)
+	}
+
+	if err := imported.writeFile("root/a/b/f", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Error("changing the import changed the original")
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("root", "docs")
+	fs.mkdir("root/docs", "old")
+	for _, name := range []string{"a", "b", "c"} {
+		fs.touch("root/docs", name)
+		if err := fs.writeFile("root/docs/"+name, []byte(name+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := treeOf(t, fs)
+	path := filepath.Join(t.TempDir(), "fs.img")
+	if err := fs.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := treeOf(t, loaded); !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded tree:\n got %v\nwant %v", got, want)
+	}
+	if err := loaded.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExportImportSnapshot(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "a")),
+		errOf(fs.mkdir("/root/a", "b")),
+		errOf(fs.touch("/root/a/b", "f")),
+		fs.writeFile("/root/a/b/f", bytes.Repeat([]byte("data"), 100)),
+		fs.symlink("/root/a/b/f", "/root/link"),
+		fs.createNamedSnapshot("s"),
+		fs.rm("/root/link"),
+		fs.writeFile("/root/a/b/f", []byte("later")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := fs.exportSnapshot("s", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.exportSnapshot("missing", &buf); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("exportSnapshot of a missing snapshot: %v, want ErrNoSnapshot", err)
+	}
+	if err := fs.restoreNamedSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	want := treeOf(t, fs)
+	listing, err := fs.lsRecursive("/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := NewFileSystem()
+	if _, err := fresh.touch("/root", "replaced"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.importSnapshot("imported", bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.importSnapshot("imported", bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrExists) {
+		t.Errorf("importing under a name in use: %v, want ErrExists", err)
+	}
+	if got := fresh.listSnapshots(); !reflect.DeepEqual(got, []string{"imported"}) {
+		t.Errorf("snapshots after import = %v", got)
+	}
+	if err := fresh.restoreNamedSnapshot("imported"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeOf(t, fresh); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored tree:\n got %v\nwant %v", got, want)
+	}
+	if got, err := fresh.lsRecursive("/root"); err != nil || !reflect.DeepEqual(got, listing) {
+		t.Errorf("lsRecursive after restore = %q, %v, want %q", got, err, listing)
+	}
+	if inode := fresh.resolvePath("/root/a/b"); inode == nil || inode.Parent != fresh.resolvePath("/root/a") {
+		t.Error("Parent pointers not rebuilt")
+	}
+
+	if err := fresh.importSnapshot("garbage", bytes.NewReader([]byte("not a snapshot"))); err == nil {
+		t.Error("importing garbage succeeded")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"time"
+)
+
+// IOFS exposes a FileSystem through the io/fs interfaces. Paths follow io/fs
+// rules: slash-separated, unrooted, with "." naming the root directory.
+type IOFS struct {
+	fs *FileSystem
+}
+
+var (
+	_ iofs.FS          = IOFS{}
+	_ iofs.ReadDirFS   = IOFS{}
+	_ iofs.StatFS      = IOFS{}
+	_ iofs.ReadDirFile = (*ioDir)(nil)
+)
+
+// IOFS returns an io/fs view of the filesystem.
+func (fs *FileSystem) IOFS() IOFS {
+	return IOFS{fs: fs}
+}
+
+// internalPath maps an io/fs path onto this filesystem's path convention.
+func internalPath(op, name string) (string, error) {
+	if !iofs.ValidPath(name) {
+		return "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	if name == "." {
+		return "/root", nil
+	}
+	return "/root/" + name, nil
+}
+
+func ioError(op, name string, err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		err = iofs.ErrNotExist
+	case errors.Is(err, ErrNotDirectory), errors.Is(err, ErrIsDirectory):
+		err = iofs.ErrInvalid
+	case errors.Is(err, ErrPermission):
+		err = iofs.ErrPermission
+	}
+	return &iofs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Open implements fs.FS.
+func (f IOFS) Open(name string) (iofs.File, error) {
+	path, err := internalPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.fs.lockRead(); err != nil {
+		return nil, ioError("open", name, err)
+	}
+	defer f.fs.mu.RUnlock()
+
+	inode := f.fs.resolvePath(path)
+	if inode == nil {
+		return nil, ioError("open", name, ErrNotFound)
+	}
+	if !f.fs.may(inode, permRead) {
+		return nil, ioError("open", name, ErrPermission)
+	}
+	info := newIOFileInfo(name, inode)
+	if inode.IsDirectory {
+		return &ioDir{info: info, entries: f.fs.ioDirEntries(inode)}, nil
+	}
+	data, err := f.fs.fileData(inode)
+	if err != nil {
+		return nil, ioError("open", name, err)
+	}
+	f.fs.touchAccessTime(inode)
+	return &ioFile{info: info, r: bytes.NewReader(data)}, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (f IOFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	path, err := internalPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.fs.lockRead(); err != nil {
+		return nil, ioError("readdir", name, err)
+	}
+	defer f.fs.mu.RUnlock()
+
+	inode := f.fs.resolvePath(path)
+	if inode == nil {
+		return nil, ioError("readdir", name, ErrNotFound)
+	}
+	if !inode.IsDirectory {
+		return nil, ioError("readdir", name, ErrNotDirectory)
+	}
+	return f.fs.ioDirEntries(inode), nil
+}
+
+// Stat implements fs.StatFS.
+func (f IOFS) Stat(name string) (iofs.FileInfo, error) {
+	path, err := internalPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.fs.lockRead(); err != nil {
+		return nil, ioError("stat", name, err)
+	}
+	defer f.fs.mu.RUnlock()
+
+	inode := f.fs.resolvePath(path)
+	if inode == nil {
+		return nil, ioError("stat", name, ErrNotFound)
+	}
+	return newIOFileInfo(name, inode), nil
+}
+
+// ioDirEntries lists a directory in sorted order. The caller must hold fs.mu.
+func (fs *FileSystem) ioDirEntries(dir *Inode) []iofs.DirEntry {
+	var entries []iofs.DirEntry
+	for _, entry := range fs.dirTree(dir).entries() {
+		child := fs.lookupInode(entry.InodeIndex)
+		if child == nil {
+			continue
+		}
+		entries = append(entries, iofs.FileInfoToDirEntry(newIOFileInfo(entry.Name, child)))
+	}
+	return entries
+}
+
+// ioFileInfo implements fs.FileInfo from a copy of the inode's metadata.
+type ioFileInfo struct {
+	name    string
+	size    int64
+	mode    iofs.FileMode
+	modTime time.Time
+	inode   *Inode
+}
+
+func newIOFileInfo(name string, inode *Inode) *ioFileInfo {
+	if name != "." {
+		_, name = splitPath(name)
+	}
+	mode := iofs.FileMode(inode.Mode & 0777)
+	if inode.IsDirectory {
+		mode |= iofs.ModeDir
+	}
+	if inode.IsSymlink {
+		mode |= iofs.ModeSymlink
+	}
+	return &ioFileInfo{
+		name:    name,
+		size:    int64(inode.Size),
+		mode:    mode,
+		modTime: inode.ModifiedAt,
+		inode:   inode,
+	}
+}
+
+func (i *ioFileInfo) Name() string        { return i.name }
+func (i *ioFileInfo) Size() int64         { return i.size }
+func (i *ioFileInfo) Mode() iofs.FileMode { return i.mode }
+func (i *ioFileInfo) ModTime() time.Time  { return i.modTime }
+func (i *ioFileInfo) IsDir() bool         { return i.mode.IsDir() }
+func (i *ioFileInfo) Sys() interface{}    { return i.inode }
+
+// ioFile is an open regular file. Its contents are copied at Open time.
+type ioFile struct {
+	info   *ioFileInfo
+	r      *bytes.Reader
+	closed bool
+}
+
+func (f *ioFile) Stat() (iofs.FileInfo, error) { return f.info, nil }
+
+func (f *ioFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, iofs.ErrClosed
+	}
+	return f.r.Read(p)
+}
+
+func (f *ioFile) Close() error {
+	if f.closed {
+		return iofs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// ioDir is an open directory. Its entries are captured at Open time.
+type ioDir struct {
+	info    *ioFileInfo
+	entries []iofs.DirEntry
+	offset  int
+	closed  bool
+}
+
+func (d *ioDir) Stat() (iofs.FileInfo, error) { return d.info, nil }
+
+func (d *ioDir) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.info.name, Err: iofs.ErrInvalid}
+}
+
+func (d *ioDir) Close() error {
+	if d.closed {
+		return iofs.ErrClosed
+	}
+	d.closed = true
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *ioDir) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if d.closed {
+		return nil, iofs.ErrClosed
+	}
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return append([]iofs.DirEntry{}, remaining...), nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return append([]iofs.DirEntry(nil), remaining[:n]...), nil
+}
+
+// walkNode is a directory tree captured for WalkDir.
+type walkNode struct {
+	path     string
+	entry    iofs.DirEntry
+	children []*walkNode
+}
+
+// WalkDir walks the tree rooted at root with the semantics of
+// filepath.WalkDir: each directory is visited before its entries, which
+// come in sorted order, fn may return fs.SkipDir to prune a directory (or,
+// from a file, the rest of its directory) and fs.SkipAll to stop, and any
+// other error from fn aborts the walk. Like Walk, the tree is captured
+// under the read lock before fn runs.
+func (fs *FileSystem) WalkDir(root string, fn iofs.WalkDirFunc) error {
+	if err := fs.lockRead(); err != nil {
+		return fn(root, nil, ioError("walk", root, err))
+	}
+	start := fs.resolvePath(root)
+	if start == nil {
+		fs.mu.RUnlock()
+		return fn(root, nil, ioError("walk", root, ErrNotFound))
+	}
+	root = fs.absPath(root)
+	_, name := splitPath(root)
+	tree := fs.captureWalk(root, name, start)
+	fs.mu.RUnlock()
+
+	err := walkDir(tree, fn)
+	if err == iofs.SkipDir || err == iofs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (fs *FileSystem) captureWalk(path, name string, inode *Inode) *walkNode {
+	node := &walkNode{path: path, entry: iofs.FileInfoToDirEntry(newIOFileInfo(name, inode))}
+	if !inode.IsDirectory {
+		return node
+	}
+	for _, entry := range fs.dirTree(inode).entries() {
+		if child := fs.lookupInode(entry.InodeIndex); child != nil {
+			node.children = append(node.children, fs.captureWalk(path+"/"+entry.Name, entry.Name, child))
+		}
+	}
+	return node
+}
+
+func walkDir(node *walkNode, fn iofs.WalkDirFunc) error {
+	if err := fn(node.path, node.entry, nil); err != nil || !node.entry.IsDir() {
+		if err == iofs.SkipDir && node.entry.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	for _, child := range node.children {
+		if err := walkDir(child, fn); err != nil {
+			if err == iofs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
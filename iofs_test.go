@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// populated returns a filesystem holding a small tree of files and
+// directories.
+func populated(t *testing.T) *FileSystem {
+	t.Helper()
+	fs := NewFileSystem()
+	fs.mkdir("root", "a")
+	fs.mkdir("root/a", "b")
+	fs.mkdir("root", "c")
+	for path, data := range map[string]string{"root/a/x": "x", "root/a/b/y": "yy", "root/z": "zzz"} {
+		dir, name := splitPath(path)
+		fs.touch(dir, name)
+		if err := fs.writeFile(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs
+}
+
+func TestIOFSWalkDir(t *testing.T) {
+	fsys := populated(t).IOFS()
+	var got []string
+	err := iofs.WalkDir(fsys, ".", func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		kind := "file"
+		if d.IsDir() {
+			kind = "dir"
+		}
+		got = append(got, kind+" "+path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"dir .", "dir a", "dir a/b", "file a/b/y", "file a/x", "dir c", "file z"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WalkDir visited %v, want %v", got, want)
+	}
+
+	data, err := iofs.ReadFile(fsys, "a/b/y")
+	if err != nil || string(data) != "yy" {
+		t.Errorf("ReadFile(a/b/y) = %q, %v", data, err)
+	}
+	if _, err := fsys.Open("missing"); !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("Open(missing): %v, want ErrNotExist", err)
+	}
+	if _, err := fsys.Open("/a"); !errors.Is(err, iofs.ErrInvalid) {
+		t.Errorf("Open(/a): %v, want ErrInvalid", err)
+	}
+}
+
+func TestIOFSConformance(t *testing.T) {
+	if err := fstest.TestFS(populated(t).IOFS(), "a/x", "a/b/y", "c", "z"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWalkDir(t *testing.T) {
+	fs := populated(t)
+	// Enough entries that /root/many has inner B-tree nodes.
+	if _, err := fs.mkdir("/root", "many"); err != nil {
+		t.Fatal(err)
+	}
+	var many []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("m%02d", i)
+		if _, err := fs.touch("/root/many", name); err != nil {
+			t.Fatal(err)
+		}
+		many = append(many, "/root/many/"+name)
+	}
+
+	walk := func(root string, fn func(path string, d iofs.DirEntry) error) ([]string, error) {
+		var visited []string
+		err := fs.WalkDir(root, func(path string, d iofs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			visited = append(visited, path)
+			return fn(path, d)
+		})
+		return visited, err
+	}
+	none := func(string, iofs.DirEntry) error { return nil }
+
+	got, err := walk("/root", none)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]string{"/root", "/root/a", "/root/a/b", "/root/a/b/y", "/root/a/x", "/root/c", "/root/many"}, many...)
+	want = append(want, "/root/z")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pre-order walk:\n got %v\nwant %v", got, want)
+	}
+
+	// SkipDir from a directory prunes it; from a file it skips the rest of
+	// the directory holding the file.
+	got, err = walk("/root", func(path string, d iofs.DirEntry) error {
+		if path == "/root/a" || path == "/root/many/m02" {
+			return iofs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"/root", "/root/a", "/root/c", "/root/many", "/root/many/m00", "/root/many/m01", "/root/many/m02", "/root/z"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walk with SkipDir:\n got %v\nwant %v", got, want)
+	}
+
+	got, err = walk("/root", func(path string, d iofs.DirEntry) error {
+		if path == "/root/a/b" {
+			return iofs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/root", "/root/a", "/root/a/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("walk with SkipAll = %v, want %v", got, want)
+	}
+
+	stop := errors.New("stop")
+	got, err = walk("/root", func(path string, d iofs.DirEntry) error {
+		if path == "/root/a/x" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || got[len(got)-1] != "/root/a/x" {
+		t.Errorf("walk aborted at %v with %v, want /root/a/x and stop", got, err)
+	}
+
+	if _, err := walk("/root/missing", none); !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("walk of a missing root: %v, want ErrNotExist", err)
+	}
+}
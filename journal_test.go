@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEstimateRecovery(t *testing.T) {
+	fs := NewFileSystem()
+	if n, d := fs.estimateRecovery(); n != 0 || d != 0 {
+		t.Errorf("empty journal: estimateRecovery() = %d, %v", n, d)
+	}
+	fs.mkdir("root", "d")
+	for _, name := range []string{"a", "b", "c"} {
+		fs.touch("root/d", name)
+	}
+
+	n, d := fs.estimateRecovery()
+	if n != 4 {
+		t.Errorf("estimateRecovery() counted %d entries, want 4", n)
+	}
+	var want time.Duration
+	for _, op := range []string{"mkdir", "touch", "touch", "touch"} {
+		cost, ok := replayCost[op]
+		if !ok {
+			cost = defaultReplayCost
+		}
+		want += cost
+	}
+	if d != want || d == 0 {
+		t.Errorf("estimateRecovery() = %v, want %v", d, want)
+	}
+}
+
+// replayed rebuilds a new filesystem from the journal of fs.
+func replayed(fs *FileSystem) *FileSystem {
+	fresh := NewFileSystem()
+	fresh.Journal = append([]JournalEntry(nil), fs.Journal...)
+	fresh.replayJournal()
+	return fresh
+}
+
+func TestReplayJournal(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("/root", "docs")
+	fs.touch("/root/docs", "a")
+	fs.touch("/root/docs", "b")
+	fs.touch("/root", "gone")
+	fs.mkdir("/root", "empty")
+	for _, err := range []error{
+		fs.rm("/root/gone"),
+		fs.rmdir("/root/empty"),
+		fs.mv("/root/docs/b", "/root/b"),
+		fs.mv("/root/b", "/root/docs/a"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fs.Journal) != 9 {
+		t.Errorf("journal holds %d entries, want 9", len(fs.Journal))
+	}
+
+	got := replayed(fs)
+	if want := treeOf(t, fs); !reflect.DeepEqual(treeOf(t, got), want) {
+		t.Errorf("after replay:\n got %v\nwant %v", treeOf(t, got), want)
+	}
+	if err := got.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplayJournalTouchThenRm(t *testing.T) {
+	fs := NewFileSystem()
+	fs.touch("/root", "f")
+	if err := fs.rm("/root/f"); err != nil {
+		t.Fatal(err)
+	}
+
+	if replayed(fs).resolvePath("/root/f") != nil {
+		t.Error("/root/f exists after replaying touch and rm")
+	}
+}
+
+// File contents, modes and links are journaled along with the namespace,
+// so replay reproduces the tree exactly.
+func TestReplayJournalDataOperations(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("/root", "d")
+	fs.touch("/root/d", "f")
+	for _, err := range []error{
+		fs.writeFile("/root/d/f", []byte("first")),
+		fs.writeFile("/root/d/f", bytes.Repeat([]byte("x"), 3*BlockSize)),
+		fs.appendFile("/root/d/f", []byte("tail")),
+		fs.writeAt("/root/d/f", 10, []byte("mid")),
+		fs.truncate("/root/d/f", 2*BlockSize+5),
+		fs.chmod("/root/d/f", 0600),
+		fs.setxattr("/root/d/f", "user.a", "1"),
+		fs.setxattr("/root/d/f", "user.b", "2"),
+		fs.removexattr("/root/d/f", "user.a"),
+		fs.link("/root/d/f", "/root/hard"),
+		fs.symlink("d/f", "/root/soft"),
+		fs.cp("/root/d", "/root/copy"),
+		fs.setQuota("/root/copy", 1<<20),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := fs.open("/root/d/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("through a handle")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := replayed(fs)
+	if want := treeOf(t, fs); !reflect.DeepEqual(treeOf(t, got), want) {
+		t.Errorf("after replay:\n got %v\nwant %v", treeOf(t, got), want)
+	}
+	if inode, _ := got.stat("/root/hard"); inode == nil || inode.LinkCount != 2 {
+		t.Error("hard link not restored by replay")
+	}
+	if dir, _ := got.stat("/root/copy"); dir == nil || dir.Quota != 1<<20 {
+		t.Error("quota not restored by replay")
+	}
+	if keys, _ := got.listxattr("/root/d/f"); !reflect.DeepEqual(keys, []string{"user.b"}) {
+		t.Errorf("xattrs after replay = %v, want [user.b]", keys)
+	}
+	if err := got.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJournalSkipsFailedOperations(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("/root", "d")
+	n := len(fs.Journal)
+
+	for _, tt := range []struct {
+		op   string
+		err  error
+		want error
+	}{
+		{"mkdir of an existing name", errOf(fs.mkdir("/root", "d")), ErrExists},
+		{"touch in a missing directory", errOf(fs.touch("/root/missing", "f")), ErrNotFound},
+		{"rm of a missing file", fs.rm("/root/nothing"), ErrNotFound},
+		{"writeFile on a directory", fs.writeFile("/root/d", []byte("x")), ErrIsDirectory},
+		{"link of a missing file", fs.link("/root/nothing", "/root/l"), ErrNotFound},
+	} {
+		if !errors.Is(tt.err, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.op, tt.err, tt.want)
+		}
+	}
+	if len(fs.Journal) != n {
+		t.Errorf("journal grew from %d to %d entries on failed operations", n, len(fs.Journal))
+	}
+}
+
+// Past the journal limit replay starts from the automatic checkpoint and
+// still rebuilds the tree.
+func TestJournalSequenceAndCheckpoint(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("/root", "d")
+	for i := 0; i < 3; i++ {
+		fs.touch("/root/d", fmt.Sprintf("f%d", i))
+	}
+	for i := 0; i < JournalMax+5; i++ {
+		if err := fs.writeFile("/root/d/f0", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, err := range []error{fs.rm("/root/d/f1"), fs.mv("/root/d/f2", "/root/f2")} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := treeOf(t, fs)
+
+	if len(fs.Journal) > JournalMax {
+		t.Errorf("journal holds %d entries, limit %d", len(fs.Journal), JournalMax)
+	}
+	for i := 1; i < len(fs.Journal); i++ {
+		if fs.Journal[i].Seq != fs.Journal[i-1].Seq+1 {
+			t.Errorf("sequence numbers %d then %d", fs.Journal[i-1].Seq, fs.Journal[i].Seq)
+		}
+	}
+	ops := uint64(1 + 3 + JournalMax + 5 + 2)
+	if last := fs.Journal[len(fs.Journal)-1].Seq; last != ops {
+		t.Errorf("last sequence number %d, want %d", last, ops)
+	}
+
+	fs.replayJournal()
+	if got := treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after replay:\n got %v\nwant %v", got, want)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJournalPolicies(t *testing.T) {
+	const limit = 5
+	setup := func(t *testing.T, policy JournalPolicy) *FileSystem {
+		t.Helper()
+		fs := NewFileSystem()
+		if _, err := fs.mkdir("/root", "d"); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.setJournalLimit(limit, policy); err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+	touch := func(fs *FileSystem, i int) error {
+		_, err := fs.touch("/root/d", fmt.Sprintf("f%d", i))
+		return err
+	}
+
+	t.Run("checkpoint", func(t *testing.T) {
+		fs := setup(t, JournalCheckpoint)
+		for i := 0; i < 3*limit+2; i++ {
+			if err := touch(fs, i); err != nil {
+				t.Fatal(err)
+			}
+			if len(fs.Journal) > limit {
+				t.Fatalf("after %d changes the journal holds %d entries, limit %d", i+1, len(fs.Journal), limit)
+			}
+		}
+		want := treeOf(t, fs)
+		fs.replayJournal()
+		if got := treeOf(t, fs); !reflect.DeepEqual(got, want) {
+			t.Errorf("after replay:\n got %v\nwant %v", got, want)
+		}
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		fs := setup(t, JournalDropOldest)
+		for i := 0; i < limit+2; i++ {
+			if err := touch(fs, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(fs.Journal) != limit {
+			t.Fatalf("journal holds %d entries, want %d", len(fs.Journal), limit)
+		}
+		if first := fs.Journal[0].Data.(map[string]interface{})["fileName"]; first != "f2" {
+			t.Errorf("oldest entry kept is for %v, want f2", first)
+		}
+		// Replay can't bring back what was dropped.
+		fs.replayJournal()
+		if fs.exists("/root/d/f0") || !fs.exists("/root/d/f6") {
+			t.Error("replay of a trimmed journal reproduced the dropped entries")
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		fs := setup(t, JournalReject)
+		for i := 0; i < limit; i++ {
+			if err := touch(fs, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := touch(fs, limit); !errors.Is(err, ErrJournalFull) {
+			t.Fatalf("change past the limit: %v, want ErrJournalFull", err)
+		}
+		if fs.exists(fmt.Sprintf("/root/d/f%d", limit)) || len(fs.Journal) != limit {
+			t.Error("a rejected change was applied")
+		}
+		want := treeOf(t, fs)
+		fs.replayJournal()
+		if got := treeOf(t, fs); !reflect.DeepEqual(got, want) {
+			t.Errorf("after replay:\n got %v\nwant %v", got, want)
+		}
+		if err := fs.checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		if err := touch(fs, limit); err != nil {
+			t.Errorf("change after a checkpoint: %v", err)
+		}
+	})
+
+	fs := NewFileSystem()
+	for _, tt := range []struct {
+		max    int
+		policy JournalPolicy
+	}{{0, JournalCheckpoint}, {limit, JournalPolicy(-1)}, {limit, JournalReject + 1}} {
+		if err := fs.setJournalLimit(tt.max, tt.policy); !errors.Is(err, ErrInvalid) {
+			t.Errorf("setJournalLimit(%d, %d): %v, want ErrInvalid", tt.max, tt.policy, err)
+		}
+	}
+}
+
+// A damaged entry is skipped and dropped while the rest replays.
+func TestReplaySkipsMalformedEntries(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "d")),
+		errOf(fs.touch("/root/d", "f")),
+		fs.writeFile("/root/d/f", []byte("data")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq := fs.journalSeq
+	bad := []JournalEntry{
+		{Operation: "frobnicate", Path: "/root/x"},
+		{Operation: "mkdir", Data: "not a map"},
+		{Operation: "touch", Data: map[string]interface{}{"dirPath": "/root/d"}},
+		{Operation: "chmod", Path: "/root/d/f", Data: map[string]interface{}{"mode": 0600}},
+		{Operation: "txn", Data: []JournalEntry{
+			{Operation: "touch", Data: map[string]interface{}{"dirPath": "/root/d", "fileName": "g"}},
+			{Operation: "mv", Path: "/root/d/g", Data: map[string]interface{}{"dstPath": 7}},
+		}},
+	}
+	for i := range bad {
+		seq++
+		bad[i].Seq = seq
+	}
+	fs.Journal = append(fs.Journal, bad...)
+	fs.journalSeq = seq
+	if _, err := fs.touch("/root/d", "h"); err != nil {
+		t.Fatal(err)
+	}
+	// Well formed, but its file is gone by the time it is replayed.
+	fs.Journal = append(fs.Journal, JournalEntry{Seq: seq + 2, Operation: "rm", Path: "/root/d/missing"})
+	want := treeOf(t, fs)
+
+	summary := fs.replayJournal()
+	if want := (ReplaySummary{Replayed: 4, Failed: 1, Skipped: len(bad)}); summary != want {
+		t.Errorf("summary = %+v, want %+v", summary, want)
+	}
+	if got := treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after replay:\n got %v\nwant %v", got, want)
+	}
+	for _, entry := range fs.Journal {
+		if err := checkJournalEntry(entry); err != nil {
+			t.Errorf("journal kept a malformed entry: %v", err)
+		}
+	}
+	if len(fs.Journal) != 5 {
+		t.Errorf("journal holds %d entries after replay, want 5", len(fs.Journal))
+	}
+	for _, entry := range bad {
+		if err := checkJournalEntry(entry); !errors.Is(err, ErrBadEntry) {
+			t.Errorf("checkJournalEntry(%+v) = %v, want ErrBadEntry", entry, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// jsonNode is one inode in the output of ExportJSON.
+type jsonNode struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Size     int         `json:"size"`
+	Target   string      `json:"target,omitempty"`
+	Children []*jsonNode `json:"children,omitempty"`
+}
+
+// ExportJSON writes the subtree rooted at path to w as indented JSON: an
+// object with the name, type ("directory", "file" or "symlink") and size of
+// each inode, the target of a symlink, and the children of a non-empty
+// directory in sorted order. Symlinks are not followed. A directory that
+// is its own ancestor, which only a damaged filesystem has, is written
+// without children.
+func (fs *FileSystem) ExportJSON(path string, w io.Writer) error {
+	if err := fs.lockRead(); err != nil {
+		return err
+	}
+	defer fs.mu.RUnlock()
+
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return ErrNotFound
+	}
+	root := fs.jsonTree(inode, basename(fs.absPath(path)), make(map[int]bool))
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(root)
+}
+
+// jsonTree builds the jsonNode for inode. ancestors holds the directories
+// being described above it, so a cycle ends instead of recursing forever.
+func (fs *FileSystem) jsonTree(inode *Inode, name string, ancestors map[int]bool) *jsonNode {
+	node := &jsonNode{Name: name, Type: "file", Size: inode.Size}
+	switch {
+	case inode.IsSymlink:
+		node.Type, node.Target = "symlink", inode.Target
+	case inode.IsDirectory:
+		node.Type = "directory"
+		if ancestors[inode.InodeNumber] {
+			return node
+		}
+		ancestors[inode.InodeNumber] = true
+		for _, entry := range fs.dirTree(inode).entries() {
+			if child := fs.lookupInode(entry.InodeIndex); child != nil {
+				node.Children = append(node.Children, fs.jsonTree(child, entry.Name, ancestors))
+			}
+		}
+		delete(ancestors, inode.InodeNumber)
+	}
+	return node
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportJSON(t *testing.T) {
+	fs, err := NewFileSystemWithOrder(MinBTreeOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "d")),
+		errOf(fs.mkdir("/root/d", "empty")),
+		errOf(fs.touch("/root/d", "f")),
+		fs.writeFile("/root/d/f", []byte("hello")),
+		fs.symlink("/root/d/f", "/root/d/link"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Enough entries to split the directory's B-tree over several nodes.
+	var many []string
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("n%02d", i)
+		if _, err := fs.touch("/root/d", name); err != nil {
+			t.Fatal(err)
+		}
+		many = append(many, fmt.Sprintf(`{"name": %q, "type": "file", "size": 0}`, name))
+	}
+
+	var buf bytes.Buffer
+	if err := fs.ExportJSON("/root/d", &buf); err != nil {
+		t.Fatal(err)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %s: %v", buf.String(), err)
+	}
+	expected := `{"name": "d", "type": "directory", "size": %d, "children": [
+		{"name": "empty", "type": "directory", "size": %d},
+		{"name": "f", "type": "file", "size": 5},
+		{"name": "link", "type": "symlink", "size": %d, "target": "/root/d/f"},
+		` + strings.Join(many, ",\n\t\t") + `
+	]}`
+	d, _ := fs.stat("/root/d")
+	empty, _ := fs.stat("/root/d/empty")
+	link, _ := fs.lstat("/root/d/link")
+	if err := json.Unmarshal([]byte(fmt.Sprintf(expected, d.Size, empty.Size, link.Size)), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExportJSON:\n%s", buf.String())
+	}
+
+	if err := fs.ExportJSON("/root/missing", &buf); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ExportJSON of a missing path: %v, want ErrNotFound", err)
+	}
+}
+
+func TestExportJSONCycle(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{errOf(fs.mkdir("/root", "a")), errOf(fs.mkdir("/root/a", "b"))} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, _ := fs.stat("/root/a")
+	b, _ := fs.stat("/root/a/b")
+	fs.addEntryToDir(b, DirEntry{Name: "loop", InodeIndex: a.InodeNumber})
+
+	var buf bytes.Buffer
+	if err := fs.ExportJSON("/root/a", &buf); err != nil {
+		t.Fatal(err)
+	}
+	var root jsonNode
+	if err := json.Unmarshal(buf.Bytes(), &root); err != nil {
+		t.Fatal(err)
+	}
+	if len(root.Children) != 1 || len(root.Children[0].Children) != 1 {
+		t.Fatalf("ExportJSON:\n%s", buf.String())
+	}
+	if loop := root.Children[0].Children[0]; loop.Name != "loop" || loop.Children != nil {
+		t.Errorf("the cycle was followed:\n%s", buf.String())
+	}
+}
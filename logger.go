@@ -0,0 +1,31 @@
+package main
+
+// Logger receives the filesystem's operational messages: the results and
+// errors reported by the entry points that don't return them, such as mkdir
+// and createFilesystemSnapshot. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// nopLogger discards everything; it is the default so library users get
+// no output unless they ask for it.
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
+
+// setLogger installs l to receive operational messages; nil silences them.
+func (fs *FileSystem) setLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.logger = l
+}
+
+// logf sends a message to the installed logger.
+func (fs *FileSystem) logf(format string, args ...interface{}) {
+	fs.logger.Printf(format, args...)
+}
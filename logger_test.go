@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// captureLogger records every message it is given.
+type captureLogger struct {
+	lines []string
+}
+
+func (l *captureLogger) Printf(format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	fs := NewFileSystem()
+	// Nothing is logged, and nothing breaks, before a logger is installed.
+	fs.ls("/root")
+
+	log := &captureLogger{}
+	fs.setLogger(log)
+	for _, err := range []error{errOf(fs.touch("/root", "b")), errOf(fs.mkdir("/root", "a"))} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.ls("/root")
+	fs.ls("/root/missing")
+	fs.createFilesystemSnapshot()
+	fs.restoreFilesystemSnapshot()
+	fs.createDirectorySnapshot("/root/a")
+	fs.checkFilesystemConsistency()
+
+	want := []string{
+		"a",
+		"b",
+		"Invalid directory",
+		"Filesystem snapshot created",
+		"Filesystem snapshot restored",
+		"Directory snapshot created for: /root/a",
+		"Filesystem consistency check passed",
+	}
+	if !reflect.DeepEqual(log.lines, want) {
+		t.Errorf("logged:\n got %q\nwant %q", log.lines, want)
+	}
+
+	fs.setLogger(nil)
+	fs.ls("/root")
+	if len(log.lines) != len(want) {
+		t.Errorf("logging continued after setLogger(nil): %q", log.lines[len(want):])
+	}
+}
@@ -1,16 +1,76 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
 	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Constants
 const (
-	BlockSize  = 4096
-	MaxBlocks  = 1024
-	MaxKeys    = 3   // For simplicity, B-tree order is 4 (MaxKeys + 1)
-	JournalMax = 100 // Maximum number of journal entries
+	BlockSize     = 4096
+	InitialBlocks = 1024 // Blocks a new filesystem starts with; it grows on demand
+	MaxFileBlocks = 256  // Blocks a single file may occupy
+	MaxKeys       = 3    // Keys per node at the default B-tree order of 4 (MaxKeys + 1)
+	JournalMax    = 100  // Default journal entries kept; see setJournalLimit
+
+	// DefaultBlockLimit is the most blocks the filesystem grows to unless
+	// changed with setBlockLimit.
+	DefaultBlockLimit = 64 * InitialBlocks
+
+	DefaultDirMode  = 0755
+	DefaultFileMode = 0644
+
+	// MinBTreeOrder is the smallest B-tree order NewFileSystemWithOrder
+	// accepts.
+	MinBTreeOrder = 3
+
+	// DefaultMaxNameLength is the longest name allowed unless changed with
+	// setMaxNameLength.
+	DefaultMaxNameLength = 255
+
+	// MaxSymlinkHops bounds how many symbolic links one lookup may follow.
+	MaxSymlinkHops = 40
+)
+
+var (
+	ErrNotFound      = errors.New("no such file or directory")
+	ErrNotDirectory  = errors.New("not a directory")
+	ErrExists        = errors.New("file exists")
+	ErrInvalidMove   = errors.New("cannot move a directory into itself")
+	ErrIsDirectory   = errors.New("is a directory")
+	ErrFileTooLarge  = errors.New("file too large")
+	ErrNoSpace       = errors.New("no space left on device")
+	ErrNotEmpty      = errors.New("directory not empty")
+	ErrBusy          = errors.New("resource busy")
+	ErrBlockFree     = errors.New("block is already free")
+	ErrReadOnly      = errors.New("read-only filesystem")
+	ErrTooManyLinks  = errors.New("too many levels of symbolic links")
+	ErrNotSymlink    = errors.New("not a symbolic link")
+	ErrInvalid       = errors.New("invalid argument")
+	ErrNoSnapshot    = errors.New("no filesystem snapshots available")
+	ErrTxnDone       = errors.New("transaction already committed or rolled back")
+	ErrChecksum      = errors.New("block checksum mismatch")
+	ErrInvalidName   = errors.New("invalid file name")
+	ErrAuthFailed    = errors.New("authentication failed")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrNoAttr        = errors.New("no such attribute")
+	ErrNotLocked     = errors.New("lock not held")
+	ErrPermission    = errors.New("permission denied")
+	ErrJournalFull   = errors.New("journal full")
+	ErrBadEntry      = errors.New("malformed journal entry")
+	ErrVerify        = errors.New("write did not read back as written")
+	ErrNotMounted    = errors.New("filesystem not mounted")
+	ErrNoInodes      = errors.New("no free inodes")
 )
 
 // Inode structure
@@ -21,6 +81,43 @@ type Inode struct {
 	Size         int
 	BlockPointer int
 	Parent       *Inode
+	Mode         uint32
+	UID          int
+	GID          int
+	Packed       *PackedExtent
+	CreatedAt    time.Time
+	ModifiedAt   time.Time
+	AccessedAt   time.Time
+	IsSymlink    bool
+	Target       string
+	// LinkCount is the number of directory entries referring to the inode.
+	// Parent and Name describe one of them.
+	LinkCount int
+	// Xattrs holds extended attributes; nil until one is set.
+	Xattrs map[string]string
+	// ACL grants named users and groups access beyond the mode bits; see
+	// acl.go.
+	ACL []ACLEntry
+	// Overflow lists, in order, the blocks holding a file's data beyond the
+	// first BlockSize bytes, which live in BlockPointer.
+	Overflow []int
+	// Compressed marks a file whose blocks hold its contents compressed
+	// with flate. Size is still the uncompressed length.
+	Compressed bool
+	// Encrypted marks a file whose blocks hold its contents, after any
+	// compression, sealed with AES-GCM.
+	Encrypted bool
+	// Quota caps the bytes a directory's subtree may hold, 0 meaning no
+	// limit; QuotaUsed is the running total. See setQuota.
+	Quota     int
+	QuotaUsed int
+	// TrashedFrom is the path a file in the trash was removed from, and
+	// TrashedAt when; both are empty outside the trash. See trash.go.
+	TrashedFrom string
+	TrashedAt   time.Time
+	// snapshotGen is the snapshot generation in which the inode was last
+	// preserved; see preserveInode.
+	snapshotGen uint64
 }
 
 // Directory entry structure
@@ -40,6 +137,11 @@ type BTreeNode struct {
 // BTree structure
 type BTree struct {
 	Root *BTreeNode
+	// Order is the most children a node may have; nodes hold at most
+	// Order-1 keys.
+	Order int
+	// Collation decides how names are compared.
+	Collation Collation
 }
 
 // Superblock structure
@@ -48,174 +150,751 @@ type Superblock struct {
 	TotalBlocks int
 	FreeBlocks  []int
 	InodeMap    []*Inode
+	// FreeInodes holds the numbers of empty InodeMap slots, reused last
+	// freed first.
+	FreeInodes []int
+	// ReservedBlocks free blocks can only be allocated by root. They are
+	// ReservedPercent percent of TotalBlocks, rescaled as it changes.
+	ReservedBlocks  int
+	ReservedPercent int
+	// BlockRefs counts the owners of each data block shared by more than
+	// one file, as cp leaves them. Blocks with a single owner are absent.
+	BlockRefs map[int]int
+	// BlockBitmap marks the blocks not on the free list, and InodeBitmap
+	// the InodeMap slots in use, so either can be tested in constant time.
+	// Both are rebuilt rather than saved.
+	BlockBitmap bitmap
+	InodeBitmap bitmap
+}
+
+// Cred identifies the user performing operations. UID 0 is root.
+type Cred struct {
+	UID int
+	GID int
 }
 
 // Journal entry structure
 type JournalEntry struct {
+	// Seq numbers entries in the order they were recorded, starting at 1.
+	Seq       uint64
 	Operation string
 	Path      string
 	Data      interface{}
 }
 
 // FileSystem structure
+//
+// Locking: mu guards all filesystem state. Operation entry points (mkdir,
+// touch, ls, readFile, writeFile, stat, mv, the snapshot functions, ...)
+// acquire it themselves, taking the write lock when they mutate and the read
+// lock otherwise. Internal helpers such as resolvePath, createInode,
+// allocateBlock and the *Internal functions expect the caller to hold it and
+// must never call an entry point, since the lock is not reentrant.
 type FileSystem struct {
-	Superblock Superblock
-	DataBlocks [MaxBlocks][]byte
-	Journal    []JournalEntry
+	Superblock   Superblock
+	Journal      []JournalEntry
+	BlockPacking bool
+	Dedup        bool
+	Compression  bool
+	Trash        bool
+	VerifyWrites bool
+
+	// aead encrypts file contents when set; see crypt.go.
+	aead cipher.AEAD
+
+	// dedupIndex maps a block checksum to a file block with those contents
+	// for deduplication; see dedup.go.
+	dedupIndex map[uint32]int
+
+	// blocks holds every block's contents and CRC32, kept by writeBlock
+	// and grown by growBlocks; see blocktable.go.
+	blocks blockTable
+	// blockLimit caps how far growBlocks may grow the block table.
+	blockLimit int
+	// inodeLimit caps how many inode slots the InodeMap may hold; 0 means
+	// no limit. See setInodeLimit.
+	inodeLimit int
+
+	// btreeOrder is the order of newly created directory B-trees.
+	btreeOrder int
+	// collation is how names compare in newly created directories.
+	collation Collation
+
+	// journalSeq is the Seq of the last journal entry recorded.
+	journalSeq uint64
+	// journalMax is how many entries the journal holds before
+	// journalPolicy applies.
+	journalMax    int
+	journalPolicy JournalPolicy
+	// lastCheckpoint is the state as of journal entry JournalSeq; the
+	// journal holds only the entries after it.
+	lastCheckpoint *fsImage
+	// txnEntries, while a transaction commits, collects the entries its
+	// operations record so they are journaled together; see txn.go.
+	txnEntries *[]JournalEntry
+
+	filesystemSnapshots []Snapshot
+	directorySnapshots  map[string]DirectorySnapshot
+	snapshotSeq         int
+	// snapshotGen counts the filesystem snapshots taken; see preserveInode.
+	snapshotGen uint64
+
+	// cred is the user on whose behalf operations run.
+	cred Cred
+	// cwd is the canonical path relative paths are resolved against.
+	cwd string
+	// maxNameLen is the longest name, in bytes, a new entry may have.
+	maxNameLen int
+	// readOnly rejects every mutating operation with ErrReadOnly.
+	readOnly bool
+	// mountPath is the file a filesystem from Mount is flushed to, and
+	// unmounted is set once Unmount has done so; see mount.go.
+	mountPath string
+	unmounted bool
+	// dirtyBlocks marks the blocks written since the last Sync, and
+	// syncID and syncSeq identify the filesystem and its last Sync in the
+	// records Sync appends. syncBase is set once the image at mountPath
+	// carries syncID; see sync.go.
+	dirtyBlocks bitmap
+	syncID      uint64
+	syncSeq     uint64
+	syncBase    bool
+
+	mu sync.RWMutex
+	// cache holds parsed directory B-trees keyed by block. Modified trees are
+	// written back to their blocks by the time the write lock is released;
+	// see unlockWrite.
+	cache *treeCache
+	// atimeMu serializes AccessedAt updates made under the read lock, and
+	// the snapshot inodes they preserve.
+	atimeMu sync.Mutex
+	// blockFreed is closed and replaced whenever a block is freed, waking
+	// any allocateBlockWait callers.
+	blockFreed   chan struct{}
+	allocBackoff AllocBackoff
+	// files is the descriptor table of open File handles, keyed by
+	// descriptor; filesMu guards it and nextFD.
+	files   map[int]*File
+	nextFD  int
+	filesMu sync.Mutex
+	// logger receives operational messages; see logger.go.
+	logger Logger
+	// stats holds the counters reported by Stats.
+	stats FSStats
+	// subscribers are notified of pendingEvents once the write lock is
+	// released; see events.go.
+	subscribers   []func(Event)
+	pendingEvents []Event
+	// watchers are the subtree watches set up with watch; see watch.go.
+	watchers []*watcher
+	// locks holds the advisory locks taken with lock, keyed by inode;
+	// locksMu guards it and locksFreed wakes waiters. See flock.go.
+	locks      map[int]*advisoryLock
+	locksMu    sync.Mutex
+	locksFreed *sync.Cond
 }
 
 type Snapshot struct {
-	Inodes     []*Inode
-	DataBlocks [MaxBlocks][]byte
+	Name string
+	// Inodes holds the inode map as the snapshot was taken. Entries are the
+	// live inodes until preserveInode replaces them with copies, so read
+	// them through snapshotInodes.
+	Inodes      []*Inode
+	Data        blockTable
+	FreeBlocks  []int
+	TotalInodes int
 }
 
 type DirectorySnapshot struct {
-	RootInode  *Inode
-	Inodes     []*Inode
-	DataBlocks [MaxBlocks][]byte
+	RootInode *Inode
+	Inodes    []*Inode
+	Data      blockTable
+	// Blocks lists, in order, the blocks the subtree's inodes used; only
+	// these are restored.
+	Blocks []int
+}
+
+// NewFileSystem creates an empty filesystem containing only the root directory
+func NewFileSystem() *FileSystem {
+	return newFileSystem(MaxKeys + 1)
 }
 
-var fs FileSystem
+// NewFileSystemWithOrder is like NewFileSystem but gives directory B-trees
+// the specified order. A higher order means fewer, wider nodes.
+func NewFileSystemWithOrder(order int) (*FileSystem, error) {
+	if order < MinBTreeOrder {
+		return nil, fmt.Errorf("B-tree order %d below minimum %d: %w", order, MinBTreeOrder, ErrInvalid)
+	}
+	return newFileSystem(order), nil
+}
 
-// Initialize the filesystem
-func initializeFS() {
-	fs = FileSystem{
+func newFileSystem(order int) *FileSystem {
+	fs := &FileSystem{
 		Superblock: Superblock{
 			TotalInodes: 0,
-			TotalBlocks: MaxBlocks,
-			FreeBlocks:  make([]int, MaxBlocks),
+			TotalBlocks: InitialBlocks,
+			FreeBlocks:  make([]int, InitialBlocks),
 			InodeMap:    make([]*Inode, 0),
 		},
-		Journal: make([]JournalEntry, 0, JournalMax),
+		blocks:             newBlockTable(InitialBlocks),
+		blockLimit:         DefaultBlockLimit,
+		Journal:            make([]JournalEntry, 0, JournalMax),
+		journalMax:         JournalMax,
+		directorySnapshots: make(map[string]DirectorySnapshot),
+		blockFreed:         make(chan struct{}),
+		allocBackoff:       defaultAllocBackoff,
+		cwd:                "/root",
+		btreeOrder:         order,
+		maxNameLen:         DefaultMaxNameLength,
+		files:              make(map[int]*File),
+		logger:             nopLogger{},
+		locks:              make(map[int]*advisoryLock),
 	}
+	fs.locksFreed = sync.NewCond(&fs.locksMu)
+	fs.cache = newTreeCache(defaultCacheConfig, func(block int, tree *BTree) {
+		fs.writeBlock(block, serializeBTree(tree))
+	})
 
-	for i := 0; i < MaxBlocks; i++ {
+	for i := 0; i < InitialBlocks; i++ {
 		fs.Superblock.FreeBlocks[i] = i
 	}
+	fs.recountBitmaps()
+	fs.rehashBlocks()
 
-	root := createInode("root", true, nil)
-	fs.Superblock.InodeMap = append(fs.Superblock.InodeMap, root)
+	fs.createInode("root", true, nil)
+	fs.lastCheckpoint = fs.checkpointImage()
+	return fs
 }
 
-// Create an inode
-func createInode(name string, isDir bool, parent *Inode) *Inode {
+// now is the clock used for inode timestamps.
+var now = time.Now
+
+// Create an inode and enter it in the InodeMap, reusing a free slot if there
+// is one. It fails with ErrNoSpace, changing nothing, if no block is left
+// for the inode's data.
+func (fs *FileSystem) createInode(name string, isDir bool, parent *Inode) (*Inode, error) {
+	if len(fs.Superblock.FreeInodes) == 0 && fs.inodeLimit > 0 && len(fs.Superblock.InodeMap) >= fs.inodeLimit {
+		return nil, ErrNoInodes
+	}
+	block := fs.allocateBlock()
+	if block < 0 {
+		return nil, ErrNoSpace
+	}
+
+	number := len(fs.Superblock.InodeMap)
+	if free := fs.Superblock.FreeInodes; len(free) > 0 {
+		number = free[len(free)-1]
+		fs.Superblock.FreeInodes = free[:len(free)-1]
+	} else {
+		fs.Superblock.InodeMap = append(fs.Superblock.InodeMap, nil)
+	}
+
+	t := now()
 	inode := &Inode{
-		InodeNumber:  len(fs.Superblock.InodeMap),
+		InodeNumber:  number,
 		Name:         name,
 		IsDirectory:  isDir,
 		Size:         0,
-		BlockPointer: allocateBlock(),
+		BlockPointer: block,
 		Parent:       parent,
+		Mode:         DefaultFileMode,
+		UID:          fs.cred.UID,
+		GID:          fs.cred.GID,
+		LinkCount:    1,
+		CreatedAt:    t,
+		ModifiedAt:   t,
+		AccessedAt:   t,
 	}
 
 	if isDir {
-		initializeDir(inode)
+		inode.Mode = DefaultDirMode
+		fs.initializeDir(inode)
 	}
 
+	fs.Superblock.InodeMap[number] = inode
+	fs.Superblock.InodeBitmap.set(number)
 	fs.Superblock.TotalInodes++
-	return inode
+	if isDir {
+		fs.stats.Directories++
+	} else {
+		fs.stats.Files++
+	}
+	return inode, nil
+}
+
+// freeInodeSlots lists the empty slots of inodes in the order createInode
+// should reuse them, lowest number first.
+func freeInodeSlots(inodes []*Inode) []int {
+	var free []int
+	for i := len(inodes) - 1; i >= 0; i-- {
+		if inodes[i] == nil {
+			free = append(free, i)
+		}
+	}
+	return free
+}
+
+// AllocBackoff controls how allocateBlockWait retries while no block is free.
+type AllocBackoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+var defaultAllocBackoff = AllocBackoff{Initial: time.Millisecond, Max: 100 * time.Millisecond}
+
+// lockWrite takes the write lock for a mutating operation. It fails without
+// holding the lock if the filesystem is read-only.
+func (fs *FileSystem) lockWrite() error {
+	if err := fs.lockWriteAnyJournal(); err != nil {
+		return err
+	}
+	if fs.journalPolicy == JournalReject && len(fs.Journal) >= fs.journalMax {
+		fs.mu.Unlock()
+		return ErrJournalFull
+	}
+	return nil
+}
+
+// lockWriteAnyJournal is lockWrite for the operations that empty or
+// reconfigure the journal, which must work even when it is full.
+func (fs *FileSystem) lockWriteAnyJournal() error {
+	fs.mu.Lock()
+	if fs.unmounted {
+		fs.mu.Unlock()
+		return ErrNotMounted
+	}
+	if fs.readOnly {
+		fs.mu.Unlock()
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// lockRead takes the read lock for an operation that only looks at the
+// filesystem, failing with ErrNotMounted once it has been unmounted. On
+// success the caller must release fs.mu with RUnlock.
+func (fs *FileSystem) lockRead() error {
+	fs.mu.RLock()
+	if fs.unmounted {
+		fs.mu.RUnlock()
+		return ErrNotMounted
+	}
+	return nil
 }
 
-// Allocate a block
-func allocateBlock() int {
-	if len(fs.Superblock.FreeBlocks) == 0 {
-		return -1
+// Allocate a block. Non-root callers can't dip into the reserved blocks.
+// The caller must hold the write lock.
+func (fs *FileSystem) allocateBlock() int {
+	for len(fs.Superblock.FreeBlocks) == 0 ||
+		fs.cred.UID != 0 && len(fs.Superblock.FreeBlocks) <= fs.Superblock.ReservedBlocks {
+		if !fs.growBlocks() {
+			return -1
+		}
 	}
 	block := fs.Superblock.FreeBlocks[0]
 	fs.Superblock.FreeBlocks = fs.Superblock.FreeBlocks[1:]
+	fs.Superblock.BlockBitmap.set(block)
+	fs.stats.BlocksAllocated++
 	return block
 }
 
-// Initialize a directory inode
-func initializeDir(inode *Inode) {
-	btree := newBTree()
-	inode.BlockPointer = allocateBlock()
-	fs.DataBlocks[inode.BlockPointer] = serializeBTree(btree)
+// growBlocks doubles the number of blocks, up to blockLimit, adding the new
+// ones to the free list. It reports false if the limit has been reached.
+func (fs *FileSystem) growBlocks() bool {
+	total := fs.Superblock.TotalBlocks
+	grown := 2 * total
+	if grown > fs.blockLimit {
+		grown = fs.blockLimit
+	}
+	if grown <= total {
+		return false
+	}
+	fs.blocks.grow(grown)
+	for block := total; block < grown; block++ {
+		fs.Superblock.FreeBlocks = append(fs.Superblock.FreeBlocks, block)
+	}
+	fs.setTotalBlocks(grown)
+	return true
+}
+
+// setTotalBlocks records that the filesystem has n blocks and rescales the
+// reserve to match.
+func (fs *FileSystem) setTotalBlocks(n int) {
+	fs.Superblock.TotalBlocks = n
+	fs.Superblock.ReservedBlocks = n * fs.Superblock.ReservedPercent / 100
+}
+
+// setBlockLimit sets how many blocks the filesystem may grow to. It cannot
+// be lowered below the blocks it already has.
+func (fs *FileSystem) setBlockLimit(limit int) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	if limit < fs.Superblock.TotalBlocks {
+		return fmt.Errorf("block limit %d is below the current %d blocks: %w", limit, fs.Superblock.TotalBlocks, ErrInvalid)
+	}
+	fs.blockLimit = limit
+	fs.checkpointInternal()
+	return nil
+}
+
+// allocateBlockWait allocates a block, waiting with exponential backoff for
+// one to be freed if none is available. It gives up when ctx is done.
+func (fs *FileSystem) allocateBlockWait(ctx context.Context) (int, error) {
+	fs.mu.RLock()
+	delay := fs.allocBackoff.Initial
+	fs.mu.RUnlock()
+
+	for {
+		if err := fs.lockWrite(); err != nil {
+			return -1, err
+		}
+		freed := fs.blockFreed
+		block := fs.allocateBlock()
+		maxDelay := fs.allocBackoff.Max
+		fs.mu.Unlock()
+		if block >= 0 {
+			return block, nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return -1, ctx.Err()
+		case <-freed:
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// setAllocBackoff configures the retry delays used by allocateBlockWait.
+func (fs *FileSystem) setAllocBackoff(b AllocBackoff) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.allocBackoff = b
+}
+
+// setReservedPercent reserves pct percent of all blocks for root, including
+// those the filesystem grows to later.
+func (fs *FileSystem) setReservedPercent(pct int) error {
+	if pct < 0 || pct > 100 {
+		return fmt.Errorf("reserved percentage out of range: %d", pct)
+	}
+
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	fs.Superblock.ReservedPercent = pct
+	fs.setTotalBlocks(fs.Superblock.TotalBlocks)
+	fs.checkpointInternal()
+	return nil
+}
+
+// setCred sets the user that subsequent operations run as. New inodes are
+// owned by it and access is checked against it; see perm.go.
+func (fs *FileSystem) setCred(c Cred) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.cred = c
+}
+
+// Return a block to the free pool. Freeing a block that is already free is
+// rejected so the pool never holds duplicates. The caller must hold the
+// write lock, since freeing replaces blockFreed.
+func (fs *FileSystem) freeBlock(block int) error {
+	if block < 0 || block >= fs.Superblock.TotalBlocks {
+		return fmt.Errorf("invalid block: %d", block)
+	}
+	if !fs.Superblock.BlockBitmap.has(block) {
+		return ErrBlockFree
+	}
+	if fs.Superblock.BlockRefs[block] > 0 {
+		// Other files still use it
+		fs.dropBlockRef(block)
+		return nil
+	}
+
+	fs.dedupForget(block)
+	fs.writeBlock(block, nil)
+	fs.cache.drop(block)
+	fs.Superblock.FreeBlocks = append(fs.Superblock.FreeBlocks, block)
+	fs.Superblock.BlockBitmap.clear(block)
+	fs.stats.BlocksFreed++
+	close(fs.blockFreed)
+	fs.blockFreed = make(chan struct{})
+	return nil
+}
+
+// df reports block usage.
+func (fs *FileSystem) df() (used, free, total int) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	total = fs.Superblock.TotalBlocks
+	free = len(fs.Superblock.FreeBlocks)
+	return total - free, free, total
+}
+
+// dfInodes reports inode usage. Without an inode limit the total is the
+// slots the InodeMap has so far, so it grows as inodes are created.
+func (fs *FileSystem) dfInodes() (used, free, total int) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	slots := len(fs.Superblock.InodeMap)
+	total = max(fs.inodeLimit, slots)
+	free = len(fs.Superblock.FreeInodes) + total - slots
+	return fs.Superblock.TotalInodes, free, total
+}
+
+// setInodeLimit sets how many inodes the filesystem may hold, counting the
+// root; creating one more fails with ErrNoInodes. It cannot be lowered
+// below the inode slots already in use or freed, and 0 removes the limit.
+func (fs *FileSystem) setInodeLimit(limit int) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	if limit != 0 && limit < len(fs.Superblock.InodeMap) {
+		return fmt.Errorf("inode limit %d is below the current %d inode slots: %w", limit, len(fs.Superblock.InodeMap), ErrInvalid)
+	}
+	fs.inodeLimit = limit
+	fs.checkpointInternal()
+	return nil
+}
+
+// Initialize a directory inode with an empty B-tree in its block
+func (fs *FileSystem) initializeDir(inode *Inode) {
+	tree := newBTree(fs.btreeOrder)
+	tree.Collation = fs.collation
+	fs.storeDirTree(inode, tree)
 }
 
-func newBTree() *BTree {
+func newBTree(order int) *BTree {
 	return &BTree{
 		Root: &BTreeNode{
 			IsLeaf:   true,
-			Keys:     make([]DirEntry, 0, MaxKeys),
+			Keys:     make([]DirEntry, 0, order-1),
 			Children: make([]*BTreeNode, 0),
 		},
+		Order: order,
 	}
 }
 
-// insert adds a directory entry to the tree
+// maxKeys is the most keys a node of the tree may hold.
+func (t *BTree) maxKeys() int {
+	return t.Order - 1
+}
+
+// minKeys is the fewest keys a node other than the root may hold.
+func (t *BTree) minKeys() int {
+	return (t.Order+1)/2 - 1
+}
+
+// insert adds a directory entry to the tree. A node that overflows on the
+// way back up is split, so both halves keep at least minKeys keys.
 func (t *BTree) insert(entry DirEntry) {
-	root := t.Root
-	if len(root.Keys) == MaxKeys {
+	t.insertInto(t.Root, entry)
+	if len(t.Root.Keys) > t.maxKeys() {
 		newRoot := &BTreeNode{
 			IsLeaf:   false,
-			Children: []*BTreeNode{root},
+			Children: []*BTreeNode{t.Root},
 		}
-		root.Parent = newRoot
+		t.Root.Parent = newRoot
 		t.splitChild(newRoot, 0)
 		t.Root = newRoot
 	}
-	t.insertNonFull(t.Root, entry)
 }
 
-func (t *BTree) insertNonFull(node *BTreeNode, entry DirEntry) {
+// insertInto adds entry below node, which may be left holding one key more
+// than maxKeys for the caller to split.
+func (t *BTree) insertInto(node *BTreeNode, entry DirEntry) {
 	i := len(node.Keys) - 1
+	key := t.Collation.key(entry.Name)
 
 	if node.IsLeaf {
 		node.Keys = append(node.Keys, DirEntry{}) // Make space for the new entry
-		for i >= 0 && entry.Name < node.Keys[i].Name {
+		for i >= 0 && key < t.Collation.key(node.Keys[i].Name) {
 			node.Keys[i+1] = node.Keys[i]
 			i--
 		}
 		node.Keys[i+1] = entry
 	} else {
-		for i >= 0 && entry.Name < node.Keys[i].Name {
+		for i >= 0 && key < t.Collation.key(node.Keys[i].Name) {
 			i--
 		}
 		i++
-		if len(node.Children[i].Keys) == MaxKeys {
+		t.insertInto(node.Children[i], entry)
+		if len(node.Children[i].Keys) > t.maxKeys() {
 			t.splitChild(node, i)
-			if entry.Name > node.Keys[i].Name {
-				i++
-			}
 		}
-		t.insertNonFull(node.Children[i], entry)
 	}
 }
 
+// splitChild splits parent's overflowing child at index around its middle
+// key, which moves up into parent at index. The child keeps the keys before
+// the middle one, and a new node at index+1 takes those after it along with
+// the children between them. An overflowing node holds Order keys, so
+// either half gets at least minKeys of them.
 func (t *BTree) splitChild(parent *BTreeNode, index int) {
-	fullChild := parent.Children[index]
-	newChild := &BTreeNode{
-		IsLeaf:   fullChild.IsLeaf,
-		Keys:     make([]DirEntry, MaxKeys/2),
+	left := parent.Children[index]
+	mid := len(left.Keys) / 2
+	median := left.Keys[mid]
+
+	// Copy rather than reslice so later appends to left can't overwrite
+	// the moved entries.
+	right := &BTreeNode{
+		IsLeaf:   left.IsLeaf,
+		Keys:     append(make([]DirEntry, 0, t.maxKeys()), left.Keys[mid+1:]...),
 		Children: make([]*BTreeNode, 0),
 		Parent:   parent,
 	}
+	left.Keys = left.Keys[:mid]
+	if !left.IsLeaf {
+		right.Children = append(right.Children, left.Children[mid+1:]...)
+		left.Children = left.Children[:mid+1]
+		for _, child := range right.Children {
+			child.Parent = right
+		}
+	}
+
+	parent.Keys = append(parent.Keys, DirEntry{})
+	copy(parent.Keys[index+1:], parent.Keys[index:])
+	parent.Keys[index] = median
+	parent.Children = append(parent.Children, nil)
+	copy(parent.Children[index+2:], parent.Children[index+1:])
+	parent.Children[index+1] = right
+}
+
+// bulkLoad replaces the tree's contents with entries, which must be sorted
+// under the tree's collation without duplicates. Rather than inserting them one by one it
+// builds the tree bottom-up: each level is cut into as few nodes as will
+// hold it, with the keys spread evenly so every node stays at least half
+// full, and the key between each pair of nodes moves up to the next level.
+func (t *BTree) bulkLoad(entries []DirEntry) {
+	maxKeys := t.maxKeys()
+	keys := entries
+	var children []*BTreeNode
+	for {
+		count := (len(keys) + maxKeys + 1) / (maxKeys + 1)
+		size, extra := (len(keys)-count+1)/count, (len(keys)-count+1)%count
+		nodes := make([]*BTreeNode, count)
+		var separators []DirEntry
+		pos, child := 0, 0
+		for i := range nodes {
+			n := size
+			if i < extra {
+				n++
+			}
+			node := &BTreeNode{
+				IsLeaf:   children == nil,
+				Keys:     append(make([]DirEntry, 0, maxKeys), keys[pos:pos+n]...),
+				Children: make([]*BTreeNode, 0),
+			}
+			pos += n
+			if children != nil {
+				node.Children = append(node.Children, children[child:child+n+1]...)
+				for _, c := range node.Children {
+					c.Parent = node
+				}
+				child += n + 1
+			}
+			if i < count-1 {
+				separators = append(separators, keys[pos])
+				pos++
+			}
+			nodes[i] = node
+		}
+		if count == 1 {
+			t.Root = nodes[0]
+			return
+		}
+		keys, children = separators, nodes
+	}
+}
 
-	midIndex := MaxKeys / 2
-	parent.Keys = append(parent.Keys[:index], append([]DirEntry{fullChild.Keys[midIndex]}, parent.Keys[index:]...)...)
-	parent.Children = append(parent.Children[:index+1], append([]*BTreeNode{newChild}, parent.Children[index+1:]...)...)
+// underfull reports whether a node other than the root holds fewer than
+// minKeys keys, as trees written before inserts split overflowing nodes
+// can at odd orders.
+func (t *BTree) underfull() bool {
+	var check func(node *BTreeNode) bool
+	check = func(node *BTreeNode) bool {
+		if node != t.Root && len(node.Keys) < t.minKeys() {
+			return true
+		}
+		for _, child := range node.Children {
+			if check(child) {
+				return true
+			}
+		}
+		return false
+	}
+	return check(t.Root)
+}
 
-	newChild.Keys = fullChild.Keys[midIndex+1:]
-	fullChild.Keys = fullChild.Keys[:midIndex]
+// rebalanceBTree rebuilds a directory's B-tree from its sorted entries if
+// any of its nodes is underfull, and reports whether it did. The entries,
+// order and collation are unchanged; only the shape of the tree is.
+func (fs *FileSystem) rebalanceBTree(dir *Inode) bool {
+	tree := fs.dirTree(dir)
+	if !tree.underfull() {
+		return false
+	}
+	rebuilt := newBTree(tree.Order)
+	rebuilt.Collation = tree.Collation
+	rebuilt.bulkLoad(tree.entries())
+	fs.storeDirTree(dir, rebuilt)
+	return true
+}
 
-	if !fullChild.IsLeaf {
-		newChild.Children = fullChild.Children[midIndex+1:]
-		fullChild.Children = fullChild.Children[:midIndex+1]
-		for _, child := range newChild.Children {
-			child.Parent = newChild
+// renumber changes the InodeIndex of every entry found in numbers to the
+// number it maps to.
+func (t *BTree) renumber(numbers map[int]int) {
+	var walk func(node *BTreeNode)
+	walk = func(node *BTreeNode) {
+		for i, entry := range node.Keys {
+			if number, ok := numbers[entry.InodeIndex]; ok {
+				node.Keys[i].InodeIndex = number
+			}
+		}
+		for _, child := range node.Children {
+			walk(child)
 		}
 	}
+	walk(t.Root)
 }
 
+// serializeBTree encodes a tree as an "order=N" line, with " collation=C"
+// added unless names compare as bytes, followed by its nodes.
 func serializeBTree(btree *BTree) []byte {
-	var data []byte
+	header := fmt.Sprintf("order=%d", btree.Order)
+	if btree.Collation != CollateBytes {
+		header += fmt.Sprintf(" collation=%d", btree.Collation)
+	}
+	data := []byte(header + "\n")
 	serializeNode(btree.Root, &data)
 	return data
 }
 
+// serializeNode writes one line per node in pre-order. Each line is prefixed
+// with the node's child count so the shape can be rebuilt on the way back.
 func serializeNode(node *BTreeNode, data *[]byte) {
 	// serialize the node keys
+	*data = append(*data, []byte(fmt.Sprintf("%d|", len(node.Children)))...)
 	for _, key := range node.Keys {
 		*data = append(*data, []byte(fmt.Sprintf("%s:%d;", key.Name, key.InodeIndex))...)
 	}
@@ -229,387 +908,3459 @@ func serializeNode(node *BTreeNode, data *[]byte) {
 	}
 }
 
+// deserializeBTree decodes a tree written by serializeBTree. Blocks written
+// before the order was recorded get the default order.
 func deserializeBTree(data []byte) *BTree {
-	btree := newBTree()
+	btree := newBTree(MaxKeys + 1)
 	nodeData := strings.Split(string(data), "\n")
-	btree.Root = deserializeNode(nodeData, 0, nil)
+	pos := 0
+	if strings.HasPrefix(nodeData[0], "order=") {
+		for _, field := range strings.Fields(nodeData[0]) {
+			name, value, _ := strings.Cut(field, "=")
+			switch name {
+			case "order":
+				if order := atoi(value); order >= MinBTreeOrder {
+					btree.Order = order
+				}
+			case "collation":
+				btree.Collation = Collation(atoi(value))
+			}
+		}
+		pos++
+	}
+	btree.Root = deserializeNode(nodeData, &pos, nil)
 	return btree
 }
 
-func deserializeNode(data []string, index int, parent *BTreeNode) *BTreeNode {
+func deserializeNode(data []string, pos *int, parent *BTreeNode) *BTreeNode {
 	node := &BTreeNode{
+		IsLeaf:   true,
 		Keys:     make([]DirEntry, 0),
 		Children: make([]*BTreeNode, 0),
 		Parent:   parent,
 	}
-	if index >= len(data) {
+	if *pos >= len(data) {
 		return node
 	}
+	line := data[*pos]
+	*pos++
+
+	numChildren := 0
+	if bar := strings.Index(line, "|"); bar >= 0 {
+		numChildren = atoi(line[:bar])
+		line = line[bar+1:]
+	}
 
 	// Deserialize keys
-	keyData := strings.Split(data[index], ";")
+	keyData := strings.Split(line, ";")
 	for _, key := range keyData {
 		if key == "" {
 			continue
 		}
-		parts := strings.Split(key, ":")
-		inodeIndex := atoi(parts[1])
-		node.Keys = append(node.Keys, DirEntry{Name: parts[0], InodeIndex: inodeIndex})
+		sep := strings.LastIndex(key, ":")
+		if sep < 0 {
+			continue
+		}
+		inodeIndex := atoi(key[sep+1:])
+		node.Keys = append(node.Keys, DirEntry{Name: key[:sep], InodeIndex: inodeIndex})
 	}
 
 	// Deserialize children
-	if len(data[index+1]) > 0 {
-		for i := index + 1; i < len(data); i++ {
-			if data[i] == "" {
-				continue
-			}
-			child := deserializeNode(data, i, node)
-			node.Children = append(node.Children, child)
-		}
+	for i := 0; i < numChildren; i++ {
+		node.Children = append(node.Children, deserializeNode(data, pos, node))
 	}
+	node.IsLeaf = len(node.Children) == 0
 
 	return node
 }
 
-func atoi(s string) int {
-	var n int
-	fmt.Sscanf(s, "%d", &n)
-	return n
+// entries returns every entry in the tree in sorted order.
+func (t *BTree) entries() []DirEntry {
+	var out []DirEntry
+	collectEntries(t.Root, &out)
+	return out
 }
 
-// Journal functions
-func addJournalEntry(operation, path string, data interface{}) {
-	entry := JournalEntry{
-		Operation: operation,
-		Path:      path,
-		Data:      data,
-	}
-	fs.Journal = append(fs.Journal, entry)
-	if len(fs.Journal) > JournalMax {
-		fs.Journal = fs.Journal[1:]
+func collectEntries(node *BTreeNode, out *[]DirEntry) {
+	if node == nil {
+		return
 	}
-}
-
-func replayJournal() {
-	for _, entry := range fs.Journal {
-		switch entry.Operation {
-		case "mkdir":
-			data := entry.Data.(map[string]interface{})
-			mkdirInternal(data["parentPath"].(string), data["dirName"].(string))
-		case "touch":
-			data := entry.Data.(map[string]interface{})
-			touchInternal(data["dirPath"].(string), data["fileName"].(string))
+	for i := 0; i < len(node.Keys); i++ {
+		if !node.IsLeaf {
+			collectEntries(node.Children[i], out)
 		}
+		*out = append(*out, node.Keys[i])
+	}
+	if !node.IsLeaf {
+		collectEntries(node.Children[len(node.Children)-1], out)
 	}
 }
 
-// Directory operations
-func mkdir(parentPath, dirName string) {
-	addJournalEntry("mkdir", parentPath+"/"+dirName, map[string]interface{}{
-		"parentPath": parentPath,
-		"dirName":    dirName,
-	})
-	mkdirInternal(parentPath, dirName)
+// entriesInRange returns, in sorted order, the entries whose names are at
+// least lo and, unless hi is empty, below hi, comparing under the tree's
+// collation. Subtrees that lie wholly outside the range are not visited.
+func (t *BTree) entriesInRange(lo, hi string) []DirEntry {
+	var out []DirEntry
+	t.collectRange(t.Root, t.Collation.key(lo), t.Collation.key(hi), &out)
+	return out
 }
 
-func mkdirInternal(parentPath, dirName string) {
-	parentInode := resolvePath(parentPath)
-	if parentInode == nil || !parentInode.IsDirectory {
-		fmt.Println("Invalid parent directory")
+func (t *BTree) collectRange(node *BTreeNode, lo, hi string, out *[]DirEntry) {
+	if node == nil {
 		return
 	}
+	for i, entry := range node.Keys {
+		key := t.Collation.key(entry.Name)
+		// Children[i] holds the names between Keys[i-1] and key.
+		if !node.IsLeaf && key > lo {
+			t.collectRange(node.Children[i], lo, hi, out)
+		}
+		if hi != "" && key >= hi {
+			return
+		}
+		if key >= lo {
+			*out = append(*out, entry)
+		}
+	}
+	if !node.IsLeaf {
+		t.collectRange(node.Children[len(node.Children)-1], lo, hi, out)
+	}
+}
 
-	newDirInode := createInode(dirName, true, parentInode)
-	fs.Superblock.InodeMap = append(fs.Superblock.InodeMap, newDirInode)
-
-	entry := DirEntry{Name: dirName, InodeIndex: newDirInode.InodeNumber}
-	addEntryToDir(parentInode, entry)
+// remove deletes the entry with the given name and reports whether it was
+// present. An entry in an inner node is replaced by its predecessor from
+// the leaves, and any node left below minKeys on the way back up borrows
+// from a sibling or is merged with one, shrinking the tree when the root
+// runs out of keys.
+func (t *BTree) remove(name string) bool {
+	if !t.removeFrom(t.Root, name) {
+		return false
+	}
+	for !t.Root.IsLeaf && len(t.Root.Keys) == 0 {
+		t.Root = t.Root.Children[0]
+		t.Root.Parent = nil
+	}
+	return true
 }
 
-func touch(dirPath, fileName string) {
-	addJournalEntry("touch", dirPath+"/"+fileName, map[string]interface{}{
-		"dirPath":  dirPath,
-		"fileName": fileName,
+func (t *BTree) removeFrom(node *BTreeNode, name string) bool {
+	key := t.Collation.key(name)
+	i := sort.Search(len(node.Keys), func(i int) bool {
+		return t.Collation.key(node.Keys[i].Name) >= key
 	})
-	touchInternal(dirPath, fileName)
+	if i < len(node.Keys) && t.Collation.key(node.Keys[i].Name) == key {
+		if node.IsLeaf {
+			node.Keys = append(node.Keys[:i], node.Keys[i+1:]...)
+			return true
+		}
+		if last, ok := t.removeMax(node.Children[i]); ok {
+			node.Keys[i] = last
+			t.fixChild(node, i)
+		} else {
+			// Nothing precedes the entry, so it goes with its empty child.
+			node.Keys = append(node.Keys[:i], node.Keys[i+1:]...)
+			node.Children = append(node.Children[:i], node.Children[i+1:]...)
+		}
+		return true
+	}
+	if node.IsLeaf || !t.removeFrom(node.Children[i], name) {
+		return false
+	}
+	t.fixChild(node, i)
+	return true
+}
+
+// removeMax deletes and returns the last entry of node's subtree, and
+// reports false if the subtree holds none. Trees written before inserts
+// split overflowing nodes can have empty nodes at odd orders; an empty last
+// child is dropped and the key before it taken instead.
+func (t *BTree) removeMax(node *BTreeNode) (DirEntry, bool) {
+	if node.IsLeaf {
+		if len(node.Keys) == 0 {
+			return DirEntry{}, false
+		}
+		last := node.Keys[len(node.Keys)-1]
+		node.Keys = node.Keys[:len(node.Keys)-1]
+		return last, true
+	}
+	last := len(node.Children) - 1
+	if entry, ok := t.removeMax(node.Children[last]); ok {
+		t.fixChild(node, last)
+		return entry, true
+	}
+	if last == 0 {
+		return DirEntry{}, false
+	}
+	entry := node.Keys[last-1]
+	node.Keys = node.Keys[:last-1]
+	node.Children = node.Children[:last]
+	return entry, true
 }
 
-func touchInternal(dirPath, fileName string) {
-	dirInode := resolvePath(dirPath)
-	if dirInode == nil || !dirInode.IsDirectory {
-		fmt.Println("Invalid directory")
+// fixChild brings parent.Children[index] back up to minKeys after a removal
+// left it one short, taking a key through parent from a sibling that can
+// spare one, or else merging it with a sibling. A sibling that is short
+// itself, even empty, is merged with, never borrowed from. A parent with no
+// keys, as older trees hold at order 3, has no siblings to offer, and is
+// left for its own parent to fix.
+func (t *BTree) fixChild(parent *BTreeNode, index int) {
+	child := parent.Children[index]
+	if len(child.Keys) >= t.minKeys() || len(parent.Children) == 1 {
 		return
 	}
+	switch {
+	case index > 0 && len(parent.Children[index-1].Keys) > t.minKeys():
+		left := parent.Children[index-1]
+		child.Keys = append(child.Keys, DirEntry{})
+		copy(child.Keys[1:], child.Keys)
+		child.Keys[0] = parent.Keys[index-1]
+		parent.Keys[index-1] = left.Keys[len(left.Keys)-1]
+		left.Keys = left.Keys[:len(left.Keys)-1]
+		if !child.IsLeaf {
+			moved := left.Children[len(left.Children)-1]
+			left.Children = left.Children[:len(left.Children)-1]
+			child.Children = append(child.Children, nil)
+			copy(child.Children[1:], child.Children)
+			child.Children[0] = moved
+			moved.Parent = child
+		}
+	case index < len(parent.Children)-1 && len(parent.Children[index+1].Keys) > t.minKeys():
+		right := parent.Children[index+1]
+		child.Keys = append(child.Keys, parent.Keys[index])
+		parent.Keys[index] = right.Keys[0]
+		right.Keys = append(right.Keys[:0], right.Keys[1:]...)
+		if !child.IsLeaf {
+			moved := right.Children[0]
+			right.Children = append(right.Children[:0], right.Children[1:]...)
+			child.Children = append(child.Children, moved)
+			moved.Parent = child
+		}
+	case index > 0:
+		t.mergeChildren(parent, index-1)
+	default:
+		t.mergeChildren(parent, index)
+	}
+}
 
-	fileInode := createInode(fileName, false, dirInode)
-	fs.Superblock.InodeMap = append(fs.Superblock.InodeMap, fileInode)
+// mergeChildren folds parent.Children[index+1] and the key between them
+// into parent.Children[index]. It is only called when one of the two is a
+// key short of minKeys and the other has no more than minKeys, so the
+// result holds at most 2*minKeys keys, never more than maxKeys.
+func (t *BTree) mergeChildren(parent *BTreeNode, index int) {
+	left, right := parent.Children[index], parent.Children[index+1]
+	left.Keys = append(left.Keys, parent.Keys[index])
+	left.Keys = append(left.Keys, right.Keys...)
+	for _, c := range right.Children {
+		c.Parent = left
+	}
+	left.Children = append(left.Children, right.Children...)
+	parent.Keys = append(parent.Keys[:index], parent.Keys[index+1:]...)
+	parent.Children = append(parent.Children[:index+1], parent.Children[index+2:]...)
+}
 
-	entry := DirEntry{Name: fileName, InodeIndex: fileInode.InodeNumber}
-	addEntryToDir(dirInode, entry)
+// search finds the entry whose name matches name under the tree's
+// collation, descending into children.
+func (t *BTree) search(name string) (DirEntry, bool) {
+	key := t.Collation.key(name)
+	node := t.Root
+	for node != nil {
+		i := 0
+		for i < len(node.Keys) && key > t.Collation.key(node.Keys[i].Name) {
+			i++
+		}
+		if i < len(node.Keys) && t.Collation.key(node.Keys[i].Name) == key {
+			return node.Keys[i], true
+		}
+		if node.IsLeaf {
+			break
+		}
+		node = node.Children[i]
+	}
+	return DirEntry{}, false
 }
 
-func addEntryToDir(inode *Inode, entry DirEntry) {
-	btree := deserializeBTree(fs.DataBlocks[inode.BlockPointer])
-	btree.insert(entry)
-	fs.DataBlocks[inode.BlockPointer] = serializeBTree(btree)
+func atoi(s string) int {
+	var n int
+	fmt.Sscanf(s, "%d", &n)
+	return n
 }
 
-// Directory listing
-func ls(path string) {
-	inode := resolvePath(path)
-	if inode == nil || !inode.IsDirectory {
-		fmt.Println("Invalid directory")
-		return
+// Journal functions
+//
+// Every operation that changes the filesystem's contents is recorded once
+// it has succeeded, so a failed operation leaves nothing for replay to
+// repeat. What happens once the journal is full depends on its
+// JournalPolicy.
+
+// JournalPolicy decides what happens when the journal reaches its limit.
+type JournalPolicy int
+
+const (
+	// JournalCheckpoint, the default, takes a checkpoint of the current
+	// state and empties the journal, so replaying the checkpoint and then
+	// the journal always reproduces the latest state.
+	JournalCheckpoint JournalPolicy = iota
+	// JournalDropOldest discards the oldest entry to make room. Replay then
+	// skips the dropped operations and no longer reproduces the latest
+	// state; it only suits callers that read the journal as a log.
+	JournalDropOldest
+	// JournalReject refuses further changes with ErrJournalFull until
+	// checkpoint empties the journal. Replay stays exact, and the caller
+	// decides when to pay for the checkpoint.
+	JournalReject
+)
+
+// setJournalLimit sets how many entries the journal holds and what happens
+// once it is full. Like the other settings it takes a checkpoint, which
+// leaves the journal empty.
+func (fs *FileSystem) setJournalLimit(max int, policy JournalPolicy) error {
+	if max < 1 || policy < JournalCheckpoint || policy > JournalReject {
+		return ErrInvalid
+	}
+	if err := fs.lockWriteAnyJournal(); err != nil {
+		return err
 	}
+	defer fs.unlockWrite()
 
-	btree := deserializeBTree(fs.DataBlocks[inode.BlockPointer])
-	listBTree(btree.Root)
+	fs.journalMax, fs.journalPolicy = max, policy
+	fs.checkpointInternal()
+	return nil
 }
 
-func listBTree(node *BTreeNode) {
-	if node == nil {
+// addJournalEntry records an operation that has just been applied.
+func (fs *FileSystem) addJournalEntry(operation, path string, data interface{}) {
+	if fs.txnEntries != nil {
+		*fs.txnEntries = append(*fs.txnEntries, JournalEntry{Operation: operation, Path: path, Data: data})
 		return
 	}
-
-	for i := 0; i < len(node.Keys); i++ {
-		if !node.IsLeaf {
-			listBTree(node.Children[i])
-		}
-		fmt.Println(node.Keys[i].Name)
+	fs.journalSeq++
+	entry := JournalEntry{
+		Seq:       fs.journalSeq,
+		Operation: operation,
+		Path:      path,
+		Data:      data,
 	}
-	if !node.IsLeaf {
-		listBTree(node.Children[len(node.Children)-1])
+	fs.Journal = append(fs.Journal, entry)
+	if len(fs.Journal) <= fs.journalMax {
+		return
 	}
+	switch fs.journalPolicy {
+	case JournalCheckpoint:
+		// The checkpoint already holds the operation just recorded
+		fs.checkpointInternal()
+	case JournalDropOldest:
+		fs.Journal = append(fs.Journal[:0], fs.Journal[len(fs.Journal)-fs.journalMax:]...)
+	}
+	// Under JournalReject an operation that began with room, such as a
+	// transaction or rmdirAll, may overrun the limit; lockWrite then
+	// refuses the next one.
 }
 
-// Path resolution
-func resolvePath(path string) *Inode {
-	parts := strings.Split(path, "/")
-	if len(parts) == 0 || parts[0] != "root" {
-		return nil
+// checkpoint records the current state and truncates the journal.
+func (fs *FileSystem) checkpoint() error {
+	if err := fs.lockWriteAnyJournal(); err != nil {
+		return err
 	}
+	defer fs.unlockWrite()
 
-	inode := fs.Superblock.InodeMap[0] // Start with the root inode
-	for _, part := range parts[1:] {
-		if part == "" {
-			continue
-		}
+	fs.checkpointInternal()
+	return nil
+}
 
-		found := false
-		btree := deserializeBTree(fs.DataBlocks[inode.BlockPointer])
-		for _, entry := range btree.Root.Keys {
-			if entry.Name == part {
-				inode = fs.Superblock.InodeMap[entry.InodeIndex]
-				found = true
-				break
-			}
-		}
-		if !found {
-			return nil
-		}
-	}
+func (fs *FileSystem) checkpointInternal() {
+	fs.lastCheckpoint = fs.checkpointImage()
+	fs.Journal = make([]JournalEntry, 0, JournalMax)
+}
 
-	return inode
+// checkpointImage captures the current state for replay to start from.
+func (fs *FileSystem) checkpointImage() *fsImage {
+	img := fs.newImage()
+	img.FreeBlocks = append([]int(nil), img.FreeBlocks...)
+	img.Journal = nil
+	return img
 }
 
-// Consistency check function
-func checkFilesystemConsistency() {
-	usedBlocks := make(map[int]bool)
-	usedInodes := make(map[int]bool)
+// ReplaySummary counts what replayJournal did with the journal entries
+// recorded after the checkpoint.
+type ReplaySummary struct {
+	// Replayed entries were applied.
+	Replayed int
+	// Failed entries were well formed but could not be applied, as when
+	// the file they change is missing. They stay in the journal.
+	Failed int
+	// Skipped entries were malformed, for instance after a partial write or
+	// a format change. They are logged and dropped from the journal.
+	Skipped int
+}
+
+// replayJournal rebuilds the filesystem from the last checkpoint, which a
+// new or loaded filesystem starts out with, by applying the journal entries
+// recorded after it. Each entry is checked against the shape its operation
+// records before it is applied, so a damaged journal is replayed as far as
+// it can be rather than panicking.
+func (fs *FileSystem) replayJournal() ReplaySummary {
+	var summary ReplaySummary
+	if err := fs.lockWriteAnyJournal(); err != nil {
+		fs.logf("%v", err)
+		return summary
+	}
+	defer fs.unlockWrite()
+
+	journal, since := fs.Journal, uint64(0)
+	if checkpoint := fs.lastCheckpoint; checkpoint != nil {
+		fs.rollbackTo(checkpoint)
+		since = checkpoint.JournalSeq
+	}
+	fs.Journal = make([]JournalEntry, 0, JournalMax)
+
+	for _, entry := range journal {
+		if entry.Seq != 0 && entry.Seq <= since {
+			continue
+		}
+		if entry.Seq > fs.journalSeq {
+			fs.journalSeq = entry.Seq
+		}
+		if err := checkJournalEntry(entry); err != nil {
+			fs.logf("journal entry %d skipped: %v", entry.Seq, err)
+			summary.Skipped++
+			continue
+		}
+		fs.Journal = append(fs.Journal, entry)
+		if err := fs.applyJournalEntry(entry); err != nil {
+			summary.Failed++
+		} else {
+			summary.Replayed++
+		}
+	}
+	return summary
+}
+
+// journalFields gives, for each operation, the fields its entries carry
+// and a value of the type each must have. Operations that record only a
+// path map to nil.
+var journalFields = map[string]map[string]interface{}{
+	"mkdir":         {"parentPath": "", "dirName": ""},
+	"touch":         {"dirPath": "", "fileName": ""},
+	"rm":            nil,
+	"rmdir":         nil,
+	"trash":         {"trashName": ""},
+	"undelete":      nil,
+	"emptyTrash":    nil,
+	"mv":            {"dstPath": ""},
+	"writeFile":     {"data": []byte(nil)},
+	"appendFile":    {"data": []byte(nil)},
+	"truncate":      {"size": 0},
+	"writeAt":       {"offset": 0, "data": []byte(nil)},
+	"chmod":         {"mode": uint32(0)},
+	"chown":         {"uid": 0, "gid": 0},
+	"setxattr":      {"key": "", "value": ""},
+	"setfacl":       {"acl": []ACLEntry(nil)},
+	"link":          {"newPath": ""},
+	"symlink":       {"target": ""},
+	"setQuota":      {"maxBytes": 0},
+	"cp":            {"dstPath": ""},
+	"importDir":     {"mode": uint32(0)},
+	"importFile":    {"mode": uint32(0), "data": []byte(nil)},
+	"importSymlink": {"target": ""},
+}
+
+// checkJournalEntry reports an error wrapping ErrBadEntry unless entry has
+// the shape applyJournalEntry expects of its operation. A transaction is
+// checked as a whole, so one bad operation rejects all of it.
+func checkJournalEntry(entry JournalEntry) error {
+	if entry.Operation == "txn" {
+		ops, ok := entry.Data.([]JournalEntry)
+		if !ok {
+			return fmt.Errorf("txn: data is %T: %w", entry.Data, ErrBadEntry)
+		}
+		for _, op := range ops {
+			if err := checkJournalEntry(op); err != nil {
+				return fmt.Errorf("txn: %w", err)
+			}
+		}
+		return nil
+	}
+	fields, ok := journalFields[entry.Operation]
+	if !ok {
+		return fmt.Errorf("unknown operation %q: %w", entry.Operation, ErrBadEntry)
+	}
+	if fields == nil {
+		return nil
+	}
+	data, ok := entry.Data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: data is %T: %w", entry.Operation, entry.Data, ErrBadEntry)
+	}
+	for key, want := range fields {
+		if got := reflect.TypeOf(data[key]); got != reflect.TypeOf(want) {
+			return fmt.Errorf("%s: field %q is %v, want %T: %w", entry.Operation, key, got, want, ErrBadEntry)
+		}
+	}
+	return nil
+}
+
+// applyJournalEntry performs the operation an entry records.
+func (fs *FileSystem) applyJournalEntry(entry JournalEntry) error {
+	switch entry.Operation {
+	case "mkdir":
+		data := entry.Data.(map[string]interface{})
+		_, err := fs.mkdirInternal(data["parentPath"].(string), data["dirName"].(string))
+		return err
+	case "touch":
+		data := entry.Data.(map[string]interface{})
+		_, err := fs.touchInternal(data["dirPath"].(string), data["fileName"].(string))
+		return err
+	case "rm":
+		return fs.rmInternal(entry.Path)
+	case "rmdir":
+		return fs.rmdirInternal(entry.Path)
+	case "trash":
+		data := entry.Data.(map[string]interface{})
+		return fs.trashInternal(entry.Path, data["trashName"].(string))
+	case "undelete":
+		return fs.undeleteInternal(entry.Path)
+	case "emptyTrash":
+		fs.emptyTrashInternal()
+	case "mv":
+		data := entry.Data.(map[string]interface{})
+		return fs.move(entry.Path, data["dstPath"].(string), true)
+	case "writeFile", "appendFile", "truncate", "writeAt":
+		inode, err := fs.fileAt(entry.Path)
+		if err != nil {
+			return err
+		}
+		data := entry.Data.(map[string]interface{})
+		switch entry.Operation {
+		case "writeFile":
+			return fs.storeFileData(inode, data["data"].([]byte))
+		case "appendFile":
+			return fs.appendInternal(inode, data["data"].([]byte))
+		case "truncate":
+			return fs.truncateInternal(inode, data["size"].(int))
+		default:
+			return fs.writeAtInternal(inode, data["offset"].(int), data["data"].([]byte))
+		}
+	case "chmod", "chown", "setxattr", "setfacl":
+		inode := fs.resolvePath(entry.Path)
+		if inode == nil {
+			return ErrNotFound
+		}
+		data := entry.Data.(map[string]interface{})
+		fs.preserveInode(inode)
+		switch entry.Operation {
+		case "chmod":
+			inode.Mode = data["mode"].(uint32)
+		case "chown":
+			chownInternal(inode, data["uid"].(int), data["gid"].(int))
+		case "setxattr":
+			setxattrInternal(inode, data["key"].(string), data["value"].(string))
+		default:
+			inode.ACL = nil
+			if acl := data["acl"].([]ACLEntry); len(acl) > 0 {
+				inode.ACL = append([]ACLEntry(nil), acl...)
+			}
+		}
+	case "link":
+		data := entry.Data.(map[string]interface{})
+		return fs.linkInternal(entry.Path, data["newPath"].(string))
+	case "symlink":
+		data := entry.Data.(map[string]interface{})
+		dirPath, name := splitPath(entry.Path)
+		return fs.symlinkInternal(data["target"].(string), dirPath, name)
+	case "setQuota":
+		dir := fs.resolvePath(entry.Path)
+		if dir == nil || !dir.IsDirectory {
+			return ErrNotDirectory
+		}
+		fs.setQuotaInternal(dir, entry.Data.(map[string]interface{})["maxBytes"].(int))
+	case "cp":
+		data := entry.Data.(map[string]interface{})
+		return fs.cpInternal(entry.Path, data["dstPath"].(string))
+	case "importDir":
+		data := entry.Data.(map[string]interface{})
+		return fs.importDirInternal(entry.Path, data["mode"].(uint32))
+	case "importFile":
+		data := entry.Data.(map[string]interface{})
+		return fs.importFileInternal(entry.Path, data["mode"].(uint32), data["data"].([]byte))
+	case "importSymlink":
+		data := entry.Data.(map[string]interface{})
+		return fs.importSymlinkInternal(entry.Path, data["target"].(string))
+	case "txn":
+		for _, op := range entry.Data.([]JournalEntry) {
+			if err := fs.applyJournalEntry(op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Estimated cost of replaying one journal entry, by operation. Directory
+// creation allocates a block as touch does, but also builds an empty B-tree
+// and serializes it into that block, so it costs more.
+var replayCost = map[string]time.Duration{
+	"mkdir": 50 * time.Microsecond,
+	"touch": 30 * time.Microsecond,
+}
+
+// defaultReplayCost is used for operations without an entry in replayCost.
+const defaultReplayCost = 40 * time.Microsecond
+
+// estimateRecovery reports how many journal entries a replay would apply
+// and roughly how long it would take.
+func (fs *FileSystem) estimateRecovery() (entries int, estimated time.Duration) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	for _, entry := range fs.Journal {
+		cost, ok := replayCost[entry.Operation]
+		if !ok {
+			cost = defaultReplayCost
+		}
+		estimated += cost
+	}
+	return len(fs.Journal), estimated
+}
+
+// Directory operations
+
+// mkdir creates the directory dirName in parentPath and returns its inode.
+func (fs *FileSystem) mkdir(parentPath, dirName string) (*Inode, error) {
+	if err := fs.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer fs.unlockWrite()
+	return fs.mkdirLocked(parentPath, dirName)
+}
+
+// mkdirLocked is mkdir with the write lock already held.
+func (fs *FileSystem) mkdirLocked(parentPath, dirName string) (*Inode, error) {
+	parentPath = fs.absPath(parentPath)
+	if err := fs.mayModifyDir(joinPath(parentPath, dirName)); err != nil {
+		return nil, err
+	}
+	inode, err := fs.mkdirInternal(parentPath, dirName)
+	if err != nil {
+		return nil, err
+	}
+	fs.addJournalEntry("mkdir", joinPath(parentPath, dirName), map[string]interface{}{
+		"parentPath": parentPath,
+		"dirName":    dirName,
+	})
+	fs.stats.Mkdirs++
+	fs.queueEvent(Event{Op: EventCreate, Path: joinPath(parentPath, dirName), IsDir: true})
+	return inode, nil
+}
+
+// mkdirAll creates the directory at path along with any missing parents,
+// like os.MkdirAll. It succeeds without change if path is already a
+// directory, and fails with ErrNotDirectory if a component is something
+// else. Directories created before a failure are left in place.
+func (fs *FileSystem) mkdirAll(path string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	parts, ok := pathSegments(fs.absPath(path))
+	if !ok {
+		return ErrNotFound
+	}
+	dir := "/root"
+	for _, name := range parts {
+		next := joinPath(dir, name)
+		switch inode := fs.resolvePath(next); {
+		case inode == nil:
+			if _, err := fs.mkdirLocked(dir, name); err != nil {
+				return fmt.Errorf("%s: %w", next, err)
+			}
+		case !inode.IsDirectory:
+			return fmt.Errorf("%s: %w", next, ErrNotDirectory)
+		}
+		dir = next
+	}
+	return nil
+}
+
+func (fs *FileSystem) mkdirInternal(parentPath, dirName string) (*Inode, error) {
+	if err := fs.validateName(dirName); err != nil {
+		return nil, err
+	}
+	parentInode := fs.resolvePath(parentPath)
+	if parentInode == nil {
+		return nil, ErrNotFound
+	}
+	if !parentInode.IsDirectory {
+		return nil, ErrNotDirectory
+	}
+	if _, exists := fs.dirTree(parentInode).search(dirName); exists {
+		return nil, ErrExists
+	}
+	if err := fs.checkQuota(parentInode, 0); err != nil {
+		return nil, err
+	}
+
+	newDirInode, err := fs.createInode(dirName, true, parentInode)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := DirEntry{Name: dirName, InodeIndex: newDirInode.InodeNumber}
+	if err := fs.addEntryToDir(parentInode, entry); err != nil {
+		fs.releaseInode(newDirInode)
+		return nil, err
+	}
+	return newDirInode, nil
+}
+
+// touch creates the empty file fileName in dirPath and returns its inode.
+func (fs *FileSystem) touch(dirPath, fileName string) (*Inode, error) {
+	if err := fs.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer fs.unlockWrite()
+	return fs.touchLocked(dirPath, fileName)
+}
+
+// touchLocked is touch with the write lock already held.
+func (fs *FileSystem) touchLocked(dirPath, fileName string) (*Inode, error) {
+	dirPath = fs.absPath(dirPath)
+	if err := fs.mayModifyDir(joinPath(dirPath, fileName)); err != nil {
+		return nil, err
+	}
+	inode, err := fs.touchInternal(dirPath, fileName)
+	if err != nil {
+		return nil, err
+	}
+	fs.addJournalEntry("touch", joinPath(dirPath, fileName), map[string]interface{}{
+		"dirPath":  dirPath,
+		"fileName": fileName,
+	})
+	fs.stats.Touches++
+	fs.queueEvent(Event{Op: EventCreate, Path: joinPath(dirPath, fileName)})
+	return inode, nil
+}
+
+func (fs *FileSystem) touchInternal(dirPath, fileName string) (*Inode, error) {
+	if err := fs.validateName(fileName); err != nil {
+		return nil, err
+	}
+	dirInode := fs.resolvePath(dirPath)
+	if dirInode == nil {
+		return nil, ErrNotFound
+	}
+	if !dirInode.IsDirectory {
+		return nil, ErrNotDirectory
+	}
+	if _, exists := fs.dirTree(dirInode).search(fileName); exists {
+		return nil, ErrExists
+	}
+	if err := fs.checkQuota(dirInode, 0); err != nil {
+		return nil, err
+	}
+
+	fileInode, err := fs.createInode(fileName, false, dirInode)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := DirEntry{Name: fileName, InodeIndex: fileInode.InodeNumber}
+	if err := fs.addEntryToDir(dirInode, entry); err != nil {
+		fs.releaseInode(fileInode)
+		return nil, err
+	}
+	return fileInode, nil
+}
+
+// File contents
+func (fs *FileSystem) writeFile(path string, data []byte) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	path = fs.absPath(path)
+	inode, err := fs.fileAt(path)
+	if err != nil {
+		return err
+	}
+	if !fs.may(inode, permWrite) {
+		return ErrPermission
+	}
+	if err := fs.storeFileDataVerified(inode, data); err != nil {
+		return err
+	}
+	fs.addJournalEntry("writeFile", path, map[string]interface{}{
+		"data": append([]byte(nil), data...),
+	})
+	fs.queueEvent(Event{Op: EventWrite, Path: path})
+	return nil
+}
+
+// fileAt returns the inode at path, which must not be a directory.
+func (fs *FileSystem) fileAt(path string) (*Inode, error) {
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return nil, ErrNotFound
+	}
+	if inode.IsDirectory {
+		return nil, ErrIsDirectory
+	}
+	return inode, nil
+}
+
+// truncate shrinks the file at path to size bytes, freeing blocks it no
+// longer needs, or extends it with zero bytes.
+func (fs *FileSystem) truncate(path string, size int) error {
+	if size < 0 {
+		return ErrInvalid
+	}
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	path = fs.absPath(path)
+	inode, err := fs.fileAt(path)
+	if err != nil {
+		return err
+	}
+	if !fs.may(inode, permWrite) {
+		return ErrPermission
+	}
+	if size == inode.Size {
+		return nil
+	}
+	if err := fs.truncateInternal(inode, size); err != nil {
+		return err
+	}
+	fs.addJournalEntry("truncate", path, map[string]interface{}{
+		"size": size,
+	})
+	fs.queueEvent(Event{Op: EventWrite, Path: path})
+	return nil
+}
+
+func (fs *FileSystem) truncateInternal(inode *Inode, size int) error {
+	data, err := fs.fileData(inode)
+	if err != nil {
+		return err
+	}
+	if size < len(data) {
+		data = data[:size]
+	} else {
+		data = append(data, make([]byte, size-len(data))...)
+	}
+	return fs.storeFileData(inode, data)
+}
+
+// appendFile writes data after the current end of the file at path.
+func (fs *FileSystem) appendFile(path string, data []byte) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	path = fs.absPath(path)
+	inode, err := fs.fileAt(path)
+	if err != nil {
+		return err
+	}
+	if !fs.may(inode, permWrite) {
+		return ErrPermission
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if err := fs.appendInternal(inode, data); err != nil {
+		return err
+	}
+	fs.addJournalEntry("appendFile", path, map[string]interface{}{
+		"data": append([]byte(nil), data...),
+	})
+	fs.queueEvent(Event{Op: EventWrite, Path: path})
+	return nil
+}
+
+func (fs *FileSystem) appendInternal(inode *Inode, data []byte) error {
+	contents, err := fs.fileData(inode)
+	if err != nil {
+		return err
+	}
+	return fs.storeFileData(inode, append(contents, data...))
+}
+
+// readAt reads up to n bytes of the file at path starting at byte off. A
+// read reaching past the end of the file is short; one starting at or past
+// the end returns no data.
+func (fs *FileSystem) readAt(path string, off, n int) ([]byte, error) {
+	if off < 0 || n < 0 {
+		return nil, ErrInvalid
+	}
+	data, err := fs.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if off >= len(data) {
+		return []byte{}, nil
+	}
+	end := off + n
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[off:end], nil
+}
+
+// writeAt writes data into the file at path starting at byte off, extending
+// the file if needed. A gap between the old end and off is zero-filled.
+func (fs *FileSystem) writeAt(path string, off int, data []byte) error {
+	if off < 0 {
+		return ErrInvalid
+	}
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	path = fs.absPath(path)
+	inode, err := fs.fileAt(path)
+	if err != nil {
+		return err
+	}
+	if !fs.may(inode, permWrite) {
+		return ErrPermission
+	}
+	if err := fs.writeAtInternal(inode, off, data); err != nil {
+		return err
+	}
+	fs.journalWriteAt(path, off, data)
+	fs.queueEvent(Event{Op: EventWrite, Path: path})
+	return nil
+}
+
+// journalWriteAt records a write of data at off into the file at path.
+func (fs *FileSystem) journalWriteAt(path string, off int, data []byte) {
+	fs.addJournalEntry("writeAt", path, map[string]interface{}{
+		"offset": off,
+		"data":   append([]byte(nil), data...),
+	})
+}
+
+func (fs *FileSystem) writeAtInternal(inode *Inode, off int, data []byte) error {
+	contents, err := fs.fileData(inode)
+	if err != nil {
+		return err
+	}
+	if end := off + len(data); end > len(contents) {
+		contents = append(contents, make([]byte, end-len(contents))...)
+	}
+	copy(contents[off:], data)
+	return fs.storeFileData(inode, contents)
+}
+
+// storeFileData replaces the contents of a file. The contents are
+// compressed and encrypted first if those options are on. Small results are
+// packed when block packing is on; others fill BlockPointer and then as many
+// overflow blocks as they need.
+func (fs *FileSystem) storeFileData(inode *Inode, data []byte) error {
+	fs.preserveInode(inode)
+	if len(data) > MaxFileBlocks*BlockSize {
+		return ErrFileTooLarge
+	}
+
+	// From here on data is what is stored: the contents themselves or, when
+	// that is smaller, their compressed form, possibly encrypted.
+	size, compressed, encrypted := len(data), false, false
+	if delta := size - inode.Size; delta > 0 {
+		if err := fs.checkQuota(inode.Parent, delta); err != nil {
+			return err
+		}
+	}
+	if fs.Compression && len(data) > 0 {
+		if z := compressData(data); len(z) < len(data) {
+			data, compressed = z, true
+		}
+	}
+	if fs.aead != nil {
+		data, encrypted = fs.encrypt(data), true
+	}
+
+	var err error
+	if fs.BlockPacking && len(data) <= PackMaxFileSize {
+		err = fs.packFile(inode, data)
+	} else {
+		err = fs.storeBlocks(inode, data, !compressed && !encrypted)
+	}
+	if err != nil {
+		return err
+	}
+	fs.resized(inode, size-inode.Size)
+	inode.Compressed = compressed
+	inode.Encrypted = encrypted
+	inode.Size = size
+	inode.ModifiedAt = now()
+	return nil
+}
+
+// storeBlocks writes data to the blocks of an unpacked file, allocating
+// overflow blocks or freeing surplus ones to fit. With sparse, an overflow
+// block of nothing but zeros is left as a hole rather than stored; the
+// first block is always stored, as every file owns its BlockPointer.
+func (fs *FileSystem) storeBlocks(inode *Inode, data []byte, sparse bool) error {
+	if inode.Packed != nil {
+		if err := fs.unpackFile(inode); err != nil {
+			return err
+		}
+	}
+
+	overflow := 0
+	if len(data) > BlockSize {
+		overflow = (len(data) - 1) / BlockSize
+	}
+	chunk := func(i int) []byte {
+		end := (i + 1) * BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		return data[i*BlockSize : end]
+	}
+	stored := func(i int) bool {
+		return i == 0 || !sparse || !allZero(chunk(i))
+	}
+
+	// Allocate the blocks that are missing before changing anything, so
+	// running out of space leaves the file as it was.
+	var fresh []int
+	for i := 1; i <= overflow; i++ {
+		if stored(i) && (i > len(inode.Overflow) || inode.Overflow[i-1] == hole) {
+			block := fs.allocateBlock()
+			if block < 0 {
+				for _, b := range fresh {
+					fs.freeBlock(b)
+				}
+				return ErrNoSpace
+			}
+			fresh = append(fresh, block)
+		}
+	}
+	if len(inode.Overflow) > overflow {
+		for _, b := range inode.Overflow[overflow:] {
+			if b != hole {
+				fs.freeBlock(b)
+			}
+		}
+		inode.Overflow = inode.Overflow[:overflow]
+	}
+	for len(inode.Overflow) < overflow {
+		inode.Overflow = append(inode.Overflow, hole)
+	}
+	if overflow == 0 {
+		inode.Overflow = nil
+	}
+
+	for i, block := range fileBlocks(inode) {
+		chunk := chunk(i)
+		if !stored(i) {
+			if block != hole {
+				fs.freeBlock(block)
+				setFileBlock(inode, i, hole)
+			}
+			continue
+		}
+		if block == hole {
+			block, fresh = fresh[0], fresh[1:]
+			setFileBlock(inode, i, block)
+		}
+		if bytes.Equal(fs.blocks.data(block), chunk) {
+			continue
+		}
+		if fs.Dedup && len(chunk) > 0 {
+			if shared, ok := fs.dedupLookup(chunk); ok {
+				fs.shareBlock(shared)
+				fs.freeBlock(block)
+				setFileBlock(inode, i, shared)
+				continue
+			}
+		}
+		if err := fs.unshareBlock(inode, i); err != nil {
+			return err
+		}
+		block = fileBlocks(inode)[i]
+		fs.writeBlock(block, append([]byte(nil), chunk...))
+		if fs.Dedup {
+			fs.dedupRecord(block)
+		}
+	}
+	return nil
+}
+
+// allZero reports whether b holds nothing but zero bytes.
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hole stands in the block list of a sparse file for a block of zeros that
+// has no storage.
+const hole = -1
+
+// fileBlocks returns the blocks of an unpacked file in order, holes
+// included.
+func fileBlocks(inode *Inode) []int {
+	return append([]int{inode.BlockPointer}, inode.Overflow...)
+}
+
+// setFileBlock makes block the i'th block of an unpacked file.
+func setFileBlock(inode *Inode, i, block int) {
+	if i == 0 {
+		inode.BlockPointer = block
+	} else {
+		inode.Overflow[i-1] = block
+	}
+}
+
+// releaseOverflow frees a file's overflow blocks.
+func (fs *FileSystem) releaseOverflow(inode *Inode) {
+	fs.preserveInode(inode)
+	for _, block := range inode.Overflow {
+		if block != hole {
+			fs.freeBlock(block)
+		}
+	}
+	inode.Overflow = nil
+}
+
+func (fs *FileSystem) readFile(path string) ([]byte, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return nil, ErrNotFound
+	}
+	if inode.IsDirectory {
+		return nil, ErrIsDirectory
+	}
+	if !fs.may(inode, permRead) {
+		return nil, ErrPermission
+	}
+
+	for _, block := range inodeBlocks(inode) {
+		if err := fs.verifyBlock(block); err != nil {
+			return nil, err
+		}
+	}
+	fs.touchAccessTime(inode)
+	return fs.fileData(inode)
+}
+
+// fileData returns a copy of a file's contents, decrypting and
+// decompressing them as needed.
+func (fs *FileSystem) fileData(inode *Inode) ([]byte, error) {
+	data := fs.storedData(inode)
+	if inode.Encrypted {
+		var err error
+		if data, err = fs.decrypt(data); err != nil {
+			return nil, err
+		}
+	}
+	if inode.Compressed {
+		data = decompressData(data)
+	}
+	if len(data) < inode.Size {
+		data = append(data, make([]byte, inode.Size-len(data))...)
+	}
+	return data[:inode.Size], nil
+}
+
+// storedData returns a copy of the bytes stored for a file.
+func (fs *FileSystem) storedData(inode *Inode) []byte {
+	if inode.Packed != nil {
+		ext := inode.Packed
+		block := fs.blocks.data(ext.Block)
+		return append([]byte(nil), block[ext.Offset:ext.Offset+ext.Length]...)
+	}
+	var data []byte
+	for i, block := range fileBlocks(inode) {
+		if block == hole {
+			// Only uncompressed files have holes, so Size is what is stored.
+			data = append(data, make([]byte, min(BlockSize, inode.Size-i*BlockSize))...)
+			continue
+		}
+		data = append(data, fs.blocks.data(block)...)
+	}
+	return data
+}
+
+// touchAccessTime bumps AccessedAt. Reads only hold the read lock, so the
+// update is serialized separately.
+func (fs *FileSystem) touchAccessTime(inode *Inode) {
+	fs.atimeMu.Lock()
+	fs.preserveInode(inode)
+	inode.AccessedAt = now()
+	fs.atimeMu.Unlock()
+}
+
+// releaseInode drops an inode that no directory entry refers to any more.
+func (fs *FileSystem) releaseInode(inode *Inode) {
+	if inode.Packed != nil {
+		fs.releasePackedExtent(inode)
+	} else if inode.BlockPointer >= 0 {
+		fs.freeBlock(inode.BlockPointer)
+	}
+	fs.releaseOverflow(inode)
+	if inode.IsDirectory {
+		fs.stats.Directories--
+	} else {
+		fs.stats.Files--
+		fs.resized(inode, -inode.Size)
+	}
+	fs.Superblock.InodeMap[inode.InodeNumber] = nil
+	fs.Superblock.InodeBitmap.clear(inode.InodeNumber)
+	fs.Superblock.FreeInodes = append(fs.Superblock.FreeInodes, inode.InodeNumber)
+	fs.Superblock.TotalInodes--
+}
+
+// rm removes a file, or moves it into the trash while that is enabled.
+func (fs *FileSystem) rm(path string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+	return fs.rmLocked(path)
+}
+
+// rmLocked is rm with the write lock already held.
+func (fs *FileSystem) rmLocked(path string) error {
+	path = fs.absPath(path)
+	if err := fs.mayModifyDir(path); err != nil {
+		return err
+	}
+	if fs.Trash && !inTrash(path) {
+		if err := fs.trash(path); err != nil {
+			return err
+		}
+	} else {
+		if err := fs.rmInternal(path); err != nil {
+			return err
+		}
+		fs.addJournalEntry("rm", path, nil)
+	}
+	fs.stats.Removes++
+	fs.queueEvent(Event{Op: EventDelete, Path: path})
+	return nil
+}
+
+func (fs *FileSystem) rmInternal(path string) error {
+	inode := fs.resolvePathNoFollow(path)
+	if inode == nil {
+		return ErrNotFound
+	}
+	if inode.IsDirectory {
+		return ErrIsDirectory
+	}
+
+	dirPath, name := splitPath(fs.absPath(path))
+	dir := fs.resolvePath(dirPath)
+	fs.removeEntryFromDir(dir, name)
+	fs.unlinkInode(inode, dir, name)
+	return nil
+}
+
+// unlinkInode accounts for the removal of the entry name in dir, releasing
+// inode once no entry refers to it. If the removed entry was the one Parent
+// and Name describe, they are moved to a remaining link.
+func (fs *FileSystem) unlinkInode(inode *Inode, dir *Inode, name string) {
+	fs.preserveInode(inode)
+	inode.LinkCount--
+	if inode.LinkCount <= 0 {
+		fs.releaseInode(inode)
+		return
+	}
+	collation := fs.dirTree(dir).Collation
+	if inode.Parent == dir && collation.key(inode.Name) == collation.key(name) {
+		// The usage follows the Parent entry
+		fs.chargeQuota(inode.Parent, -inode.Size)
+		inode.Parent, inode.Name = fs.findLink(inode)
+		fs.chargeQuota(inode.Parent, inode.Size)
+	}
+}
+
+// findLink returns a directory and name under which inode is linked.
+func (fs *FileSystem) findLink(inode *Inode) (*Inode, string) {
+	for _, dir := range fs.Superblock.InodeMap {
+		if dir == nil || !dir.IsDirectory {
+			continue
+		}
+		for _, entry := range fs.dirTree(dir).entries() {
+			if entry.InodeIndex == inode.InodeNumber {
+				return dir, entry.Name
+			}
+		}
+	}
+	return nil, ""
+}
+
+// link creates newPath as another directory entry for the file at
+// existingPath. Directories cannot be linked.
+func (fs *FileSystem) link(existingPath, newPath string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	existingPath, newPath = fs.absPath(existingPath), fs.absPath(newPath)
+	if err := fs.mayModifyDir(newPath); err != nil {
+		return err
+	}
+	if err := fs.linkInternal(existingPath, newPath); err != nil {
+		return err
+	}
+	fs.addJournalEntry("link", existingPath, map[string]interface{}{
+		"newPath": newPath,
+	})
+	return nil
+}
+
+func (fs *FileSystem) linkInternal(existingPath, newPath string) error {
+	inode := fs.resolvePathNoFollow(existingPath)
+	if inode == nil {
+		return ErrNotFound
+	}
+	if inode.IsDirectory {
+		return ErrIsDirectory
+	}
+
+	dirPath, name := splitPath(newPath)
+	if err := fs.validateName(name); err != nil {
+		return err
+	}
+	dir := fs.resolvePath(dirPath)
+	if dir == nil {
+		return ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return ErrNotDirectory
+	}
+	if _, exists := fs.dirTree(dir).search(name); exists {
+		return ErrExists
+	}
+
+	if err := fs.addEntryToDir(dir, DirEntry{Name: name, InodeIndex: inode.InodeNumber}); err != nil {
+		return err
+	}
+	fs.preserveInode(inode)
+	inode.LinkCount++
+	return nil
+}
+
+// rmdir removes an empty directory.
+func (fs *FileSystem) rmdir(path string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+	return fs.rmdirLocked(path)
+}
+
+// rmdirLocked is rmdir with the write lock already held.
+func (fs *FileSystem) rmdirLocked(path string) error {
+	path = fs.absPath(path)
+	if err := fs.mayModifyDir(path); err != nil {
+		return err
+	}
+	if err := fs.rmdirInternal(path); err != nil {
+		return err
+	}
+	fs.addJournalEntry("rmdir", path, nil)
+	fs.stats.Removes++
+	fs.queueEvent(Event{Op: EventDelete, Path: path, IsDir: true})
+	return nil
+}
+
+// rmdirAll removes the directory at path and everything below it, as rm and
+// rmdir would one entry at a time, and returns the removed paths in the
+// order they went: every entry before the directory holding it. Permission
+// to remove each entry is checked before anything is removed; should a
+// removal still fail, the paths removed so far are returned with the
+// error. With dryRun the filesystem is left alone and the paths that would
+// be removed are returned.
+func (fs *FileSystem) rmdirAll(path string, dryRun bool) ([]string, error) {
+	if err := fs.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer fs.unlockWrite()
+
+	path = fs.absPath(path)
+	dir := fs.resolvePathNoFollow(path)
+	if dir == nil {
+		return nil, ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return nil, ErrNotDirectory
+	}
+	if dir.Parent == nil {
+		return nil, ErrBusy
+	}
+
+	var paths []string
+	dirs := map[string]bool{path: true}
+	fs.walkTree(dir, path, func(p string, inode *Inode) error {
+		paths = append(paths, p)
+		dirs[p] = inode.IsDirectory
+		return nil
+	})
+	for i, j := 0, len(paths)-1; i < j; i, j = i+1, j-1 {
+		paths[i], paths[j] = paths[j], paths[i]
+	}
+	paths = append(paths, path)
+	for _, p := range paths {
+		if err := fs.mayModifyDir(p); err != nil {
+			return nil, err
+		}
+	}
+	if dryRun {
+		return paths, nil
+	}
+
+	for i, p := range paths {
+		var err error
+		if dirs[p] {
+			err = fs.rmdirLocked(p)
+		} else {
+			err = fs.rmLocked(p)
+		}
+		if err != nil {
+			return paths[:i], err
+		}
+	}
+	return paths, nil
+}
+
+// removeAll removes path and, if it is a directory, everything below it,
+// like rm -rf. Every inode in the subtree is released along with its blocks,
+// except files still linked from elsewhere. The root can't be removed.
+func (fs *FileSystem) removeAll(path string) error {
+	_, err := fs.rmdirAll(path, false)
+	if errors.Is(err, ErrNotDirectory) {
+		return fs.rm(path)
+	}
+	return err
+}
+
+func (fs *FileSystem) rmdirInternal(path string) error {
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return ErrNotFound
+	}
+	if !inode.IsDirectory {
+		return ErrNotDirectory
+	}
+	if inode.Parent == nil {
+		return ErrBusy
+	}
+	if len(fs.dirTree(inode).Root.Keys) > 0 {
+		return ErrNotEmpty
+	}
+
+	dirPath, name := splitPath(fs.absPath(path))
+	fs.removeEntryFromDir(fs.resolvePath(dirPath), name)
+	fs.releaseInode(inode)
+	return nil
+}
+
+// addEntryToDir inserts entry into the directory. With VerifyWrites on, an
+// entry that doesn't survive the directory's block format is taken out
+// again and ErrVerify returned.
+func (fs *FileSystem) addEntryToDir(inode *Inode, entry DirEntry) error {
+	btree := fs.dirTree(inode)
+	btree.insert(entry)
+	if fs.VerifyWrites {
+		if err := verifyDirEntry(btree, entry); err != nil {
+			btree.remove(entry.Name)
+			return err
+		}
+	}
+	fs.storeDirTree(inode, btree)
+	fs.preserveInode(inode)
+	inode.ModifiedAt = now()
+	return nil
+}
+
+func (fs *FileSystem) removeEntryFromDir(inode *Inode, name string) bool {
+	btree := fs.dirTree(inode)
+	if !btree.remove(name) {
+		return false
+	}
+	fs.storeDirTree(inode, btree)
+	fs.preserveInode(inode)
+	inode.ModifiedAt = now()
+	return true
+}
+
+// pathSegments returns the names below the root directory that path walks
+// through, which may include "." and "..". It reports false if path does
+// not start at the root. Leading "." and ".." segments are dropped since
+// nothing lies above the root.
+func pathSegments(path string) ([]string, bool) {
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part == "" || (len(parts) == 0 && (part == "." || part == "..")) {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return nil, true
+	}
+	if parts[0] != "root" {
+		return nil, false
+	}
+	return parts[1:], true
+}
+
+// canonicalPath rewrites path in the canonical "/root/..." form, resolving
+// "." and ".." lexically and clamping ".." at the root. Paths that don't
+// start at the root are only stripped of redundant slashes.
+func canonicalPath(path string) string {
+	parts, ok := pathSegments(path)
+	if !ok {
+		return "/" + strings.Join(strings.FieldsFunc(path, func(r rune) bool { return r == '/' }), "/")
+	}
+
+	clean := []string{"/root"}
+	for _, part := range parts {
+		switch part {
+		case ".":
+		case "..":
+			if len(clean) > 1 {
+				clean = clean[:len(clean)-1]
+			}
+		default:
+			clean = append(clean, part)
+		}
+	}
+	return strings.Join(clean, "/")
+}
+
+// validateName rejects names that can't be stored in a directory: empty
+// names, the reserved "." and "..", names longer than the configured limit,
+// and names containing '/', NUL, or the ';' and newline separators of the
+// directory block format.
+func (fs *FileSystem) validateName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+	if len(name) > fs.maxNameLen {
+		return fmt.Errorf("name of %d bytes exceeds limit of %d: %w", len(name), fs.maxNameLen, ErrInvalidName)
+	}
+	if strings.ContainsAny(name, "/\x00;\n") {
+		return fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+	return nil
+}
+
+// setMaxNameLength changes the longest name new entries may have. Existing
+// entries are unaffected.
+func (fs *FileSystem) setMaxNameLength(n int) error {
+	if n < 1 {
+		return ErrInvalid
+	}
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	fs.maxNameLen = n
+	fs.checkpointInternal()
+	return nil
+}
+
+// absPath returns path in canonical form, resolving a relative path against
+// the working directory. For compatibility a path starting with "root" is
+// absolute even without its leading slash. The caller must hold fs.mu.
+func (fs *FileSystem) absPath(path string) string {
+	if !strings.HasPrefix(path, "/") && path != "root" && !strings.HasPrefix(path, "root/") {
+		path = fs.cwd + "/" + path
+	}
+	return canonicalPath(path)
+}
+
+// cd changes the working directory used for relative paths. It fails, leaving
+// the working directory unchanged, unless path names a directory.
+func (fs *FileSystem) cd(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return ErrNotFound
+	}
+	if !inode.IsDirectory {
+		return ErrNotDirectory
+	}
+	fs.cwd = fs.absPath(path)
+	return nil
+}
+
+// pwd returns the working directory. If it has since been removed or moved,
+// relative paths fail to resolve until the next cd.
+func (fs *FileSystem) pwd() string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.cwd
+}
+
+// splitPath separates a path into its parent directory and final name.
+func splitPath(path string) (string, string) {
+	path = canonicalPath(path)
+	slash := strings.LastIndex(path, "/")
+	if slash < 0 {
+		return "", path
+	}
+	return path[:slash], path[slash+1:]
+}
+
+// cleanPath normalizes path lexically. Absolute paths take the canonical
+// form; relative ones lose redundant slashes and "." elements, and ".."
+// cancels the element before it, keeping leading ".." for absPath.
+func cleanPath(path string) string {
+	if strings.HasPrefix(path, "/") {
+		return canonicalPath(path)
+	}
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		switch {
+		case part == "" || part == ".":
+		case part == ".." && len(parts) > 0 && parts[len(parts)-1] != "..":
+			parts = parts[:len(parts)-1]
+		default:
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "."
+	}
+	return strings.Join(parts, "/")
+}
+
+// joinPath joins the non-empty parts with slashes and cleans the result.
+func joinPath(parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return "."
+	}
+	return cleanPath(strings.Join(nonEmpty, "/"))
+}
+
+// dirname returns all but the last element of path, cleaned. The root is
+// its own parent, as with "..".
+func dirname(path string) string {
+	path = cleanPath(path)
+	if path == "/root" {
+		return path
+	}
+	switch slash := strings.LastIndex(path, "/"); slash {
+	case -1:
+		return "."
+	case 0:
+		return "/"
+	default:
+		return path[:slash]
+	}
+}
+
+// basename returns the last element of path, cleaned, ignoring trailing
+// slashes. The basename of the root is "root".
+func basename(path string) string {
+	path = cleanPath(path)
+	if path == "/" {
+		return path
+	}
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// mv moves or renames the inode at srcPath to dstPath with the semantics of
+// POSIX rename. An existing destination is replaced if it is a file and
+// srcPath is not a directory, or if both are directories and the
+// destination is empty; the replaced inode is released once no other link
+// refers to it. Otherwise mv fails with ErrIsDirectory, ErrNotDirectory or
+// ErrNotEmpty. Every check is made before anything changes, so a failed mv
+// leaves the filesystem as it was.
+func (fs *FileSystem) mv(srcPath, dstPath string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	return fs.journaledMove(srcPath, dstPath)
+}
+
+func (fs *FileSystem) journaledMove(srcPath, dstPath string) error {
+	srcPath, dstPath = fs.absPath(srcPath), fs.absPath(dstPath)
+	if err := fs.mayModifyDir(srcPath); err != nil {
+		return err
+	}
+	if err := fs.mayModifyDir(dstPath); err != nil {
+		return err
+	}
+	if err := fs.move(srcPath, dstPath, true); err != nil {
+		return err
+	}
+	fs.addJournalEntry("mv", srcPath, map[string]interface{}{
+		"dstPath": dstPath,
+	})
+	moved := fs.resolvePathNoFollow(dstPath)
+	fs.queueEvent(Event{Op: EventRename, Path: dstPath, OldPath: srcPath, IsDir: moved.IsDirectory})
+	return nil
+}
+
+func (fs *FileSystem) move(srcPath, dstPath string, overwrite bool) error {
+	srcPath, dstPath = fs.absPath(srcPath), fs.absPath(dstPath)
+	srcDirPath, srcName := dirname(srcPath), basename(srcPath)
+	dstDirPath, dstName := dirname(dstPath), basename(dstPath)
+	if err := fs.validateName(dstName); err != nil {
+		return err
+	}
+
+	srcDir := fs.resolvePath(srcDirPath)
+	src := fs.resolvePathNoFollow(srcPath)
+	if srcDir == nil || src == nil || src.Parent == nil {
+		return ErrNotFound
+	}
+	dstDir := fs.resolvePath(dstDirPath)
+	if dstDir == nil {
+		return ErrNotFound
+	}
+	if !dstDir.IsDirectory {
+		return ErrNotDirectory
+	}
+
+	// A directory cannot become its own ancestor.
+	if src.IsDirectory {
+		for p := dstDir; p != nil; p = p.Parent {
+			if p == src {
+				return ErrInvalidMove
+			}
+		}
+	}
+
+	existing := fs.resolvePathNoFollow(dstPath)
+	if existing != nil {
+		switch {
+		case existing == src:
+			// Two links to one inode, as rename leaves them.
+			return nil
+		case !overwrite:
+			return ErrExists
+		case existing.Parent == nil:
+			return ErrBusy
+		case existing.IsDirectory && !src.IsDirectory:
+			return ErrIsDirectory
+		case !existing.IsDirectory && src.IsDirectory:
+			return ErrNotDirectory
+		case existing.IsDirectory && len(fs.dirTree(existing).Root.Keys) > 0:
+			return ErrNotEmpty
+		}
+	}
+
+	// The subtree's quota usage moves with it
+	usage := fs.quotaUsage(src)
+	fs.chargeQuota(src.Parent, -usage)
+	if usage > 0 {
+		if err := fs.checkQuota(dstDir, usage); err != nil {
+			fs.chargeQuota(src.Parent, usage)
+			return err
+		}
+	}
+
+	var replaced DirEntry
+	if existing != nil {
+		replaced, _ = fs.dirTree(dstDir).search(dstName)
+		fs.removeEntryFromDir(dstDir, dstName)
+	}
+	if err := fs.addEntryToDir(dstDir, DirEntry{Name: dstName, InodeIndex: src.InodeNumber}); err != nil {
+		if existing != nil {
+			// It was stored before, so it can be again.
+			fs.addEntryToDir(dstDir, replaced)
+		}
+		fs.chargeQuota(src.Parent, usage)
+		return err
+	}
+	if existing != nil {
+		if existing.IsDirectory {
+			fs.releaseInode(existing)
+		} else {
+			fs.unlinkInode(existing, dstDir, dstName)
+		}
+	}
+	fs.removeEntryFromDir(srcDir, srcName)
+	fs.preserveInode(src)
+	src.Name = dstName
+	src.Parent = dstDir
+	fs.chargeQuota(dstDir, usage)
+	return nil
+}
+
+// stat returns the inode at path.
+func (fs *FileSystem) stat(path string) (*Inode, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	return fs.resolve(path, true)
+}
+
+// lstat is like stat but doesn't follow a symbolic link in the final position.
+func (fs *FileSystem) lstat(path string) (*Inode, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	return fs.resolve(path, false)
+}
+
+// exists reports whether path resolves to an inode, following symlinks.
+func (fs *FileSystem) exists(path string) bool {
+	_, err := fs.stat(path)
+	return err == nil
+}
+
+// isDir reports whether path resolves to a directory, following symlinks.
+func (fs *FileSystem) isDir(path string) bool {
+	inode, err := fs.stat(path)
+	return err == nil && inode.IsDirectory
+}
+
+// isFile reports whether path resolves to a regular file, following
+// symlinks.
+func (fs *FileSystem) isFile(path string) bool {
+	inode, err := fs.stat(path)
+	return err == nil && !inode.IsDirectory && !inode.IsSymlink
+}
+
+// symlink creates a symbolic link at linkPath pointing to target. The target
+// is stored as given and need not exist.
+func (fs *FileSystem) symlink(target, linkPath string) error {
+	if target == "" {
+		return ErrInvalid
+	}
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	linkPath = fs.absPath(linkPath)
+	if err := fs.mayModifyDir(linkPath); err != nil {
+		return err
+	}
+	dirPath, name := splitPath(linkPath)
+	if err := fs.symlinkInternal(target, dirPath, name); err != nil {
+		return err
+	}
+	fs.addJournalEntry("symlink", linkPath, map[string]interface{}{
+		"target": target,
+	})
+	return nil
+}
+
+func (fs *FileSystem) symlinkInternal(target, dirPath, name string) error {
+	if err := fs.validateName(name); err != nil {
+		return err
+	}
+	dir := fs.resolvePath(dirPath)
+	if dir == nil {
+		return ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return ErrNotDirectory
+	}
+	if _, exists := fs.dirTree(dir).search(name); exists {
+		return ErrExists
+	}
+	if err := fs.checkQuota(dir, len(target)); err != nil {
+		return err
+	}
+
+	link, err := fs.createInode(name, false, dir)
+	if err != nil {
+		return err
+	}
+	link.IsSymlink = true
+	link.Target = target
+	link.Size = len(target)
+	link.Mode = 0777
+	fs.resized(link, link.Size)
+	if err := fs.addEntryToDir(dir, DirEntry{Name: name, InodeIndex: link.InodeNumber}); err != nil {
+		fs.releaseInode(link)
+		return err
+	}
+	return nil
+}
+
+// readlink returns the target of the symbolic link at path without
+// following it.
+func (fs *FileSystem) readlink(path string) (string, error) {
+	if err := fs.lockRead(); err != nil {
+		return "", err
+	}
+	defer fs.mu.RUnlock()
+
+	inode, err := fs.resolve(path, false)
+	if err != nil {
+		return "", err
+	}
+	if !inode.IsSymlink {
+		return "", ErrNotSymlink
+	}
+	return inode.Target, nil
+}
+
+// chmod sets the permission bits of the inode at path.
+func (fs *FileSystem) chmod(path string, mode uint32) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return ErrNotFound
+	}
+	if fs.cred.UID != 0 && fs.cred.UID != inode.UID {
+		return ErrPermission
+	}
+	fs.preserveInode(inode)
+	inode.Mode = mode & 07777
+	fs.addJournalEntry("chmod", fs.absPath(path), map[string]interface{}{
+		"mode": inode.Mode,
+	})
+	return nil
+}
+
+// chown changes the owner and group of the inode at path. An ID of -1
+// leaves that one unchanged.
+func (fs *FileSystem) chown(path string, uid, gid int) error {
+	if uid < -1 || gid < -1 {
+		return ErrInvalid
+	}
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	path = fs.absPath(path)
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return ErrNotFound
+	}
+	if fs.cred.UID != 0 {
+		return ErrPermission
+	}
+	fs.preserveInode(inode)
+	chownInternal(inode, uid, gid)
+	fs.addJournalEntry("chown", path, map[string]interface{}{
+		"uid": uid,
+		"gid": gid,
+	})
+	return nil
+}
+
+func chownInternal(inode *Inode, uid, gid int) {
+	if uid != -1 {
+		inode.UID = uid
+	}
+	if gid != -1 {
+		inode.GID = gid
+	}
+}
+
+// Directory listing
+func (fs *FileSystem) ls(path string) {
+	names, err := fs.list(path)
+	if err != nil {
+		fs.logf("Invalid directory")
+		return
+	}
+	for _, name := range names {
+		fs.logf("%s", name)
+	}
+}
+
+// list returns the names in the directory at path in sorted order.
+func (fs *FileSystem) list(path string) ([]string, error) {
+	entries, err := fs.dirEntries(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return names, nil
+}
+
+// dirEntries returns the entries of the directory at path sorted by name,
+// gathered from every node of its B-tree.
+func (fs *FileSystem) dirEntries(path string) ([]DirEntry, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	dir, err := fs.readableDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.dirTree(dir).entries(), nil
+}
+
+// entriesInRange returns the entries of the directory at path whose names
+// fall in [lo, hi), in sorted order. A range with hi at or below lo is
+// empty.
+func (fs *FileSystem) entriesInRange(path, lo, hi string) ([]DirEntry, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	dir, err := fs.readableDir(path)
+	if err != nil {
+		return nil, err
+	}
+	tree := fs.dirTree(dir)
+	if tree.Collation.key(hi) <= tree.Collation.key(lo) {
+		return nil, nil
+	}
+	return tree.entriesInRange(lo, hi), nil
+}
+
+// entriesWithPrefix returns the entries of the directory at path whose
+// names start with prefix, in sorted order.
+func (fs *FileSystem) entriesWithPrefix(path, prefix string) ([]DirEntry, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	dir, err := fs.readableDir(path)
+	if err != nil {
+		return nil, err
+	}
+	tree := fs.dirTree(dir)
+	prefix = tree.Collation.key(prefix)
+	return tree.entriesInRange(prefix, prefixEnd(prefix)), nil
+}
+
+// prefixEnd returns the least string above every string starting with
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// readableDir resolves path to a directory the current credentials may
+// list and marks it accessed. The caller must hold the lock.
+func (fs *FileSystem) readableDir(path string) (*Inode, error) {
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return nil, ErrNotFound
+	}
+	if !inode.IsDirectory {
+		return nil, ErrNotDirectory
+	}
+	if !fs.may(inode, permRead) {
+		return nil, ErrPermission
+	}
+	fs.touchAccessTime(inode)
+	return inode, nil
+}
+
+// lsLong returns a line per entry of the directory at path in the style of
+// ls -l: type and permissions, link count, size, modification time and name.
+// Symbolic links also show their target.
+func (fs *FileSystem) lsLong(path string) ([]string, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	dir := fs.resolvePath(path)
+	if dir == nil {
+		return nil, ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return nil, ErrNotDirectory
+	}
+	if !fs.may(dir, permRead) {
+		return nil, ErrPermission
+	}
+
+	fs.touchAccessTime(dir)
+	var lines []string
+	for _, entry := range fs.dirTree(dir).entries() {
+		inode := fs.lookupInode(entry.InodeIndex)
+		if inode == nil {
+			continue
+		}
+		line := fmt.Sprintf("%s %3d %5d %5d %8d %s %s",
+			newIOFileInfo(entry.Name, inode).Mode(), inode.LinkCount, inode.UID, inode.GID, inode.Size,
+			inode.ModifiedAt.Format("Jan _2 15:04"), entry.Name)
+		if inode.IsSymlink {
+			line += " -> " + inode.Target
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// lsRecursive lists the directory at path and every directory below it, like
+// ls -R: each directory contributes a "path:" header followed by its entry
+// names, and sections are separated by a blank line. Subdirectories are
+// visited in sorted order after their parent; symbolic links to directories
+// are listed but not followed.
+func (fs *FileSystem) lsRecursive(path string) ([]string, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	dir := fs.resolvePath(path)
+	if dir == nil {
+		return nil, ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return nil, ErrNotDirectory
+	}
+	if !fs.may(dir, permRead) {
+		return nil, ErrPermission
+	}
+
+	var lines []string
+	fs.listRecursive(dir, fs.absPath(path), &lines)
+	return lines, nil
+}
+
+func (fs *FileSystem) listRecursive(dir *Inode, dirPath string, lines *[]string) {
+	if len(*lines) > 0 {
+		*lines = append(*lines, "")
+	}
+	*lines = append(*lines, dirPath+":")
+
+	fs.touchAccessTime(dir)
+	var subdirs []DirEntry
+	for _, entry := range fs.dirTree(dir).entries() {
+		*lines = append(*lines, entry.Name)
+		if child := fs.lookupInode(entry.InodeIndex); child != nil && child.IsDirectory {
+			subdirs = append(subdirs, entry)
+		}
+	}
+	for _, entry := range subdirs {
+		fs.listRecursive(fs.lookupInode(entry.InodeIndex), dirPath+"/"+entry.Name, lines)
+	}
+}
+
+// Path resolution
+//
+// Paths are slash-separated. The root directory is named "root", so its
+// canonical path is "/root" and everything else lives below it, e.g.
+// "/root/dir1/file1". "/" is accepted as another name for the root.
+// Repeated and trailing slashes are ignored. A path that doesn't start with
+// "/" or "root" is relative to the working directory set by cd. "." names
+// the current directory and ".." its parent, stopping at the root.
+// Symbolic links are followed wherever they appear; resolvePathNoFollow
+// leaves a link in the final position unresolved.
+func (fs *FileSystem) resolvePath(path string) *Inode {
+	inode, _ := fs.resolve(path, true)
+	return inode
+}
+
+// resolvePathNoFollow is like resolvePath but returns a symbolic link in the
+// final position itself rather than its target.
+func (fs *FileSystem) resolvePathNoFollow(path string) *Inode {
+	inode, _ := fs.resolve(path, false)
+	return inode
+}
+
+// resolve walks path from the root, following symbolic links in every
+// position except the last unless followLast is set. Relative link targets
+// are resolved against the directory holding the link.
+func (fs *FileSystem) resolve(path string, followLast bool) (*Inode, error) {
+	parts, ok := pathSegments(fs.absPath(path))
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	root := fs.Superblock.InodeMap[0]
+	inode := root // Start with the root inode
+	hops := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		if !inode.IsDirectory {
+			return nil, ErrNotDirectory
+		}
+		if part == "." {
+			continue
+		}
+		if part == ".." {
+			// The root is its own parent
+			if inode.Parent != nil {
+				inode = inode.Parent
+			}
+			continue
+		}
+
+		btree := fs.dirTree(inode)
+		entry, found := btree.search(part)
+		if !found {
+			return nil, ErrNotFound
+		}
+		child := fs.lookupInode(entry.InodeIndex)
+		if child == nil {
+			return nil, ErrNotFound
+		}
+
+		if child.IsSymlink && (len(parts) > 0 || followLast) {
+			hops++
+			if hops > MaxSymlinkHops {
+				return nil, ErrTooManyLinks
+			}
+			var target []string
+			if strings.HasPrefix(child.Target, "/") {
+				if target, ok = pathSegments(child.Target); !ok {
+					return nil, ErrNotFound
+				}
+				inode = root
+			} else {
+				target = strings.FieldsFunc(child.Target, func(r rune) bool { return r == '/' })
+			}
+			parts = append(target, parts...)
+			continue
+		}
+		inode = child
+	}
+
+	return inode, nil
+}
+
+// Consistency check function
+func (fs *FileSystem) checkFilesystemConsistency() {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if err := fs.verifyFilesystem(); err != nil {
+		fs.logf("%v", err)
+		return
+	}
+	fs.logf("Filesystem consistency check passed")
+}
+
+// verifyFilesystem returns the first inconsistency found, or nil. The caller
+// must hold fs.mu.
+func (fs *FileSystem) verifyFilesystem() error {
+	fs.flushDirTrees()
+	usedBlocks := make(map[int]bool)
+	usedInodes := make(map[int]bool)
+	packBlocks := make(map[int]bool)
+	owners := make(map[int]int)
+	links := make(map[int]int)
+
+	if err := fs.checkReachability(); err != nil {
+		return err
+	}
+	if fs.blocks.len() != fs.Superblock.TotalBlocks {
+		return fmt.Errorf("block count mismatch: %d blocks, TotalBlocks %d", fs.blocks.len(), fs.Superblock.TotalBlocks)
+	}
 
 	// Check inode consistency
 	for _, inode := range fs.Superblock.InodeMap {
 		if inode == nil {
 			continue
 		}
-		if inode.InodeNumber < 0 || inode.InodeNumber >= fs.Superblock.TotalInodes {
-			fmt.Printf("Invalid inode number: %d\n", inode.InodeNumber)
-			return
+		if inode.InodeNumber < 0 || inode.InodeNumber >= len(fs.Superblock.InodeMap) {
+			return fmt.Errorf("invalid inode number: %d", inode.InodeNumber)
+		}
+		if usedInodes[inode.InodeNumber] {
+			return fmt.Errorf("duplicate inode number: %d", inode.InodeNumber)
+		}
+		usedInodes[inode.InodeNumber] = true
+
+		// Check directory consistency
+		if inode.IsDirectory {
+			btree := deserializeBTree(fs.blocks.data(inode.BlockPointer))
+			if btree == nil {
+				return fmt.Errorf("invalid B-tree for directory inode: %d", inode.InodeNumber)
+			}
+			if err := fs.checkBTreeConsistency(btree.Root, inode.InodeNumber); err != nil {
+				return err
+			}
+			for _, entry := range btree.entries() {
+				links[entry.InodeIndex]++
+			}
+		}
+
+		// Packed files share a block and have no block of their own
+		if inode.Packed != nil {
+			if inode.Packed.Block < 0 || inode.Packed.Block >= fs.Superblock.TotalBlocks {
+				return fmt.Errorf("invalid packed block: %d", inode.Packed.Block)
+			}
+			if usedBlocks[inode.Packed.Block] && !packBlocks[inode.Packed.Block] {
+				return fmt.Errorf("duplicate block pointer: %d", inode.Packed.Block)
+			}
+			usedBlocks[inode.Packed.Block] = true
+			packBlocks[inode.Packed.Block] = true
+			continue
+		}
+
+		// Check block consistency
+		if inode.BlockPointer < 0 || inode.BlockPointer >= fs.Superblock.TotalBlocks {
+			return fmt.Errorf("invalid block pointer: %d", inode.BlockPointer)
+		}
+		for _, block := range fileBlocks(inode) {
+			if block == hole {
+				continue
+			}
+			if block < 0 || block >= fs.Superblock.TotalBlocks {
+				return fmt.Errorf("invalid block pointer: %d", block)
+			}
+			if usedBlocks[block] && (owners[block] == 0 || fs.Superblock.BlockRefs[block] == 0) {
+				return fmt.Errorf("duplicate block pointer: %d", block)
+			}
+			usedBlocks[block] = true
+			owners[block]++
+		}
+	}
+
+	// Shared blocks need as many owners as their reference count
+	for block, refs := range fs.Superblock.BlockRefs {
+		if owners[block] != refs {
+			return fmt.Errorf("reference count mismatch for block %d: %d owners, count %d", block, owners[block], refs)
+		}
+	}
+
+	if len(usedInodes) != fs.Superblock.TotalInodes {
+		return fmt.Errorf("inode count mismatch: %d in use, TotalInodes %d", len(usedInodes), fs.Superblock.TotalInodes)
+	}
+
+	// Free inode numbers must name empty slots, each listed once
+	freeInodes := make(map[int]bool)
+	for _, number := range fs.Superblock.FreeInodes {
+		if number < 0 || number >= len(fs.Superblock.InodeMap) || fs.Superblock.InodeMap[number] != nil {
+			return fmt.Errorf("inode marked as free but used: %d", number)
+		}
+		if freeInodes[number] {
+			return fmt.Errorf("duplicate free inode: %d", number)
+		}
+		freeInodes[number] = true
+	}
+
+	// A linked inode needs as many entries as its link count
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode != nil && links[inode.InodeNumber] > 0 && links[inode.InodeNumber] != inode.LinkCount {
+			return fmt.Errorf("link count mismatch for inode %d: %d entries, count %d", inode.InodeNumber, links[inode.InodeNumber], inode.LinkCount)
+		}
+	}
+
+	// Quota usage must match what the subtree holds
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode != nil && inode.Quota > 0 {
+			if used := fs.quotaUsage(inode); used != inode.QuotaUsed {
+				return fmt.Errorf("quota usage mismatch for inode %d: %d bytes held, %d recorded", inode.InodeNumber, used, inode.QuotaUsed)
+			}
+		}
+	}
+
+	// Check block contents against their checksums
+	for block := range usedBlocks {
+		if err := fs.verifyBlock(block); err != nil {
+			return err
+		}
+	}
+
+	// Check free block consistency: each block is either used or listed as
+	// free exactly once
+	freeBlocks := make(map[int]bool)
+	for _, block := range fs.Superblock.FreeBlocks {
+		if block < 0 || block >= fs.Superblock.TotalBlocks {
+			return fmt.Errorf("invalid free block: %d", block)
+		}
+		if freeBlocks[block] {
+			return fmt.Errorf("duplicate free block: %d", block)
+		}
+		if usedBlocks[block] {
+			return fmt.Errorf("block marked as free but used: %d", block)
+		}
+		freeBlocks[block] = true
+	}
+	for block := 0; block < fs.Superblock.TotalBlocks; block++ {
+		if !usedBlocks[block] && !freeBlocks[block] {
+			return fmt.Errorf("block leaked: %d is neither used nor free", block)
+		}
+	}
+	if err := fs.bitmapErrors(usedBlocks, usedInodes); err != nil {
+		return err
+	}
+
+	if errs := fs.serializationErrors(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// verifyAllSerializations checks that every directory block survives a
+// deserialize/serialize round trip byte for byte and matches the cached
+// in-memory tree. It returns one error per unstable directory.
+func (fs *FileSystem) verifyAllSerializations() []error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.serializationErrors()
+}
+
+func (fs *FileSystem) serializationErrors() []error {
+	fs.flushDirTrees()
+	var errs []error
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode == nil || !inode.IsDirectory || inode.BlockPointer < 0 || inode.BlockPointer >= fs.blocks.len() {
+			continue
+		}
+		stored := fs.blocks.data(inode.BlockPointer)
+		if !bytes.Equal(serializeBTree(deserializeBTree(stored)), stored) {
+			errs = append(errs, fmt.Errorf("unstable serialization for directory inode: %d", inode.InodeNumber))
+			continue
+		}
+		if tree, ok := fs.cache.peek(inode.BlockPointer); ok && !bytes.Equal(serializeBTree(tree), stored) {
+			errs = append(errs, fmt.Errorf("cached B-tree differs from block for directory inode: %d", inode.InodeNumber))
+		}
+	}
+	return errs
+}
+
+// checkReachability walks the directory tree from the root and reports a
+// directory reached more than once, which means the tree has a cycle, or an
+// inode that can't be reached at all. It doesn't rely on Parent pointers, so
+// it terminates even when they are wrong.
+func (fs *FileSystem) checkReachability() error {
+	root := fs.Superblock.InodeMap[0]
+	reached := map[int]bool{root.InodeNumber: true}
+	stack := []*Inode{root}
+	for len(stack) > 0 {
+		dir := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, entry := range fs.dirTree(dir).entries() {
+			child := fs.lookupInode(entry.InodeIndex)
+			if child == nil {
+				continue
+			}
+			if child.IsDirectory {
+				if reached[child.InodeNumber] {
+					return fmt.Errorf("directory cycle: inode %d is reachable more than once", child.InodeNumber)
+				}
+				stack = append(stack, child)
+			}
+			reached[child.InodeNumber] = true
+		}
+	}
+
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode != nil && !reached[inode.InodeNumber] {
+			return fmt.Errorf("orphaned inode: %d", inode.InodeNumber)
+		}
+	}
+	return nil
+}
+
+// Check B-tree consistency
+func (fs *FileSystem) checkBTreeConsistency(node *BTreeNode, parentInode int) error {
+	if node == nil {
+		return nil
+	}
+
+	for i := 0; i < len(node.Keys); i++ {
+		entry := node.Keys[i]
+		if entry.InodeIndex < 0 || entry.InodeIndex >= len(fs.Superblock.InodeMap) {
+			return fmt.Errorf("inode reference out of range in B-tree: %d", entry.InodeIndex)
+		}
+		inode := fs.lookupInode(entry.InodeIndex)
+		if inode == nil {
+			return fmt.Errorf("invalid inode reference in B-tree: %d", entry.InodeIndex)
+		}
+		// A hard-linked file has entries in several directories but only
+		// one Parent.
+		if inode.LinkCount <= 1 && inode.Parent == nil {
+			return fmt.Errorf("inconsistent parent: inode %d has none", entry.InodeIndex)
+		}
+		if inode.LinkCount <= 1 && inode.Parent.InodeNumber != parentInode {
+			return fmt.Errorf("inode parent mismatch: %d", entry.InodeIndex)
+		}
+
+		if !node.IsLeaf {
+			if err := fs.checkBTreeConsistency(node.Children[i], parentInode); err != nil {
+				return err
+			}
+		}
+	}
+	if !node.IsLeaf {
+		return fs.checkBTreeConsistency(node.Children[len(node.Children)-1], parentInode)
+	}
+	return nil
+}
+
+// danglingEntries returns the paths of directory entries under root whose
+// InodeIndex does not resolve to an inode in the InodeMap.
+func (fs *FileSystem) danglingEntries(root string) ([]string, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	return fs.danglingEntriesInternal(root)
+}
+
+func (fs *FileSystem) danglingEntriesInternal(root string) ([]string, error) {
+	inode := fs.resolvePath(root)
+	if inode == nil {
+		return nil, ErrNotFound
+	}
+	if !inode.IsDirectory {
+		return nil, ErrNotDirectory
+	}
+
+	var dangling []string
+	fs.collectDangling(inode, fs.absPath(root), &dangling)
+	return dangling, nil
+}
+
+func (fs *FileSystem) collectDangling(dir *Inode, dirPath string, dangling *[]string) {
+	btree := fs.dirTree(dir)
+	for _, entry := range btree.entries() {
+		childPath := dirPath + "/" + entry.Name
+		child := fs.lookupInode(entry.InodeIndex)
+		if child == nil {
+			*dangling = append(*dangling, childPath)
+			continue
+		}
+		if child.IsDirectory {
+			fs.collectDangling(child, childPath, dangling)
 		}
-		if usedInodes[inode.InodeNumber] {
-			fmt.Printf("Duplicate inode number: %d\n", inode.InodeNumber)
-			return
+	}
+}
+
+// removeDanglingEntries deletes every dangling entry under root from its
+// parent directory and returns the paths that were removed.
+func (fs *FileSystem) removeDanglingEntries(root string) ([]string, error) {
+	if err := fs.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer fs.unlockWrite()
+
+	dangling, err := fs.danglingEntriesInternal(root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range dangling {
+		slash := strings.LastIndex(path, "/")
+		parent := fs.resolvePath(path[:slash])
+		if parent == nil {
+			continue
 		}
-		usedInodes[inode.InodeNumber] = true
+		fs.removeEntryFromDir(parent, path[slash+1:])
+	}
+	if len(dangling) > 0 {
+		fs.checkpointInternal()
+	}
+	return dangling, nil
+}
 
-		// Check directory consistency
-		if inode.IsDirectory {
-			btree := deserializeBTree(fs.DataBlocks[inode.BlockPointer])
-			if btree == nil {
-				fmt.Printf("Invalid B-tree for directory inode: %d\n", inode.InodeNumber)
-				return
+// walkTree calls fn for every inode below dir in sorted order, descending
+// into subdirectories after visiting them. Entries that don't resolve to an
+// inode are skipped. The walk stops at the first error returned by fn.
+func (fs *FileSystem) walkTree(dir *Inode, dirPath string, fn func(path string, inode *Inode) error) error {
+	btree := fs.dirTree(dir)
+	for _, entry := range btree.entries() {
+		child := fs.lookupInode(entry.InodeIndex)
+		if child == nil {
+			continue
+		}
+		childPath := dirPath + "/" + entry.Name
+		if err := fn(childPath, child); err != nil {
+			return err
+		}
+		if child.IsDirectory {
+			if err := fs.walkTree(child, childPath, fn); err != nil {
+				return err
 			}
-			checkBTreeConsistency(btree.Root, inode.InodeNumber)
 		}
+	}
+	return nil
+}
 
-		// Check block consistency
-		if inode.BlockPointer < 0 || inode.BlockPointer >= MaxBlocks {
-			fmt.Printf("Invalid block pointer: %d\n", inode.BlockPointer)
-			return
+// Walk calls fn for root and every inode below it in sorted, depth-first
+// order. The tree is captured under the read lock before fn runs, so fn may
+// call back into the filesystem. The walk stops at the first error from fn,
+// which Walk returns.
+func (fs *FileSystem) Walk(root string, fn func(path string, inode *Inode) error) error {
+	type visit struct {
+		path  string
+		inode *Inode
+	}
+
+	if err := fs.lockRead(); err != nil {
+		return err
+	}
+	start := fs.resolvePath(root)
+	if start == nil {
+		fs.mu.RUnlock()
+		return ErrNotFound
+	}
+	root = fs.absPath(root)
+	visits := []visit{{root, start}}
+	if start.IsDirectory {
+		fs.walkTree(start, root, func(path string, inode *Inode) error {
+			visits = append(visits, visit{path, inode})
+			return nil
+		})
+	}
+	fs.mu.RUnlock()
+
+	for _, v := range visits {
+		if err := fn(v.path, v.inode); err != nil {
+			return err
 		}
-		if usedBlocks[inode.BlockPointer] {
-			fmt.Printf("Duplicate block pointer: %d\n", inode.BlockPointer)
-			return
+	}
+	return nil
+}
+
+// du returns the bytes used by path: the size of every file under it plus
+// the bytes each directory's serialized entries occupy in its block.
+func (fs *FileSystem) du(path string) (int, error) {
+	if err := fs.lockRead(); err != nil {
+		return 0, err
+	}
+	defer fs.mu.RUnlock()
+
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return 0, ErrNotFound
+	}
+
+	fs.flushDirTrees()
+	usage := func(inode *Inode) int {
+		if inode.IsDirectory {
+			return len(fs.blocks.data(inode.BlockPointer))
 		}
-		usedBlocks[inode.BlockPointer] = true
+		return inode.Size
+	}
+	total := usage(inode)
+	if inode.IsDirectory {
+		fs.walkTree(inode, path, func(_ string, child *Inode) error {
+			total += usage(child)
+			return nil
+		})
 	}
+	return total, nil
+}
 
-	// Check free block consistency
-	for _, block := range fs.Superblock.FreeBlocks {
-		if usedBlocks[block] {
-			fmt.Printf("Block marked as free but used: %d\n", block)
-			return
+// find returns the paths of every inode below root whose name matches the
+// pattern name, in sorted depth-first order. Patterns use path.Match syntax,
+// so a plain name matches only itself.
+func (fs *FileSystem) find(root, name string) ([]string, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	if err := checkPattern(name); err != nil {
+		return nil, err
+	}
+
+	dir := fs.resolvePath(root)
+	if dir == nil {
+		return nil, ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return nil, ErrNotDirectory
+	}
+
+	matches := []string{}
+	fs.walkTree(dir, fs.absPath(root), func(path string, _ *Inode) error {
+		if _, base := splitPath(path); matchName(name, base) {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	return matches, nil
+}
+
+// directoriesNearCapacity returns the paths of directories whose B-tree root
+// node is filled beyond threshold (a fraction of its key capacity), meaning the next
+// few inserts are likely to split it.
+func (fs *FileSystem) directoriesNearCapacity(threshold float64) ([]string, error) {
+	if threshold < 0 || threshold > 1 {
+		return nil, fmt.Errorf("threshold out of range: %v", threshold)
+	}
+
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	var dirs []string
+	check := func(path string, inode *Inode) error {
+		if !inode.IsDirectory {
+			return nil
 		}
-		usedBlocks[block] = true
+		btree := fs.dirTree(inode)
+		if float64(len(btree.Root.Keys))/float64(btree.maxKeys()) > threshold {
+			dirs = append(dirs, path)
+		}
+		return nil
 	}
+	root := fs.Superblock.InodeMap[0]
+	check("/root", root)
+	fs.walkTree(root, "/root", check)
+	return dirs, nil
+}
 
-	fmt.Println("Filesystem consistency check passed")
+// lookupInode returns the inode with the given number, or nil if the number
+// is out of range or the slot is empty.
+func (fs *FileSystem) lookupInode(index int) *Inode {
+	if index < 0 || index >= len(fs.Superblock.InodeMap) {
+		return nil
+	}
+	return fs.Superblock.InodeMap[index]
 }
 
-// Check B-tree consistency
-func checkBTreeConsistency(node *BTreeNode, parentInode int) {
-	if node == nil {
-		return
+// copyInode returns a copy of inode that shares no mutable state with it.
+// Parent still points at the original's parent.
+func copyInode(inode *Inode) Inode {
+	clone := *inode
+	if inode.Packed != nil {
+		ext := *inode.Packed
+		clone.Packed = &ext
+	}
+	clone.Overflow = append([]int(nil), inode.Overflow...)
+	if inode.ACL != nil {
+		clone.ACL = append([]ACLEntry(nil), inode.ACL...)
+	}
+	if inode.Xattrs != nil {
+		clone.Xattrs = make(map[string]string, len(inode.Xattrs))
+		for k, v := range inode.Xattrs {
+			clone.Xattrs[k] = v
+		}
 	}
+	return clone
+}
 
-	for i := 0; i < len(node.Keys); i++ {
-		entry := node.Keys[i]
-		inode := fs.Superblock.InodeMap[entry.InodeIndex]
+// cloneInodes deep-copies a set of inodes so later changes to the live
+// inodes (renames, timestamps, modes) don't leak into a snapshot. Parent
+// pointers are remapped to the copies where the parent is in the set.
+func cloneInodes(inodes []*Inode) []*Inode {
+	clones := make([]*Inode, len(inodes))
+	byOriginal := make(map[*Inode]*Inode, len(inodes))
+	for i, inode := range inodes {
 		if inode == nil {
-			fmt.Printf("Invalid inode reference in B-tree: %d\n", entry.InodeIndex)
-			return
+			continue
 		}
-		if inode.Parent.InodeNumber != parentInode {
-			fmt.Printf("Inode parent mismatch: %d\n", entry.InodeIndex)
-			return
+		clone := copyInode(inode)
+		clones[i] = &clone
+		byOriginal[inode] = &clone
+	}
+	for _, clone := range clones {
+		if clone == nil {
+			continue
 		}
-
-		if !node.IsLeaf {
-			checkBTreeConsistency(node.Children[i], parentInode)
+		if parent, ok := byOriginal[clone.Parent]; ok {
+			clone.Parent = parent
 		}
 	}
-	if !node.IsLeaf {
-		checkBTreeConsistency(node.Children[len(node.Children)-1], parentInode)
+	return clones
+}
+
+// preserveInode stores a copy of inode in the filesystem snapshots that
+// still share it, and must be called before inode changes. A snapshot keeps
+// the live inodes it was taken with until they change, so taking one costs
+// a copy of the inode map rather than of every inode.
+func (fs *FileSystem) preserveInode(inode *Inode) {
+	if inode.snapshotGen == fs.snapshotGen {
+		return
+	}
+	var preserved *Inode
+	for _, snapshot := range fs.filesystemSnapshots {
+		if n := inode.InodeNumber; n < len(snapshot.Inodes) && snapshot.Inodes[n] == inode {
+			if preserved == nil {
+				clone := copyInode(inode)
+				preserved = &clone
+			}
+			snapshot.Inodes[n] = preserved
+		}
 	}
+	inode.snapshotGen = fs.snapshotGen
 }
 
-var filesystemSnapshots []Snapshot
-var directorySnapshots map[string]DirectorySnapshot
+// snapshotInodes returns copies of a filesystem snapshot's inodes, with
+// Parent pointing among the copies. A preserved inode's Parent may still be
+// the live parent, so parents are found by number.
+func (fs *FileSystem) snapshotInodes(snapshot Snapshot) []*Inode {
+	fs.atimeMu.Lock()
+	defer fs.atimeMu.Unlock()
 
-func init() {
-	directorySnapshots = make(map[string]DirectorySnapshot)
+	clones := make([]*Inode, len(snapshot.Inodes))
+	for i, inode := range snapshot.Inodes {
+		if inode != nil {
+			clone := copyInode(inode)
+			clones[i] = &clone
+		}
+	}
+	for _, clone := range clones {
+		if clone != nil && clone.Parent != nil {
+			clone.Parent = clones[clone.Parent.InodeNumber]
+		}
+	}
+	return clones
 }
 
 // Create a snapshot of the entire filesystem
-func createFilesystemSnapshot() {
-	snapshot := Snapshot{
-		Inodes:     make([]*Inode, len(fs.Superblock.InodeMap)),
-		DataBlocks: fs.DataBlocks,
+func (fs *FileSystem) createFilesystemSnapshot() {
+	if _, err := fs.snapshot(); err != nil {
+		fs.logf("%v", err)
+		return
+	}
+	fs.logf("Filesystem snapshot created")
+}
+
+// snapshot records the whole filesystem and returns the snapshot's name.
+func (fs *FileSystem) snapshot() (string, error) {
+	if err := fs.lockWrite(); err != nil {
+		return "", err
+	}
+	defer fs.unlockWrite()
+
+	name := ""
+	for name == "" || fs.snapshotIndex(name) >= 0 {
+		fs.snapshotSeq++
+		name = fmt.Sprintf("snapshot-%d", fs.snapshotSeq)
+	}
+	fs.takeSnapshot(name)
+	return name, nil
+}
+
+// createNamedSnapshot records the whole filesystem under name, which must
+// not already be in use.
+func (fs *FileSystem) createNamedSnapshot(name string) error {
+	if name == "" {
+		return ErrInvalid
+	}
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	if fs.snapshotIndex(name) >= 0 {
+		return fmt.Errorf("snapshot %q: %w", name, ErrExists)
+	}
+	fs.takeSnapshot(name)
+	return nil
+}
+
+func (fs *FileSystem) takeSnapshot(name string) {
+	fs.flushDirTrees()
+	fs.snapshotGen++
+	fs.filesystemSnapshots = append(fs.filesystemSnapshots, Snapshot{
+		Name:        name,
+		Data:        fs.blocks.share(),
+		Inodes:      append([]*Inode(nil), fs.Superblock.InodeMap...),
+		FreeBlocks:  append([]int(nil), fs.Superblock.FreeBlocks...),
+		TotalInodes: fs.Superblock.TotalInodes,
+	})
+}
+
+// listSnapshots returns the names of the filesystem snapshots, oldest first.
+func (fs *FileSystem) listSnapshots() []string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	names := make([]string, len(fs.filesystemSnapshots))
+	for i, snapshot := range fs.filesystemSnapshots {
+		names[i] = snapshot.Name
+	}
+	return names
+}
+
+// deleteSnapshot drops the named filesystem snapshot.
+func (fs *FileSystem) deleteSnapshot(name string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
 	}
+	defer fs.unlockWrite()
 
-	copy(snapshot.Inodes, fs.Superblock.InodeMap)
-	filesystemSnapshots = append(filesystemSnapshots, snapshot)
-	fmt.Println("Filesystem snapshot created")
+	idx := fs.snapshotIndex(name)
+	if idx < 0 {
+		return fmt.Errorf("snapshot %q: %w", name, ErrNoSnapshot)
+	}
+	fs.filesystemSnapshots = append(fs.filesystemSnapshots[:idx:idx], fs.filesystemSnapshots[idx+1:]...)
+	return nil
 }
 
 // Restore the latest filesystem snapshot
-func restoreFilesystemSnapshot() {
-	if len(filesystemSnapshots) == 0 {
-		fmt.Println("No filesystem snapshots available")
+func (fs *FileSystem) restoreFilesystemSnapshot() {
+	if err := fs.restoreLatest(); err != nil {
+		fs.logf("%v", err)
 		return
 	}
+	fs.logf("Filesystem snapshot restored")
+}
+
+// restoreLatest rolls the filesystem back to the most recent snapshot.
+func (fs *FileSystem) restoreLatest() error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	if len(fs.filesystemSnapshots) == 0 {
+		return ErrNoSnapshot
+	}
+	fs.restoreSnapshotAt(len(fs.filesystemSnapshots) - 1)
+	return nil
+}
+
+// restoreFilesystemSnapshotAt rolls the filesystem back to the snapshot at
+// index in the order listSnapshots reports them, oldest first. Later
+// snapshots are kept.
+func (fs *FileSystem) restoreFilesystemSnapshotAt(index int) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	if index < 0 || index >= len(fs.filesystemSnapshots) {
+		return fmt.Errorf("snapshot %d of %d: %w", index, len(fs.filesystemSnapshots), ErrNoSnapshot)
+	}
+	fs.restoreSnapshotAt(index)
+	return nil
+}
+
+// restoreNamedSnapshot rolls the filesystem back to the named snapshot.
+// Later snapshots are kept.
+func (fs *FileSystem) restoreNamedSnapshot(name string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	idx := fs.snapshotIndex(name)
+	if idx < 0 {
+		return fmt.Errorf("snapshot %q: %w", name, ErrNoSnapshot)
+	}
+	fs.restoreSnapshotAt(idx)
+	return nil
+}
+
+func (fs *FileSystem) restoreSnapshotAt(idx int) {
+	snapshot := fs.filesystemSnapshots[idx]
+	fs.Superblock.InodeMap = fs.snapshotInodes(snapshot)
+	fs.Superblock.FreeInodes = freeInodeSlots(fs.Superblock.InodeMap)
+	fs.Superblock.BlockRefs = countBlockRefs(fs.Superblock.InodeMap)
+	fs.Superblock.FreeBlocks = append([]int(nil), snapshot.FreeBlocks...)
+	fs.Superblock.TotalInodes = snapshot.TotalInodes
+	fs.setTotalBlocks(snapshot.Data.len())
+	fs.blocks = snapshot.Data.share()
+	fs.markAllDirty()
+	fs.cache.reset()
+	fs.dedupIndex = nil
+	fs.recountQuotas()
+	fs.recountStats()
+	fs.recountBitmaps()
+	// The journal doesn't record restores
+	fs.checkpointInternal()
+}
+
+// mountSnapshot returns a read-only filesystem showing the named snapshot.
+// It shares the snapshot's blocks rather than copying them, and all the read
+// operations work on it as usual; mutations fail with ErrReadOnly.
+func (fs *FileSystem) mountSnapshot(name string) (*FileSystem, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	idx := fs.snapshotIndex(name)
+	if idx < 0 {
+		return nil, fmt.Errorf("snapshot %q: %w", name, ErrNotFound)
+	}
+	snapshot := fs.filesystemSnapshots[idx]
+
+	view := newFileSystem(fs.btreeOrder)
+	view.Superblock = Superblock{
+		TotalInodes:     snapshot.TotalInodes,
+		TotalBlocks:     snapshot.Data.len(),
+		FreeBlocks:      append([]int(nil), snapshot.FreeBlocks...),
+		InodeMap:        fs.snapshotInodes(snapshot),
+		ReservedPercent: fs.Superblock.ReservedPercent,
+	}
+	view.setTotalBlocks(snapshot.Data.len())
+	view.Superblock.FreeInodes = freeInodeSlots(view.Superblock.InodeMap)
+	view.Superblock.BlockRefs = countBlockRefs(view.Superblock.InodeMap)
+	view.recountStats()
+	view.recountBitmaps()
+	view.blocks = snapshot.Data.share()
+	view.cache.reset()
+	view.Journal = nil
+	view.readOnly = true
+	view.aead = fs.aead
+	return view, nil
+}
+
+// inodeBlocks returns the data blocks an inode refers to.
+func inodeBlocks(inode *Inode) []int {
+	if inode.Packed != nil {
+		return []int{inode.Packed.Block}
+	}
+	if inode.BlockPointer < 0 {
+		return nil
+	}
+	var blocks []int
+	for _, block := range fileBlocks(inode) {
+		if block != hole {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+func referencesBlock(inodes []*Inode, block int) bool {
+	for _, inode := range inodes {
+		if inode == nil {
+			continue
+		}
+		for _, b := range inodeBlocks(inode) {
+			if b == block {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blockOwners returns who references a data block: "live" for the current
+// filesystem, then the names of filesystem snapshots in creation order, then
+// the paths of directory snapshots.
+func (fs *FileSystem) blockOwners(index int) []string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	owners := []string{}
+	if referencesBlock(fs.Superblock.InodeMap, index) {
+		owners = append(owners, "live")
+	}
+	fs.atimeMu.Lock()
+	for _, snapshot := range fs.filesystemSnapshots {
+		if referencesBlock(snapshot.Inodes, index) {
+			owners = append(owners, snapshot.Name)
+		}
+	}
+	fs.atimeMu.Unlock()
+	var dirs []string
+	for path, snapshot := range fs.directorySnapshots {
+		if referencesBlock(snapshot.Inodes, index) {
+			dirs = append(dirs, path)
+		}
+	}
+	sort.Strings(dirs)
+	return append(owners, dirs...)
+}
+
+// coalesceSnapshots merges a contiguous chain of snapshots, given oldest
+// first, into a single baseline called newName and drops the originals.
+// Every snapshot is a full copy of the filesystem, so the newest snapshot in
+// the chain already holds the combined state; blocks referenced only by the
+// dropped snapshots are released with them.
+func (fs *FileSystem) coalesceSnapshots(names []string, newName string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	if len(names) == 0 {
+		return errors.New("no snapshots to coalesce")
+	}
+
+	first := -1
+	for i, name := range names {
+		idx := fs.snapshotIndex(name)
+		if idx < 0 {
+			return fmt.Errorf("snapshot %q: %w", name, ErrNotFound)
+		}
+		if i == 0 {
+			first = idx
+		} else if idx != first+i {
+			return fmt.Errorf("snapshot %q does not follow %q", name, names[i-1])
+		}
+	}
+	if idx := fs.snapshotIndex(newName); idx >= 0 && (idx < first || idx >= first+len(names)) {
+		return fmt.Errorf("snapshot %q: %w", newName, ErrExists)
+	}
+
+	merged := fs.filesystemSnapshots[first+len(names)-1]
+	merged.Name = newName
+	snapshots := append([]Snapshot(nil), fs.filesystemSnapshots[:first]...)
+	snapshots = append(snapshots, merged)
+	fs.filesystemSnapshots = append(snapshots, fs.filesystemSnapshots[first+len(names):]...)
+	return nil
+}
 
-	snapshot := filesystemSnapshots[len(filesystemSnapshots)-1]
-	fs.Superblock.InodeMap = snapshot.Inodes
-	fs.DataBlocks = snapshot.DataBlocks
-	fmt.Println("Filesystem snapshot restored")
+// snapshotIndex returns the position of the named filesystem snapshot, or
+// -1 if there is none.
+func (fs *FileSystem) snapshotIndex(name string) int {
+	for i, snapshot := range fs.filesystemSnapshots {
+		if snapshot.Name == name {
+			return i
+		}
+	}
+	return -1
 }
 
 // createDirectorySnapshot creates a snapshot of a specific directory
-func createDirectorySnapshot(path string) {
-	inode := resolvePath(path)
+func (fs *FileSystem) createDirectorySnapshot(path string) {
+	if err := fs.lockWrite(); err != nil {
+		fs.logf("%v", err)
+		return
+	}
+	defer fs.unlockWrite()
+
+	inode := fs.resolvePath(path)
 	if inode == nil || !inode.IsDirectory {
-		fmt.Println("Invalid directory")
+		fs.logf("Invalid directory")
 		return
 	}
 
+	fs.flushDirTrees()
 	snapshot := DirectorySnapshot{
-		RootInode:  inode,
-		Inodes:     make([]*Inode, 0),
-		DataBlocks: fs.DataBlocks,
+		RootInode: inode,
+		Inodes:    make([]*Inode, 0),
 	}
+	snapshot.Data = fs.blocks.share()
 
 	snapshot.Inodes = append(snapshot.Inodes, inode)
-	snapshotDirectory(inode, &snapshot)
-	directorySnapshots[path] = snapshot
-	fmt.Println("Directory snapshot created for:", path)
+	fs.snapshotDirectory(inode, &snapshot, map[int]bool{inode.InodeNumber: true})
+	used := make(map[int]bool)
+	for _, inode := range snapshot.Inodes {
+		for _, block := range inodeBlocks(inode) {
+			if !used[block] {
+				used[block] = true
+				snapshot.Blocks = append(snapshot.Blocks, block)
+			}
+		}
+	}
+	sort.Ints(snapshot.Blocks)
+	snapshot.Inodes = cloneInodes(snapshot.Inodes)
+	snapshot.RootInode = snapshot.Inodes[0]
+	fs.directorySnapshots[fs.absPath(path)] = snapshot
+	fs.logf("Directory snapshot created for: %s", path)
 }
 
-// snapshotDirectory stores directory records
-func snapshotDirectory(inode *Inode, snapshot *DirectorySnapshot) {
-	btree := deserializeBTree(fs.DataBlocks[inode.BlockPointer])
-	for _, entry := range btree.Root.Keys {
-		childInode := fs.Superblock.InodeMap[entry.InodeIndex]
+// snapshotDirectory stores directory records. An inode linked more than once
+// in the subtree is stored once.
+func (fs *FileSystem) snapshotDirectory(inode *Inode, snapshot *DirectorySnapshot, seen map[int]bool) {
+	btree := fs.dirTree(inode)
+	for _, entry := range btree.entries() {
+		childInode := fs.lookupInode(entry.InodeIndex)
+		if childInode == nil || seen[childInode.InodeNumber] {
+			continue
+		}
+		seen[childInode.InodeNumber] = true
 		snapshot.Inodes = append(snapshot.Inodes, childInode)
 		if childInode.IsDirectory {
-			snapshotDirectory(childInode, snapshot)
+			fs.snapshotDirectory(childInode, snapshot, seen)
 		}
 	}
 }
 
-// restoreDirectorySnapshot restores a specific directory snapshot
-func restoreDirectorySnapshot(path string) {
-	snapshot, exists := directorySnapshots[path]
+// restoreDirectorySnapshot restores a specific directory snapshot. Only the
+// directory's subtree is put back; changes made elsewhere since the
+// snapshot are kept. If the restore can't be completed nothing changes.
+func (fs *FileSystem) restoreDirectorySnapshot(path string) {
+	if err := fs.lockWrite(); err != nil {
+		fs.logf("%v", err)
+		return
+	}
+	defer fs.unlockWrite()
+
+	snapshot, exists := fs.directorySnapshots[fs.absPath(path)]
 	if !exists {
-		fmt.Println("No snapshot available for directory:", path)
+		fs.logf("No snapshot available for directory: %s", path)
 		return
 	}
 
-	for _, inode := range snapshot.Inodes {
-		fs.Superblock.InodeMap[inode.InodeNumber] = inode
+	before := fs.newImage()
+	if err := fs.restoreSubtree(fs.absPath(path), snapshot); err != nil {
+		fs.rollbackTo(before)
+		fs.logf("Cannot restore directory snapshot for %s: %v", path, err)
+		return
+	}
+	fs.checkpointInternal()
+	fs.logf("Directory snapshot restored for: %s", path)
+}
+
+// restoreSubtree replaces the subtree at path with the one snapshot holds,
+// recreating the directory if it has been removed since. The inodes in the
+// subtree now are released first, except files still linked from outside
+// it, which stay as they are. Restored inodes keep their numbers, and
+// their blocks their indexes, unless something outside the subtree has
+// taken them since; those get free ones instead. It may leave the
+// filesystem half restored on error.
+func (fs *FileSystem) restoreSubtree(path string, snapshot DirectorySnapshot) error {
+	fs.flushDirTrees()
+
+	var parent *Inode
+	rootNumber := -1
+	if dir := fs.resolvePath(path); dir != nil {
+		if !dir.IsDirectory {
+			return ErrNotDirectory
+		}
+		// Drop the subtree's entries as rm would: a file also linked from
+		// outside the subtree keeps its inode.
+		var files []*Inode
+		seen := make(map[int]bool)
+		fs.walkTree(dir, "", func(_ string, inode *Inode) error {
+			if inode.IsDirectory {
+				fs.releaseInode(inode)
+				return nil
+			}
+			fs.preserveInode(inode)
+			inode.LinkCount--
+			if !seen[inode.InodeNumber] {
+				seen[inode.InodeNumber] = true
+				files = append(files, inode)
+			}
+			return nil
+		})
+		parent, rootNumber = dir.Parent, dir.InodeNumber
+		fs.releaseInode(dir)
+		for _, inode := range files {
+			if inode.LinkCount <= 0 {
+				fs.releaseInode(inode)
+			} else if fs.lookupInode(inode.Parent.InodeNumber) != inode.Parent {
+				inode.Parent, inode.Name = fs.findLink(inode)
+			}
+		}
+	} else {
+		parentPath, _ := splitPath(path)
+		if parent = fs.resolvePath(parentPath); parent == nil || !parent.IsDirectory {
+			return ErrNotFound
+		}
+	}
+
+	// Claim the inode numbers that are still free, then number the rest.
+	inodes := cloneInodes(snapshot.Inodes)
+	numbers := make(map[int]int, len(inodes))
+	renumbered := false
+	place := func(inode *Inode, number int) {
+		for number >= len(fs.Superblock.InodeMap) {
+			fs.Superblock.InodeMap = append(fs.Superblock.InodeMap, nil)
+		}
+		numbers[inode.InodeNumber] = number
+		renumbered = renumbered || number != inode.InodeNumber
+		fs.Superblock.InodeMap[number] = inode
+	}
+	var taken []*Inode
+	for i, inode := range inodes {
+		switch {
+		case i == 0 && rootNumber >= 0:
+			place(inode, rootNumber)
+		case fs.lookupInode(inode.InodeNumber) == nil:
+			place(inode, inode.InodeNumber)
+		default:
+			taken = append(taken, inode)
+		}
+	}
+	for _, inode := range taken {
+		number := len(fs.Superblock.InodeMap)
+		for n, slot := range fs.Superblock.InodeMap {
+			if slot == nil {
+				number = n
+				break
+			}
+		}
+		place(inode, number)
+	}
+
+	// Likewise the blocks.
+	blocks := make(map[int]int, len(snapshot.Blocks))
+	var moved []int
+	for _, block := range snapshot.Blocks {
+		if block < fs.Superblock.TotalBlocks && !fs.Superblock.BlockBitmap.has(block) {
+			blocks[block] = block
+			fs.Superblock.BlockBitmap.set(block)
+		} else {
+			moved = append(moved, block)
+		}
+	}
+	var free []int
+	for _, block := range fs.Superblock.FreeBlocks {
+		if !fs.Superblock.BlockBitmap.has(block) {
+			free = append(free, block)
+		}
+	}
+	fs.Superblock.FreeBlocks = free
+	for _, block := range moved {
+		if blocks[block] = fs.allocateBlock(); blocks[block] < 0 {
+			return ErrNoSpace
+		}
+	}
+	for old, block := range blocks {
+		fs.writeBlock(block, snapshot.Data.data(old))
+	}
+
+	for _, inode := range inodes {
+		inode.InodeNumber = numbers[inode.InodeNumber]
+		if inode.Packed != nil {
+			inode.Packed.Block = blocks[inode.Packed.Block]
+		} else if inode.BlockPointer >= 0 {
+			inode.BlockPointer = blocks[inode.BlockPointer]
+		}
+		for i, block := range inode.Overflow {
+			if block != hole {
+				inode.Overflow[i] = blocks[block]
+			}
+		}
+	}
+	if renumbered {
+		for _, dir := range inodes {
+			if dir.IsDirectory {
+				tree := deserializeBTree(fs.blocks.data(dir.BlockPointer))
+				tree.renumber(numbers)
+				fs.writeBlock(dir.BlockPointer, serializeBTree(tree))
+			}
+		}
+	}
+	root := inodes[0]
+	root.Parent = parent
+
+	fs.cache.reset()
+	// Only the restored entries refer to the restored files now, whatever
+	// links they had outside the subtree when the snapshot was taken.
+	restored := make(map[*Inode]bool, len(inodes))
+	for _, inode := range inodes {
+		restored[inode] = true
+		if !inode.IsDirectory {
+			inode.LinkCount = 0
+		}
+	}
+	for _, dir := range inodes {
+		if !dir.IsDirectory {
+			continue
+		}
+		for _, entry := range fs.dirTree(dir).entries() {
+			inode := fs.lookupInode(entry.InodeIndex)
+			if inode == nil || inode.IsDirectory {
+				continue
+			}
+			fs.preserveInode(inode)
+			inode.LinkCount++
+			if !restored[inode.Parent] {
+				inode.Parent, inode.Name = dir, entry.Name
+			}
+		}
+	}
+	fs.dedupIndex = nil
+	fs.Superblock.BlockRefs = countBlockRefs(fs.Superblock.InodeMap)
+	fs.recountQuotas()
+	fs.recountStats()
+	fs.Superblock.TotalInodes = 0
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode != nil {
+			fs.Superblock.TotalInodes++
+		}
+	}
+	fs.Superblock.FreeInodes = freeInodeSlots(fs.Superblock.InodeMap)
+	fs.recountBitmaps()
+
+	if rootNumber < 0 {
+		_, name := splitPath(path)
+		root.Name = name
+		return fs.addEntryToDir(parent, DirEntry{Name: name, InodeIndex: root.InodeNumber})
 	}
-	fs.DataBlocks = snapshot.DataBlocks
-	fmt.Println("Directory snapshot restored for:", path)
+	return nil
 }
 
 func main() {
-	initializeFS()
+	fs := NewFileSystem()
+	fs.setLogger(log.New(os.Stdout, "", 0))
+
+	if len(os.Args) > 1 && os.Args[1] == "repl" {
+		if err := fs.repl(os.Stdin, os.Stdout); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	// Report failures of the steps below without stopping
+	check := func(_ *Inode, err error) {
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
 
 	// Replay the journal to recover from a crash
-	replayJournal()
+	fs.replayJournal()
 
 	// Create a new directory and file
-	mkdir("/root", "dir1")
-	touch("/root/dir1", "file1")
+	check(fs.mkdir("/root", "dir1"))
+	check(fs.touch("/root/dir1", "file1"))
 
 	// Create a filesystem snapshot
-	createFilesystemSnapshot()
+	fs.createFilesystemSnapshot()
 
 	// Modify the filesystem
-	mkdir("/root", "dir2")
-	touch("/root/dir2", "file2")
+	check(fs.mkdir("/root", "dir2"))
+	check(fs.touch("/root/dir2", "file2"))
 
-	ls("/root")
+	fs.ls("/root")
 
 	// Restore the filesystem snapshot
-	restoreFilesystemSnapshot()
+	fs.restoreFilesystemSnapshot()
 
 	// List root directory after restoring snapshot
-	ls("/root")
+	fs.ls("/root")
 
 	// Create a directory snapshot
-	createDirectorySnapshot("/root/dir1")
+	fs.createDirectorySnapshot("/root/dir1")
 
 	// Modify the directory
-	touch("/root/dir1", "file2")
+	check(fs.touch("/root/dir1", "file2"))
 
-	ls("/root/dir1")
+	fs.ls("/root/dir1")
 
 	// Restore the directory snapshot
-	restoreDirectorySnapshot("/root/dir1")
+	fs.restoreDirectorySnapshot("/root/dir1")
 
 	// List directory after restoring snapshot
-	ls("/root/dir1")
+	fs.ls("/root/dir1")
 
-	checkFilesystemConsistency()
+	fs.checkFilesystemConsistency()
 }
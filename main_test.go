@@ -0,0 +1,1647 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDanglingEntries(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("root", "d")
+	fs.touch("root/d", "real")
+	fs.addEntryToDir(fs.resolvePath("root/d"), DirEntry{Name: "ghost", InodeIndex: 9999})
+
+	dangling, err := fs.danglingEntries("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/root/d/ghost"}; !reflect.DeepEqual(dangling, want) {
+		t.Errorf("danglingEntries = %v, want %v", dangling, want)
+	}
+
+	removed, err := fs.removeDanglingEntries("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/root/d/ghost"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removeDanglingEntries = %v, want %v", removed, want)
+	}
+	if dangling, _ := fs.danglingEntries("root"); len(dangling) != 0 {
+		t.Errorf("still dangling: %v", dangling)
+	}
+	if fs.resolvePath("root/d/real") == nil {
+		t.Error("a real entry was removed")
+	}
+	if _, err := fs.danglingEntries("root/missing"); err != ErrNotFound {
+		t.Errorf("fs.danglingEntries(root/missing): %v, want ErrNotFound", err)
+	}
+}
+
+func TestMv(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("root", "a")
+	fs.mkdir("root/a", "sub")
+	fs.mkdir("root", "b")
+	fs.touch("root/a", "f")
+
+	// Within a directory
+	if err := fs.mv("root/a/f", "root/a/g"); err != nil {
+		t.Fatal(err)
+	}
+	if fs.resolvePath("root/a/f") != nil || fs.resolvePath("root/a/g") == nil {
+		t.Error("rename within a directory did not move the file")
+	}
+	// Across directories, taking a subtree along
+	for _, err := range []error{fs.mv("root/a/g", "root/b/g"), fs.mv("root/a/sub", "root/b/sub")} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if inode := fs.resolvePath("root/b/g"); inode == nil || inode.Name != "g" {
+		t.Error("moved file not found under its new name")
+	}
+	if inode := fs.resolvePath("root/b/sub"); inode == nil || inode.Parent == nil || inode.Parent.Name != "b" {
+		t.Error("moved directory has the wrong parent")
+	}
+	if entries := fs.dirTree(fs.resolvePath("root/a")).entries(); len(entries) != 0 {
+		t.Errorf("root/a still lists %v", entries)
+	}
+
+	// Into itself or below itself
+	for _, dst := range []string{"root/b/x", "root/b/sub/x"} {
+		if err := fs.mv("root/b", dst); !errors.Is(err, ErrInvalidMove) {
+			t.Errorf("mv root/b %s: %v, want ErrInvalidMove", dst, err)
+		}
+	}
+	if err := fs.mv("root/b/g", "root/b/sub"); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("mv of a file onto a directory: %v, want ErrIsDirectory", err)
+	}
+	if err := fs.mv("root/missing", "root/b/y"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("mv of a missing path: %v, want ErrNotFound", err)
+	}
+}
+
+// mv replaces its destination as POSIX rename does, and a refused mv
+// changes nothing.
+func TestMvReplaces(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.touch("/root", "src")),
+		fs.writeFile("/root/src", []byte("new")),
+		errOf(fs.touch("/root", "dst")),
+		fs.writeFile("/root/dst", []byte("old contents")),
+		fs.link("/root/dst", "/root/dst-link"),
+		errOf(fs.touch("/root", "lone")),
+		fs.writeFile("/root/lone", []byte("lone")),
+		errOf(fs.mkdir("/root", "full")),
+		errOf(fs.touch("/root/full", "x")),
+		errOf(fs.mkdir("/root", "empty")),
+		errOf(fs.mkdir("/root", "moving")),
+		errOf(fs.touch("/root/moving", "y")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Over a file still linked elsewhere, which keeps its contents
+	old := fs.resolvePath("/root/dst")
+	if err := fs.mv("/root/src", "/root/dst"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.readFile("/root/dst"); err != nil || string(data) != "new" {
+		t.Errorf("dst = %q, %v, want new", data, err)
+	}
+	if data, err := fs.readFile("/root/dst-link"); err != nil || string(data) != "old contents" || old.LinkCount != 1 {
+		t.Errorf("dst-link = %q, %v with %d links, want the old contents and 1 link", data, err, old.LinkCount)
+	}
+	if fs.exists("/root/src") {
+		t.Error("/root/src still exists")
+	}
+
+	// Over its last link, which releases the old inode and its blocks
+	usedBefore, _, _ := fs.df()
+	replaced := fs.resolvePath("/root/dst-link").InodeNumber
+	if err := fs.mv("/root/lone", "/root/dst-link"); err != nil {
+		t.Fatal(err)
+	}
+	if used, _, _ := fs.df(); used != usedBefore-1 || fs.lookupInode(replaced) != nil {
+		t.Errorf("%d blocks used, want %d, and inode %d released", used, usedBefore-1, replaced)
+	}
+
+	before := treeOf(t, fs)
+	journal := len(fs.Journal)
+	for _, tt := range []struct {
+		src, dst string
+		want     error
+	}{
+		{"/root/dst", "/root/full", ErrIsDirectory},
+		{"/root/dst", "/root/empty", ErrIsDirectory},
+		{"/root/moving", "/root/dst", ErrNotDirectory},
+		{"/root/moving", "/root/full", ErrNotEmpty},
+	} {
+		if err := fs.mv(tt.src, tt.dst); !errors.Is(err, tt.want) {
+			t.Errorf("mv %s %s: %v, want %v", tt.src, tt.dst, err, tt.want)
+		}
+	}
+	if after := treeOf(t, fs); !reflect.DeepEqual(after, before) || len(fs.Journal) != journal {
+		t.Errorf("refused mv changed the filesystem:\n got %v\nwant %v", after, before)
+	}
+
+	// A directory over an empty one
+	if err := fs.mv("/root/moving", "/root/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.exists("/root/empty/y") || fs.exists("/root/moving") {
+		t.Error("directory was not moved over the empty one")
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+	if got, want := treeOf(t, replayed(fs)), treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after replay:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestChmod(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("root", "d")
+	fs.touch("root", "f")
+	for path, want := range map[string]uint32{"root/d": DefaultDirMode, "root/f": DefaultFileMode} {
+		if inode, err := fs.stat(path); err != nil || inode.Mode != want {
+			t.Errorf("fs.stat(%s) = %v; want mode %o", path, err, want)
+		}
+	}
+	for _, tt := range []struct{ set, want uint32 }{
+		{0600, 0600},
+		{0755, 0755},
+		{04711, 04711},
+		{0170644, 0644},
+	} {
+		if err := fs.chmod("root/f", tt.set); err != nil {
+			t.Fatal(err)
+		}
+		inode, err := fs.stat("root/f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inode.Mode != tt.want {
+			t.Errorf("chmod %o: mode %o, want %o", tt.set, inode.Mode, tt.want)
+		}
+	}
+	if err := fs.chmod("root/missing", 0644); !errors.Is(err, ErrNotFound) {
+		t.Errorf("chmod of a missing file: %v, want ErrNotFound", err)
+	}
+}
+
+// exhaustBlocks allocates every free block and returns them.
+func exhaustBlocks(fs *FileSystem) []int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var blocks []int
+	for {
+		block := fs.allocateBlock()
+		if block < 0 {
+			return blocks
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+func TestAllocateBlockWaitForFree(t *testing.T) {
+	fs := NewFileSystem()
+	fs.setAllocBackoff(AllocBackoff{Initial: time.Millisecond, Max: 10 * time.Millisecond})
+	blocks := exhaustBlocks(fs)
+
+	got := make(chan int)
+	go func() {
+		block, err := fs.allocateBlockWait(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- block
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// The waiter reads blockFreed, which freeBlock replaces, so free the
+	// block under the write lock as the filesystem's own callers do.
+	fs.mu.Lock()
+	err := fs.freeBlock(blocks[3])
+	fs.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case block := <-got:
+		if block != blocks[3] {
+			t.Errorf("waiter got block %d, want the freed %d", block, blocks[3])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter did not get the freed block")
+	}
+}
+
+func TestAllocateBlockWaitGivesUp(t *testing.T) {
+	fs := NewFileSystem()
+	exhaustBlocks(fs)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if block, err := fs.allocateBlockWait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("allocateBlockWait with nothing free = %d, %v; want DeadlineExceeded", block, err)
+	}
+}
+
+// errOf drops the inode returned by mkdir or touch, so the call can go in a
+// list of errors.
+func errOf(_ *Inode, err error) error {
+	return err
+}
+
+func fakeClock(t *testing.T) (advance func(time.Duration)) {
+	t.Helper()
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+	return func(d time.Duration) { clock = clock.Add(d) }
+}
+
+func TestTimestamps(t *testing.T) {
+	advance := fakeClock(t)
+	fs := NewFileSystem()
+	fs.touch("root", "f")
+	created, err := fs.stat("root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdAt, modifiedAt := created.CreatedAt, created.ModifiedAt
+	if !createdAt.Equal(modifiedAt) {
+		t.Errorf("new file created %v but modified %v", createdAt, modifiedAt)
+	}
+
+	advance(time.Hour)
+	if err := fs.writeFile("root/f", []byte("later")); err != nil {
+		t.Fatal(err)
+	}
+	inode, _ := fs.stat("root/f")
+	if !inode.CreatedAt.Equal(createdAt) {
+		t.Errorf("CreatedAt moved from %v to %v", createdAt, inode.CreatedAt)
+	}
+	if want := modifiedAt.Add(time.Hour); !inode.ModifiedAt.Equal(want) {
+		t.Errorf("ModifiedAt = %v, want %v", inode.ModifiedAt, want)
+	}
+
+	advance(time.Hour)
+	if _, err := fs.readFile("root/f"); err != nil {
+		t.Fatal(err)
+	}
+	if inode, _ := fs.stat("root/f"); !inode.ModifiedAt.Equal(modifiedAt.Add(time.Hour)) || !inode.AccessedAt.After(inode.ModifiedAt) {
+		t.Errorf("after a read: modified %v, accessed %v", inode.ModifiedAt, inode.AccessedAt)
+	}
+
+	// A restore brings back the timestamps the snapshot recorded.
+	name, err := fs.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapped, _ := fs.stat("root/f")
+	want := [3]time.Time{snapped.CreatedAt, snapped.ModifiedAt, snapped.AccessedAt}
+	advance(time.Hour)
+	if err := fs.writeFile("root/f", []byte("after the snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.readFile("root/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.restoreNamedSnapshot(name); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := fs.stat("root/f")
+	got := [3]time.Time{restored.CreatedAt, restored.ModifiedAt, restored.AccessedAt}
+	for i := range got {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("restored created, modified, accessed = %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestFileSystemsAreIndependent(t *testing.T) {
+	a, b := NewFileSystem(), NewFileSystem()
+	a.mkdir("root", "only-a")
+	a.touch("root/only-a", "f")
+	if err := a.writeFile("root/only-a/f", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	b.touch("root", "only-b")
+
+	if b.resolvePath("root/only-a") != nil || a.resolvePath("root/only-b") != nil {
+		t.Error("an entry created in one filesystem appears in the other")
+	}
+	if len(a.Journal) == len(b.Journal) {
+		t.Errorf("both journals hold %d entries", len(a.Journal))
+	}
+	if usedBlocks(a) == usedBlocks(b) {
+		t.Errorf("both filesystems use %d blocks", usedBlocks(a))
+	}
+	for _, fs := range []*FileSystem{a, b} {
+		if err := fs.verifyFilesystem(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	fs := NewFileSystem()
+	const workers, files = 3, 3
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			dir := fmt.Sprintf("w%d", w)
+			fs.mkdir("root", dir)
+			for i := 0; i < files; i++ {
+				name := fmt.Sprintf("f%d", i)
+				fs.touch("root/"+dir, name)
+				if err := fs.writeFile("root/"+dir+"/"+name, []byte(name)); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := fs.recentlyModified("root", 5); err != nil {
+					t.Error(err)
+					return
+				}
+				fs.stat("root/w0/f0")
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w := 0; w < workers; w++ {
+		names, err := fs.list(fmt.Sprintf("root/w%d", w))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != files {
+			t.Errorf("w%d holds %d files, want %d", w, len(names), files)
+		}
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReservedBlocks(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		fs.setBlockLimit(fs.Superblock.TotalBlocks),
+		fs.setReservedPercent(10),
+		fs.chmod("/root", 0777),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	reserved := fs.Superblock.ReservedBlocks
+	if reserved == 0 {
+		t.Fatal("no blocks reserved")
+	}
+	fs.setCred(user)
+
+	var err error
+	for i := 0; err == nil; i++ {
+		_, err = fs.touch("/root", fmt.Sprintf("f%d", i))
+	}
+	if !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("filling as a user stopped with %v, want ErrNoSpace", err)
+	}
+	if _, free, _ := fs.df(); free != reserved {
+		t.Errorf("user stopped with %d blocks free, want the %d reserved", free, reserved)
+	}
+
+	fs.setCred(Cred{})
+	for _, err := range []error{
+		errOf(fs.touch("root", "root-file")),
+		fs.writeFile("root/root-file", []byte("root may use the reserve")),
+		fs.verifyFilesystem(),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The reserve stays the same share of the blocks as the filesystem grows,
+// and images keep that share.
+func TestReservedBlocksGrow(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.setReservedPercent(10); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), MaxFileBlocks*BlockSize)
+	for i := 0; fs.Superblock.TotalBlocks == InitialBlocks; i++ {
+		name := fmt.Sprintf("f%d", i)
+		for _, err := range []error{errOf(fs.touch("/root", name)), fs.writeFile("/root/"+name, data)} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if got, want := fs.Superblock.ReservedBlocks, fs.Superblock.TotalBlocks/10; got != want {
+		t.Errorf("%d blocks reserved of %d, want %d", got, fs.Superblock.TotalBlocks, want)
+	}
+
+	loaded := NewFileSystem()
+	loaded.applyImage(fs.newImage())
+	if sb := loaded.Superblock; sb.ReservedPercent != 10 || sb.ReservedBlocks != fs.Superblock.ReservedBlocks {
+		t.Errorf("loaded reserve is %d%%, %d blocks", sb.ReservedPercent, sb.ReservedBlocks)
+	}
+}
+
+func TestDirectoriesNearCapacity(t *testing.T) {
+	fs := NewFileSystem()
+	for dir, n := range map[string]int{"empty": 0, "one": 1, "two": 2, "full": MaxKeys} {
+		fs.mkdir("root", dir)
+		for i := 0; i < n; i++ {
+			fs.touch("root/"+dir, fmt.Sprintf("f%d", i))
+		}
+	}
+
+	for _, tt := range []struct {
+		threshold float64
+		want      []string
+	}{
+		{0.9, []string{"/root/full"}},
+		{0.5, []string{"/root/full", "/root/two"}},
+		{0.2, []string{"/root", "/root/full", "/root/one", "/root/two"}},
+	} {
+		got, err := fs.directoriesNearCapacity(tt.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("directoriesNearCapacity(%v) = %v, want %v", tt.threshold, got, tt.want)
+		}
+	}
+	if _, err := fs.directoriesNearCapacity(1.5); err == nil {
+		t.Error("threshold 1.5 accepted")
+	}
+}
+
+func TestFreeBlocksAndDf(t *testing.T) {
+	fs := NewFileSystem()
+	used0, free0, total := fs.df()
+	if used0+free0 != total {
+		t.Fatalf("df() = %d used + %d free != %d total", used0, free0, total)
+	}
+
+	fs.mkdir("root", "d")
+	withDir, _, _ := fs.df()
+	if withDir != used0+1 {
+		t.Errorf("a directory uses %d blocks, want 1", withDir-used0)
+	}
+	fs.touch("root/d", "f")
+	if err := fs.writeFile("root/d/f", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if used, _, _ := fs.df(); used != withDir+1 {
+		t.Errorf("after writing %d blocks in use, want %d", used, withDir+1)
+	}
+	if err := fs.rm("root/d/f"); err != nil {
+		t.Fatal(err)
+	}
+	if used, _, _ := fs.df(); used != withDir {
+		t.Errorf("after rm %d blocks in use, want %d", used, withDir)
+	}
+	if err := fs.rmdir("root/d"); err != nil {
+		t.Fatal(err)
+	}
+	if used, free, _ := fs.df(); used != used0 || free != free0 {
+		t.Errorf("after rmdir df() = %d, %d; want %d, %d", used, free, used0, free0)
+	}
+
+	fs.mu.Lock()
+	block := fs.allocateBlock()
+	if err := fs.freeBlock(block); err != nil {
+		t.Error(err)
+	}
+	err := fs.freeBlock(block)
+	fs.mu.Unlock()
+	if !errors.Is(err, ErrBlockFree) {
+		t.Errorf("freeing a free block: %v, want ErrBlockFree", err)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDfInodes(t *testing.T) {
+	fs := NewFileSystem()
+	check := func(step string, used, free, total int) {
+		t.Helper()
+		u, f, tot := fs.dfInodes()
+		if u != used || f != free || tot != total {
+			t.Errorf("%s: dfInodes() = %d, %d, %d; want %d, %d, %d", step, u, f, tot, used, free, total)
+		}
+	}
+	check("empty", 1, 0, 1)
+	if err := fs.setInodeLimit(5); err != nil {
+		t.Fatal(err)
+	}
+	check("limited", 1, 4, 5)
+
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := fs.touch("/root", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.mkdir("/root", "d"); err != nil {
+		t.Fatal(err)
+	}
+	check("full", 5, 0, 5)
+	usedBlocks, _, _ := fs.df()
+	if _, err := fs.touch("/root", "e"); err != ErrNoInodes {
+		t.Errorf("touch with no free inodes = %v, want ErrNoInodes", err)
+	}
+	if used, _, _ := fs.df(); used != usedBlocks {
+		t.Errorf("failed touch left %d blocks in use, want %d", used, usedBlocks)
+	}
+
+	if err := fs.rm("/root/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.rmdir("/root/d"); err != nil {
+		t.Fatal(err)
+	}
+	check("after removals", 3, 2, 5)
+	if _, err := fs.touch("/root", "e"); err != nil {
+		t.Fatal(err)
+	}
+	check("slot reused", 4, 1, 5)
+
+	if err := fs.setInodeLimit(4); !errors.Is(err, ErrInvalid) {
+		t.Errorf("limit below the slots in use: %v, want ErrInvalid", err)
+	}
+	restored := NewFileSystem()
+	restored.applyImage(fs.newImage())
+	if u, f, tot := restored.dfInodes(); u != 4 || f != 1 || tot != 5 {
+		t.Errorf("restored dfInodes() = %d, %d, %d; want 4, 1, 5", u, f, tot)
+	}
+	if err := fs.setInodeLimit(0); err != nil {
+		t.Fatal(err)
+	}
+	check("unlimited", 4, 1, 5)
+}
+
+func TestWalk(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("root", "b")
+	fs.mkdir("root/b", "d")
+	fs.mkdir("root", "a")
+	for _, f := range []struct{ dir, name string }{
+		{"root", "z"}, {"root/b", "c"}, {"root/b/d", "e"}, {"root/a", "x"},
+	} {
+		fs.touch(f.dir, f.name)
+	}
+
+	var visited []string
+	if err := fs.Walk("root", func(path string, inode *Inode) error {
+		visited = append(visited, path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/root", "/root/a", "/root/a/x", "/root/b", "/root/b/c", "/root/b/d", "/root/b/d/e", "/root/z"}
+	if !reflect.DeepEqual(visited, want) {
+		t.Errorf("visited %v, want %v", visited, want)
+	}
+
+	stop := errors.New("stop")
+	visited = nil
+	err := fs.Walk("root/b", func(path string, inode *Inode) error {
+		visited = append(visited, path)
+		if path == "/root/b/c" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || !reflect.DeepEqual(visited, []string{"/root/b", "/root/b/c"}) {
+		t.Errorf("stopped walk visited %v and returned %v", visited, err)
+	}
+	if err := fs.Walk("root/missing", func(string, *Inode) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Walk of a missing path: %v, want ErrNotFound", err)
+	}
+}
+
+func TestDu(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("root", "d")
+	fs.mkdir("root/d", "e")
+	sizes := map[string]int{"root/d/a": 100, "root/d/e/b": BlockSize, "root/d/e/c": 1}
+	for path, size := range sizes {
+		dir, name := splitPath(path)
+		fs.touch(dir, name)
+		if err := fs.writeFile(path, bytes.Repeat([]byte("x"), size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, size := range sizes {
+		if got, err := fs.du(path); err != nil || got != size {
+			t.Errorf("du(%s) = %d, %v; want %d", path, got, err, size)
+		}
+	}
+	// Directories count the bytes of their serialized entries
+	dirBytes := func(path string) int {
+		inode := fs.resolvePath(path)
+		fs.flushDirTrees()
+		return len(fs.blocks.data(inode.BlockPointer))
+	}
+	e := dirBytes("root/d/e") + sizes["root/d/e/b"] + sizes["root/d/e/c"]
+	if got, _ := fs.du("root/d/e"); got != e {
+		t.Errorf("du(root/d/e) = %d, want %d", got, e)
+	}
+	d := dirBytes("root/d") + sizes["root/d/a"] + e
+	if got, _ := fs.du("root/d"); got != d {
+		t.Errorf("du(root/d) = %d, want %d", got, d)
+	}
+	if _, err := fs.du("root/missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("du of a missing path: %v, want ErrNotFound", err)
+	}
+}
+
+func TestVerifyAllSerializations(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("root", "d")
+	fs.touch("root/d", "f")
+	if errs := fs.verifyAllSerializations(); len(errs) != 0 {
+		t.Fatalf("errors on a sound filesystem: %v", errs)
+	}
+
+	// A stray separator is dropped when the block is parsed, so writing the
+	// tree back gives different bytes.
+	dir := fs.resolvePath("root/d")
+	fs.mu.Lock()
+	fs.flushDirTrees()
+	stored := fs.blocks.data(dir.BlockPointer)
+	fs.blocks.set(dir.BlockPointer, append(stored[:len(stored)-1:len(stored)-1], ";\n"...), fs.blocks.sum(dir.BlockPointer))
+	fs.cache.drop(dir.BlockPointer)
+	fs.mu.Unlock()
+
+	if errs := fs.verifyAllSerializations(); len(errs) != 1 {
+		t.Errorf("verifyAllSerializations() = %v, want one error", errs)
+	}
+	if fs.verifyFilesystem() == nil {
+		t.Error("consistency check passed with an unstable directory")
+	}
+}
+
+func TestFind(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("root", "a")
+	fs.mkdir("root/a", "b")
+	fs.mkdir("root", "c")
+	fs.mkdir("root/c", "target")
+	for _, dir := range []string{"root", "root/a", "root/a/b"} {
+		fs.touch(dir, "target")
+		fs.touch(dir, "other")
+	}
+
+	got, err := fs.find("root", "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/root/a/b/target", "/root/a/target", "/root/c/target", "/root/target"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("find(root, target) = %v, want %v", got, want)
+	}
+	got, err = fs.find("root/a", "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/root/a/b/target", "/root/a/target"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("find(root/a, target) = %v, want %v", got, want)
+	}
+	if got, _ := fs.find("root", "missing"); len(got) != 0 {
+		t.Errorf("find of a missing name = %v", got)
+	}
+	if got, err := fs.find("root/missing", "target"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("find under a missing root = %v, %v; want ErrNotFound", got, err)
+	}
+}
+
+func TestRootPathForms(t *testing.T) {
+	fs := NewFileSystem()
+	root, err := fs.stat("/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.mkdir("/root", "dir1")
+	dir1, err := fs.stat("/root/dir1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path, canonical string
+		inode           *Inode
+	}{
+		{"/", "/root", root},
+		{"/root", "/root", root},
+		{"/root/", "/root", root},
+		{"//root//", "/root", root},
+		{"/root/dir1", "/root/dir1", dir1},
+		{"/root/dir1/", "/root/dir1", dir1},
+		{"//root//dir1", "/root/dir1", dir1},
+	} {
+		if got := canonicalPath(tt.path); got != tt.canonical {
+			t.Errorf("canonicalPath(%q) = %q, want %q", tt.path, got, tt.canonical)
+		}
+		if got, err := fs.stat(tt.path); err != nil || got != tt.inode {
+			t.Errorf("stat(%q) = inode %v, %v; want %d", tt.path, got, err, tt.inode.InodeNumber)
+		}
+	}
+	if fs.resolvePath("/other") != nil {
+		t.Error("a path outside /root resolved")
+	}
+}
+
+func TestDotSegments(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("/root", "a")
+	fs.mkdir("/root/a", "b")
+	fs.touch("/root/a/b", "f")
+
+	for _, tt := range []struct{ path, want string }{
+		{"/root/a/./b/f", "/root/a/b/f"},
+		{"/root/a/b/../b/f", "/root/a/b/f"},
+		{"/root/a/b/../../a/b/./f", "/root/a/b/f"},
+		{"/root/..", "/root"},
+		{"/root/../../..", "/root"},
+		{"/root/a/../../../a/b", "/root/a/b"},
+		{"/../root/a", "/root/a"},
+		{"/./root/./a/.", "/root/a"},
+	} {
+		if got := canonicalPath(tt.path); got != tt.want {
+			t.Errorf("canonicalPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+		want, err := fs.stat(tt.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := fs.stat(tt.path); err != nil || got != want {
+			t.Errorf("stat(%q) = %v, %v; want the inode of %s", tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("/root", "d")
+	fs.mkdir("/root", "x")
+	fs.touch("/root/d", "f")
+	for _, err := range []error{
+		fs.writeFile("/root/d/f", []byte("target")),
+		fs.symlink("d/f", "/root/rel"),
+		fs.symlink("/root/d", "/root/dirlink"),
+		fs.symlink("/root/nowhere", "/root/x/dangling"),
+		fs.symlink("/root/x/b", "/root/x/a"),
+		fs.symlink("/root/x/a", "/root/x/b"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Working links are followed, including through a directory
+	for _, path := range []string{"/root/rel", "/root/dirlink/f"} {
+		if data, err := fs.readFile(path); err != nil || string(data) != "target" {
+			t.Errorf("readFile(%s) = %q, %v", path, data, err)
+		}
+	}
+	if target, err := fs.readlink("/root/rel"); err != nil || target != "d/f" {
+		t.Errorf("readlink(/root/rel) = %q, %v", target, err)
+	}
+
+	// A dangling link exists itself but doesn't resolve
+	if _, err := fs.stat("/root/x/dangling"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("stat of a dangling link: %v, want ErrNotFound", err)
+	}
+	if inode, err := fs.lstat("/root/x/dangling"); err != nil || !inode.IsSymlink {
+		t.Errorf("lstat of a dangling link = %v, %v", inode, err)
+	}
+
+	// A cycle is detected rather than followed forever
+	if _, err := fs.stat("/root/x/a"); !errors.Is(err, ErrTooManyLinks) {
+		t.Errorf("stat of a link cycle: %v, want ErrTooManyLinks", err)
+	}
+	if _, err := fs.readFile("/root/x/b"); err == nil {
+		t.Error("readFile of a link cycle succeeded")
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHardLinks(t *testing.T) {
+	fs := NewFileSystem()
+	fs.mkdir("/root", "other")
+	fs.touch("/root", "f")
+	for _, err := range []error{fs.writeFile("/root/f", []byte("shared")), fs.link("/root/f", "/root/other/g")} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, _ := fs.stat("/root/f")
+	g, _ := fs.stat("/root/other/g")
+	if f != g || f.LinkCount != 2 {
+		t.Fatalf("link gave inodes %p and %p with link count %d", f, g, f.LinkCount)
+	}
+	if err := fs.writeFile("/root/other/g", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := fs.readFile("/root/f"); string(data) != "changed" {
+		t.Errorf("write through one link not seen through the other: %q", data)
+	}
+
+	used := fs.Superblock.TotalInodes
+	if err := fs.rm("/root/f"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.readFile("/root/other/g"); err != nil || string(data) != "changed" {
+		t.Errorf("after removing one link the other reads %q, %v", data, err)
+	}
+	if g.LinkCount != 1 {
+		t.Errorf("link count %d after rm, want 1", g.LinkCount)
+	}
+	if now := fs.Superblock.TotalInodes; now != used {
+		t.Errorf("inodes in use went from %d to %d while a link remains", used, now)
+	}
+	if err := fs.rm("/root/other/g"); err != nil {
+		t.Fatal(err)
+	}
+	if now := fs.Superblock.TotalInodes; now != used-1 {
+		t.Errorf("inodes in use %d after the last link went, want %d", now, used-1)
+	}
+
+	fs.mkdir("/root", "dir")
+	if err := fs.link("/root/dir", "/root/dirlink"); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("linking a directory: %v, want ErrIsDirectory", err)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWorkingDirectory(t *testing.T) {
+	fs := NewFileSystem()
+	if fs.pwd() != "/root" {
+		t.Errorf("initial pwd = %s, want /root", fs.pwd())
+	}
+	fs.mkdir("/root", "a")
+	fs.mkdir("/root/a", "b")
+	for _, err := range []error{fs.cd("a"), fs.cd("b")} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fs.pwd() != "/root/a/b" {
+		t.Errorf("pwd = %s, want /root/a/b", fs.pwd())
+	}
+	fs.touch(".", "here")
+	fs.mkdir("..", "sibling")
+	for _, err := range []error{fs.writeFile("here", []byte("rel")), fs.mv("here", "../sibling/moved")} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, err := fs.readFile("/root/a/sibling/moved"); err != nil || string(data) != "rel" {
+		t.Errorf("file created by relative path = %q, %v", data, err)
+	}
+
+	if err := fs.cd("/root"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := fs.readFile("a/sibling/moved"); string(data) != "rel" {
+		t.Errorf("relative read from /root = %q", data)
+	}
+	fs.touch("/root", "file")
+	if err := fs.cd("file"); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("cd into a file: %v, want ErrNotDirectory", err)
+	}
+	if err := fs.cd("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("cd into a missing directory: %v, want ErrNotFound", err)
+	}
+	if fs.pwd() != "/root" {
+		t.Errorf("failed cd changed pwd to %s", fs.pwd())
+	}
+}
+
+func TestInodeNumbersReused(t *testing.T) {
+	fs := NewFileSystem()
+	for _, dir := range []string{"a", "b", "c"} {
+		fs.mkdir("/root", dir)
+	}
+	numbers := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		path := fmt.Sprintf("/root/%c/f%d", 'a'+i/3, i)
+		dir, name := splitPath(path)
+		fs.touch(dir, name)
+		numbers[path] = fs.resolvePath(path).InodeNumber
+	}
+	freed := make(map[int]bool)
+	for _, path := range []string{"/root/a/f1", "/root/b/f3", "/root/b/f4"} {
+		if err := fs.rm(path); err != nil {
+			t.Fatal(err)
+		}
+		freed[numbers[path]] = true
+	}
+	mapLen := len(fs.Superblock.InodeMap)
+
+	inUse := make(map[int]bool)
+	for _, path := range []string{"/root/a/f0", "/root/a/f2", "/root/b/f5"} {
+		inUse[numbers[path]] = true
+	}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("d%d", i)
+		fs.mkdir("/root/c", name)
+		inode := fs.resolvePath("/root/c/" + name)
+		if !freed[inode.InodeNumber] {
+			t.Errorf("new inode %d, want one of the freed %v", inode.InodeNumber, freed)
+		}
+		if inUse[inode.InodeNumber] {
+			t.Errorf("inode %d handed out twice", inode.InodeNumber)
+		}
+		inUse[inode.InodeNumber] = true
+	}
+	if len(fs.Superblock.InodeMap) != mapLen {
+		t.Errorf("inode map grew from %d to %d with free slots", mapLen, len(fs.Superblock.InodeMap))
+	}
+	fs.touch("/root/b", "next")
+	if inode := fs.resolvePath("/root/b/next"); inode != nil && inUse[inode.InodeNumber] {
+		t.Errorf("inode %d handed out twice", inode.InodeNumber)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLsLong(t *testing.T) {
+	fakeClock(t)
+	fs := NewFileSystem()
+	if _, err := fs.mkdir("/root", "dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.touch("/root", "file"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		fs.writeFile("/root/file", []byte("12345")),
+		fs.symlink("file", "/root/link"),
+		fs.chmod("/root/dir", 0750),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := fs.lsLong("/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"drwxr-x---   1     0     0        0 Jan  1 00:00 dir",
+		"-rw-r--r--   1     0     0        5 Jan  1 00:00 file",
+		"Lrwxrwxrwx   1     0     0        4 Jan  1 00:00 link -> file",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lsLong:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if _, err := fs.lsLong("/root/file"); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("lsLong of a file: %v, want ErrNotDirectory", err)
+	}
+}
+
+func TestLsRecursive(t *testing.T) {
+	fs := NewFileSystem()
+	for _, dir := range [][2]string{{"/root", "a"}, {"/root/a", "b"}, {"/root/a/b", "c"}, {"/root", "d"}} {
+		if _, err := fs.mkdir(dir[0], dir[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range [][2]string{{"/root", "top"}, {"/root/a", "one"}, {"/root/a/b", "two"}, {"/root/a/b/c", "three"}} {
+		if _, err := fs.touch(file[0], file[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := fs.lsRecursive("/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"/root:", "a", "d", "top",
+		"",
+		"/root/a:", "b", "one",
+		"",
+		"/root/a/b:", "c", "two",
+		"",
+		"/root/a/b/c:", "three",
+		"",
+		"/root/d:",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lsRecursive:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestConsistencyCheckFindsCycle(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{errOf(fs.mkdir("/root", "a")), errOf(fs.mkdir("/root/a", "b"))} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := fs.stat("/root/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.stat("/root/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.addEntryToDir(b, DirEntry{Name: "loop", InodeIndex: a.InodeNumber})
+
+	err = fs.verifyFilesystem()
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("verifyFilesystem = %v, want a cycle", err)
+	}
+}
+
+func TestConsistencyCheckFindsOrphan(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.stat("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.stat("/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fs.removeEntryFromDir(root, "f") {
+		t.Fatal("entry not removed")
+	}
+
+	err = fs.verifyFilesystem()
+	if want := fmt.Sprintf("orphaned inode: %d", f.InodeNumber); err == nil || err.Error() != want {
+		t.Errorf("verifyFilesystem = %v, want %q", err, want)
+	}
+}
+
+// A block taken off the free list but never used, as a double allocation
+// leaves one, is reported, as is a block listed as free twice. Both are
+// for repair to fix.
+func TestConsistencyCheckFindsFreeListErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		spoil func(fs *FileSystem) int
+		want  string
+	}{
+		{"leaked", func(fs *FileSystem) int {
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+			return fs.allocateBlock()
+		}, "block leaked: %d is neither used nor free"},
+		{"duplicate", func(fs *FileSystem) int {
+			block := fs.Superblock.FreeBlocks[len(fs.Superblock.FreeBlocks)-1]
+			fs.Superblock.FreeBlocks = append(fs.Superblock.FreeBlocks, block)
+			return block
+		}, "duplicate free block: %d"},
+	} {
+		fs := NewFileSystem()
+		if _, err := fs.touch("/root", "f"); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.verifyFilesystem(); err != nil {
+			t.Fatal(err)
+		}
+		block := tt.spoil(fs)
+
+		err := fs.verifyFilesystem()
+		if want := fmt.Sprintf(tt.want, block); err == nil || err.Error() != want {
+			t.Errorf("%s: verifyFilesystem = %v, want %q", tt.name, err, want)
+		}
+		if _, err := fs.repair(); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.verifyFilesystem(); err != nil {
+			t.Errorf("%s: after repair: %v", tt.name, err)
+		}
+	}
+}
+
+// Entries whose inode has no Parent, or whose index lies outside the
+// InodeMap, are reported rather than crashing the check, and repair fixes
+// both.
+func TestConsistencyCheckFindsBadReferences(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		spoil func(fs *FileSystem, f *Inode) int
+		want  string
+	}{
+		{"nil parent", func(fs *FileSystem, f *Inode) int {
+			f.Parent = nil
+			return f.InodeNumber
+		}, "inconsistent parent: inode %d has none"},
+		{"wrong parent", func(fs *FileSystem, f *Inode) int {
+			f.Parent = fs.resolvePath("/root/d")
+			return f.InodeNumber
+		}, "inode parent mismatch: %d"},
+		{"out of range", func(fs *FileSystem, f *Inode) int {
+			index := len(fs.Superblock.InodeMap) + 10
+			fs.addEntryToDir(fs.resolvePath("/root"), DirEntry{Name: "far", InodeIndex: index})
+			return index
+		}, "inode reference out of range in B-tree: %d"},
+	} {
+		fs := NewFileSystem()
+		for _, err := range []error{errOf(fs.mkdir("/root", "d")), errOf(fs.touch("/root", "f"))} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		number := tt.spoil(fs, fs.resolvePath("/root/f"))
+
+		err := fs.verifyFilesystem()
+		if want := fmt.Sprintf(tt.want, number); err == nil || err.Error() != want {
+			t.Errorf("%s: verifyFilesystem = %v, want %q", tt.name, err, want)
+		}
+		if _, err := fs.repair(); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.verifyFilesystem(); err != nil {
+			t.Errorf("%s: after repair: %v", tt.name, err)
+		}
+	}
+}
+
+func TestBlocksGrowPastInitialSize(t *testing.T) {
+	fs := NewFileSystem()
+	if fs.Superblock.TotalBlocks != InitialBlocks {
+		t.Fatalf("TotalBlocks = %d, want %d", fs.Superblock.TotalBlocks, InitialBlocks)
+	}
+	files := InitialBlocks/MaxFileBlocks + 1
+	data := pattern(MaxFileBlocks * BlockSize)
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("f%d", i)
+		for _, err := range []error{
+			errOf(fs.touch("/root", name)),
+			fs.writeFile("/root/"+name, data),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if total := fs.Superblock.TotalBlocks; total <= InitialBlocks || fs.blocks.len() != total {
+		t.Errorf("TotalBlocks = %d with %d data blocks after writing past %d", total, fs.blocks.len(), InitialBlocks)
+	}
+	got, err := fs.readFile(fmt.Sprintf("/root/f%d", files-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("file past the initial blocks reads back wrong")
+	}
+
+	// Once the limit is reached a write fails and the blocks it had
+	// already taken are given back.
+	if err := fs.setBlockLimit(fs.Superblock.TotalBlocks); err != nil {
+		t.Fatal(err)
+	}
+	for i := files; ; i++ {
+		name := fmt.Sprintf("f%d", i)
+		if _, err := fs.touch("/root", name); err != nil {
+			t.Fatal(err)
+		}
+		_, free, _ := fs.df()
+		err := fs.writeFile("/root/"+name, data)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrNoSpace) {
+			t.Fatalf("writing past the limit: %v, want ErrNoSpace", err)
+		}
+		if _, after, _ := fs.df(); after != free {
+			t.Errorf("failed write left %d free blocks, want %d", after, free)
+		}
+		if inode, _ := fs.stat("/root/" + name); inode.Size != 0 || inode.BlockPointer < 0 {
+			t.Errorf("failed write left Size %d, BlockPointer %d", inode.Size, inode.BlockPointer)
+		}
+		break
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateWithNoFreeBlocks(t *testing.T) {
+	fs := NewFileSystem()
+	blocks := exhaustBlocks(fs)
+	inodes := fs.Superblock.TotalInodes
+
+	if _, err := fs.touch("/root", "f"); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("touch with no free blocks: %v, want ErrNoSpace", err)
+	}
+	if _, err := fs.mkdir("/root", "d"); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("mkdir with no free blocks: %v, want ErrNoSpace", err)
+	}
+	if err := fs.symlink("f", "/root/l"); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("symlink with no free blocks: %v, want ErrNoSpace", err)
+	}
+	if fs.Superblock.TotalInodes != inodes || fs.resolvePath("/root/f") != nil || fs.resolvePath("/root/d") != nil {
+		t.Error("failed creates left inodes behind")
+	}
+
+	fs.mu.Lock()
+	for _, block := range blocks {
+		if err := fs.freeBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.mu.Unlock()
+	for _, err := range []error{errOf(fs.touch("/root", "f")), fs.verifyFilesystem()} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExistsIsDirIsFile(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "d")),
+		errOf(fs.touch("/root/d", "f")),
+		fs.symlink("d/f", "/root/to-file"),
+		fs.symlink("d", "/root/to-dir"),
+		fs.symlink("missing", "/root/dangling"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		path                  string
+		exists, isDir, isFile bool
+	}{
+		{"/root", true, true, false},
+		{"/", true, true, false},
+		{"", true, true, false},
+		{"/root/", true, true, false},
+		{"/root/d", true, true, false},
+		{"/root/d/f", true, false, true},
+		{"d//f", true, false, true},
+		{"/root/to-file", true, false, true},
+		{"/root/to-dir", true, true, false},
+		{"/root/dangling", false, false, false},
+		{"/root/missing", false, false, false},
+		{"/root/d/f/below", false, false, false},
+		{"/elsewhere", false, false, false},
+		{"//\x00/..//", false, false, false},
+		{"/root/../../..", true, true, false},
+	} {
+		if got := fs.exists(tt.path); got != tt.exists {
+			t.Errorf("exists(%q) = %v, want %v", tt.path, got, tt.exists)
+		}
+		if got := fs.isDir(tt.path); got != tt.isDir {
+			t.Errorf("isDir(%q) = %v, want %v", tt.path, got, tt.isDir)
+		}
+		if got := fs.isFile(tt.path); got != tt.isFile {
+			t.Errorf("isFile(%q) = %v, want %v", tt.path, got, tt.isFile)
+		}
+	}
+}
+
+func TestCreateReturnsInode(t *testing.T) {
+	fs := NewFileSystem()
+	dir, err := fs.mkdir("/root", "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.touch("/root/d", "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		inode *Inode
+		path  string
+		name  string
+		isDir bool
+	}{
+		{dir, "/root/d", "d", true},
+		{file, "/root/d/f", "f", false},
+	} {
+		if tt.inode.Name != tt.name || tt.inode.IsDirectory != tt.isDir {
+			t.Errorf("%s: Name %q, IsDirectory %v", tt.path, tt.inode.Name, tt.inode.IsDirectory)
+		}
+		if b := tt.inode.BlockPointer; b < 0 || b >= fs.Superblock.TotalBlocks {
+			t.Errorf("%s: BlockPointer %d out of range", tt.path, b)
+		}
+		if resolved, _ := fs.stat(tt.path); resolved != tt.inode {
+			t.Errorf("%s: returned inode is not the one at the path", tt.path)
+		}
+	}
+	if file.Parent != dir {
+		t.Error("file's Parent is not the returned directory")
+	}
+	if dir.BlockPointer == file.BlockPointer {
+		t.Error("directory and file share a block")
+	}
+
+	if inode, err := fs.touch("/root/d", "f"); err == nil || inode != nil {
+		t.Errorf("touch of an existing name = %v, %v; want nil and an error", inode, err)
+	}
+	if inode, err := fs.mkdir("/root/missing", "d"); err == nil || inode != nil {
+		t.Errorf("mkdir in a missing directory = %v, %v; want nil and an error", inode, err)
+	}
+}
+
+func TestPathHelpers(t *testing.T) {
+	for _, tt := range []struct {
+		path, clean, dir, base string
+	}{
+		{"/root", "/root", "/root", "root"},
+		{"/", "/root", "/root", "root"},
+		{"/root/", "/root", "/root", "root"},
+		{"/root/..", "/root", "/root", "root"},
+		{"//root//a//", "/root/a", "/root", "a"},
+		{"/root/a/b/", "/root/a/b", "/root/a", "b"},
+		{"/root/a/./b/../c", "/root/a/c", "/root/a", "c"},
+		{"a//b/", "a/b", "a", "b"},
+		{"../a", "../a", "..", "a"},
+		{"a/../..", "..", ".", ".."},
+		{"", ".", ".", "."},
+	} {
+		if got := cleanPath(tt.path); got != tt.clean {
+			t.Errorf("cleanPath(%q) = %q, want %q", tt.path, got, tt.clean)
+		}
+		if got := dirname(tt.path); got != tt.dir {
+			t.Errorf("dirname(%q) = %q, want %q", tt.path, got, tt.dir)
+		}
+		if got := basename(tt.path); got != tt.base {
+			t.Errorf("basename(%q) = %q, want %q", tt.path, got, tt.base)
+		}
+	}
+	for _, tt := range []struct {
+		parts []string
+		want  string
+	}{
+		{[]string{"/root", "a/", "/b"}, "/root/a/b"},
+		{[]string{"/root/a", "../b"}, "/root/b"},
+		{[]string{"", "a", ""}, "a"},
+		{[]string{"a", "..", ".."}, ".."},
+		{nil, "."},
+	} {
+		if got := joinPath(tt.parts...); got != tt.want {
+			t.Errorf("joinPath(%q) = %q, want %q", tt.parts, got, tt.want)
+		}
+	}
+
+	// The operations accept the same untidy forms.
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root/", "d")),
+		errOf(fs.touch("//root//d/", "f")),
+		fs.mv("/root/d//f/", "/root/./d/g"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := fs.list("/root/d/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"g"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("list = %v, want %v", got, want)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRmdirAll(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "d")),
+		errOf(fs.mkdir("/root/d", "sub")),
+		errOf(fs.touch("/root/d", "a")),
+		errOf(fs.touch("/root/d/sub", "b")),
+		fs.symlink("/root/d", "/root/d/sub/up"),
+		errOf(fs.touch("/root", "keep")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := fs.lsRecursive("/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := len(fs.Journal)
+
+	want := []string{"/root/d/sub/up", "/root/d/sub/b", "/root/d/sub", "/root/d/a", "/root/d"}
+	paths, err := fs.rmdirAll("/root/d", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("dry run:\n got %v\nwant %v", paths, want)
+	}
+	after, err := fs.lsRecursive("/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after, before) || len(fs.Journal) != journal {
+		t.Errorf("dry run changed the filesystem:\n got %v\nwant %v", after, before)
+	}
+
+	paths, err = fs.rmdirAll("/root/d", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("removed:\n got %v\nwant %v", paths, want)
+	}
+	if fs.exists("/root/d") || !fs.exists("/root/keep") {
+		t.Errorf("after rmdirAll: /root/d exists %v, /root/keep exists %v", fs.exists("/root/d"), fs.exists("/root/keep"))
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+	if replayed(fs).exists("/root/d") {
+		t.Error("/root/d exists after replay")
+	}
+
+	if _, err := fs.rmdirAll("/root/keep", true); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("rmdirAll of a file: %v, want ErrNotDirectory", err)
+	}
+	if _, err := fs.rmdirAll("/root", true); !errors.Is(err, ErrBusy) {
+		t.Errorf("rmdirAll of the root: %v, want ErrBusy", err)
+	}
+}
+
+// A dry run reports a permission problem anywhere in the tree just as the
+// real removal would, and the real removal then removes nothing.
+func TestRmdirAllChecksPermissionsFirst(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "d")),
+		errOf(fs.touch("/root/d", "a")),
+		errOf(fs.mkdir("/root/d", "locked")),
+		errOf(fs.touch("/root/d/locked", "b")),
+		fs.chmod("/root", 0777),
+		fs.chown("/root/d", 1000, 1000),
+		fs.chmod("/root/d/locked", 0755),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.setCred(user)
+	for _, dryRun := range []bool{true, false} {
+		if _, err := fs.rmdirAll("/root/d", dryRun); !errors.Is(err, ErrPermission) {
+			t.Errorf("rmdirAll with dry run %v: %v, want ErrPermission", dryRun, err)
+		}
+	}
+	if !fs.exists("/root/d/a") {
+		t.Error("/root/d/a was removed")
+	}
+}
+
+func TestMkdirAll(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.mkdirAll("/root/a/b/c/d"); err != nil {
+		t.Fatal(err)
+	}
+	inode := fs.resolvePath("/root/a/b/c/d")
+	if inode == nil || !inode.IsDirectory {
+		t.Fatal("/root/a/b/c/d was not created as a directory")
+	}
+	journal := len(fs.Journal)
+	for _, path := range []string{"/root/a/b/c/d", "a/b", "/root"} {
+		if err := fs.mkdirAll(path); err != nil {
+			t.Errorf("mkdirAll(%q) again: %v", path, err)
+		}
+	}
+	if len(fs.Journal) != journal {
+		t.Error("mkdirAll of existing directories changed the journal")
+	}
+	if err := fs.mkdirAll("/root/a/x/y"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.touch("/root/a", "file"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/root/a/file", "/root/a/file/sub"} {
+		if err := fs.mkdirAll(path); !errors.Is(err, ErrNotDirectory) {
+			t.Errorf("mkdirAll(%q): %v, want ErrNotDirectory", path, err)
+		}
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+	if !replayed(fs).exists("/root/a/x/y") {
+		t.Error("/root/a/x/y is missing after replay")
+	}
+}
+
+// Removing a subtree frees every inode and block in it, across directories
+// big enough to need inner B-tree nodes, but not a file linked from outside.
+func TestRemoveAll(t *testing.T) {
+	fs, err := NewFileSystemWithOrder(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inodes := func() int {
+		n := 0
+		for _, inode := range fs.Superblock.InodeMap {
+			if inode != nil {
+				n++
+			}
+		}
+		return n
+	}
+	if _, err := fs.touch("/root", "keep"); err != nil {
+		t.Fatal(err)
+	}
+	usedBefore, _, _ := fs.df()
+	inodesBefore := inodes()
+
+	for _, dir := range []string{"/root/t/a/x", "/root/t/a/y", "/root/t/b"} {
+		if err := fs.mkdirAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			name := fmt.Sprintf("f%02d", i)
+			if _, err := fs.touch(dir, name); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.writeFile(dir+"/"+name, bytes.Repeat([]byte{byte(i)}, i*BlockSize/4)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := fs.link("/root/t/b/f10", "/root/shared"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.dirTree(fs.resolvePath("/root/t/b")).Root.Children) == 0 {
+		t.Fatal("test directory fits in one B-tree node")
+	}
+
+	if err := fs.removeAll("/root/t"); err != nil {
+		t.Fatal(err)
+	}
+	if fs.exists("/root/t") {
+		t.Error("/root/t still exists")
+	}
+	if data, err := fs.readFile("/root/shared"); err != nil || len(data) != 10*BlockSize/4 {
+		t.Errorf("linked file: %d bytes, %v", len(data), err)
+	}
+	if err := fs.rm("/root/shared"); err != nil {
+		t.Fatal(err)
+	}
+	if used, _, _ := fs.df(); used != usedBefore {
+		t.Errorf("%d blocks used, want %d", used, usedBefore)
+	}
+	if n := inodes(); n != inodesBefore {
+		t.Errorf("%d inodes in use, want %d", n, inodesBefore)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+
+	if err := fs.removeAll("/root/keep"); err != nil || fs.exists("/root/keep") {
+		t.Errorf("removeAll of a file: %v", err)
+	}
+	if err := fs.removeAll("/root"); !errors.Is(err, ErrBusy) {
+		t.Errorf("removeAll of the root: %v, want ErrBusy", err)
+	}
+}
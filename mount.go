@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// Mount loads the filesystem saved at path, or starts an empty one if
+// nothing is saved there yet, and ties it to path so that Unmount writes it
+// back.
+func Mount(path string) (*FileSystem, error) {
+	fs, err := Load(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fs, err = NewFileSystem(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fs.mountPath = path
+	if fs.syncID == 0 {
+		fs.syncID = uint64(time.Now().UnixNano())
+	} else {
+		fs.syncBase = true
+	}
+	return fs, nil
+}
+
+// Unmount writes the filesystem, with its modified directory blocks and its
+// journal, back to the file it was mounted from, taking the place of the
+// records Sync appended, and detaches it: every operation afterwards fails
+// with ErrNotMounted. It fails with ErrNotMounted for a filesystem that
+// didn't come from Mount or has already been unmounted. If the write fails
+// the filesystem stays mounted.
+func (fs *FileSystem) Unmount() error {
+	if err := fs.lockWriteAnyJournal(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	if fs.mountPath == "" {
+		return ErrNotMounted
+	}
+	if err := fs.save(fs.mountPath); err != nil {
+		return err
+	}
+	// The image holds everything synced, so the records are spent.
+	if err := os.Remove(syncPath(fs.mountPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	fs.dirtyBlocks = nil
+	fs.unmounted = true
+	return nil
+}
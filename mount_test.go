@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMountUnmount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fs.img")
+	fs, err := Mount(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		fs.mkdirAll("/root/docs/old"),
+		errOf(fs.touch("/root/docs", "a")),
+		fs.writeFile("/root/docs/a", []byte("kept")),
+		fs.symlink("/root/docs/a", "/root/latest"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := treeOf(t, fs)
+	if err := fs.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, readErr := fs.readFile("/root/docs/a")
+	_, listErr := fs.list("/root")
+	for name, err := range map[string]error{
+		"readFile": readErr,
+		"list":     listErr,
+		"stat":     errOf(fs.stat("/root/docs")),
+		"touch":    errOf(fs.touch("/root", "b")),
+		"rm":       fs.rm("/root/docs/a"),
+		"Save":     fs.Save(path + ".copy"),
+		"Unmount":  fs.Unmount(),
+	} {
+		if !errors.Is(err, ErrNotMounted) {
+			t.Errorf("%s after unmount: %v, want ErrNotMounted", name, err)
+		}
+	}
+
+	fs, err = Mount(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after remount:\n got %v\nwant %v", got, want)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnmountRequiresMount(t *testing.T) {
+	if err := NewFileSystem().Unmount(); !errors.Is(err, ErrNotMounted) {
+		t.Errorf("Unmount of an unmounted filesystem: %v, want ErrNotMounted", err)
+	}
+	path := filepath.Join(t.TempDir(), "bad.img")
+	if err := os.WriteFile(path, []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Mount(path); err == nil {
+		t.Error("Mount of a damaged image succeeded")
+	}
+}
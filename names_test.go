@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInvalidNamesRejected(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("n", DefaultMaxNameLength+1)
+	ops := map[string]func(name string) error{
+		"mkdir": func(name string) error { return errOf(fs.mkdir("/root", name)) },
+		"touch": func(name string) error { return errOf(fs.touch("/root", name)) },
+	}
+	for op, do := range ops {
+		for _, name := range []string{"", ".", "..", "a/b", "a;b", "a\nb", "a\x00b", long} {
+			before := fs.Superblock.TotalInodes
+			if err := do(name); !errors.Is(err, ErrInvalidName) {
+				t.Errorf("%s %q: err = %v, want ErrInvalidName", op, name, err)
+			}
+			if fs.Superblock.TotalInodes != before {
+				t.Errorf("%s %q: inode count changed from %d to %d", op, name, before, fs.Superblock.TotalInodes)
+			}
+		}
+	}
+	for _, path := range []string{"/root/" + long, "/root/a;b"} {
+		if err := fs.link("/root/f", path); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("link to %q: err = %v, want ErrInvalidName", path, err)
+		}
+		if err := fs.symlink("f", path); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("symlink at %q: err = %v, want ErrInvalidName", path, err)
+		}
+		if err := fs.mv("/root/f", path); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("mv to %q: err = %v, want ErrInvalidName", path, err)
+		}
+	}
+
+	// The limit is configurable, and a name at the limit is fine.
+	for _, err := range []error{errOf(fs.touch("/root", long[1:])), fs.setMaxNameLength(4)} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.touch("/root", "abcde"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("touch over a lowered limit: err = %v, want ErrInvalidName", err)
+	}
+	for _, err := range []error{errOf(fs.touch("/root", "abcd")), fs.verifyFilesystem()} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// So is a reloaded filesystem.
+	path := filepath.Join(t.TempDir(), "fs.img")
+	if err := fs.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.touch("/root", "abcde"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("touch over the limit after a reload: err = %v, want ErrInvalidName", err)
+	}
+}
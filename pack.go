@@ -0,0 +1,171 @@
+package main
+
+import "sort"
+
+// PackMaxFileSize is the largest file that is packed into a shared block
+// when block packing is enabled.
+const PackMaxFileSize = 512
+
+// PackedExtent locates a packed file's contents inside a shared block.
+type PackedExtent struct {
+	Block  int
+	Offset int
+	Length int
+}
+
+// setBlockPacking turns block packing on or off for subsequent writes.
+// Files that are already packed stay packed until they are rewritten.
+func (fs *FileSystem) setBlockPacking(enabled bool) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	fs.BlockPacking = enabled
+	fs.checkpointInternal()
+	return nil
+}
+
+// packedInodes returns the inodes whose contents live in the given block,
+// ordered by offset.
+func (fs *FileSystem) packedInodes(block int) []*Inode {
+	var inodes []*Inode
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode != nil && inode.Packed != nil && inode.Packed.Block == block {
+			inodes = append(inodes, inode)
+		}
+	}
+	sort.Slice(inodes, func(i, j int) bool {
+		return inodes[i].Packed.Offset < inodes[j].Packed.Offset
+	})
+	return inodes
+}
+
+// packBlockList returns every block currently holding packed files in
+// ascending order.
+func (fs *FileSystem) packBlockList() []int {
+	seen := make(map[int]bool)
+	var blocks []int
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode != nil && inode.Packed != nil && !seen[inode.Packed.Block] {
+			seen[inode.Packed.Block] = true
+			blocks = append(blocks, inode.Packed.Block)
+		}
+	}
+	sort.Ints(blocks)
+	return blocks
+}
+
+// packFile stores data for inode in a shared pack block, releasing the
+// inode's own block or previous extent.
+func (fs *FileSystem) packFile(inode *Inode, data []byte) error {
+	fs.preserveInode(inode)
+	if inode.Packed != nil {
+		fs.releasePackedExtent(inode)
+	} else if inode.BlockPointer >= 0 {
+		fs.freeBlock(inode.BlockPointer)
+		fs.releaseOverflow(inode)
+		inode.BlockPointer = -1
+	}
+
+	block := -1
+	for _, b := range fs.packBlockList() {
+		if len(fs.blocks.data(b))+len(data) <= BlockSize {
+			block = b
+			break
+		}
+	}
+	if block < 0 {
+		block = fs.allocateBlock()
+		if block < 0 {
+			return ErrNoSpace
+		}
+	}
+
+	// Copy rather than append in place so snapshots sharing the old slice
+	// keep their view of the block.
+	old := fs.blocks.data(block)
+	buf := make([]byte, len(old)+len(data))
+	copy(buf, old)
+	copy(buf[len(old):], data)
+	fs.writeBlock(block, buf)
+
+	inode.Packed = &PackedExtent{Block: block, Offset: len(old), Length: len(data)}
+	return nil
+}
+
+// unpackFile moves a packed file back into a block of its own.
+func (fs *FileSystem) unpackFile(inode *Inode) error {
+	fs.preserveInode(inode)
+	block := fs.allocateBlock()
+	if block < 0 {
+		return ErrNoSpace
+	}
+	ext := inode.Packed
+	fs.writeBlock(block, append([]byte(nil), fs.blocks.data(ext.Block)[ext.Offset:ext.Offset+ext.Length]...))
+	fs.releasePackedExtent(inode)
+	inode.BlockPointer = block
+	return nil
+}
+
+// releasePackedExtent detaches inode from its pack block. The block itself
+// is freed only once no other packed file lives in it.
+func (fs *FileSystem) releasePackedExtent(inode *Inode) {
+	fs.preserveInode(inode)
+	block := inode.Packed.Block
+	inode.Packed = nil
+	if len(fs.packedInodes(block)) == 0 {
+		fs.freeBlock(block)
+	}
+}
+
+// compactPackedBlocks rewrites all packed files contiguously, filling the
+// lowest pack blocks first, and frees blocks left empty. It returns the
+// number of blocks freed.
+func (fs *FileSystem) compactPackedBlocks() int {
+	if err := fs.lockWrite(); err != nil {
+		return 0
+	}
+	defer fs.unlockWrite()
+
+	blocks := fs.packBlockList()
+	var inodes []*Inode
+	var contents [][]byte
+	for _, b := range blocks {
+		for _, inode := range fs.packedInodes(b) {
+			ext := inode.Packed
+			inodes = append(inodes, inode)
+			contents = append(contents, fs.blocks.data(b)[ext.Offset:ext.Offset+ext.Length])
+		}
+	}
+
+	used := 0
+	var buf []byte
+	var placed []*Inode
+	flush := func() {
+		fs.writeBlock(blocks[used], buf)
+		for _, inode := range placed {
+			inode.Packed.Block = blocks[used]
+		}
+		used++
+		buf, placed = nil, nil
+	}
+	for i, inode := range inodes {
+		fs.preserveInode(inode)
+		ext := inode.Packed
+		if len(buf)+ext.Length > BlockSize {
+			flush()
+		}
+		ext.Offset = len(buf)
+		buf = append(buf, contents[i]...)
+		placed = append(placed, inode)
+	}
+	if len(placed) > 0 {
+		flush()
+	}
+
+	for _, b := range blocks[used:] {
+		fs.freeBlock(b)
+	}
+	return len(blocks) - used
+}
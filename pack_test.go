@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// usedBlocks returns how many blocks are off the free list.
+func usedBlocks(fs *FileSystem) int {
+	return fs.Superblock.TotalBlocks - len(fs.Superblock.FreeBlocks)
+}
+
+func TestPackSmallFiles(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.setBlockPacking(true); err != nil {
+		t.Fatal(err)
+	}
+	usedBefore := usedBlocks(fs)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("f%d", i)
+		fs.touch("root", name)
+		if err := fs.writeFile("root/"+name, []byte(fmt.Sprintf("contents of %s", name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocks := fs.packBlockList()
+	if len(blocks) != 1 {
+		t.Fatalf("packed into blocks %v, want one", blocks)
+	}
+	if n := len(fs.packedInodes(blocks[0])); n != 10 {
+		t.Errorf("%d files in the pack block, want 10", n)
+	}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("f%d", i)
+		if data, err := fs.readFile("root/" + name); err != nil || string(data) != "contents of "+name {
+			t.Errorf("%s = %q, %v", name, data, err)
+		}
+	}
+	// touch allocates no blocks, so the pack block is the only one used.
+	if used := usedBlocks(fs) - usedBefore; used != 1 {
+		t.Errorf("%d blocks used for ten packed files, want 1", used)
+	}
+}
+
+func TestPackedFilesGrowOutOfThePack(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.setBlockPacking(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		fs.touch("root", name)
+		if err := fs.writeFile("root/"+name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big := make([]byte, PackMaxFileSize+1)
+	if err := fs.writeFile("root/a", big); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := fs.stat("root/a"); a.Packed != nil {
+		t.Error("a file over PackMaxFileSize stayed packed")
+	}
+	if data, _ := fs.readFile("root/b"); string(data) != "b" {
+		t.Errorf("b = %q after a was unpacked", data)
+	}
+	if data, _ := fs.readFile("root/a"); len(data) != len(big) {
+		t.Errorf("a holds %d bytes, want %d", len(data), len(big))
+	}
+}
+
+func TestCompactPackedBlocks(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.setBlockPacking(true); err != nil {
+		t.Fatal(err)
+	}
+	chunk := make([]byte, PackMaxFileSize)
+	for i := 0; i < 16; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		chunk[0] = byte(i)
+		fs.touch("root", name)
+		if err := fs.writeFile("root/"+name, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(fs.packBlockList()); n != 2 {
+		t.Fatalf("16 files of %d bytes in %d blocks, want 2", PackMaxFileSize, n)
+	}
+	// Growing every other file out of the pack leaves both blocks half full
+	for i := 0; i < 16; i += 2 {
+		if err := fs.writeFile(fmt.Sprintf("root/f%02d", i), make([]byte, PackMaxFileSize+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if freed := fs.compactPackedBlocks(); freed != 1 {
+		t.Errorf("compactPackedBlocks freed %d blocks, want 1", freed)
+	}
+	for i := 1; i < 16; i += 2 {
+		data, err := fs.readFile(fmt.Sprintf("root/f%02d", i))
+		if err != nil || len(data) != PackMaxFileSize || data[0] != byte(i) {
+			t.Errorf("f%02d after compaction: %d bytes, %v", i, len(data), err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+// Permission bits, as in one rwx triplet of a mode.
+const (
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+// may reports whether the credentials set with setCred are granted want, a
+// combination of the perm bits, on inode. As with POSIX ACLs the first
+// class that matches decides: the owner triplet of the mode for the
+// inode's owner, then a user entry of the ACL, then the group triplet and
+// the ACL's group entries, any of which may grant, and finally the other
+// triplet. Root is granted everything.
+func (fs *FileSystem) may(inode *Inode, want uint32) bool {
+	if fs.cred.UID == 0 {
+		return true
+	}
+	if fs.cred.UID == inode.UID {
+		return (inode.Mode>>6)&want == want
+	}
+	for _, e := range inode.ACL {
+		if e.Tag == ACLUser && e.ID == fs.cred.UID {
+			return e.Perm&want == want
+		}
+	}
+	inGroup := false
+	if fs.cred.GID == inode.GID {
+		if (inode.Mode>>3)&want == want {
+			return true
+		}
+		inGroup = true
+	}
+	for _, e := range inode.ACL {
+		if e.Tag == ACLGroup && e.ID == fs.cred.GID {
+			if e.Perm&want == want {
+				return true
+			}
+			inGroup = true
+		}
+	}
+	if inGroup {
+		return false
+	}
+	return inode.Mode&want == want
+}
+
+// mayModifyDir checks that an entry may be created in, or removed from,
+// the directory holding path, which takes write and search permission on
+// it. A missing directory is left for the operation itself to report.
+func (fs *FileSystem) mayModifyDir(path string) error {
+	dir := fs.resolvePath(dirname(fs.absPath(path)))
+	if dir != nil && !fs.may(dir, permWrite|permExec) {
+		return ErrPermission
+	}
+	return nil
+}
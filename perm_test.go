@@ -0,0 +1,324 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var user = Cred{UID: 1000, GID: 1000}
+
+func TestPermissionsNonRoot(t *testing.T) {
+	tests := []struct {
+		mode              uint32
+		uid, gid          int
+		canRead, canWrite bool
+	}{
+		{0644, 0, 0, true, false},
+		{0600, 0, 0, false, false},
+		{0666, 0, 0, true, true},
+		{0640, 0, 1000, true, false},
+		{0660, 0, 1000, true, true},
+		{0600, 1000, 0, true, true},
+		{0400, 1000, 0, true, false},
+		{0077, 1000, 1000, false, false},
+	}
+	for _, tt := range tests {
+		fs := NewFileSystem()
+		for _, err := range []error{
+			errOf(fs.touch("/root", "f")),
+			fs.writeFile("/root/f", []byte("data")),
+			fs.chmod("/root/f", tt.mode),
+			fs.chown("/root/f", tt.uid, tt.gid),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		fs.setCred(user)
+
+		_, err := fs.readFile("/root/f")
+		if got := err == nil; got != tt.canRead || !got && !errors.Is(err, ErrPermission) {
+			t.Errorf("mode %o owner %d:%d: readFile error %v, want allowed %v", tt.mode, tt.uid, tt.gid, err, tt.canRead)
+		}
+		err = fs.writeFile("/root/f", []byte("new"))
+		if got := err == nil; got != tt.canWrite || !got && !errors.Is(err, ErrPermission) {
+			t.Errorf("mode %o owner %d:%d: writeFile error %v, want allowed %v", tt.mode, tt.uid, tt.gid, err, tt.canWrite)
+		}
+	}
+}
+
+func TestCreateNeedsWriteAndExecOnParent(t *testing.T) {
+	for _, tt := range []struct {
+		mode uint32
+		ok   bool
+	}{
+		{0755, false},
+		{0777, true},
+		{0776, false},
+		{0773, true},
+	} {
+		fs := NewFileSystem()
+		for _, err := range []error{
+			errOf(fs.mkdir("/root", "d")),
+			fs.chmod("/root/d", tt.mode),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		fs.setCred(user)
+
+		_, err := fs.touch("/root/d", "f")
+		if got := err == nil; got != tt.ok || !got && !errors.Is(err, ErrPermission) {
+			t.Errorf("touch in a %o directory: %v, want allowed %v", tt.mode, err, tt.ok)
+		}
+		_, err = fs.mkdir("/root/d", "sub")
+		if got := err == nil; got != tt.ok || !got && !errors.Is(err, ErrPermission) {
+			t.Errorf("mkdir in a %o directory: %v, want allowed %v", tt.mode, err, tt.ok)
+		}
+	}
+}
+
+func TestRootBypassesPermissions(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.chown("/root/f", 1000, 1000),
+		fs.chmod("/root/f", 0),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.writeFile("/root/f", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.readFile("/root/f"); err != nil {
+		t.Errorf("root reading a mode 0 file: %v", err)
+	}
+}
+
+func TestTxnChecksPermissions(t *testing.T) {
+	fs := NewFileSystem()
+	if err := errOf(fs.touch("/root", "f")); err != nil {
+		t.Fatal(err)
+	}
+	fs.setCred(user)
+
+	tx := fs.Begin()
+	tx.Rm("/root/f")
+	if err := tx.Commit(); !errors.Is(err, ErrPermission) {
+		t.Errorf("Commit removing a root-owned file: %v, want ErrPermission", err)
+	}
+	if !fs.exists("/root/f") {
+		t.Error("transaction removed a file the user may not remove")
+	}
+
+	tx = fs.Begin()
+	tx.Mkdir("/root", "d")
+	if err := tx.Commit(); !errors.Is(err, ErrPermission) {
+		t.Errorf("Commit creating in a root-owned directory: %v, want ErrPermission", err)
+	}
+}
+
+// Operations later in a transaction are checked against what the earlier
+// ones did, so a user may fill a directory created in the same transaction.
+func TestTxnChecksPermissionsInOrder(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.chmod("/root", 0777); err != nil {
+		t.Fatal(err)
+	}
+	fs.setCred(user)
+
+	tx := fs.Begin()
+	tx.Mkdir("/root", "mine")
+	tx.Touch("/root/mine", "f")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.exists("/root/mine/f") {
+		t.Error("/root/mine/f was not created")
+	}
+}
+
+func TestXattrNeedsWrite(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.setxattr("/root/f", "user.k", "v"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.setCred(user)
+
+	if err := fs.setxattr("/root/f", "user.k", "x"); !errors.Is(err, ErrPermission) {
+		t.Errorf("setxattr on a read-only file: %v, want ErrPermission", err)
+	}
+	if err := fs.removexattr("/root/f", "user.k"); !errors.Is(err, ErrPermission) {
+		t.Errorf("removexattr on a read-only file: %v, want ErrPermission", err)
+	}
+	if v, _ := fs.getxattr("/root/f", "user.k"); v != "v" {
+		t.Errorf("user.k = %q, want \"v\"", v)
+	}
+}
+
+func TestTrashNeedsPermission(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.setTrash(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.rm("/root/f"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.setCred(user)
+
+	if err := fs.undelete("/root/f"); !errors.Is(err, ErrPermission) {
+		t.Errorf("undelete into a root-owned directory: %v, want ErrPermission", err)
+	}
+	if n, err := fs.emptyTrash(); !errors.Is(err, ErrPermission) {
+		t.Errorf("emptyTrash of a root-owned trash = %d, %v; want ErrPermission", n, err)
+	}
+	if len(fs.listTrash()) != 1 {
+		t.Error("the trashed file is gone")
+	}
+}
+
+func TestImportTarChecksPermissions(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "f", Mode: 0644, Size: 3, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := tw.Write([]byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewFileSystem()
+	if err := errOf(fs.mkdir("/root", "closed")); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "open")),
+		fs.chmod("/root/open", 0777),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, err := range []error{
+		errOf(fs.touch("/root/open", "f")),
+		fs.writeFile("/root/open/f", []byte("old")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.setCred(user)
+
+	if err := fs.ImportTar(bytes.NewReader(buf.Bytes()), "/root/closed"); !errors.Is(err, ErrPermission) {
+		t.Errorf("ImportTar into a root-owned directory: %v, want ErrPermission", err)
+	}
+	if fs.exists("/root/closed/f") {
+		t.Error("ImportTar created a file in a root-owned directory")
+	}
+	if err := fs.ImportTar(bytes.NewReader(buf.Bytes()), "/root/open"); !errors.Is(err, ErrPermission) {
+		t.Errorf("ImportTar over a root-owned file: %v, want ErrPermission", err)
+	}
+	if data, _ := fs.readFile("/root/open/f"); string(data) != "old" {
+		t.Errorf("root-owned file overwritten with %q", data)
+	}
+}
+
+func TestImportFromOSChecksPermissions(t *testing.T) {
+	host := t.TempDir()
+	for _, err := range []error{
+		os.Mkdir(filepath.Join(host, "sub"), 0755),
+		os.WriteFile(filepath.Join(host, "sub", "f"), []byte("new"), 0644),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := NewFileSystem()
+	fs.setCred(user)
+	if err := fs.ImportFromOS(host, "/root"); !errors.Is(err, ErrPermission) {
+		t.Errorf("ImportFromOS into a root-owned directory: %v, want ErrPermission", err)
+	}
+	if fs.exists("/root/sub") {
+		t.Error("ImportFromOS created a directory in a root-owned directory")
+	}
+}
+
+func TestChown(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+	if inode, _ := fs.stat("/root/f"); inode.UID != 0 || inode.GID != 0 {
+		t.Errorf("new file owned by %d:%d, want 0:0", inode.UID, inode.GID)
+	}
+	if err := fs.chown("/root/f", 1000, 2000); err != nil {
+		t.Fatal(err)
+	}
+	inode, err := fs.stat("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inode.UID != 1000 || inode.GID != 2000 {
+		t.Errorf("after chown owned by %d:%d, want 1000:2000", inode.UID, inode.GID)
+	}
+	if err := fs.chown("/root/f", -1, 3000); err != nil {
+		t.Fatal(err)
+	}
+	if inode.UID != 1000 || inode.GID != 3000 {
+		t.Errorf("after changing only the group owned by %d:%d, want 1000:3000", inode.UID, inode.GID)
+	}
+	if err := fs.chown("/root/f", -2, 0); !errors.Is(err, ErrInvalid) {
+		t.Errorf("chown to -2: %v, want ErrInvalid", err)
+	}
+
+	// Replaying the journal gives the file the same owner.
+	if inode := replayed(fs).resolvePath("/root/f"); inode == nil || inode.UID != 1000 || inode.GID != 3000 {
+		t.Errorf("after replay owned by %v, want 1000:3000", inode)
+	}
+
+	// Ownership is captured by a snapshot and comes back with it.
+	for _, err := range []error{
+		fs.createNamedSnapshot("s"),
+		fs.chown("/root/f", 0, 0),
+		fs.restoreNamedSnapshot("s"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	inode, err = fs.stat("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inode.UID != 1000 || inode.GID != 3000 {
+		t.Errorf("after restore owned by %d:%d, want 1000:3000", inode.UID, inode.GID)
+	}
+
+	// Only root may give files away.
+	fs.setCred(user)
+	if err := fs.chown("/root/f", 1000, 1000); !errors.Is(err, ErrPermission) {
+		t.Errorf("chown by a user: %v, want ErrPermission", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import "fmt"
+
+// setQuota limits the bytes of file contents and symlink targets held
+// under the directory at path to maxBytes; 0 removes the limit. A limit
+// below the current usage is allowed and only stops further growth. Once
+// a subtree is at its limit, new entries cannot be created in it either.
+//
+// Usage is kept as a running total on the directory. An inode with several
+// hard links counts against the subtree holding its Parent entry.
+func (fs *FileSystem) setQuota(path string, maxBytes int) error {
+	if maxBytes < 0 {
+		return ErrInvalid
+	}
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	dir := fs.resolvePath(path)
+	if dir == nil {
+		return ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return ErrNotDirectory
+	}
+	fs.setQuotaInternal(dir, maxBytes)
+	fs.addJournalEntry("setQuota", fs.absPath(path), map[string]interface{}{
+		"maxBytes": maxBytes,
+	})
+	return nil
+}
+
+func (fs *FileSystem) setQuotaInternal(dir *Inode, maxBytes int) {
+	fs.preserveInode(dir)
+	dir.Quota = maxBytes
+	dir.QuotaUsed = 0
+	if maxBytes > 0 {
+		dir.QuotaUsed = fs.quotaUsage(dir)
+	}
+}
+
+// quotaUsage returns the bytes inode accounts for: its size for a file or
+// symlink, and for a directory the usage of the inodes it is Parent of.
+func (fs *FileSystem) quotaUsage(inode *Inode) int {
+	if !inode.IsDirectory {
+		return inode.Size
+	}
+	total := 0
+	for _, entry := range fs.dirTree(inode).entries() {
+		child := fs.lookupInode(entry.InodeIndex)
+		if child != nil && child.Parent == inode && child.Name == entry.Name {
+			total += fs.quotaUsage(child)
+		}
+	}
+	return total
+}
+
+// checkQuota returns ErrQuotaExceeded if adding delta bytes below dir
+// would take dir or one of its ancestors over its quota. A delta of 0
+// stands for a new empty entry, which is refused once a quota is reached.
+func (fs *FileSystem) checkQuota(dir *Inode, delta int) error {
+	for p := dir; p != nil; p = p.Parent {
+		if p.Quota == 0 {
+			continue
+		}
+		if delta > 0 && p.QuotaUsed+delta > p.Quota || delta == 0 && p.QuotaUsed >= p.Quota {
+			return fmt.Errorf("%s: %w (%d of %d bytes used)", p.Name, ErrQuotaExceeded, p.QuotaUsed, p.Quota)
+		}
+	}
+	return nil
+}
+
+// chargeQuota adds delta bytes to the usage of every quota on the way from
+// dir to the root.
+func (fs *FileSystem) chargeQuota(dir *Inode, delta int) {
+	for p := dir; p != nil; p = p.Parent {
+		if p.Quota > 0 {
+			fs.preserveInode(p)
+			p.QuotaUsed += delta
+		}
+	}
+}
+
+// recountQuotas recomputes every quota's usage from scratch, for use after
+// the inodes have been replaced wholesale.
+func (fs *FileSystem) recountQuotas() {
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode != nil && inode.Quota > 0 {
+			fs.preserveInode(inode)
+			inode.QuotaUsed = fs.quotaUsage(inode)
+		}
+	}
+}
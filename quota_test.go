@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "q")),
+		errOf(fs.mkdir("/root/q", "sub")),
+		fs.setQuota("/root/q", 100),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"/root/q/a", "/root/q/sub/b", "/root/outside"} {
+		if _, err := fs.touch(splitPath(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, err := range []error{
+		fs.writeFile("/root/q/a", pattern(60)),
+		fs.writeFile("/root/q/sub/b", pattern(40)),
+		fs.writeFile("/root/outside", make([]byte, 500)),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q, _ := fs.stat("/root/q"); q.QuotaUsed != 100 {
+		t.Fatalf("QuotaUsed = %d, want 100", q.QuotaUsed)
+	}
+
+	// The subtree is full: growing a file or creating an entry fails.
+	if err := fs.appendFile("/root/q/sub/b", []byte("x")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("append over the quota: %v, want ErrQuotaExceeded", err)
+	}
+	if _, err := fs.touch("/root/q", "c"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("touch in a full subtree: %v, want ErrQuotaExceeded", err)
+	}
+	if _, err := fs.mkdir("/root/q/sub", "d"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("mkdir in a full subtree: %v, want ErrQuotaExceeded", err)
+	}
+	if got, _ := fs.readFile("/root/q/sub/b"); len(got) != 40 {
+		t.Errorf("rejected append left b with %d bytes", len(got))
+	}
+
+	// Deleting frees the quota again.
+	if err := fs.rm("/root/q/a"); err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := fs.stat("/root/q"); q.QuotaUsed != 40 {
+		t.Errorf("QuotaUsed after rm = %d, want 40", q.QuotaUsed)
+	}
+	for _, err := range []error{
+		errOf(fs.touch("/root/q", "c")),
+		fs.writeFile("/root/q/c", pattern(60)),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.writeFile("/root/q/c", pattern(61)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("rewrite over the quota: %v, want ErrQuotaExceeded", err)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+}
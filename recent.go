@@ -0,0 +1,93 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// EntryInfo describes an inode found while scanning a subtree.
+type EntryInfo struct {
+	Path        string
+	Name        string
+	IsDirectory bool
+	Size        int
+	ModifiedAt  time.Time
+}
+
+// entryHeap is a min-heap on ModifiedAt, so the oldest entry is evicted
+// first once the heap exceeds its limit.
+type entryHeap []EntryInfo
+
+func (h entryHeap) Len() int { return len(h) }
+func (h entryHeap) Less(i, j int) bool {
+	if h[i].ModifiedAt.Equal(h[j].ModifiedAt) {
+		return h[i].Path > h[j].Path
+	}
+	return h[i].ModifiedAt.Before(h[j].ModifiedAt)
+}
+func (h entryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *entryHeap) Push(x interface{}) { *h = append(*h, x.(EntryInfo)) }
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// recentlyModified returns up to limit files under root, newest first. A
+// file linked more than once under root is reported once, under the first
+// of its paths in walk order.
+func (fs *FileSystem) recentlyModified(root string, limit int) ([]EntryInfo, error) {
+	return fs.recentlyModifiedEntries(root, limit, false)
+}
+
+// recentlyModifiedEntries is like recentlyModified but can include
+// directories in the results.
+func (fs *FileSystem) recentlyModifiedEntries(root string, limit int, includeDirs bool) ([]EntryInfo, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	dir := fs.resolvePath(root)
+	if dir == nil {
+		return nil, ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return nil, ErrNotDirectory
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	h := &entryHeap{}
+	seen := make(map[int]bool)
+	fs.walkTree(dir, fs.absPath(root), func(path string, inode *Inode) error {
+		if (inode.IsDirectory && !includeDirs) || seen[inode.InodeNumber] {
+			return nil
+		}
+		seen[inode.InodeNumber] = true
+		heap.Push(h, EntryInfo{
+			Path:        path,
+			Name:        basename(path),
+			IsDirectory: inode.IsDirectory,
+			Size:        inode.Size,
+			ModifiedAt:  inode.ModifiedAt,
+		})
+		if h.Len() > limit {
+			heap.Pop(h)
+		}
+		return nil
+	})
+
+	result := []EntryInfo(*h)
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ModifiedAt.Equal(result[j].ModifiedAt) {
+			return result[i].Path < result[j].Path
+		}
+		return result[i].ModifiedAt.After(result[j].ModifiedAt)
+	})
+	return result, nil
+}
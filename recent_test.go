@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecentlyModified(t *testing.T) {
+	advance := fakeClock(t)
+	fs := NewFileSystem()
+	fs.mkdir("root", "d")
+	fs.mkdir("root/d", "e")
+	for _, f := range []struct{ dir, name string }{
+		{"root/d", "old"}, {"root/d/e", "mid"}, {"root", "new"}, {"root/d/e", "newest"},
+	} {
+		advance(time.Minute)
+		fs.touch(f.dir, f.name)
+	}
+	advance(time.Minute)
+	if err := fs.writeFile("root/d/old", []byte("rewritten")); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := func(entries []EntryInfo) []string {
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Path)
+		}
+		return out
+	}
+	got, err := fs.recentlyModified("root", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/root/d/old", "/root/d/e/newest", "/root/new"}; !reflect.DeepEqual(paths(got), want) {
+		t.Errorf("recentlyModified(root, 3) = %v, want %v", paths(got), want)
+	}
+	got, err = fs.recentlyModified("root/d/e", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/root/d/e/newest", "/root/d/e/mid"}; !reflect.DeepEqual(paths(got), want) {
+		t.Errorf("recentlyModified(root/d/e, 10) = %v, want %v", paths(got), want)
+	}
+	if got, _ := fs.recentlyModified("root", 0); len(got) != 0 {
+		t.Errorf("limit 0 returned %v", paths(got))
+	}
+	got, err = fs.recentlyModifiedEntries("root/d", 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/root/d/old"}; !reflect.DeepEqual(paths(got), want) {
+		t.Errorf("recentlyModifiedEntries(root/d, 1) = %v, want %v", paths(got), want)
+	}
+
+	// A file linked twice is reported once, by the name it was found under.
+	if err := fs.link("/root/d/e/newest", "/root/d/a"); err != nil {
+		t.Fatal(err)
+	}
+	got, err = fs.recentlyModified("/root/d", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/root/d/old", "/root/d/a", "/root/d/e/mid"}; !reflect.DeepEqual(paths(got), want) {
+		t.Errorf("recentlyModified(/root/d, 10) with a link = %v, want %v", paths(got), want)
+	}
+	if got[1].Name != "a" {
+		t.Errorf("linked entry is named %q, want a", got[1].Name)
+	}
+}
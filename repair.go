@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// LostAndFound is the directory below the root that repair reattaches
+// orphaned inodes to.
+const LostAndFound = "lost+found"
+
+// repair fixes the problems the consistency check looks for and returns one
+// line per change made. It reattaches orphaned inodes under /root/lost+found,
+// drops directory entries naming missing inodes, rebuilds directory B-trees
+// with underfull nodes, corrects link counts, parent pointers, inode
+// accounting, shared block counts and quota usage, and rebuilds the free
+// block list from the blocks inodes actually use and the usage bitmaps from
+// that. Running it on a consistent filesystem changes nothing beyond the
+// shape of its B-trees.
+func (fs *FileSystem) repair() ([]string, error) {
+	if err := fs.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer fs.unlockWrite()
+
+	var report []string
+	logf := func(format string, args ...interface{}) {
+		report = append(report, fmt.Sprintf(format, args...))
+	}
+
+	fs.repairOrphans(logf)
+	fs.repairDanglingEntries(logf)
+	fs.repairBTrees(logf)
+	fs.repairLinkCounts(logf)
+	fs.repairParents(logf)
+	fs.repairInodeAccounting(logf)
+	fs.repairBlockRefs(logf)
+	fs.repairFreeBlocks(logf)
+	fs.repairQuotas(logf)
+	fs.repairBitmaps(logf)
+	if len(report) > 0 {
+		fs.checkpointInternal()
+	}
+	return report, nil
+}
+
+// reachablePaths maps every inode reachable from the root to the first path
+// found for it. Directories are entered once, so cycles are harmless.
+func (fs *FileSystem) reachablePaths() map[int]string {
+	root := fs.Superblock.InodeMap[0]
+	paths := map[int]string{root.InodeNumber: "/root"}
+	queue := []*Inode{root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		for _, entry := range fs.dirTree(dir).entries() {
+			child := fs.lookupInode(entry.InodeIndex)
+			if child == nil {
+				continue
+			}
+			if _, seen := paths[child.InodeNumber]; seen {
+				continue
+			}
+			paths[child.InodeNumber] = paths[dir.InodeNumber] + "/" + entry.Name
+			if child.IsDirectory {
+				queue = append(queue, child)
+			}
+		}
+	}
+	return paths
+}
+
+// repairOrphans links every unreachable inode into lost+found. An orphaned
+// directory brings its contents with it, so only inodes that no other
+// orphaned directory holds are attached directly.
+func (fs *FileSystem) repairOrphans(logf func(string, ...interface{})) {
+	for {
+		paths := fs.reachablePaths()
+		var orphans []*Inode
+		held := make(map[int]bool)
+		for _, inode := range fs.Superblock.InodeMap {
+			if inode == nil {
+				continue
+			}
+			if _, ok := paths[inode.InodeNumber]; ok {
+				continue
+			}
+			orphans = append(orphans, inode)
+			if inode.IsDirectory {
+				for _, entry := range fs.dirTree(inode).entries() {
+					if entry.InodeIndex != inode.InodeNumber {
+						held[entry.InodeIndex] = true
+					}
+				}
+			}
+		}
+		if len(orphans) == 0 {
+			return
+		}
+
+		// Orphaned directories holding each other in a cycle are all
+		// held; attaching the first one breaks the cycle.
+		orphan := orphans[0]
+		for _, inode := range orphans {
+			if !held[inode.InodeNumber] {
+				orphan = inode
+				break
+			}
+		}
+
+		lostFound := fs.lostAndFound(logf)
+		if lostFound == nil {
+			return
+		}
+		name := fmt.Sprintf("#%d", orphan.InodeNumber)
+		if err := fs.addEntryToDir(lostFound, DirEntry{Name: name, InodeIndex: orphan.InodeNumber}); err != nil {
+			logf("cannot reattach orphaned inode %d: %v", orphan.InodeNumber, err)
+			return
+		}
+		fs.preserveInode(orphan)
+		orphan.Name = name
+		orphan.Parent = lostFound
+		logf("reattached orphaned inode %d as /root/%s/%s", orphan.InodeNumber, LostAndFound, name)
+	}
+}
+
+// lostAndFound returns the lost+found directory, creating it if needed.
+func (fs *FileSystem) lostAndFound(logf func(string, ...interface{})) *Inode {
+	if dir := fs.resolvePath("/root/" + LostAndFound); dir != nil && dir.IsDirectory {
+		return dir
+	}
+	if _, err := fs.mkdirInternal("/root", LostAndFound); err != nil {
+		logf("cannot create /root/%s: %v", LostAndFound, err)
+		return nil
+	}
+	logf("created /root/%s", LostAndFound)
+	return fs.resolvePath("/root/" + LostAndFound)
+}
+
+// repairDanglingEntries removes entries whose inode no longer exists.
+func (fs *FileSystem) repairDanglingEntries(logf func(string, ...interface{})) {
+	paths := fs.reachablePaths()
+	for _, dir := range fs.Superblock.InodeMap {
+		if dir == nil || !dir.IsDirectory {
+			continue
+		}
+		for _, entry := range fs.dirTree(dir).entries() {
+			if fs.lookupInode(entry.InodeIndex) != nil {
+				continue
+			}
+			fs.removeEntryFromDir(dir, entry.Name)
+			logf("removed dangling entry %s/%s for missing inode %d", paths[dir.InodeNumber], entry.Name, entry.InodeIndex)
+		}
+	}
+}
+
+// repairBTrees rebalances every directory B-tree with underfull nodes.
+func (fs *FileSystem) repairBTrees(logf func(string, ...interface{})) {
+	for _, dir := range fs.Superblock.InodeMap {
+		if dir != nil && dir.IsDirectory && fs.rebalanceBTree(dir) {
+			logf("rebalanced B-tree of directory inode %d", dir.InodeNumber)
+		}
+	}
+}
+
+// repairParents points the Parent of each inode with a single link at the
+// directory holding its entry. Hard-linked inodes keep theirs.
+func (fs *FileSystem) repairParents(logf func(string, ...interface{})) {
+	for _, dir := range fs.Superblock.InodeMap {
+		if dir == nil || !dir.IsDirectory {
+			continue
+		}
+		for _, entry := range fs.dirTree(dir).entries() {
+			inode := fs.lookupInode(entry.InodeIndex)
+			if inode == nil || inode.LinkCount > 1 || inode.Parent == dir {
+				continue
+			}
+			logf("set parent of inode %d to directory inode %d", inode.InodeNumber, dir.InodeNumber)
+			fs.preserveInode(inode)
+			inode.Parent = dir
+		}
+	}
+}
+
+// repairLinkCounts sets each inode's LinkCount to the number of entries
+// referring to it.
+func (fs *FileSystem) repairLinkCounts(logf func(string, ...interface{})) {
+	links := make(map[int]int)
+	for _, dir := range fs.Superblock.InodeMap {
+		if dir == nil || !dir.IsDirectory {
+			continue
+		}
+		for _, entry := range fs.dirTree(dir).entries() {
+			links[entry.InodeIndex]++
+		}
+	}
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode == nil || inode.Parent == nil || links[inode.InodeNumber] == inode.LinkCount {
+			continue
+		}
+		logf("set link count of inode %d from %d to %d", inode.InodeNumber, inode.LinkCount, links[inode.InodeNumber])
+		fs.preserveInode(inode)
+		inode.LinkCount = links[inode.InodeNumber]
+	}
+}
+
+// repairInodeAccounting recomputes TotalInodes and the free inode list.
+func (fs *FileSystem) repairInodeAccounting(logf func(string, ...interface{})) {
+	total := 0
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode != nil {
+			total++
+		}
+	}
+	if total != fs.Superblock.TotalInodes {
+		logf("set TotalInodes from %d to %d", fs.Superblock.TotalInodes, total)
+		fs.Superblock.TotalInodes = total
+	}
+
+	free := freeInodeSlots(fs.Superblock.InodeMap)
+	current := append([]int(nil), fs.Superblock.FreeInodes...)
+	sort.Sort(sort.Reverse(sort.IntSlice(current)))
+	if fmt.Sprint(current) != fmt.Sprint(free) {
+		logf("rebuilt free inode list")
+		fs.Superblock.FreeInodes = free
+	}
+}
+
+// repairBlockRefs recounts the owners of shared blocks.
+func (fs *FileSystem) repairBlockRefs(logf func(string, ...interface{})) {
+	refs := countBlockRefs(fs.Superblock.InodeMap)
+	if fmt.Sprint(refs) != fmt.Sprint(fs.Superblock.BlockRefs) {
+		logf("rebuilt shared block reference counts")
+		fs.Superblock.BlockRefs = refs
+	}
+}
+
+// repairQuotas recomputes quota usage that has drifted from the subtree.
+func (fs *FileSystem) repairQuotas(logf func(string, ...interface{})) {
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode == nil || inode.Quota == 0 {
+			continue
+		}
+		if used := fs.quotaUsage(inode); used != inode.QuotaUsed {
+			logf("set quota usage of inode %d from %d to %d", inode.InodeNumber, inode.QuotaUsed, used)
+			fs.preserveInode(inode)
+			inode.QuotaUsed = used
+		}
+	}
+}
+
+// repairFreeBlocks makes the free block list hold exactly the blocks no
+// inode uses. Listed blocks keep their order; reclaimed blocks are appended.
+func (fs *FileSystem) repairFreeBlocks(logf func(string, ...interface{})) {
+	used := make(map[int]bool)
+	for _, inode := range fs.Superblock.InodeMap {
+		if inode == nil {
+			continue
+		}
+		for _, block := range inodeBlocks(inode) {
+			used[block] = true
+		}
+	}
+
+	listed := make(map[int]bool)
+	var free []int
+	for _, block := range fs.Superblock.FreeBlocks {
+		switch {
+		case block < 0 || block >= fs.Superblock.TotalBlocks:
+			logf("dropped invalid free block %d", block)
+		case used[block]:
+			logf("dropped block %d from the free list; it is in use", block)
+		case listed[block]:
+			logf("dropped duplicate free block %d", block)
+		default:
+			listed[block] = true
+			free = append(free, block)
+		}
+	}
+	for block := 0; block < fs.Superblock.TotalBlocks; block++ {
+		if used[block] || listed[block] {
+			continue
+		}
+		fs.dedupForget(block)
+		fs.writeBlock(block, nil)
+		fs.cache.drop(block)
+		free = append(free, block)
+		logf("reclaimed leaked block %d", block)
+	}
+	fs.Superblock.FreeBlocks = free
+}
+
+// repairBitmaps rebuilds the usage bitmaps from the free block list and the
+// InodeMap, which the steps before have put right.
+func (fs *FileSystem) repairBitmaps(logf func(string, ...interface{})) {
+	blocks, inodes := fs.Superblock.BlockBitmap, fs.Superblock.InodeBitmap
+	fs.recountBitmaps()
+	if !blocks.equal(fs.Superblock.BlockBitmap) || !inodes.equal(fs.Superblock.InodeBitmap) {
+		logf("rebuilt usage bitmaps")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	content := bytes.Repeat([]byte("data"), BlockSize/4)
+	setup := func(t *testing.T) *FileSystem {
+		fs := NewFileSystem()
+		for _, err := range []error{
+			errOf(fs.mkdir("/root", "d")),
+			errOf(fs.mkdir("/root/d", "e")),
+			errOf(fs.touch("/root/d", "f")),
+			fs.writeFile("/root/d/f", content),
+			errOf(fs.touch("/root/d/e", "g")),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return fs
+	}
+	inode := func(t *testing.T, fs *FileSystem, path string) *Inode {
+		inode, err := fs.stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inode
+	}
+
+	for _, tt := range []struct {
+		name    string
+		corrupt func(t *testing.T, fs *FileSystem)
+		check   func(t *testing.T, fs *FileSystem)
+	}{
+		{
+			name: "dangling entry",
+			corrupt: func(t *testing.T, fs *FileSystem) {
+				fs.addEntryToDir(inode(t, fs, "/root/d"), DirEntry{Name: "ghost", InodeIndex: 9999})
+			},
+			check: func(t *testing.T, fs *FileSystem) {
+				if fs.resolvePath("/root/d/ghost") != nil {
+					t.Error("dangling entry still listed")
+				}
+			},
+		},
+		{
+			name: "orphaned file",
+			corrupt: func(t *testing.T, fs *FileSystem) {
+				fs.removeEntryFromDir(inode(t, fs, "/root/d"), "f")
+			},
+			check: func(t *testing.T, fs *FileSystem) {
+				matches, err := fs.glob(fmt.Sprintf("/root/%s/*", LostAndFound))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(matches) != 1 {
+					t.Fatalf("lost+found holds %v", matches)
+				}
+				got, err := fs.readFile(matches[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, content) {
+					t.Error("reattached file lost its contents")
+				}
+			},
+		},
+		{
+			name: "orphaned directory",
+			corrupt: func(t *testing.T, fs *FileSystem) {
+				fs.removeEntryFromDir(inode(t, fs, "/root/d"), "e")
+			},
+			check: func(t *testing.T, fs *FileSystem) {
+				matches, err := fs.glob(fmt.Sprintf("/root/%s/*/g", LostAndFound))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(matches) != 1 {
+					t.Errorf("orphaned directory's file not reattached: %v", matches)
+				}
+			},
+		},
+		{
+			name: "used block listed free",
+			corrupt: func(t *testing.T, fs *FileSystem) {
+				block := inode(t, fs, "/root/d/f").BlockPointer
+				fs.Superblock.FreeBlocks = append(fs.Superblock.FreeBlocks, block)
+			},
+			check: func(t *testing.T, fs *FileSystem) {
+				got, err := fs.readFile("/root/d/f")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, content) {
+					t.Error("file lost its contents")
+				}
+			},
+		},
+		{
+			name: "wrong link count",
+			corrupt: func(t *testing.T, fs *FileSystem) {
+				inode(t, fs, "/root/d/f").LinkCount = 3
+			},
+			check: func(t *testing.T, fs *FileSystem) {
+				if n := inode(t, fs, "/root/d/f").LinkCount; n != 1 {
+					t.Errorf("link count = %d, want 1", n)
+				}
+			},
+		},
+		{
+			name: "wrong inode count",
+			corrupt: func(t *testing.T, fs *FileSystem) {
+				fs.Superblock.TotalInodes += 2
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := setup(t)
+			tt.corrupt(t, fs)
+			if err := fs.verifyFilesystem(); err == nil {
+				t.Fatal("corruption not detected")
+			}
+			report, err := fs.repair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report) == 0 {
+				t.Error("repair reported no changes")
+			}
+			if err := fs.verifyFilesystem(); err != nil {
+				t.Fatalf("after repair: %v\nreport: %v", err, report)
+			}
+			if tt.check != nil {
+				tt.check(t, fs)
+			}
+			report, err = fs.repair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report) != 0 {
+				t.Errorf("second repair reported %v", report)
+			}
+		})
+	}
+}
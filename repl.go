@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const replUsage = `commands:
+  mkdir [-p] PATH     create a directory, with -p any missing parents
+  touch PATH          create an empty file
+  cd PATH             change the working directory
+  pwd                 print the working directory
+  ls [-l|-R] [PATH]   list a directory (default .), or the paths
+                      matching a pattern such as *.txt
+  cat PATH            print a file
+  write PATH TEXT...  replace a file's contents
+  rm PATH             remove a file
+  rmdir PATH          remove an empty directory
+  mv SRC DST          move or rename
+  ln SRC DST          create a hard link
+  symlink TARGET DST  create a symbolic link
+  stat PATH           describe an inode
+  chown UID:GID PATH  change the owner and group of an inode
+  snapshot            snapshot the whole filesystem
+  restore             restore the latest snapshot
+  check               run the consistency check
+  repair              fix what the consistency check reports
+  help                show this message
+  exit                leave the shell`
+
+var (
+	// errUsage reports a command given the wrong arguments.
+	errUsage = errors.New("wrong number of arguments")
+	// errUnknownCommand reports a command the shell doesn't have.
+	errUnknownCommand = errors.New("unknown command")
+)
+
+// repl reads commands from in, one per line, and runs them against the
+// filesystem, writing results and errors to out. It returns when in is
+// exhausted or on "exit". Blank lines and lines starting with '#' are
+// skipped.
+func (fs *FileSystem) repl(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args := strings.Fields(line)
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+		switch err := fs.runCommand(out, args); {
+		case errors.Is(err, errUnknownCommand):
+			fmt.Fprintf(out, "unknown command %q\n", args[0])
+			fmt.Fprintln(out, replUsage)
+		case errors.Is(err, errUsage):
+			fmt.Fprintln(out, replUsage)
+		case err != nil:
+			fmt.Fprintf(out, "%s: %v\n", args[0], err)
+		}
+	}
+}
+
+// RunScript runs the commands read from r, one per line in the grammar of
+// repl, discarding their output. Blank lines and lines starting with '#'
+// are skipped and "exit" ends the script early. It stops at the first
+// command that fails, reporting its line number.
+func (fs *FileSystem) RunScript(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args := strings.Fields(line)
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+		if err := fs.runCommand(io.Discard, args); err != nil {
+			return fmt.Errorf("line %d: %s: %w", n, args[0], err)
+		}
+	}
+	return scanner.Err()
+}
+
+// runCommand executes a single parsed REPL command. It fails with errUsage
+// when the arguments don't fit the command and with errUnknownCommand when
+// there is no such command.
+func (fs *FileSystem) runCommand(out io.Writer, args []string) error {
+	cmd, args := args[0], args[1:]
+
+	// want checks the argument count.
+	want := func(n int) error {
+		if len(args) != n {
+			return errUsage
+		}
+		return nil
+	}
+
+	switch cmd {
+	case "mkdir", "touch":
+		if cmd == "mkdir" && len(args) == 2 && args[0] == "-p" {
+			return fs.mkdirAll(args[1])
+		}
+		if err := want(1); err != nil {
+			return err
+		}
+		fs.mu.RLock()
+		dir, name := splitPath(fs.absPath(args[0]))
+		fs.mu.RUnlock()
+		var err error
+		if cmd == "mkdir" {
+			_, err = fs.mkdir(dir, name)
+		} else {
+			_, err = fs.touch(dir, name)
+		}
+		return err
+	case "cd":
+		if err := want(1); err != nil {
+			return err
+		}
+		return fs.cd(args[0])
+	case "pwd":
+		fmt.Fprintln(out, fs.pwd())
+	case "ls":
+		list := fs.list
+		if len(args) > 0 && args[0] == "-l" {
+			list, args = fs.lsLong, args[1:]
+		} else if len(args) > 0 && args[0] == "-R" {
+			list, args = fs.lsRecursive, args[1:]
+		}
+		path := "."
+		if len(args) > 0 {
+			path = args[0]
+		}
+		if hasMeta(path) {
+			matches, err := fs.glob(path)
+			if err != nil {
+				return err
+			}
+			for _, match := range matches {
+				fmt.Fprintln(out, match)
+			}
+			return nil
+		}
+		names, err := list(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Fprintln(out, name)
+		}
+	case "cat":
+		if err := want(1); err != nil {
+			return err
+		}
+		data, err := fs.readFile(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(data))
+	case "write":
+		if len(args) < 1 {
+			return errUsage
+		}
+		return fs.writeFile(args[0], []byte(strings.Join(args[1:], " ")))
+	case "rm":
+		if err := want(1); err != nil {
+			return err
+		}
+		return fs.rm(args[0])
+	case "rmdir":
+		if err := want(1); err != nil {
+			return err
+		}
+		return fs.rmdir(args[0])
+	case "mv":
+		if err := want(2); err != nil {
+			return err
+		}
+		return fs.mv(args[0], args[1])
+	case "ln":
+		if err := want(2); err != nil {
+			return err
+		}
+		return fs.link(args[0], args[1])
+	case "symlink":
+		if err := want(2); err != nil {
+			return err
+		}
+		return fs.symlink(args[0], args[1])
+	case "stat":
+		if err := want(1); err != nil {
+			return err
+		}
+		inode, err := fs.lstat(args[0])
+		if err != nil {
+			return err
+		}
+		kind := "file"
+		switch {
+		case inode.IsDirectory:
+			kind = "directory"
+		case inode.IsSymlink:
+			kind = "symlink -> " + inode.Target
+		}
+		fmt.Fprintf(out, "%s: inode %d, %s, %d bytes, mode %04o, uid %d, gid %d, %d links\n",
+			inode.Name, inode.InodeNumber, kind, inode.Size, inode.Mode, inode.UID, inode.GID, inode.LinkCount)
+	case "chown":
+		if err := want(2); err != nil {
+			return err
+		}
+		owner, group, _ := strings.Cut(args[0], ":")
+		uid, gid := -1, -1
+		var err error
+		if owner != "" {
+			if uid, err = strconv.Atoi(owner); err != nil {
+				return err
+			}
+		}
+		if group != "" {
+			if gid, err = strconv.Atoi(group); err != nil {
+				return err
+			}
+		}
+		return fs.chown(args[1], uid, gid)
+	case "snapshot":
+		name, err := fs.snapshot()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "created", name)
+	case "restore":
+		if err := fs.restoreLatest(); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "restored")
+	case "check":
+		fs.mu.RLock()
+		err := fs.verifyFilesystem()
+		fs.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok")
+	case "repair":
+		report, err := fs.repair()
+		if err != nil {
+			return err
+		}
+		for _, line := range report {
+			fmt.Fprintln(out, line)
+		}
+		if len(report) == 0 {
+			fmt.Fprintln(out, "nothing to repair")
+		}
+	case "help":
+		fmt.Fprintln(out, replUsage)
+	default:
+		return errUnknownCommand
+	}
+	return nil
+}
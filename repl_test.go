@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestREPL(t *testing.T) {
+	fs := NewFileSystem()
+	script := `mkdir docs
+cd docs
+pwd
+# comments and blank lines are skipped
+
+touch notes
+write notes hello there
+cat notes
+ln notes again
+stat again
+ls
+rm missing
+frobnicate
+exit
+ls`
+	var out strings.Builder
+	if err := fs.repl(strings.NewReader(script), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "> > > /root/docs\n" +
+		"> > > > > hello there\n" +
+		"> > notes: inode 2, file, 11 bytes, mode 0644, uid 0, gid 0, 2 links\n" +
+		"> again\nnotes\n" +
+		"> rm: no such file or directory\n" +
+		"> unknown command \"frobnicate\"\n" + replUsage + "\n" +
+		"> "
+	if got := out.String(); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+	if fs.resolvePath("/root/docs/notes") == nil {
+		t.Error("the script's file was not created")
+	}
+}
+
+func TestREPLEndOfInput(t *testing.T) {
+	fs := NewFileSystem()
+	var out strings.Builder
+	if err := fs.repl(strings.NewReader("mkdir a\nmkdir a/b\nls a"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "> > > b\n> \n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	fs := NewFileSystem()
+	script := `# build a small tree
+mkdir docs
+mkdir docs/drafts
+mkdir -p docs/drafts/old/2024
+
+touch docs/drafts/a
+write docs/drafts/a first draft
+cd docs
+symlink /root/docs/drafts latest
+exit
+mkdir never`
+	if err := fs.RunScript(strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	err := fs.Walk("/root", func(path string, inode *Inode) error {
+		got = append(got, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/root", "/root/docs", "/root/docs/drafts", "/root/docs/drafts/a", "/root/docs/drafts/old", "/root/docs/drafts/old/2024", "/root/docs/latest"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tree:\n got %v\nwant %v", got, want)
+	}
+	if data, err := fs.readFile("/root/docs/latest/a"); err != nil || string(data) != "first draft" {
+		t.Errorf("readFile = %q, %v, want first draft", data, err)
+	}
+}
+
+func TestRunScriptStopsAtFirstError(t *testing.T) {
+	for _, tt := range []struct {
+		script string
+		line   int
+		err    error
+	}{
+		{"mkdir a\n\n# comment\nrmdir missing\nmkdir b", 4, ErrNotFound},
+		{"mkdir a\nmv a", 2, errUsage},
+		{"mkdir a\nmkdir b\nfrobnicate\nmkdir c", 3, errUnknownCommand},
+	} {
+		fs := NewFileSystem()
+		err := fs.RunScript(strings.NewReader(tt.script))
+		if !errors.Is(err, tt.err) || !strings.HasPrefix(fmt.Sprint(err), fmt.Sprintf("line %d: ", tt.line)) {
+			t.Errorf("script %q: %v, want line %d: %v", tt.script, err, tt.line, tt.err)
+		}
+		if fs.exists("/root/c") || fs.exists("/root/b") && tt.line < 3 {
+			t.Errorf("script %q kept going after the error", tt.script)
+		}
+	}
+}
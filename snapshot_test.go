@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCoalesceSnapshots(t *testing.T) {
+	fs := NewFileSystem()
+	snapshotNames := func() []string {
+		var names []string
+		for _, s := range fs.filesystemSnapshots {
+			names = append(names, s.Name)
+		}
+		return names
+	}
+
+	fs.touch("root", "base")
+	if err := fs.writeFile("root/base", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	fs.createFilesystemSnapshot()
+	fs.touch("root", "inc1")
+	if err := fs.writeFile("root/base", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	fs.createFilesystemSnapshot()
+	if err := fs.rm("root/inc1"); err != nil {
+		t.Fatal(err)
+	}
+	fs.mkdir("root", "inc2")
+	fs.createFilesystemSnapshot()
+	want := treeOf(t, fs)
+	fs.touch("root", "later")
+
+	if err := fs.coalesceSnapshots([]string{"snapshot-1", "snapshot-2", "snapshot-3"}, "merged"); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotNames(); !reflect.DeepEqual(got, []string{"merged"}) {
+		t.Errorf("snapshots = %v, want [merged]", got)
+	}
+	fs.restoreFilesystemSnapshot()
+	if got := treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored merged snapshot:\n got %v\nwant %v", got, want)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+
+	if err := fs.coalesceSnapshots([]string{"merged", "missing"}, "x"); err == nil {
+		t.Error("coalesced a missing snapshot")
+	}
+	fs.createFilesystemSnapshot()
+	fs.createFilesystemSnapshot()
+	if err := fs.coalesceSnapshots([]string{"merged", "snapshot-5"}, "x"); err == nil {
+		t.Error("coalesced snapshots that aren't contiguous")
+	}
+}
+
+func TestMountSnapshot(t *testing.T) {
+	fs := NewFileSystem()
+	fs.touch("root", "f")
+	if err := fs.writeFile("root/f", []byte("kept in the snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	fs.createFilesystemSnapshot()
+	if err := fs.rm("root/f"); err != nil {
+		t.Fatal(err)
+	}
+	fs.touch("root", "new")
+
+	view, err := fs.mountSnapshot("snapshot-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := view.readFile("root/f"); err != nil || string(data) != "kept in the snapshot" {
+		t.Errorf("snapshot f = %q, %v", data, err)
+	}
+	if view.resolvePath("root/new") != nil {
+		t.Error("the snapshot shows a file created after it")
+	}
+	view.touch("root", "g")
+	if view.resolvePath("root/g") != nil {
+		t.Error("touch created a file in a mounted snapshot")
+	}
+	if err := view.writeFile("root/f", nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("writeFile in a mounted snapshot: %v, want ErrReadOnly", err)
+	}
+	for _, set := range []func(bool) error{view.setCompression, view.setDedup, view.setTrash, view.setVerifyWrites, view.setBlockPacking} {
+		if err := set(true); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("changing a setting of a mounted snapshot: %v, want ErrReadOnly", err)
+		}
+	}
+	if fs.resolvePath("root/f") != nil {
+		t.Error("mounting the snapshot brought f back to the live filesystem")
+	}
+	if _, err := fs.mountSnapshot("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("mounting a missing snapshot: %v, want ErrNotFound", err)
+	}
+}
+
+func TestBlockOwners(t *testing.T) {
+	fs := NewFileSystem()
+	fs.touch("/root", "f")
+	if err := fs.writeFile("/root/f", []byte("shared")); err != nil {
+		t.Fatal(err)
+	}
+	block := fs.resolvePath("/root/f").BlockPointer
+	if got := fs.blockOwners(block); !reflect.DeepEqual(got, []string{"live"}) {
+		t.Errorf("before the snapshot owners = %v, want [live]", got)
+	}
+	fs.createFilesystemSnapshot()
+	if got := fs.blockOwners(block); !reflect.DeepEqual(got, []string{"live", "snapshot-1"}) {
+		t.Errorf("owners = %v, want [live snapshot-1]", got)
+	}
+	if err := fs.rm("/root/f"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.blockOwners(block); !reflect.DeepEqual(got, []string{"snapshot-1"}) {
+		t.Errorf("after rm owners = %v, want [snapshot-1]", got)
+	}
+}
+
+func TestNamedSnapshots(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.writeFile("/root/f", []byte("one")),
+		fs.createNamedSnapshot("one"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, err := range []error{
+		fs.writeFile("/root/f", []byte("two")),
+		fs.createNamedSnapshot("two"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	middle := treeOf(t, fs)
+	for _, err := range []error{
+		errOf(fs.touch("/root", "g")),
+		fs.writeFile("/root/f", []byte("three")),
+		fs.createNamedSnapshot("three"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.createNamedSnapshot("two"); !errors.Is(err, ErrExists) {
+		t.Errorf("reusing a name: %v, want ErrExists", err)
+	}
+	if got, want := fs.listSnapshots(), []string{"one", "two", "three"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshots = %v, want %v", got, want)
+	}
+
+	if err := fs.restoreNamedSnapshot("two"); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeOf(t, fs); !reflect.DeepEqual(got, middle) {
+		t.Errorf("restored middle snapshot:\n got %v\nwant %v", got, middle)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.deleteSnapshot("one"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fs.listSnapshots(), []string{"two", "three"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshots after delete = %v, want %v", got, want)
+	}
+	if err := fs.deleteSnapshot("one"); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("deleting twice: %v, want ErrNoSnapshot", err)
+	}
+	if err := fs.restoreNamedSnapshot("one"); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("restoring a deleted snapshot: %v, want ErrNoSnapshot", err)
+	}
+
+	// The later snapshot survives restoring an earlier one.
+	if err := fs.restoreNamedSnapshot("three"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.readFile("/root/f")
+	for _, err := range []error{
+		err,
+		fs.verifyFilesystem(),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(got) != "three" {
+		t.Errorf("after restoring three, f = %q", got)
+	}
+}
+
+func TestRestoreFilesystemSnapshotAt(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.restoreFilesystemSnapshotAt(0); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("restoring with no snapshots: %v, want ErrNoSnapshot", err)
+	}
+	var trees []map[string]string
+	for _, name := range []string{"a", "b", "c"} {
+		for _, err := range []error{
+			errOf(fs.touch("/root", name)),
+			fs.writeFile("/root/"+name, []byte(name)),
+			fs.createNamedSnapshot(name),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		trees = append(trees, treeOf(t, fs))
+	}
+
+	for _, i := range []int{1, 0, 2} {
+		if err := fs.restoreFilesystemSnapshotAt(i); err != nil {
+			t.Fatal(err)
+		}
+		if got := treeOf(t, fs); !reflect.DeepEqual(got, trees[i]) {
+			t.Errorf("restored snapshot %d:\n got %v\nwant %v", i, got, trees[i])
+		}
+		if err := fs.verifyFilesystem(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(fs.listSnapshots()); n != 3 {
+		t.Errorf("%d snapshots after restoring, want 3", n)
+	}
+	for _, i := range []int{-1, 3} {
+		if err := fs.restoreFilesystemSnapshotAt(i); !errors.Is(err, ErrNoSnapshot) {
+			t.Errorf("restoring snapshot %d: %v, want ErrNoSnapshot", i, err)
+		}
+	}
+	if got := treeOf(t, fs); !reflect.DeepEqual(got, trees[2]) {
+		t.Error("a failed restore changed the filesystem")
+	}
+}
+
+// Snapshots share the block table with the live filesystem until it changes,
+// and no later write, growth or restore shows through to a snapshot.
+func TestSnapshotsShareBlocks(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.writeFile("/root/f", []byte("one")),
+		fs.createNamedSnapshot("one"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	one := treeOf(t, fs)
+	if snapshot := fs.filesystemSnapshots[0]; snapshot.Data.chunks[0] != fs.blocks.chunks[0] {
+		t.Error("the snapshot copied the block table")
+	}
+
+	// Enough data to grow the filesystem past the blocks it had.
+	blocks := fs.blocks.len()
+	for i := 0; fs.blocks.len() == blocks; i++ {
+		name := fmt.Sprintf("g%d", i)
+		for _, err := range []error{
+			errOf(fs.touch("/root", name)),
+			fs.writeFile("/root/"+name, bytes.Repeat([]byte{byte(i)}, BlockSize)),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := fs.writeFile("/root/f", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.createNamedSnapshot("two"); err != nil {
+		t.Fatal(err)
+	}
+	two := treeOf(t, fs)
+
+	// Growing again after restoring the smaller snapshot must not write over
+	// the blocks of the larger one.
+	if err := fs.restoreNamedSnapshot("one"); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeOf(t, fs); !reflect.DeepEqual(got, one) {
+		t.Errorf("restored snapshot one:\n got %v\nwant %v", got, one)
+	}
+	for i := 0; fs.blocks.len() == blocks; i++ {
+		name := fmt.Sprintf("h%d", i)
+		for _, err := range []error{
+			errOf(fs.touch("/root", name)),
+			fs.writeFile("/root/"+name, bytes.Repeat([]byte("x"), BlockSize)),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := fs.writeFile("/root/f", []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]map[string]string{"one": one, "two": two} {
+		view, err := fs.mountSnapshot(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := treeOf(t, view); !reflect.DeepEqual(got, want) {
+			t.Errorf("snapshot %s changed:\n got %v\nwant %v", name, got, want)
+		}
+		if err := view.verifyFilesystem(); err != nil {
+			t.Errorf("snapshot %s: %v", name, err)
+		}
+	}
+	if data, err := fs.readFile("/root/f"); err != nil || string(data) != "three" {
+		t.Errorf("live f = %q, %v, want three", data, err)
+	}
+}
+
+// Writes after a snapshot copy only the chunks of the block table they
+// change; the snapshot keeps sharing the rest.
+func TestSnapshotCopiesChangedChunks(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.setBlockLimit(8 * InitialBlocks); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), MaxFileBlocks*BlockSize)
+	for i := 0; i < 16; i++ {
+		name := fmt.Sprintf("f%d", i)
+		if err := errOf(fs.touch("/root", name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.writeFile("/root/"+name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.createNamedSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		errOf(fs.touch("/root", "g")),
+		fs.writeFile("/root/g", []byte("small")),
+		fs.writeFile("/root/f0", data[:BlockSize]),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := fs.filesystemSnapshots[0].Data
+	copied, changed := 0, 0
+	for i, chunk := range snapshot.chunks {
+		if fs.blocks.chunks[i] != chunk {
+			copied++
+		}
+		for block := i * chunkBlocks; block < (i+1)*chunkBlocks; block++ {
+			if !bytes.Equal(fs.blocks.data(block), snapshot.data(block)) {
+				changed++
+				break
+			}
+		}
+	}
+	if copied != changed || copied >= len(snapshot.chunks)/4 {
+		t.Errorf("copied %d of %d chunks, %d of them changed", copied, len(snapshot.chunks), changed)
+	}
+	view, err := fs.mountSnapshot("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := view.readFile("/root/f0"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("snapshot f0 = %d bytes, %v", len(got), err)
+	}
+}
+
+// A snapshot shares the live inodes until they change, so whatever changes
+// after it, the snapshot still shows every inode as it was.
+func TestSnapshotKeepsChangedInodes(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "d")),
+		fs.setQuota("/root/d", 100*BlockSize),
+		errOf(fs.touch("/root/d", "f")),
+		fs.writeFile("/root/d/f", bytes.Repeat([]byte("x"), 3*BlockSize)),
+		fs.setxattr("/root/d/f", "user.a", "1"),
+		errOf(fs.touch("/root", "g")),
+		errOf(fs.touch("/root", "h")),
+		fs.link("/root/h", "/root/d/h"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := inodeStates(fs.Superblock.InodeMap)
+	if err := fs.createNamedSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		fs.chmod("/root/d/f", 0600),
+		fs.chown("/root/d/f", 7, 7),
+		fs.setxattr("/root/d/f", "user.b", "2"),
+		fs.removexattr("/root/d/f", "user.a"),
+		fs.setfacl("/root/d/f", []ACLEntry{{Tag: ACLUser, ID: 7, Perm: permRead}}),
+		fs.appendFile("/root/d/f", []byte("more")),
+		fs.truncate("/root/d/f", BlockSize),
+		fs.setQuota("/root/d", 0),
+		fs.mv("/root/g", "/root/d/g"),
+		fs.rm("/root/h"),
+		fs.writeFile("/root/d/h", []byte("h")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.readFile("/root/d/g"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := inodeStates(fs.snapshotInodes(fs.filesystemSnapshots[0])); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot inodes changed with the live ones")
+	}
+	if err := fs.restoreNamedSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if got := inodeStates(fs.Superblock.InodeMap); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored inodes differ from those snapshotted")
+	}
+}
+
+// inodeStates returns what inodes hold, with parents given by number.
+func inodeStates(inodes []*Inode) []*imageInode {
+	states := toImageInodes(inodes)
+	for _, state := range states {
+		if state != nil {
+			state.Inode.snapshotGen = 0
+		}
+	}
+	return states
+}
+
+// Restoring a directory snapshot brings back only that directory's
+// subtree. Inode numbers and blocks freed in it and taken since by another
+// directory stay with that directory, and the subtree gets new ones.
+func TestDirectorySnapshotIsScoped(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "dir1")),
+		errOf(fs.mkdir("/root", "dir2")),
+		errOf(fs.touch("/root/dir1", "a")),
+		fs.writeFile("/root/dir1/a", []byte("old a")),
+		errOf(fs.touch("/root/dir1", "tmp")),
+		fs.writeFile("/root/dir1/tmp", []byte("old tmp")),
+		errOf(fs.touch("/root/dir2", "b")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.createDirectorySnapshot("/root/dir1")
+	tmp := fs.resolvePath("/root/dir1/tmp")
+	number, block := tmp.InodeNumber, tmp.BlockPointer
+
+	// dir2's new file takes over tmp's inode number and block.
+	for _, err := range []error{
+		fs.writeFile("/root/dir1/a", []byte("new a")),
+		errOf(fs.touch("/root/dir1", "c")),
+		fs.rm("/root/dir1/tmp"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	free := fs.Superblock.FreeBlocks
+	for i, b := range free {
+		if b == block {
+			free[0], free[i] = free[i], free[0]
+		}
+	}
+	for _, err := range []error{
+		errOf(fs.touch("/root/dir2", "x")),
+		fs.writeFile("/root/dir2/x", []byte("kept x")),
+		fs.writeFile("/root/dir2/b", []byte("kept b")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if x := fs.resolvePath("/root/dir2/x"); x.InodeNumber != number || x.BlockPointer != block {
+		t.Fatalf("x has inode %d and block %d, want tmp's %d and %d", x.InodeNumber, x.BlockPointer, number, block)
+	}
+
+	check := func(step string) {
+		t.Helper()
+		for path, want := range map[string]string{
+			"/root/dir1/a":   "old a",
+			"/root/dir1/tmp": "old tmp",
+			"/root/dir2/b":   "kept b",
+			"/root/dir2/x":   "kept x",
+		} {
+			if got, err := fs.readFile(path); err != nil || string(got) != want {
+				t.Errorf("%s: %s = %q, %v, want %q", step, path, got, err, want)
+			}
+		}
+		if names, err := fs.list("/root/dir1"); err != nil || !reflect.DeepEqual(names, []string{"a", "tmp"}) {
+			t.Errorf("%s: dir1 lists %v, %v", step, names, err)
+		}
+		if err := fs.verifyFilesystem(); err != nil {
+			t.Errorf("%s: %v", step, err)
+		}
+	}
+	fs.restoreDirectorySnapshot("/root/dir1")
+	check("restored")
+	if tmp := fs.resolvePath("/root/dir1/tmp"); tmp.InodeNumber == number || tmp.BlockPointer == block {
+		t.Error("restored tmp shares x's inode or block")
+	}
+
+	// A removed directory is recreated.
+	if err := fs.removeAll("/root/dir1"); err != nil {
+		t.Fatal(err)
+	}
+	fs.restoreDirectorySnapshot("/root/dir1")
+	check("recreated")
+}
+
+// Restoring a directory leaves files hard-linked from outside it in place;
+// the subtree gets its own copies back.
+func TestDirectorySnapshotKeepsOutsideLinks(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "dir1")),
+		errOf(fs.mkdir("/root", "dir2")),
+		errOf(fs.touch("/root/dir1", "a")),
+		fs.writeFile("/root/dir1/a", []byte("old a")),
+		errOf(fs.touch("/root/dir2", "b")),
+		fs.writeFile("/root/dir2/b", []byte("old b")),
+		fs.link("/root/dir1/a", "/root/dir2/a"),
+		fs.link("/root/dir2/b", "/root/dir1/b"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.createDirectorySnapshot("/root/dir1")
+	for _, err := range []error{
+		fs.writeFile("/root/dir1/a", []byte("new a")),
+		fs.writeFile("/root/dir2/b", []byte("new b")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs.restoreDirectorySnapshot("/root/dir1")
+	for path, want := range map[string]string{
+		"/root/dir1/a": "old a",
+		"/root/dir1/b": "old b",
+		"/root/dir2/a": "new a",
+		"/root/dir2/b": "new b",
+	} {
+		if got, err := fs.readFile(path); err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", path, got, err, want)
+		}
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/root/dir1/a", "/root/dir1/b", "/root/dir2/a", "/root/dir2/b"} {
+		if inode := fs.resolvePath(path); inode.LinkCount != 1 {
+			t.Errorf("%s has link count %d, want 1", path, inode.LinkCount)
+		}
+	}
+}
+
+// BenchmarkSnapshot takes a snapshot of a filesystem of fixed size and then
+// changes a number of blocks. Its cost follows the number of blocks
+// changed, which copy their chunks of the block table, and of inodes
+// changed, which are copied for the snapshot, not the size of the
+// filesystem.
+func BenchmarkSnapshot(b *testing.B) {
+	const files = 64
+	fs := NewFileSystem()
+	if err := fs.setBlockLimit(2*files*MaxFileBlocks + InitialBlocks); err != nil {
+		b.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), MaxFileBlocks*BlockSize)
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("f%d", i)
+		if _, err := fs.touch("/root", name); err != nil {
+			b.Fatal(err)
+		}
+		if err := fs.writeFile("/root/"+name, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if _, err := fs.touch("/root", "changed"); err != nil {
+		b.Fatal(err)
+	}
+	for _, changed := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("%dblocks", changed), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := fs.createNamedSnapshot("s"); err != nil {
+					b.Fatal(err)
+				}
+				if err := fs.writeFile("/root/changed", bytes.Repeat([]byte{byte(i)}, changed*BlockSize)); err != nil {
+					b.Fatal(err)
+				}
+				if err := fs.deleteSnapshot("s"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
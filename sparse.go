@@ -0,0 +1,45 @@
+package main
+
+// Range is a span of bytes in a file.
+type Range struct {
+	Offset int
+	Length int
+}
+
+// holes returns the ranges of the file at path that have no storage and
+// read back as zeros, in order. Writing a block of zeros past the first,
+// whether by writeAt beyond the end of the file or by truncating it to a
+// larger size, leaves a hole; compressed, encrypted and packed files have
+// none.
+func (fs *FileSystem) holes(path string) ([]Range, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	inode, err := fs.fileAt(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fs.may(inode, permRead) {
+		return nil, ErrPermission
+	}
+	if inode.Packed != nil || inode.BlockPointer < 0 {
+		return nil, nil
+	}
+
+	var holes []Range
+	for i, block := range fileBlocks(inode) {
+		if block != hole {
+			continue
+		}
+		offset := i * BlockSize
+		length := min(BlockSize, inode.Size-offset)
+		if n := len(holes); n > 0 && holes[n-1].Offset+holes[n-1].Length == offset {
+			holes[n-1].Length += length
+		} else {
+			holes = append(holes, Range{Offset: offset, Length: length})
+		}
+	}
+	return holes, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// A write far past the end leaves the gap as holes that take no blocks and
+// read back as zeros.
+func TestSparseWriteAt(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+	usedBefore, _, _ := fs.df()
+	off := 200 * BlockSize
+	if err := fs.writeAt("/root/f", off, []byte("end")); err != nil {
+		t.Fatal(err)
+	}
+	if used, _, _ := fs.df(); used != usedBefore+1 {
+		t.Errorf("%d blocks used after the write, want %d", used, usedBefore+1)
+	}
+	data, err := fs.readFile("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != off+3 || !allZero(data[:off]) || string(data[off:]) != "end" {
+		t.Errorf("read %d bytes, want %d zeros then end", len(data), off)
+	}
+	holes, err := fs.holes("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Range{{BlockSize, off - BlockSize}}; !reflect.DeepEqual(holes, want) {
+		t.Errorf("holes = %v, want %v", holes, want)
+	}
+
+	// Filling part of the gap stores only that block.
+	if err := fs.writeAt("/root/f", 100*BlockSize+10, []byte("mid")); err != nil {
+		t.Fatal(err)
+	}
+	holes, _ = fs.holes("/root/f")
+	want := []Range{{BlockSize, 99 * BlockSize}, {101 * BlockSize, 99 * BlockSize}}
+	if !reflect.DeepEqual(holes, want) {
+		t.Errorf("holes = %v, want %v", holes, want)
+	}
+	if used, _, _ := fs.df(); used != usedBefore+2 {
+		t.Errorf("%d blocks used, want %d", used, usedBefore+2)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+
+	if err := fs.rm("/root/f"); err != nil {
+		t.Fatal(err)
+	}
+	if used, _, _ := fs.df(); used != usedBefore-1 {
+		t.Errorf("%d blocks used after removal, want %d", used, usedBefore-1)
+	}
+}
+
+// Truncating up makes a hole instead of allocating, and overwriting a
+// stored block with zeros turns it back into one.
+func TestSparseTruncate(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.writeFile("/root/f", bytes.Repeat([]byte{'x'}, 2*BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	usedBefore, _, _ := fs.df()
+	if err := fs.truncate("/root/f", 50*BlockSize+7); err != nil {
+		t.Fatal(err)
+	}
+	if used, _, _ := fs.df(); used != usedBefore {
+		t.Errorf("truncating up used %d blocks, want none", used-usedBefore)
+	}
+	holes, err := fs.holes("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Range{{2 * BlockSize, 48*BlockSize + 7}}; !reflect.DeepEqual(holes, want) {
+		t.Errorf("holes = %v, want %v", holes, want)
+	}
+	if data, err := fs.readFile("/root/f"); err != nil || len(data) != 50*BlockSize+7 || !allZero(data[2*BlockSize:]) {
+		t.Errorf("read %d bytes, %v, want %d ending in zeros", len(data), err, 50*BlockSize+7)
+	}
+
+	if err := fs.writeAt("/root/f", BlockSize, make([]byte, BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if used, _, _ := fs.df(); used != usedBefore-1 {
+		t.Errorf("%d blocks used after zeroing a block, want %d", used, usedBefore-1)
+	}
+	if holes, _ := fs.holes("/root/f"); len(holes) != 1 || holes[0].Offset != BlockSize {
+		t.Errorf("holes = %v, want one starting at %d", holes, BlockSize)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+	if got, want := treeOf(t, replayed(fs)), treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Error("sparse file differs after replay")
+	}
+}
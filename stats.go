@@ -0,0 +1,51 @@
+package main
+
+// FSStats is a snapshot of the filesystem's runtime counters. Inodes,
+// Directories, Files and BytesUsed describe the current state; the rest
+// count events since the filesystem was created or loaded.
+type FSStats struct {
+	Inodes      int
+	Directories int
+	Files       int // Regular files and symlinks
+	BytesUsed   int // Sum of file sizes and symlink target lengths
+
+	BlocksAllocated int
+	BlocksFreed     int
+	Mkdirs          int
+	Touches         int
+	Removes         int // Files and directories removed by rm and rmdir
+}
+
+// Stats returns the current counters. They are kept up to date as
+// operations run, so this doesn't scan the filesystem.
+func (fs *FileSystem) Stats() FSStats {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	stats := fs.stats
+	stats.Inodes = fs.Superblock.TotalInodes
+	return stats
+}
+
+// resized accounts for the size of inode changing by delta bytes, in the
+// stats and in the quotas above it.
+func (fs *FileSystem) resized(inode *Inode, delta int) {
+	fs.stats.BytesUsed += delta
+	fs.chargeQuota(inode.Parent, delta)
+}
+
+// recountStats recomputes the counters describing the current state, for
+// use after the inodes have been replaced wholesale.
+func (fs *FileSystem) recountStats() {
+	fs.stats.Directories, fs.stats.Files, fs.stats.BytesUsed = 0, 0, 0
+	for _, inode := range fs.Superblock.InodeMap {
+		switch {
+		case inode == nil:
+		case inode.IsDirectory:
+			fs.stats.Directories++
+		default:
+			fs.stats.Files++
+			fs.stats.BytesUsed += inode.Size
+		}
+	}
+}
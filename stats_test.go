@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestStats(t *testing.T) {
+	fs := NewFileSystem()
+	base := fs.Stats()
+
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "a")),
+		errOf(fs.mkdir("/root/a", "b")),
+		errOf(fs.touch("/root/a", "x")),
+		errOf(fs.touch("/root/a", "y")),
+		errOf(fs.touch("/root/a", "z")),
+		fs.writeFile("/root/a/x", []byte("0123456789")),
+		fs.writeFile("/root/a/y", pattern(BlockSize+1)),
+		fs.symlink("a/x", "/root/l"),
+		fs.rm("/root/a/z"),
+		fs.rmdir("/root/a/b"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := fs.Stats()
+	want := base
+	want.Inodes += 4
+	want.Directories++
+	want.Files += 3
+	want.BytesUsed += 10 + BlockSize + 1 + len("a/x")
+	want.Mkdirs += 2
+	want.Touches += 3
+	want.Removes += 2
+	want.BlocksAllocated, want.BlocksFreed = got.BlocksAllocated, got.BlocksFreed
+	if got != want {
+		t.Errorf("stats:\n got %+v\nwant %+v", got, want)
+	}
+	if got.BlocksAllocated <= base.BlocksAllocated || got.BlocksFreed <= base.BlocksFreed {
+		t.Errorf("blocks allocated %d -> %d, freed %d -> %d", base.BlocksAllocated, got.BlocksAllocated, base.BlocksFreed, got.BlocksFreed)
+	}
+
+	// Restoring a snapshot brings back its inodes and bytes; the operation
+	// counts keep running.
+	for _, err := range []error{
+		fs.createNamedSnapshot("s"),
+		fs.rm("/root/a/x"),
+		fs.rm("/root/a/y"),
+		fs.rmdir("/root/a"),
+		errOf(fs.touch("/root", "later")),
+		fs.restoreNamedSnapshot("s"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	after := fs.Stats()
+	if after.Inodes != got.Inodes || after.Directories != got.Directories ||
+		after.Files != got.Files || after.BytesUsed != got.BytesUsed {
+		t.Errorf("after restore:\n got %+v\nwant state of %+v", after, got)
+	}
+	if after.Touches != got.Touches+1 || after.Removes != got.Removes+3 {
+		t.Errorf("operation counts after restore: %+v, from %+v", after, got)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// storedBlocks returns the blocks of the file at path, failing the test if
+// it can't be found.
+func storedBlocks(t *testing.T, fs *FileSystem, path string) []int {
+	t.Helper()
+	inode, err := fs.stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inodeBlocks(inode)
+}
+
+func TestDedupSharesIdenticalBlocks(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.setDedup(true); err != nil {
+		t.Fatal(err)
+	}
+	data := pattern(BlockSize)
+	for _, err := range []error{
+		errOf(fs.touch("/root", "a")),
+		errOf(fs.touch("/root", "b")),
+		fs.writeFile("/root/a", data),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, before, _ := fs.df()
+	if err := fs.writeFile("/root/b", data); err != nil {
+		t.Fatal(err)
+	}
+	if _, after, _ := fs.df(); after < before {
+		t.Errorf("identical second file used %d more blocks", before-after)
+	}
+	a, b := storedBlocks(t, fs, "/root/a"), storedBlocks(t, fs, "/root/b")
+	if len(a) != 1 || len(b) != 1 || a[0] != b[0] {
+		t.Fatalf("blocks a=%v b=%v, want one shared block", a, b)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing one copy moves it to its own block and leaves the other.
+	if err := fs.writeAt("/root/b", 0, []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := storedBlocks(t, fs, "/root/a"), storedBlocks(t, fs, "/root/b"); a[0] == b[0] {
+		t.Error("modified copy still shares its block")
+	}
+	got, err := fs.readFile("/root/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("modifying one copy changed the other")
+	}
+	got, err = fs.readFile("/root/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append([]byte("changed"), data[7:]...); !bytes.Equal(got, want) {
+		t.Error("modified copy reads back wrong")
+	}
+
+	// The shared block is freed only when the last user goes.
+	if err := fs.rm("/root/b"); err != nil {
+		t.Fatal(err)
+	}
+	_, free, _ := fs.df()
+	if err := fs.rm("/root/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, after, _ := fs.df(); after != free+1 {
+		t.Errorf("removing the last user freed %d blocks, want 1", after-free)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	fs := NewFileSystem()
+	if err := fs.setCompression(true); err != nil {
+		t.Fatal(err)
+	}
+	compressible := bytes.Repeat([]byte("compress me "), 8*BlockSize/12)
+	random := make([]byte, 3*BlockSize)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for name, data := range map[string][]byte{"text": compressible, "random": random} {
+		for _, err := range []error{
+			errOf(fs.touch("/root", name)),
+			fs.writeFile("/root/"+name, data),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := fs.readFile("/root/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s reads back wrong", name)
+		}
+		if inode, _ := fs.stat("/root/" + name); inode.Size != len(data) {
+			t.Errorf("%s: Size = %d, want %d", name, inode.Size, len(data))
+		}
+	}
+
+	text, _ := fs.stat("/root/text")
+	if blocks := len(storedBlocks(t, fs, "/root/text")); !text.Compressed || blocks >= len(compressible)/BlockSize {
+		t.Errorf("compressible file: Compressed %v, %d blocks for %d bytes", text.Compressed, blocks, len(compressible))
+	}
+	// Random data doesn't shrink, so it is stored as it is.
+	raw, _ := fs.stat("/root/random")
+	if blocks := len(storedBlocks(t, fs, "/root/random")); raw.Compressed || blocks != 3 {
+		t.Errorf("random file: Compressed %v, %d blocks, want raw in 3", raw.Compressed, blocks)
+	}
+
+	// Appending to a compressed file keeps it readable.
+	if err := fs.appendFile("/root/text", []byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.readFile("/root/text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(compressible, "tail"...)) {
+		t.Error("appended compressed file reads back wrong")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	fs := NewFileSystem()
+	key := bytes.Repeat([]byte("k"), 32)
+	if err := fs.setEncryptionKey(key); err != nil {
+		t.Fatal(err)
+	}
+	secret := bytes.Repeat([]byte("top secret "), BlockSize/5)
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.writeFile("/root/f", secret),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := fs.readFile("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Error("encrypted file reads back wrong")
+	}
+	inode, _ := fs.stat("/root/f")
+	if !inode.Encrypted || inode.Size != len(secret) {
+		t.Errorf("Encrypted %v, Size %d, want true and %d", inode.Encrypted, inode.Size, len(secret))
+	}
+	for _, block := range inodeBlocks(inode) {
+		if bytes.Contains(fs.blocks.data(block), []byte("top secret")) {
+			t.Errorf("block %d holds plaintext", block)
+		}
+	}
+
+	if err := fs.setEncryptionKey(bytes.Repeat([]byte("x"), 32)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.readFile("/root/f"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("read with the wrong key: %v, want ErrAuthFailed", err)
+	}
+	if err := fs.setEncryptionKey(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.readFile("/root/f"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("read with no key: %v, want ErrAuthFailed", err)
+	}
+	if err := fs.setEncryptionKey([]byte("short")); !errors.Is(err, ErrInvalid) {
+		t.Errorf("setEncryptionKey with a bad length: %v, want ErrInvalid", err)
+	}
+
+	if err := fs.setEncryptionKey(key); err != nil {
+		t.Fatal(err)
+	}
+	got, err = fs.readFile("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Error("file reads back wrong with the right key again")
+	}
+}
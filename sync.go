@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// syncRecord is what Sync appends for a mounted filesystem: the blocks
+// written since the previous Sync, and the rest of the state as an image
+// without blocks. Inodes and the superblock are small next to the blocks
+// and change in too many places to track, so every record carries them
+// whole.
+type syncRecord struct {
+	// ID is the filesystem's syncID and Seq numbers the record; Load
+	// applies a record only on top of an image with the same SyncID and
+	// an earlier SyncSeq.
+	ID, Seq   uint64
+	Blocks    map[int][]byte
+	Checksums map[int]uint32
+	// Meta is the encoded image, holding TotalBlocks but no blocks.
+	Meta []byte
+}
+
+// syncPath is the file Sync appends records to for a filesystem mounted
+// from path.
+func syncPath(path string) string {
+	return path + ".sync"
+}
+
+// markAllDirty marks every block dirty, for use after the block table has
+// been replaced wholesale.
+func (fs *FileSystem) markAllDirty() {
+	for block := 0; block < fs.blocks.len(); block++ {
+		fs.dirtyBlocks.set(block)
+	}
+}
+
+// Sync makes the changes since the last Sync durable without rewriting the
+// whole image as Save does: it appends the blocks written since then, and
+// the metadata, to a file beside the one the filesystem was mounted from,
+// and Load applies them. Unmount folds them back into the image. Until the
+// image at the mount path carries the filesystem's syncID, which records
+// must match, Sync saves the whole image instead. It fails with
+// ErrNotMounted for a filesystem that didn't come from Mount.
+func (fs *FileSystem) Sync() error {
+	if err := fs.lockWriteAnyJournal(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	if fs.mountPath == "" {
+		return ErrNotMounted
+	}
+	if !fs.syncBase {
+		if err := fs.save(fs.mountPath); err != nil {
+			return err
+		}
+		fs.syncBase = true
+		fs.dirtyBlocks = nil
+		return nil
+	}
+
+	img := fs.newImage()
+	record := syncRecord{
+		ID:        fs.syncID,
+		Seq:       fs.syncSeq + 1,
+		Blocks:    make(map[int][]byte),
+		Checksums: make(map[int]uint32),
+	}
+	for block := 0; block < fs.Superblock.TotalBlocks; block++ {
+		if fs.dirtyBlocks.has(block) {
+			record.Blocks[block] = fs.blocks.data(block)
+			record.Checksums[block] = fs.blocks.sum(block)
+		}
+	}
+	img.SyncSeq = record.Seq
+	img.DataBlocks, img.Checksums = nil, nil
+	var meta bytes.Buffer
+	if err := img.encode(&meta); err != nil {
+		return err
+	}
+	record.Meta = meta.Bytes()
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(&record); err != nil {
+		return err
+	}
+	frame := binary.BigEndian.AppendUint64(nil, uint64(payload.Len()))
+	frame = append(frame, payload.Bytes()...)
+
+	f, err := os.OpenFile(syncPath(fs.mountPath), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(frame); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fs.syncSeq = record.Seq
+	fs.dirtyBlocks = nil
+	return nil
+}
+
+// readSyncRecords reads the records Sync appended to path. A record cut
+// short, as a crash during Sync leaves one, ends the list.
+func readSyncRecords(path string) ([]syncRecord, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []syncRecord
+	for len(data) >= 8 {
+		n := binary.BigEndian.Uint64(data)
+		if n > uint64(len(data)-8) {
+			break
+		}
+		var record syncRecord
+		if err := gob.NewDecoder(bytes.NewReader(data[8 : 8+n])).Decode(&record); err != nil {
+			return nil, fmt.Errorf("sync record %d: %w", len(records), err)
+		}
+		records = append(records, record)
+		data = data[8+n:]
+	}
+	return records, nil
+}
+
+// applySyncRecords brings img up to date with the records at path that
+// follow it, skipping those already in it and any left by another
+// filesystem.
+func (img *fsImage) applySyncRecords(path string) error {
+	records, err := readSyncRecords(path)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record.ID != img.SyncID || record.Seq <= img.SyncSeq {
+			continue
+		}
+		meta, err := decodeImage(bytes.NewReader(record.Meta))
+		if err != nil {
+			return fmt.Errorf("sync record %d: %w", record.Seq, err)
+		}
+		blocks := make([][]byte, meta.TotalBlocks)
+		checksums := make([]uint32, meta.TotalBlocks)
+		copy(blocks, img.DataBlocks)
+		for block := range checksums {
+			if block < len(img.Checksums) && len(img.Checksums) == len(img.DataBlocks) {
+				checksums[block] = img.Checksums[block]
+			} else {
+				checksums[block] = crc32.ChecksumIEEE(blocks[block])
+			}
+		}
+		for block, data := range record.Blocks {
+			if block < 0 || block >= len(blocks) {
+				return fmt.Errorf("sync record %d: block %d out of range", record.Seq, block)
+			}
+			// gob brings empty blocks back empty rather than nil.
+			if len(data) == 0 {
+				data = nil
+			}
+			blocks[block], checksums[block] = data, record.Checksums[block]
+		}
+		*img = *meta
+		img.DataBlocks, img.Checksums = blocks, checksums
+	}
+	return nil
+}
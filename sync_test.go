@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// dirtyList returns the blocks marked dirty, in order.
+func dirtyList(fs *FileSystem) []int {
+	var blocks []int
+	for block := 0; block < fs.Superblock.TotalBlocks; block++ {
+		if fs.dirtyBlocks.has(block) {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// A write dirties just the blocks it changed, and Sync appends just those
+// and clears them; loading the image applies what was synced.
+func TestSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fs.img")
+	fs, err := Mount(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.mkdir("/root", "d"); err != nil {
+		t.Fatal(err)
+	}
+	// The first Sync has no image to build on and saves one.
+	if err := fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("first Sync saved no image: %v", err)
+	}
+	if blocks := dirtyList(fs); blocks != nil {
+		t.Errorf("dirty after Sync: %v", blocks)
+	}
+
+	if _, err := fs.touch("/root/d", "f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	f := fs.resolvePath("/root/d/f")
+	data := bytes.Repeat([]byte("x"), BlockSize+10)
+	if err := fs.writeFile("/root/d/f", data); err != nil {
+		t.Fatal(err)
+	}
+	want := inodeBlocks(f)
+	if len(want) != 2 {
+		t.Fatalf("file uses blocks %v, want 2", want)
+	}
+	if got := dirtyList(fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("dirty after writeFile = %v, want %v", got, want)
+	}
+	if err := fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if blocks := dirtyList(fs); blocks != nil {
+		t.Errorf("dirty after Sync: %v", blocks)
+	}
+
+	records, err := readSyncRecords(syncPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("%d sync records, want 2", len(records))
+	}
+	var written []int
+	for block := range records[1].Blocks {
+		written = append(written, block)
+	}
+	sort.Ints(written)
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("second record holds blocks %v, want %v", written, want)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := treeOf(t, loaded), treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded:\n got %v\nwant %v", got, want)
+	}
+	if got, err := loaded.readFile("/root/d/f"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("loaded file = %d bytes, %v", len(got), err)
+	}
+	if err := loaded.verifyFilesystem(); err != nil {
+		t.Error(err)
+	}
+
+	// Unmount folds the records into the image.
+	if err := fs.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(syncPath(path)); !os.IsNotExist(err) {
+		t.Errorf("sync records left after Unmount: %v", err)
+	}
+	remounted, err := Mount(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := remounted.readFile("/root/d/f"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("remounted file = %d bytes, %v", len(got), err)
+	}
+}
+
+func TestSyncRequiresMount(t *testing.T) {
+	if err := NewFileSystem().Sync(); err != ErrNotMounted {
+		t.Errorf("Sync = %v, want ErrNotMounted", err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ExportTar writes the subtree under fsPath to w as a tar stream. Entries
+// are named relative to fsPath and appear in sorted, depth-first order, so
+// the same tree always produces the same stream.
+func (fs *FileSystem) ExportTar(fsPath string, w io.Writer) error {
+	if err := fs.lockRead(); err != nil {
+		return err
+	}
+	defer fs.mu.RUnlock()
+
+	dir := fs.resolvePath(fsPath)
+	if dir == nil {
+		return ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return ErrNotDirectory
+	}
+
+	tw := tar.NewWriter(w)
+	err := fs.walkTree(dir, "", func(name string, inode *Inode) error {
+		hdr := &tar.Header{
+			Name:    strings.TrimPrefix(name, "/"),
+			Mode:    int64(inode.Mode),
+			Uid:     inode.UID,
+			Gid:     inode.GID,
+			ModTime: inode.ModifiedAt,
+		}
+		var data []byte
+		switch {
+		case inode.IsDirectory:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case inode.IsSymlink:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = inode.Target
+		default:
+			hdr.Typeflag = tar.TypeReg
+			var err error
+			if data, err = fs.fileData(inode); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			hdr.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ImportTar recreates the entries of the tar stream r under the existing
+// directory at fsPath, creating any parent directories the stream leaves
+// out. Collisions are handled as in ImportFromOS. Entries other than
+// directories, regular files and symlinks, and names leaving fsPath, are
+// rejected.
+func (fs *FileSystem) ImportTar(r io.Reader, fsPath string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	base := fs.absPath(fsPath)
+	dir := fs.resolvePath(base)
+	if dir == nil {
+		return ErrNotFound
+	}
+	if !dir.IsDirectory {
+		return ErrNotDirectory
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if name == "." {
+			continue
+		}
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("tar entry %q: %w", hdr.Name, ErrInvalid)
+		}
+		parts := strings.Split(name, "/")
+		parent := base
+		for _, part := range parts[:len(parts)-1] {
+			parent += "/" + part
+			if err := fs.importDir(parent, DefaultDirMode); err != nil {
+				return err
+			}
+		}
+		target := base + "/" + name
+		mode := uint32(hdr.Mode) & 0777
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = fs.importDir(target, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			var data []byte
+			if data, err = io.ReadAll(tr); err == nil {
+				err = fs.importFile(target, mode, data)
+			}
+		case tar.TypeSymlink:
+			err = fs.importSymlink(target, hdr.Linkname)
+		default:
+			err = fmt.Errorf("tar entry %q: unsupported type %q: %w", hdr.Name, hdr.Typeflag, ErrInvalid)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
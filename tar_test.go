@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTarRoundTrip(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "a")),
+		errOf(fs.mkdir("/root/a", "b")),
+		errOf(fs.mkdir("/root", "empty")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, data := range map[string][]byte{
+		"/root/top":     []byte("top"),
+		"/root/a/big":   pattern(2*BlockSize + 3),
+		"/root/a/b/low": []byte("low"),
+	} {
+		dir, name := splitPath(path)
+		for _, err := range []error{
+			errOf(fs.touch(dir, name)),
+			fs.writeFile(path, data),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, err := range []error{
+		fs.chmod("/root/a/big", 0600),
+		fs.chmod("/root/a/b", 0700),
+		fs.symlink("../top", "/root/a/l"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := treeOf(t, fs)
+
+	var buf bytes.Buffer
+	if err := fs.ExportTar("/root", &buf); err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := fs.ExportTar("/root", &again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Error("exporting the same tree twice gave different streams")
+	}
+
+	imported := NewFileSystem()
+	if err := imported.ImportTar(&buf, "/root"); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeOf(t, imported); !reflect.DeepEqual(got, want) {
+		t.Errorf("imported tree:\n got %v\nwant %v", got, want)
+	}
+	if err := imported.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportTarImplicitDirectories(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "x/y/f", Mode: 0644, Size: 2, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := tw.Write([]byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewFileSystem()
+	if err := fs.ImportTar(bytes.NewReader(buf.Bytes()), "/root"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.readFile("/root/x/y/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hi" {
+		t.Errorf("f = %q, want hi", got)
+	}
+	if dir := fs.resolvePath("/root/x/y"); dir == nil || !dir.IsDirectory {
+		t.Error("intermediate directory not created")
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	for _, err := range []error{
+		tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0644, Typeflag: tar.TypeReg}),
+		tw.Close(),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.ImportTar(&buf, "/root/x"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("entry leaving the target: %v, want ErrInvalid", err)
+	}
+}
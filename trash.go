@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TrashDir is the hidden directory rm moves files into while the trash is
+// enabled.
+const TrashDir = "/root/.Trash"
+
+// TrashEntry describes a file held in the trash.
+type TrashEntry struct {
+	// Name is the file's entry in TrashDir.
+	Name         string
+	OriginalPath string
+	DeletedAt    time.Time
+}
+
+// setTrash turns the trash on or off. While it is on, rm moves files into
+// TrashDir, from where undelete can bring them back, instead of freeing
+// them. Files removed from inside TrashDir are always freed.
+func (fs *FileSystem) setTrash(enabled bool) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	fs.Trash = enabled
+	fs.checkpointInternal()
+	return nil
+}
+
+func inTrash(path string) bool {
+	return path == TrashDir || strings.HasPrefix(path, TrashDir+"/")
+}
+
+// trash moves the file at path, which must be canonical, into the trash.
+// Entries are named after the time of deletion and the inode, so removing
+// the same path twice keeps both files.
+func (fs *FileSystem) trash(path string) error {
+	inode := fs.resolvePathNoFollow(path)
+	if inode == nil {
+		return ErrNotFound
+	}
+	name := fmt.Sprintf("%d.%d", now().UnixNano(), inode.InodeNumber)
+	if err := fs.trashInternal(path, name); err != nil {
+		return err
+	}
+	fs.addJournalEntry("trash", path, map[string]interface{}{
+		"trashName": name,
+	})
+	return nil
+}
+
+func (fs *FileSystem) trashInternal(path, name string) error {
+	inode := fs.resolvePathNoFollow(path)
+	if inode == nil {
+		return ErrNotFound
+	}
+	if inode.IsDirectory {
+		return ErrIsDirectory
+	}
+	trash := fs.resolvePathNoFollow(TrashDir)
+	if trash == nil {
+		parent, base := splitPath(TrashDir)
+		if _, err := fs.mkdirInternal(parent, base); err != nil {
+			return err
+		}
+	} else if !trash.IsDirectory {
+		return ErrNotDirectory
+	}
+	if err := fs.move(path, TrashDir+"/"+name, false); err != nil {
+		return err
+	}
+	fs.preserveInode(inode)
+	inode.TrashedFrom, inode.TrashedAt = path, now()
+	return nil
+}
+
+// trashEntries returns the files in the trash, oldest first.
+func (fs *FileSystem) trashEntries() []TrashEntry {
+	trash := fs.resolvePathNoFollow(TrashDir)
+	if trash == nil || !trash.IsDirectory {
+		return nil
+	}
+	var entries []TrashEntry
+	for _, entry := range fs.dirTree(trash).entries() {
+		inode := fs.lookupInode(entry.InodeIndex)
+		if inode == nil || inode.TrashedFrom == "" {
+			continue
+		}
+		entries = append(entries, TrashEntry{
+			Name:         entry.Name,
+			OriginalPath: inode.TrashedFrom,
+			DeletedAt:    inode.TrashedAt,
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.Before(entries[j].DeletedAt)
+	})
+	return entries
+}
+
+// listTrash returns the files in the trash, oldest first.
+func (fs *FileSystem) listTrash() []TrashEntry {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.trashEntries()
+}
+
+// undelete moves the file most recently removed from originalPath out of
+// the trash and back into place. It fails with ErrExists if something has
+// since been created at originalPath; earlier deletions of the same path
+// stay in the trash.
+func (fs *FileSystem) undelete(originalPath string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	path := fs.absPath(originalPath)
+	if err := fs.mayModifyDir(path); err != nil {
+		return err
+	}
+	if err := fs.mayModifyTrash(); err != nil {
+		return err
+	}
+	if err := fs.undeleteInternal(path); err != nil {
+		return err
+	}
+	fs.addJournalEntry("undelete", path, nil)
+	fs.queueEvent(Event{Op: EventCreate, Path: path})
+	return nil
+}
+
+func (fs *FileSystem) undeleteInternal(path string) error {
+	entries := fs.trashEntries()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].OriginalPath != path {
+			continue
+		}
+		inode := fs.resolvePathNoFollow(TrashDir + "/" + entries[i].Name)
+		if err := fs.move(TrashDir+"/"+entries[i].Name, path, false); err != nil {
+			return err
+		}
+		fs.preserveInode(inode)
+		inode.TrashedFrom, inode.TrashedAt = "", time.Time{}
+		return nil
+	}
+	return ErrNotFound
+}
+
+// emptyTrash permanently removes every file in the trash, freeing their
+// inodes and blocks, and returns how many were removed.
+func (fs *FileSystem) emptyTrash() (int, error) {
+	if err := fs.lockWrite(); err != nil {
+		return 0, err
+	}
+	defer fs.unlockWrite()
+
+	if err := fs.mayModifyTrash(); err != nil {
+		return 0, err
+	}
+	n := fs.emptyTrashInternal()
+	fs.addJournalEntry("emptyTrash", TrashDir, nil)
+	return n, nil
+}
+
+// mayModifyTrash checks that entries may be taken out of the trash, which
+// takes write and search permission on TrashDir like any directory.
+func (fs *FileSystem) mayModifyTrash() error {
+	if trash := fs.resolvePathNoFollow(TrashDir); trash != nil && !fs.may(trash, permWrite|permExec) {
+		return ErrPermission
+	}
+	return nil
+}
+
+func (fs *FileSystem) emptyTrashInternal() int {
+	entries := fs.trashEntries()
+	for _, entry := range entries {
+		fs.rmInternal(TrashDir + "/" + entry.Name)
+	}
+	return len(entries)
+}
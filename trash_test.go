@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTrashUndelete(t *testing.T) {
+	advance := fakeClock(t)
+	fs := NewFileSystem()
+	if err := fs.setTrash(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.mkdir("/root", "d"); err != nil {
+		t.Fatal(err)
+	}
+	first := pattern(BlockSize + 5)
+	for _, err := range []error{
+		errOf(fs.touch("/root/d", "f")),
+		fs.writeFile("/root/d/f", first),
+		fs.rm("/root/d/f"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fs.resolvePath("/root/d/f") != nil {
+		t.Fatal("removed file still in place")
+	}
+
+	// The same path deleted again is kept separately.
+	advance(time.Second)
+	for _, err := range []error{
+		errOf(fs.touch("/root/d", "f")),
+		fs.writeFile("/root/d/f", []byte("second")),
+		fs.rm("/root/d/f"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := fs.listTrash()
+	if len(entries) != 2 || entries[0].OriginalPath != "/root/d/f" || entries[1].OriginalPath != "/root/d/f" ||
+		!entries[0].DeletedAt.Before(entries[1].DeletedAt) || entries[0].Name == entries[1].Name {
+		t.Fatalf("trash = %+v, want both deletions of /root/d/f, oldest first", entries)
+	}
+
+	// Undelete brings back the newest, and won't replace it with the older
+	// one.
+	readBack := func(want []byte) {
+		t.Helper()
+		got, err := fs.readFile("/root/d/f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("undeleted file holds %d bytes, want %d", len(got), len(want))
+		}
+	}
+	if err := fs.undelete("/root/d/f"); err != nil {
+		t.Fatal(err)
+	}
+	readBack([]byte("second"))
+	if err := fs.undelete("/root/d/f"); !errors.Is(err, ErrExists) {
+		t.Errorf("undelete over an existing file: %v, want ErrExists", err)
+	}
+	for _, err := range []error{
+		fs.mv("/root/d/f", "/root/d/newer"),
+		fs.undelete("/root/d/f"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	readBack(first)
+	if len(fs.listTrash()) != 0 {
+		t.Errorf("trash still holds %v", fs.listTrash())
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+
+	// emptyTrash frees what it holds for good.
+	if err := fs.rm("/root/d/f"); err != nil {
+		t.Fatal(err)
+	}
+	_, free, _ := fs.df()
+	n, err := fs.emptyTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(fs.listTrash()) != 0 {
+		t.Errorf("emptyTrash removed %d, left %v", n, fs.listTrash())
+	}
+	if _, after, _ := fs.df(); after <= free {
+		t.Error("emptyTrash freed no blocks")
+	}
+	if err := fs.undelete("/root/d/f"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("undelete after emptyTrash: %v, want ErrNotFound", err)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+// Txn buffers operations so they can be applied together. Nothing touches the
+// filesystem until Commit, which applies either every operation or none.
+type Txn struct {
+	fs   *FileSystem
+	ops  []JournalEntry
+	done bool
+}
+
+// Begin starts a transaction on the filesystem.
+func (fs *FileSystem) Begin() *Txn {
+	return &Txn{fs: fs}
+}
+
+// Mkdir queues the creation of directory dirName in parentPath.
+func (tx *Txn) Mkdir(parentPath, dirName string) {
+	tx.ops = append(tx.ops, JournalEntry{Operation: "mkdir", Data: map[string]interface{}{
+		"parentPath": parentPath,
+		"dirName":    dirName,
+	}})
+}
+
+// Touch queues the creation of an empty file fileName in dirPath.
+func (tx *Txn) Touch(dirPath, fileName string) {
+	tx.ops = append(tx.ops, JournalEntry{Operation: "touch", Data: map[string]interface{}{
+		"dirPath":  dirPath,
+		"fileName": fileName,
+	}})
+}
+
+// Rm queues the removal of the file at path.
+func (tx *Txn) Rm(path string) {
+	tx.ops = append(tx.ops, JournalEntry{Operation: "rm", Path: path})
+}
+
+// Commit applies the queued operations in order, as mkdir, touch and rm
+// would one after another, and journals them as a single entry. If any of
+// them fails the filesystem is returned to its state before Commit and the
+// error is reported. To be able to do that, every Commit copies the whole
+// metadata image with newImage first, so its cost grows with the filesystem
+// rather than with the transaction.
+func (tx *Txn) Commit() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.done = true
+
+	fs := tx.fs
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	before, events := fs.newImage(), len(fs.pendingEvents)
+	var entries []JournalEntry
+	fs.txnEntries = &entries
+	defer func() { fs.txnEntries = nil }()
+
+	for _, op := range tx.ops {
+		var err error
+		switch op.Operation {
+		case "mkdir":
+			data := op.Data.(map[string]interface{})
+			_, err = fs.mkdirLocked(data["parentPath"].(string), data["dirName"].(string))
+		case "touch":
+			data := op.Data.(map[string]interface{})
+			_, err = fs.touchLocked(data["dirPath"].(string), data["fileName"].(string))
+		case "rm":
+			err = fs.rmLocked(op.Path)
+		}
+		if err != nil {
+			fs.rollbackTo(before)
+			fs.pendingEvents = fs.pendingEvents[:events]
+			return err
+		}
+	}
+	fs.txnEntries = nil
+	fs.addJournalEntry("txn", "", entries)
+	return nil
+}
+
+// Rollback discards the queued operations.
+func (tx *Txn) Rollback() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.done = true
+	tx.ops = nil
+	return nil
+}
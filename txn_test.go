@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTxnCommit(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "old"); err != nil {
+		t.Fatal(err)
+	}
+	n := len(fs.Journal)
+
+	tx := fs.Begin()
+	tx.Mkdir("/root", "d")
+	tx.Touch("/root/d", "f")
+	tx.Rm("/root/old")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs.resolvePath("/root/d/f") == nil || fs.resolvePath("/root/old") != nil {
+		t.Error("transaction was not applied")
+	}
+	if len(fs.Journal) != n+1 || fs.Journal[n].Operation != "txn" {
+		t.Fatalf("journal after commit: %v", fs.Journal[n:])
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("second Commit: %v, want ErrTxnDone", err)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxnCommitFailureRollsBack(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "keep"); err != nil {
+		t.Fatal(err)
+	}
+	want, stats := treeOf(t, fs), fs.Stats()
+	n := len(fs.Journal)
+
+	tx := fs.Begin()
+	tx.Mkdir("/root", "d")
+	tx.Rm("/root/keep")
+	tx.Rm("/root/missing")
+	if err := tx.Commit(); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Commit: %v, want ErrNotFound", err)
+	}
+
+	if got := treeOf(t, fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("after a failed commit:\n got %v\nwant %v", got, want)
+	}
+	if len(fs.Journal) != n {
+		t.Errorf("journal grew from %d to %d entries", n, len(fs.Journal))
+	}
+	if got := fs.Stats(); got != stats {
+		t.Errorf("stats after a failed commit = %+v, want %+v", got, stats)
+	}
+	if err := fs.verifyFilesystem(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxnRollback(t *testing.T) {
+	fs := NewFileSystem()
+	tx := fs.Begin()
+	tx.Mkdir("/root", "d")
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("Commit after Rollback: %v, want ErrTxnDone", err)
+	}
+	if fs.resolvePath("/root/d") != nil {
+		t.Error("rolled back operation took effect")
+	}
+}
+
+// Replaying the journal reproduces a committed transaction.
+func TestTxnReplays(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := fs.Begin()
+	tx.Mkdir("/root", "d")
+	tx.Touch("/root/d", "g")
+	tx.Rm("/root/f")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	want := treeOf(t, fs)
+
+	if got := treeOf(t, replayed(fs)); !reflect.DeepEqual(got, want) {
+		t.Errorf("after replay:\n got %v\nwant %v", got, want)
+	}
+}
+
+// Relative paths are resolved at Commit without changing what was queued.
+func TestTxnCommitLeavesOpsAlone(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.mkdir("/root", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.cd("/root/d"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := fs.Begin()
+	tx.Touch(".", "f")
+	queued := tx.ops[0].Data.(map[string]interface{})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if fs.resolvePath("/root/d/f") == nil {
+		t.Error("/root/d/f was not created")
+	}
+	if queued["dirPath"] != "." {
+		t.Errorf("queued dirPath changed to %v", queued["dirPath"])
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// setVerifyWrites turns verify-after-write on or off. While it is on, each
+// entry added to a directory is read back from the directory's serialized
+// form, and the contents written by writeFile are read back once stored. A
+// write that doesn't read back as written is undone and fails with
+// ErrVerify. It is off by default, since every entry added serializes its
+// whole directory.
+func (fs *FileSystem) setVerifyWrites(enabled bool) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	fs.VerifyWrites = enabled
+	fs.checkpointInternal()
+	return nil
+}
+
+// verifyDirEntry checks that entry, just inserted into tree, is found as it
+// is once the tree has been through its block format.
+func verifyDirEntry(tree *BTree, entry DirEntry) error {
+	found, ok := deserializeBTree(serializeBTree(tree)).search(entry.Name)
+	if !ok || found != entry {
+		return fmt.Errorf("directory entry %q: %w", entry.Name, ErrVerify)
+	}
+	return nil
+}
+
+// storeFileDataVerified is storeFileData followed, with VerifyWrites on, by
+// reading the file back. Contents that don't match data are replaced by
+// what the file held before.
+func (fs *FileSystem) storeFileDataVerified(inode *Inode, data []byte) error {
+	if !fs.VerifyWrites {
+		return fs.storeFileData(inode, data)
+	}
+	old, err := fs.fileData(inode)
+	if err != nil {
+		return err
+	}
+	if err := fs.storeFileData(inode, data); err != nil {
+		return err
+	}
+	if got, err := fs.fileData(inode); err != nil || !bytes.Equal(got, data) {
+		fs.storeFileData(inode, old)
+		return fmt.Errorf("inode %d: %w", inode.InodeNumber, ErrVerify)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// A name holding the block format's separators slips past addEntryToDir
+// unless writes are verified, and is then lost once its directory is
+// written back and read again.
+func TestVerifyWritesCatchesBadEntry(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		fs := NewFileSystem()
+		if err := fs.setVerifyWrites(verify); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.touch("/root", "good"); err != nil {
+			t.Fatal(err)
+		}
+		root := fs.resolvePath("/root")
+		bad := DirEntry{Name: "bad;name", InodeIndex: fs.resolvePath("/root/good").InodeNumber}
+		err := fs.addEntryToDir(root, bad)
+
+		fs.flushDirTrees()
+		fs.cache.reset()
+		_, found := fs.dirTree(root).search(bad.Name)
+		if verify {
+			if !errors.Is(err, ErrVerify) {
+				t.Errorf("verified: addEntryToDir = %v, want ErrVerify", err)
+			}
+			if found {
+				t.Error("verified: rejected entry was kept")
+			}
+		} else if err != nil || found {
+			t.Errorf("unverified: addEntryToDir = %v, found after reload %v; want the fault unnoticed", err, found)
+		}
+		// Unnoticed, the entry comes back as a different name.
+		want := []string{"good"}
+		if !verify {
+			want = []string{"name", "good"}
+		}
+		if names, err := fs.list("/root"); err != nil || !reflect.DeepEqual(names, want) {
+			t.Errorf("verify %v: list = %v, %v, want %v", verify, names, err, want)
+		}
+	}
+}
+
+// Verified writes of every kind of stored contents read back.
+func TestVerifyWritesFileData(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		fs.setVerifyWrites(true),
+		fs.setCompression(true),
+		fs.setEncryptionKey(make([]byte, 32)),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.touch("/root", "f"); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{[]byte("short"), make([]byte, 3*BlockSize), nil} {
+		if err := fs.writeFile("/root/f", data); err != nil {
+			t.Fatalf("%d bytes: %v", len(data), err)
+		}
+		if got, err := fs.readFile("/root/f"); err != nil || string(got) != string(data) {
+			t.Errorf("%d bytes read back as %d, %v", len(data), len(got), err)
+		}
+	}
+	restored := NewFileSystem()
+	restored.applyImage(fs.newImage())
+	if !restored.VerifyWrites {
+		t.Error("VerifyWrites is not kept in the image")
+	}
+}
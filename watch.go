@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// WatchEvent is an Event delivered on a watch channel.
+type WatchEvent = Event
+
+// watcher is one watch: the events under dir are queued by notifyWatchers
+// and handed to ch by run, so a slow reader never holds up the filesystem.
+type watcher struct {
+	dir  string
+	ch   chan WatchEvent
+	wake chan struct{}
+	stop chan struct{}
+
+	mu    sync.Mutex
+	queue []WatchEvent
+	// ended is set with the event that removed dir; run closes ch once it
+	// has been delivered.
+	ended bool
+}
+
+// watch reports every create, delete, rename and write at or below path on
+// the returned channel, in the order they happened. A rename is reported if
+// either its old or new path is below path. Removing or renaming path
+// itself, or one of its parents, is reported and then closes the channel.
+// Calling the returned function stops the watch, drops any undelivered
+// events and closes the channel; it may be called more than once.
+func (fs *FileSystem) watch(path string) (<-chan WatchEvent, func()) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	w := &watcher{
+		dir:  fs.absPath(path),
+		ch:   make(chan WatchEvent),
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	fs.watchers = append(fs.watchers, w)
+	go w.run()
+
+	var once sync.Once
+	return w.ch, func() {
+		once.Do(func() {
+			fs.mu.Lock()
+			fs.removeWatcher(w)
+			fs.mu.Unlock()
+			close(w.stop)
+		})
+	}
+}
+
+// notifyWatchers queues events on the watchers they concern and drops the
+// watchers whose directory has gone. The caller must hold the write lock.
+func (fs *FileSystem) notifyWatchers(events []Event) {
+	for _, w := range append([]*watcher(nil), fs.watchers...) {
+		var matched []WatchEvent
+		ended := false
+		for _, ev := range events {
+			gone := removes(ev, w.dir)
+			if !gone && !within(ev.Path, w.dir) && !(ev.Op == EventRename && within(ev.OldPath, w.dir)) {
+				continue
+			}
+			matched = append(matched, ev)
+			if gone {
+				ended = true
+				break
+			}
+		}
+		if len(matched) > 0 {
+			w.push(matched, ended)
+		}
+		if ended {
+			fs.removeWatcher(w)
+		}
+	}
+}
+
+func (fs *FileSystem) removeWatcher(w *watcher) {
+	for i, other := range fs.watchers {
+		if other == w {
+			fs.watchers = append(fs.watchers[:i], fs.watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+// removes reports whether ev takes away dir, by deleting or renaming it or
+// one of its parents.
+func removes(ev Event, dir string) bool {
+	switch ev.Op {
+	case EventDelete:
+		return within(dir, ev.Path)
+	case EventRename:
+		return within(dir, ev.OldPath)
+	}
+	return false
+}
+
+// within reports whether path is dir or below it. Both must be canonical.
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+func (w *watcher) push(events []WatchEvent, ended bool) {
+	w.mu.Lock()
+	w.queue = append(w.queue, events...)
+	w.ended = ended
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued events to ch until the watch ends or is stopped.
+func (w *watcher) run() {
+	defer close(w.ch)
+	for {
+		w.mu.Lock()
+		queue, ended := w.queue, w.ended
+		w.queue = nil
+		w.mu.Unlock()
+
+		for _, ev := range queue {
+			select {
+			case w.ch <- ev:
+			case <-w.stop:
+				return
+			}
+		}
+		if ended {
+			return
+		}
+		select {
+		case <-w.wake:
+		case <-w.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// drain collects events from ch until it is closed.
+func drain(t *testing.T, ch <-chan WatchEvent) []WatchEvent {
+	t.Helper()
+	var got []WatchEvent
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return got
+			}
+			got = append(got, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch channel not closed; got %v", got)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	fs := NewFileSystem()
+	if _, err := fs.mkdir("/root", "d"); err != nil {
+		t.Fatal(err)
+	}
+	ch, cancel := fs.watch("/root/d")
+	defer cancel()
+
+	for _, err := range []error{
+		errOf(fs.mkdir("/root/d", "sub")),
+		errOf(fs.touch("/root/d/sub", "f")),
+		fs.writeFile("/root/d/sub/f", []byte("data")),
+		errOf(fs.touch("/root", "outside")),
+		errOf(fs.touch("/root", "dd")),
+		fs.writeFile("/root/outside", []byte("data")),
+		fs.mv("/root/d/sub/f", "/root/moved"),
+		fs.mv("/root/dd", "/root/d/dd"),
+		fs.rm("/root/moved"),
+		fs.rm("/root/d/dd"),
+		fs.rmdir("/root/d/sub"),
+		fs.rmdir("/root/d"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []WatchEvent{
+		{Op: EventCreate, Path: "/root/d/sub", IsDir: true},
+		{Op: EventCreate, Path: "/root/d/sub/f"},
+		{Op: EventWrite, Path: "/root/d/sub/f"},
+		{Op: EventRename, Path: "/root/moved", OldPath: "/root/d/sub/f"},
+		{Op: EventRename, Path: "/root/d/dd", OldPath: "/root/dd"},
+		{Op: EventDelete, Path: "/root/d/dd"},
+		{Op: EventDelete, Path: "/root/d/sub", IsDir: true},
+		{Op: EventDelete, Path: "/root/d", IsDir: true},
+	}
+	if got := drain(t, ch); !reflect.DeepEqual(got, want) {
+		t.Errorf("events:\n got %v\nwant %v", got, want)
+	}
+	if len(fs.watchers) != 0 {
+		t.Errorf("%d watchers left after the watched directory was removed", len(fs.watchers))
+	}
+}
+
+// Each way of changing a file's contents is reported as a write.
+func TestWatchPartialWrites(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		write func(fs *FileSystem) error
+	}{
+		{"truncate", func(fs *FileSystem) error { return fs.truncate("/root/d/f", 2) }},
+		{"appendFile", func(fs *FileSystem) error { return fs.appendFile("/root/d/f", []byte("more")) }},
+		{"writeAt", func(fs *FileSystem) error { return fs.writeAt("/root/d/f", 1, []byte("x")) }},
+		{"File.Write", func(fs *FileSystem) error {
+			f, err := fs.open("/root/d/f")
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.Write([]byte("x"))
+			return err
+		}},
+	} {
+		fs := NewFileSystem()
+		for _, err := range []error{
+			errOf(fs.mkdir("/root", "d")),
+			errOf(fs.touch("/root/d", "f")),
+			fs.writeFile("/root/d/f", []byte("data")),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		ch, cancel := fs.watch("/root/d")
+		// Removing the directory ends the watch once the write is delivered.
+		for _, err := range []error{tt.write(fs), fs.rm("/root/d/f"), fs.rmdir("/root/d")} {
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		want := []WatchEvent{
+			{Op: EventWrite, Path: "/root/d/f"},
+			{Op: EventDelete, Path: "/root/d/f"},
+			{Op: EventDelete, Path: "/root/d", IsDir: true},
+		}
+		if got := drain(t, ch); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: events %v, want %v", tt.name, got, want)
+		}
+		cancel()
+	}
+}
+
+func TestWatchEndsWhenParentMoves(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.mkdir("/root", "a")),
+		errOf(fs.mkdir("/root/a", "b")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ch, cancel := fs.watch("/root/a/b")
+	defer cancel()
+	if err := fs.mv("/root/a", "/root/c"); err != nil {
+		t.Fatal(err)
+	}
+	want := []WatchEvent{{Op: EventRename, Path: "/root/c", OldPath: "/root/a", IsDir: true}}
+	if got := drain(t, ch); !reflect.DeepEqual(got, want) {
+		t.Errorf("events: got %v, want %v", got, want)
+	}
+}
+
+func TestWatchCancel(t *testing.T) {
+	fs := NewFileSystem()
+	ch, cancel := fs.watch("/root")
+	// Nobody reads, so the filesystem must not wait for the watcher.
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := fs.touch("/root", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	cancel()
+	drain(t, ch)
+	if len(fs.watchers) != 0 {
+		t.Errorf("%d watchers left after cancel", len(fs.watchers))
+	}
+	if _, err := fs.touch("/root", "d"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import "sort"
+
+// setxattr sets the extended attribute key on the inode at path. An empty
+// value removes the attribute.
+func (fs *FileSystem) setxattr(path, key, value string) error {
+	if key == "" {
+		return ErrInvalid
+	}
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return ErrNotFound
+	}
+	if !fs.may(inode, permWrite) {
+		return ErrPermission
+	}
+	fs.preserveInode(inode)
+	setxattrInternal(inode, key, value)
+	fs.addJournalEntry("setxattr", fs.absPath(path), map[string]interface{}{
+		"key":   key,
+		"value": value,
+	})
+	return nil
+}
+
+func setxattrInternal(inode *Inode, key, value string) {
+	if value == "" {
+		delete(inode.Xattrs, key)
+		return
+	}
+	if inode.Xattrs == nil {
+		inode.Xattrs = make(map[string]string)
+	}
+	inode.Xattrs[key] = value
+}
+
+// getxattr returns the extended attribute key of the inode at path.
+func (fs *FileSystem) getxattr(path, key string) (string, error) {
+	if err := fs.lockRead(); err != nil {
+		return "", err
+	}
+	defer fs.mu.RUnlock()
+
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return "", ErrNotFound
+	}
+	value, ok := inode.Xattrs[key]
+	if !ok {
+		return "", ErrNoAttr
+	}
+	return value, nil
+}
+
+// listxattr returns the names of the extended attributes of the inode at
+// path in sorted order.
+func (fs *FileSystem) listxattr(path string) ([]string, error) {
+	if err := fs.lockRead(); err != nil {
+		return nil, err
+	}
+	defer fs.mu.RUnlock()
+
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return nil, ErrNotFound
+	}
+	keys := make([]string, 0, len(inode.Xattrs))
+	for key := range inode.Xattrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// removexattr deletes the extended attribute key of the inode at path.
+func (fs *FileSystem) removexattr(path, key string) error {
+	if err := fs.lockWrite(); err != nil {
+		return err
+	}
+	defer fs.unlockWrite()
+
+	inode := fs.resolvePath(path)
+	if inode == nil {
+		return ErrNotFound
+	}
+	if !fs.may(inode, permWrite) {
+		return ErrPermission
+	}
+	if _, ok := inode.Xattrs[key]; !ok {
+		return ErrNoAttr
+	}
+	fs.preserveInode(inode)
+	delete(inode.Xattrs, key)
+	// Replays as setting the attribute to nothing, which removes it
+	fs.addJournalEntry("setxattr", fs.absPath(path), map[string]interface{}{
+		"key":   key,
+		"value": "",
+	})
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestXattrs(t *testing.T) {
+	fs := NewFileSystem()
+	for _, err := range []error{
+		errOf(fs.touch("/root", "f")),
+		fs.setxattr("/root/f", "user.b", "2"),
+		fs.setxattr("/root/f", "user.a", "1"),
+		fs.setxattr("/root/f", "user.c", "3"),
+		fs.setxattr("/root/f", "user.a", "one"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := fs.getxattr("/root/f", "user.a"); err != nil || v != "one" {
+		t.Errorf("getxattr user.a = %q, %v, want one", v, err)
+	}
+	if _, err := fs.getxattr("/root/f", "user.missing"); !errors.Is(err, ErrNoAttr) {
+		t.Errorf("getxattr of a missing key: %v, want ErrNoAttr", err)
+	}
+	if _, err := fs.getxattr("/root/missing", "user.a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("getxattr of a missing file: %v, want ErrNotFound", err)
+	}
+	if err := fs.setxattr("/root/f", "", "v"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("setxattr with an empty key: %v, want ErrInvalid", err)
+	}
+	keys, err := fs.listxattr("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"user.a", "user.b", "user.c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("listxattr = %v, want %v", keys, want)
+	}
+
+	fs.createFilesystemSnapshot()
+	var image bytes.Buffer
+	if err := fs.ExportImage(&image); err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty value and removexattr both remove.
+	for _, err := range []error{
+		fs.setxattr("/root/f", "user.b", ""),
+		fs.removexattr("/root/f", "user.c"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.removexattr("/root/f", "user.c"); !errors.Is(err, ErrNoAttr) {
+		t.Errorf("removexattr twice: %v, want ErrNoAttr", err)
+	}
+	keys, err = fs.listxattr("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"user.a"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("listxattr after removal = %v, want %v", keys, want)
+	}
+
+	if err := fs.restoreLatest(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := fs.getxattr("/root/f", "user.c"); err != nil || v != "3" {
+		t.Errorf("after restore, user.c = %q, %v, want 3", v, err)
+	}
+
+	loaded := NewFileSystem()
+	if err := loaded.ImportImage(&image); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = loaded.listxattr("/root/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"user.a", "user.b", "user.c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("listxattr after load = %v, want %v", keys, want)
+	}
+}